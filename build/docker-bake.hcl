@@ -4,7 +4,7 @@ variable "CONTAINER_REGISTRY" {
 }
 
 group "default" {
-  targets = ["tftp", "http", "cleaner", "sync", "monitoring", "ipxeMenuGenerator"]
+  targets = ["tftp", "http", "cleaner", "sync", "monitoring", "ipxeMenuGenerator", "assetServer", "proxyDHCP"]
 }
 
 target "tftp" {
@@ -46,5 +46,27 @@ target "ipxeMenuGenerator" {
   tags       = ["${CONTAINER_REGISTRY}/planetexpress/netboot-ipxe-menu-generator:${IMAGE_TAG}"]
   dockerfile = "Dockerfile"
   context    = "./netboot-services/ipxeMenuGenerator"
+  # The iPXE binaries are copied from the tftp image of the same run, not from a mutable registry tag
+  contexts   = {
+    tftp = "target:tftp"
+  }
+  output     = ["type=registry"]
+}
+
+target "assetServer" {
+  tags       = ["${CONTAINER_REGISTRY}/planetexpress/netboot-asset-server:${IMAGE_TAG}"]
+  dockerfile = "Dockerfile"
+  context    = "./netboot-services/assetServer"
+  # The iPXE binaries are copied from the tftp image of the same run, not from a mutable registry tag
+  contexts   = {
+    tftp = "target:tftp"
+  }
+  output     = ["type=registry"]
+}
+
+target "proxyDHCP" {
+  tags       = ["${CONTAINER_REGISTRY}/planetexpress/netboot-proxy-dhcp:${IMAGE_TAG}"]
+  dockerfile = "Dockerfile"
+  context    = "./netboot-services/proxyDHCP"
   output     = ["type=registry"]
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// responseRecorder captures the status and the number of bytes of a response for the access log and the download stats
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps http.ServeContent on the sendfile path, which it only takes if the ResponseWriter implements io.ReaderFrom
+func (r *responseRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := io.Copy(r.ResponseWriter, src)
+	r.bytes += n
+	return n, err
+}
+
+// Status returns the status of the response, which is 200 if the handler did not set one explicitly
+func (r *responseRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+func clientIPOfRequest(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// logAccess writes a structured access log entry for a request
+func logAccess(r *http.Request, recorder *responseRecorder, assetPath string, start time.Time) {
+	// Rejected requests have no asset path
+	if assetPath == "" {
+		assetPath = strings.TrimPrefix(r.URL.Path, "/")
+	}
+	channel, image := imageOfAssetPath(assetPath)
+	log.WithFields(log.Fields{
+		"type":        "access",
+		"client":      clientIPOfRequest(r),
+		"method":      r.Method,
+		"path":        assetPath,
+		"channel":     channel,
+		"image":       image,
+		"range":       r.Header.Get("Range"),
+		"status":      recorder.Status(),
+		"bytes":       recorder.bytes,
+		"duration_ms": time.Since(start).Milliseconds(),
+		"user_agent":  r.UserAgent(),
+	}).Info("request")
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pullThroughDirectoryName is the hidden folder in the assets directory where files are downloaded from the upstream,
+// they are renamed into their image folder once complete
+const pullThroughDirectoryName = ".pull-through"
+
+// pullThroughMarkerFilename marks the image folders filled by the cache. They may only hold the files booted so far,
+// e.g. vmlinuz and initrd, so the cleaner does not remove them as orphaned folders.
+const pullThroughMarkerFilename = ".pull-through-cache"
+
+// errUpstreamNotFound is no real error, the file does not exist upstream either
+var errUpstreamNotFound = errors.New("not found upstream")
+
+// PullThroughCache downloads the image files which are missing locally from an upstream netboot server or blob storage.
+// The file is streamed to the client while it is written to the assets directory, and concurrent requests for the same
+// file share a single upstream download.
+type PullThroughCache struct {
+	AssetsDirectory string
+	// UpstreamURL is the base URL the asset path is appended to, its query (e.g. a SAS token) is kept
+	UpstreamURL *url.URL
+	Client      *http.Client
+
+	mutex sync.Mutex
+	fills map[string]*cacheFill
+}
+
+// cacheFill is a download from the upstream in progress, the readers follow the partial file as it grows
+type cacheFill struct {
+	mutex       sync.Mutex
+	changed     *sync.Cond
+	partialPath string
+	// ready is set once the upstream responded, status, size and modTime are known from then on
+	ready   bool
+	status  int
+	size    int64
+	modTime time.Time
+	written int64
+	done    bool
+	err     error
+}
+
+func NewPullThroughCache(assetsDirectory string, upstreamURL string) (*PullThroughCache, error) {
+	parsedURL, err := url.Parse(upstreamURL)
+	if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") {
+		return nil, fmt.Errorf("invalid upstream URL %s", strings.SplitN(upstreamURL, "?", 2)[0])
+	}
+	// Downloads interrupted by a restart cannot be resumed, they are started again on the next request
+	if err := os.RemoveAll(filepath.Join(assetsDirectory, pullThroughDirectoryName)); err != nil {
+		return nil, err
+	}
+	return &PullThroughCache{
+		AssetsDirectory: assetsDirectory,
+		UpstreamURL:     parsedURL,
+		Client:          &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, ResponseHeaderTimeout: 30 * time.Second}},
+		fills:           map[string]*cacheFill{},
+	}, nil
+}
+
+// isCacheable returns whether a missing asset is fetched from the upstream. Only the files of image and kernel folders
+// are cached, as they never change, unlike files like kernels/newest-kernel-version.json.
+func isCacheable(assetPath string) bool {
+	return len(strings.Split(assetPath, "/")) >= 3
+}
+
+// Serve streams the asset from the upstream to the client. If the file was completed in the meantime, it returns
+// false without writing a response, so the caller serves the local file.
+func (c *PullThroughCache) Serve(w http.ResponseWriter, r *http.Request, assetPath string) bool {
+	if r.Method == http.MethodHead {
+		return c.serveHead(w, r, assetPath)
+	}
+	fill, reader, err := c.startFill(assetPath)
+	if err != nil {
+		log.WithFields(log.Fields{"path": assetPath}).WithError(err).Error("could not start the upstream download")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return true
+	}
+	if fill == nil {
+		return false
+	}
+	defer reader.Close()
+
+	// Range requests are answered with the complete file, which HTTP allows, until the file is cached
+	status, size, modTime := fill.waitReady()
+	if !writeHeaders(w, assetPath, status, size, modTime) {
+		return true
+	}
+
+	buffer := make([]byte, 256*1024)
+	var offset int64
+	for {
+		written, done, err := fill.waitFor(offset)
+		if written > offset {
+			length := written - offset
+			if length > int64(len(buffer)) {
+				length = int64(len(buffer))
+			}
+			n, readErr := reader.ReadAt(buffer[:length], offset)
+			if n > 0 {
+				if _, writeErr := w.Write(buffer[:n]); writeErr != nil {
+					// The client is gone, the download continues for the cache
+					return true
+				}
+				offset += int64(n)
+			}
+			if readErr != nil && !errors.Is(readErr, io.EOF) {
+				panic(http.ErrAbortHandler)
+			}
+			continue
+		}
+		if err != nil {
+			// The headers are already sent, aborting the connection tells the client the file is incomplete
+			panic(http.ErrAbortHandler)
+		}
+		if done {
+			return true
+		}
+	}
+}
+
+// serveHead answers a HEAD request from the response headers of the upstream, without downloading the file
+func (c *PullThroughCache) serveHead(w http.ResponseWriter, r *http.Request, assetPath string) bool {
+	if _, err := os.Stat(c.localPath(assetPath)); err == nil {
+		return false
+	}
+	status, size, modTime := http.StatusBadGateway, int64(-1), time.Time{}
+	request, err := http.NewRequestWithContext(r.Context(), http.MethodHead, c.upstreamURL(assetPath), nil)
+	if err == nil {
+		var response *http.Response
+		if response, err = c.Client.Do(request); err == nil {
+			response.Body.Close()
+			status = response.StatusCode
+			size = response.ContentLength
+			modTime, _ = http.ParseTime(response.Header.Get("Last-Modified"))
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"path": assetPath}).WithError(redactURLError(err)).Error("upstream HEAD request failed")
+	}
+	writeHeaders(w, assetPath, status, size, modTime)
+	return true
+}
+
+// writeHeaders answers with the status of the upstream and returns whether the file content follows
+func writeHeaders(w http.ResponseWriter, assetPath string, status int, size int64, modTime time.Time) bool {
+	switch {
+	case status == http.StatusNotFound:
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return false
+	case status != http.StatusOK:
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return false
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(assetPath))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	if size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+	return true
+}
+
+// startFill joins the running download of the asset or starts a new one. The returned reader is opened while the
+// download is registered, so it stays valid once the partial file is renamed or removed.
+// It returns no fill if the file exists by now.
+func (c *PullThroughCache) startFill(assetPath string) (*cacheFill, *os.File, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	fill, ok := c.fills[assetPath]
+	if !ok {
+		if _, err := os.Stat(c.localPath(assetPath)); err == nil {
+			return nil, nil, nil
+		}
+		directory := filepath.Join(c.AssetsDirectory, pullThroughDirectoryName)
+		if err := os.MkdirAll(directory, 0755); err != nil {
+			return nil, nil, err
+		}
+		partialFile, err := os.CreateTemp(directory, "*.partial")
+		if err != nil {
+			return nil, nil, err
+		}
+		fill = &cacheFill{partialPath: partialFile.Name(), size: -1}
+		fill.changed = sync.NewCond(&fill.mutex)
+		c.fills[assetPath] = fill
+		go c.download(assetPath, fill, partialFile)
+	}
+
+	reader, err := os.Open(fill.partialPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fill, reader, nil
+}
+
+// download copies the file from the upstream into the partial file and renames it into the assets directory.
+// It does not depend on the request which started it, so the file is cached even if that client disconnects.
+func (c *PullThroughCache) download(assetPath string, fill *cacheFill, partialFile *os.File) {
+	start := time.Now()
+	written, err := c.copyFromUpstream(assetPath, fill, partialFile)
+	if closeErr := partialFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && fill.size >= 0 && written != fill.size {
+		err = fmt.Errorf("expected %d bytes, got %d", fill.size, written)
+	}
+	if err == nil && !fill.modTime.IsZero() {
+		err = os.Chtimes(fill.partialPath, fill.modTime, fill.modTime)
+	}
+
+	c.mutex.Lock()
+	if err == nil {
+		localPath := c.localPath(assetPath)
+		if err = os.MkdirAll(filepath.Dir(localPath), 0755); err == nil {
+			err = c.markImageFolder(assetPath)
+		}
+		if err == nil {
+			err = os.Rename(fill.partialPath, localPath)
+		}
+	}
+	if err != nil {
+		os.Remove(fill.partialPath)
+	}
+	delete(c.fills, assetPath)
+	c.mutex.Unlock()
+
+	fill.finish(err)
+	fields := log.Fields{"path": assetPath, "status": fill.status, "bytes": written, "duration": time.Since(start).String()}
+	switch {
+	case errors.Is(err, errUpstreamNotFound):
+	case err != nil:
+		log.WithFields(fields).WithError(err).Error("upstream download failed")
+	default:
+		log.WithFields(fields).Info("cached file from upstream")
+	}
+}
+
+func (c *PullThroughCache) copyFromUpstream(assetPath string, fill *cacheFill, partialFile *os.File) (int64, error) {
+	request, err := http.NewRequestWithContext(context.Background(), http.MethodGet, c.upstreamURL(assetPath), nil)
+	if err != nil {
+		fill.setReady(http.StatusBadGateway, nil)
+		return 0, redactURLError(err)
+	}
+	response, err := c.Client.Do(request)
+	if err != nil {
+		fill.setReady(http.StatusBadGateway, nil)
+		return 0, redactURLError(err)
+	}
+	defer response.Body.Close()
+	fill.setReady(response.StatusCode, response)
+	if response.StatusCode == http.StatusNotFound {
+		return 0, errUpstreamNotFound
+	}
+	if response.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("upstream responded with %s", response.Status)
+	}
+
+	buffer := make([]byte, 256*1024)
+	var written int64
+	for {
+		n, readErr := response.Body.Read(buffer)
+		if n > 0 {
+			if _, err := partialFile.Write(buffer[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+			fill.setWritten(written)
+		}
+		if errors.Is(readErr, io.EOF) {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
+
+// upstreamURL appends the escaped asset path to the path of the upstream URL
+func (c *PullThroughCache) upstreamURL(assetPath string) string {
+	upstreamURL := *c.UpstreamURL
+	upstreamURL.Path = strings.TrimSuffix(upstreamURL.Path, "/") + "/" + assetPath
+	upstreamURL.RawPath = ""
+	return upstreamURL.String()
+}
+
+// redactURLError leaves the query out of the URL of a failed request, it contains the SAS token of the upstream
+func redactURLError(err error) error {
+	var urlError *url.Error
+	if !errors.As(err, &urlError) {
+		return err
+	}
+	return &url.Error{Op: urlError.Op, URL: strings.SplitN(urlError.URL, "?", 2)[0], Err: urlError.Err}
+}
+
+// markImageFolder writes the marker file into the image folder of the asset before its first file is renamed into it
+func (c *PullThroughCache) markImageFolder(assetPath string) error {
+	segments := strings.SplitN(assetPath, "/", 3)
+	markerPath := c.localPath(path.Join(segments[0], segments[1], pullThroughMarkerFilename))
+	marker, err := os.OpenFile(markerPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return marker.Close()
+}
+
+func (c *PullThroughCache) localPath(assetPath string) string {
+	return filepath.Join(c.AssetsDirectory, filepath.FromSlash(assetPath))
+}
+
+func (f *cacheFill) setReady(status int, response *http.Response) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.ready = true
+	f.status = status
+	if response != nil && status == http.StatusOK {
+		f.size = response.ContentLength
+		f.modTime, _ = http.ParseTime(response.Header.Get("Last-Modified"))
+	}
+	f.changed.Broadcast()
+}
+
+func (f *cacheFill) setWritten(written int64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.written = written
+	f.changed.Broadcast()
+}
+
+func (f *cacheFill) finish(err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.ready {
+		f.ready = true
+		f.status = http.StatusBadGateway
+	}
+	f.done = true
+	f.err = err
+	f.changed.Broadcast()
+}
+
+func (f *cacheFill) waitReady() (int, int64, time.Time) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for !f.ready {
+		f.changed.Wait()
+	}
+	return f.status, f.size, f.modTime
+}
+
+// waitFor blocks until more than offset bytes are written or the download is done
+func (f *cacheFill) waitFor(offset int64) (int64, bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for f.written <= offset && !f.done {
+		f.changed.Wait()
+	}
+	return f.written, f.done, f.err
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestUpstream serves a squashfs file, the response body is held back until release is closed
+func newTestUpstream(t *testing.T, content string, release chan struct{}) (*httptest.Server, *atomic.Int64) {
+	var requests atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path != "/netboot/prod/24-09-01-master-c0ffee0/image.squashfs" || r.URL.Query().Get("sig") != "secret" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Last-Modified", "Sun, 01 Sep 2024 10:00:00 GMT")
+		w.Header().Set("Content-Length", "16")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, content[:8])
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, content[8:])
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, &requests
+}
+
+func newTestCachingServer(t *testing.T, upstreamURL string) (*AssetServer, string) {
+	assetsDir := createTestAssets(t)
+	cache, err := NewPullThroughCache(assetsDir, upstreamURL+"/netboot?sig=secret")
+	require.NoError(t, err)
+	return &AssetServer{AssetsDirectory: assetsDir, Stats: NewDownloadStats(24, 64), Cache: cache}, assetsDir
+}
+
+func TestPullThroughCacheCollapsesConcurrentRequests(t *testing.T) {
+	// Arrange
+	release := make(chan struct{})
+	upstream, upstreamRequests := newTestUpstream(t, "squashfs-content", release)
+	server, assetsDir := newTestCachingServer(t, upstream.URL)
+	assetServer := httptest.NewServer(server)
+	defer assetServer.Close()
+
+	// Act
+	bodies := make([]string, 3)
+	var wait sync.WaitGroup
+	for i := range bodies {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			response, err := http.Get(assetServer.URL + "/prod/24-09-01-master-c0ffee0/image.squashfs")
+			if err != nil {
+				return
+			}
+			defer response.Body.Close()
+			body, _ := io.ReadAll(response.Body)
+			bodies[i] = string(body)
+		}(i)
+	}
+	// All clients get the first half while the upstream download is still running
+	assert.Eventually(t, func() bool { return server.Stats.ActiveDownloads() == 3 }, time.Second, 10*time.Millisecond)
+	close(release)
+	wait.Wait()
+
+	// Assert
+	assert.Equal(t, []string{"squashfs-content", "squashfs-content", "squashfs-content"}, bodies)
+	assert.Equal(t, int64(1), upstreamRequests.Load())
+	cachedPath := filepath.Join(assetsDir, "prod", "24-09-01-master-c0ffee0", "image.squashfs")
+	content, err := os.ReadFile(cachedPath)
+	require.NoError(t, err)
+	assert.Equal(t, "squashfs-content", string(content))
+	info, err := os.Stat(cachedPath)
+	require.NoError(t, err)
+	assert.True(t, info.ModTime().Equal(time.Date(2024, 9, 1, 10, 0, 0, 0, time.UTC)))
+	entries, err := os.ReadDir(filepath.Join(assetsDir, pullThroughDirectoryName))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	// The cleaner does not remove the image folder as orphaned while only some of its files are cached
+	_, err = os.Stat(filepath.Join(assetsDir, "prod", "24-09-01-master-c0ffee0", pullThroughMarkerFilename))
+	assert.NoError(t, err)
+
+	// The next request is served from the cache with range support
+	request := httptest.NewRequest(http.MethodGet, "/prod/24-09-01-master-c0ffee0/image.squashfs", nil)
+	request.Header.Set("Range", "bytes=9-")
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusPartialContent, recorder.Code)
+	assert.Equal(t, "content", recorder.Body.String())
+	assert.Equal(t, int64(1), upstreamRequests.Load())
+}
+
+func TestPullThroughCacheNotFound(t *testing.T) {
+	// Arrange
+	upstream, upstreamRequests := newTestUpstream(t, "squashfs-content", nil)
+	server, assetsDir := newTestCachingServer(t, upstream.URL)
+
+	tests := []struct {
+		name                     string
+		path                     string
+		expectedStatus           int
+		expectedUpstreamRequests int64
+	}{
+		{name: "Missing upstream", path: "/prod/24-09-02-master-c0ffee0/image.squashfs", expectedStatus: http.StatusNotFound, expectedUpstreamRequests: 1},
+		{name: "File of a channel folder", path: "/kernels/newest-kernel-version.json", expectedStatus: http.StatusNotFound, expectedUpstreamRequests: 1},
+		{name: "Local file", path: "/prod/24-08-29-master-a46edbc/vmlinuz", expectedStatus: http.StatusOK, expectedUpstreamRequests: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+			// Assert
+			assert.Equal(t, test.expectedStatus, recorder.Code)
+			assert.Equal(t, test.expectedUpstreamRequests, upstreamRequests.Load())
+		})
+	}
+	assert.NoDirExists(t, filepath.Join(assetsDir, "prod", "24-09-02-master-c0ffee0"))
+}
+
+func TestPullThroughCacheHead(t *testing.T) {
+	// Arrange
+	release := make(chan struct{})
+	close(release)
+	upstream, upstreamRequests := newTestUpstream(t, "squashfs-content", release)
+	server, assetsDir := newTestCachingServer(t, upstream.URL)
+
+	// Act
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodHead, "/prod/24-09-01-master-c0ffee0/image.squashfs", nil))
+
+	// Assert
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "16", recorder.Header().Get("Content-Length"))
+	assert.Equal(t, "Sun, 01 Sep 2024 10:00:00 GMT", recorder.Header().Get("Last-Modified"))
+	assert.Empty(t, recorder.Body.String())
+	assert.Equal(t, int64(1), upstreamRequests.Load())
+	assert.NoDirExists(t, filepath.Join(assetsDir, "prod", "24-09-01-master-c0ffee0"))
+	assert.NoDirExists(t, filepath.Join(assetsDir, pullThroughDirectoryName))
+}
+
+func TestRedactURLError(t *testing.T) {
+	// Arrange
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+	request, err := http.NewRequest(http.MethodGet, upstream.URL+"/netboot/prod/image.squashfs?sig=secret", nil)
+	require.NoError(t, err)
+	_, requestErr := http.DefaultClient.Do(request)
+
+	// Act
+	err = redactURLError(requestErr)
+
+	// Assert
+	require.Error(t, requestErr)
+	assert.NotContains(t, err.Error(), "secret")
+	assert.Contains(t, err.Error(), "/netboot/prod/image.squashfs")
+}
+
+func TestUsageTrackerFlush(t *testing.T) {
+	// Arrange
+	assetsDir := createTestAssets(t)
+	server := &AssetServer{AssetsDirectory: assetsDir, Stats: NewDownloadStats(24, 64), Usage: NewUsageTracker(filepath.Join(assetsDir, usageFilename))}
+	server.Usage.Record("prod/24-08-20-master-a46edbc/image.squashfs", time.Now())
+
+	// Act
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/prod/24-08-29-master-a46edbc/image.squashfs", nil))
+	err := server.Usage.Flush()
+
+	// Assert
+	require.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(assetsDir, usageFilename))
+	require.NoError(t, err)
+	var usage UsageFile
+	require.NoError(t, json.Unmarshal(content, &usage))
+	// The file of a removed image is dropped
+	assert.Len(t, usage.LastAccess, 1)
+	assert.WithinDuration(t, time.Now(), usage.LastAccess["prod/24-08-29-master-a46edbc/image.squashfs"], 2*time.Second)
+	assert.Equal(t, usage.LastAccess, NewUsageTracker(filepath.Join(assetsDir, usageFilename)).lastAccess)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// HealthcheckDocument is served as healthcheck.json. Health is the path of a small file of the most recent production image relative to the
+// prod folder, which monitor_serveravailability.sh downloads to check that the newest image is available on this server.
+type HealthcheckDocument struct {
+	Health string `json:"health"`
+}
+
+// isHealthcheckPath matches /healthcheck.json as well as /healthcheck/[health]/healthcheck.json, which the monitoring requests as well
+func isHealthcheckPath(urlPath string) bool {
+	return urlPath == "/healthcheck.json" || (strings.HasPrefix(urlPath, "/healthcheck/") && strings.HasSuffix(urlPath, "/healthcheck.json"))
+}
+
+func (s *AssetServer) serveHealthcheck(w http.ResponseWriter, r *http.Request) {
+	document := HealthcheckDocument{Health: newestProdImageFile(filepath.Join(s.AssetsDirectory, "prod"))}
+
+	w.Header().Set("Content-Type", "application/json")
+	if document.Health == "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(document)
+}
+
+// newestProdImageFile returns the kernel sidecar of the most recently modified image folder, or its kernel if there is no sidecar
+func newestProdImageFile(prodFolder string) string {
+	folders, err := os.ReadDir(prodFolder)
+	if err != nil {
+		return ""
+	}
+
+	var newestFolder string
+	var newestModTime time.Time
+	for _, folder := range folders {
+		if !folder.IsDir() || strings.HasPrefix(folder.Name(), ".") {
+			continue
+		}
+		info, err := folder.Info()
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(newestModTime) {
+			newestFolder = folder.Name()
+			newestModTime = info.ModTime()
+		}
+	}
+	if newestFolder == "" {
+		return ""
+	}
+
+	files, err := os.ReadDir(filepath.Join(prodFolder, newestFolder))
+	if err != nil {
+		return ""
+	}
+	fallback := ""
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), "kernel.json") {
+			return newestFolder + "/" + file.Name()
+		}
+		if file.Name() == "vmlinuz" {
+			fallback = newestFolder + "/" + file.Name()
+		}
+	}
+	return fallback
+}
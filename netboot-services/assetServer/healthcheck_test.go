@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeHealthcheck(t *testing.T) {
+	// Arrange
+	assetsDir := createTestAssets(t)
+	olderImage := filepath.Join(assetsDir, "prod", "24-08-28-master-a46edbc")
+	require.NoError(t, os.Chtimes(olderImage, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)))
+	server := &AssetServer{AssetsDirectory: assetsDir, Stats: NewDownloadStats(24, 64)}
+
+	for _, path := range []string{"/healthcheck.json", "/healthcheck/24-08-29-master-a46edbc/24-08-29-master-a46edbc-kernel.json/healthcheck.json"} {
+		t.Run(path, func(t *testing.T) {
+			// Act
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+
+			// Assert
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			var document HealthcheckDocument
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &document))
+			assert.Equal(t, "24-08-29-master-a46edbc/24-08-29-master-a46edbc-kernel.json", document.Health)
+		})
+	}
+}
+
+func TestServeHealthcheckWithoutImages(t *testing.T) {
+	// Arrange
+	server := &AssetServer{AssetsDirectory: t.TempDir(), Stats: NewDownloadStats(24, 64)}
+
+	// Act
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthcheck.json", nil))
+
+	// Assert
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	AssetsDirectory    = "/assets"
+	ListenAddress      = ":80"
+	BootFilesDirectory = "/srv/tftp"
+	MenusDirectory     = "/menus"
+	UsageFlushInterval = time.Minute
+)
+
+// Path prefixes of the iPXE binaries and the menus, which are served for UEFI HTTP Boot clients and menus chained via HTTP
+const (
+	BootFilesPathPrefix = "boot"
+	MenusPathPrefix     = "ipxe"
+)
+
+// AssetServer serves the kernels, initial ramdisks and squashfs files of the assets folder
+type AssetServer struct {
+	AssetsDirectory string
+	// TokenValidator is optional, if set the files of the protected channels are only served with a valid token
+	TokenValidator    *AssetTokenValidator
+	ProtectedChannels []string
+	Stats             *DownloadStats
+	// BootFilesDirectory and MenusDirectory are optional, if empty /boot/ and /ipxe/ are looked up in the assets directory
+	BootFilesDirectory string
+	MenusDirectory     string
+	// Cache is optional, if set missing image files are fetched from the upstream
+	Cache *PullThroughCache
+	// Usage is optional, if set the last access of all image files is recorded for the cleaner
+	Usage *UsageTracker
+}
+
+func main() {
+	log.SetLevel(log.InfoLevel)
+	log.SetFormatter(&log.JSONFormatter{})
+
+	if os.Getenv("ASSETS_DIRECTORY") != "" {
+		AssetsDirectory = os.Getenv("ASSETS_DIRECTORY")
+	}
+	if os.Getenv("LISTEN_ADDRESS") != "" {
+		ListenAddress = os.Getenv("LISTEN_ADDRESS")
+	}
+	if os.Getenv("BOOT_FILES_DIRECTORY") != "" {
+		BootFilesDirectory = os.Getenv("BOOT_FILES_DIRECTORY")
+	}
+	if os.Getenv("MENUS_DIRECTORY") != "" {
+		MenusDirectory = os.Getenv("MENUS_DIRECTORY")
+	}
+
+	tokenValidator, err := parseAssetTokenSecrets(os.Getenv("ASSET_TOKEN_SECRETS"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	protectedChannels := []string{"dev", "prod"}
+	if os.Getenv("ASSET_TOKEN_CHANNELS") != "" {
+		protectedChannels = strings.Split(os.Getenv("ASSET_TOKEN_CHANNELS"), ",")
+	}
+
+	subnetPrefixLengthIPv4, err := getIntEnv("CLIENT_SUBNET_PREFIX_LENGTH_IPV4", 24)
+	if err != nil {
+		log.Fatal(err)
+	}
+	subnetPrefixLengthIPv6, err := getIntEnv("CLIENT_SUBNET_PREFIX_LENGTH_IPV6", 64)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := &AssetServer{
+		AssetsDirectory:    AssetsDirectory,
+		TokenValidator:     tokenValidator,
+		ProtectedChannels:  protectedChannels,
+		Stats:              NewDownloadStats(subnetPrefixLengthIPv4, subnetPrefixLengthIPv6),
+		BootFilesDirectory: BootFilesDirectory,
+		MenusDirectory:     MenusDirectory,
+	}
+
+	if os.Getenv("UPSTREAM_URL") != "" {
+		server.Cache, err = NewPullThroughCache(AssetsDirectory, os.Getenv("UPSTREAM_URL"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Fetching missing image files from %s", server.Cache.UpstreamURL.Redacted())
+	}
+	// The cleaner evicts the images which were not booted for the longest time, a caching server always tracks the usage
+	if os.Getenv("TRACK_USAGE") == "true" || server.Cache != nil {
+		server.Usage = NewUsageTracker(filepath.Join(AssetsDirectory, usageFilename))
+		go server.Usage.Run(UsageFlushInterval)
+		log.Infof("Writing the last access of the image files to %s", server.Usage.Path)
+	}
+
+	log.Infof("Serving %s on %s, tokens required: %t", AssetsDirectory, ListenAddress, tokenValidator != nil)
+	log.Fatal(http.ListenAndServe(ListenAddress, server))
+}
+
+func getIntEnv(name string, defaultValue int) (int, error) {
+	if os.Getenv(name) == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(os.Getenv(name))
+}
+
+func (s *AssetServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/metrics":
+		s.Stats.ServeHTTP(w, r)
+		return
+	case isHealthcheckPath(r.URL.Path):
+		s.serveHealthcheck(w, r)
+		return
+	}
+
+	start := time.Now()
+	recorder := &responseRecorder{ResponseWriter: w}
+
+	assetPath, status := s.resolveAssetPath(r.URL.Path, start)
+	if status != http.StatusOK {
+		http.Error(recorder, http.StatusText(status), status)
+	} else {
+		s.serveFile(recorder, r, assetPath)
+	}
+
+	logAccess(r, recorder, assetPath, start)
+	if recorder.Status() == http.StatusOK || recorder.Status() == http.StatusPartialContent {
+		// HEAD requests transfer no file, they are no downloads
+		if r.Method == http.MethodGet {
+			s.Stats.Record(assetPath, clientIPOfRequest(r), recorder.bytes)
+		}
+		if s.Usage != nil && isImageFilePath(assetPath) {
+			s.Usage.Record(assetPath, start)
+		}
+	}
+}
+
+// resolveAssetPath returns the path of the requested file relative to the assets directory, with a possible token removed.
+// If the request must not be served, the HTTP status to respond with is returned instead of http.StatusOK.
+func (s *AssetServer) resolveAssetPath(urlPath string, now time.Time) (string, int) {
+	assetPath := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	segments := strings.Split(assetPath, "/")
+
+	// Hidden files and folders are used for in-progress downloads and bookkeeping and are never served
+	for _, segment := range segments {
+		if strings.HasPrefix(segment, ".") {
+			return "", http.StatusNotFound
+		}
+	}
+
+	if segments[0] == TokenPathPrefix {
+		if s.TokenValidator == nil || len(segments) < 5 {
+			return "", http.StatusNotFound
+		}
+		assetPath = strings.Join(segments[2:], "/")
+		scope := strings.Join(segments[2:4], "/") + "/"
+		err := s.TokenValidator.Validate(segments[1], scope, now)
+		if err != nil {
+			log.Warnf("Rejected token for %s: %s", assetPath, err)
+			return "", http.StatusForbidden
+		}
+		return assetPath, http.StatusOK
+	}
+
+	// The kernel sidecars are small and are used by the monitoring, so they are served without a token
+	if s.TokenValidator != nil && s.isProtectedChannel(segments[0]) && !strings.HasSuffix(assetPath, ".json") {
+		return "", http.StatusForbidden
+	}
+
+	return assetPath, http.StatusOK
+}
+
+func (s *AssetServer) isProtectedChannel(channel string) bool {
+	for _, protectedChannel := range s.ProtectedChannels {
+		if strings.TrimSpace(protectedChannel) == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// filePath returns the path of an asset on disk, the iPXE binaries and the menus are kept outside of the assets directory
+func (s *AssetServer) filePath(assetPath string) string {
+	prefix, rest, _ := strings.Cut(assetPath, "/")
+	switch {
+	case prefix == BootFilesPathPrefix && s.BootFilesDirectory != "":
+		return filepath.Join(s.BootFilesDirectory, filepath.FromSlash(rest))
+	case prefix == MenusPathPrefix && s.MenusDirectory != "":
+		return filepath.Join(s.MenusDirectory, filepath.FromSlash(rest))
+	default:
+		return filepath.Join(s.AssetsDirectory, filepath.FromSlash(assetPath))
+	}
+}
+
+// serveFile serves a file of the assets directory, directories are not listed
+func (s *AssetServer) serveFile(w http.ResponseWriter, r *http.Request, assetPath string) {
+	if s.isPullThroughPath(assetPath) {
+		if _, err := os.Stat(s.filePath(assetPath)); errors.Is(err, fs.ErrNotExist) && s.servePullThrough(w, r, assetPath) {
+			return
+		}
+	}
+
+	file, err := os.Open(s.filePath(assetPath))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	defer s.Stats.StartDownload(assetPath)()
+	// ServeContent handles Range requests and uses sendfile for the file content
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// isPullThroughPath returns whether the asset is an image file, which is fetched from the upstream if it is missing
+func (s *AssetServer) isPullThroughPath(assetPath string) bool {
+	return s.Cache != nil && isImageFilePath(assetPath)
+}
+
+// isImageFilePath returns whether the asset is a file of an image or kernel folder, i.e. [channel]/[folder]/[file]
+func isImageFilePath(assetPath string) bool {
+	prefix, _, _ := strings.Cut(assetPath, "/")
+	return prefix != BootFilesPathPrefix && prefix != MenusPathPrefix && isCacheable(assetPath)
+}
+
+func (s *AssetServer) servePullThrough(w http.ResponseWriter, r *http.Request, assetPath string) bool {
+	defer s.Stats.StartDownload(assetPath)()
+	return s.Cache.Serve(w, r, assetPath)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssetServerServeHTTP(t *testing.T) {
+	// Arrange
+	assetsDir := createTestAssets(t)
+	validator := &AssetTokenValidator{Secrets: map[string][]byte{"2024b": []byte("secret")}}
+	server := &AssetServer{AssetsDirectory: assetsDir, TokenValidator: validator, ProtectedChannels: []string{"dev", "prod"}, Stats: NewDownloadStats(24, 64)}
+
+	expires := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	token := "2024b." + expires + "." + assetTokenMAC([]byte("secret"), "2024b", expires, "prod/24-08-29-master-a46edbc/")
+
+	tests := []struct {
+		name           string
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "Squashfs with token", path: "/_token/" + token + "/prod/24-08-29-master-a46edbc/image.squashfs", expectedStatus: http.StatusOK, expectedBody: "squashfs"},
+		{name: "Kernel with token", path: "/_token/" + token + "/prod/24-08-29-master-a46edbc/vmlinuz", expectedStatus: http.StatusOK, expectedBody: "vmlinuz"},
+		{name: "Squashfs without token", path: "/prod/24-08-29-master-a46edbc/image.squashfs", expectedStatus: http.StatusForbidden},
+		{name: "Token of another image", path: "/_token/" + token + "/prod/24-08-28-master-a46edbc/image.squashfs", expectedStatus: http.StatusForbidden},
+		{name: "Kernel sidecar without token", path: "/prod/24-08-29-master-a46edbc/24-08-29-master-a46edbc-kernel.json", expectedStatus: http.StatusOK, expectedBody: "{}"},
+		{name: "Unprotected channel", path: "/kernels/latest-kernel-version.json", expectedStatus: http.StatusOK, expectedBody: "{}"},
+		{name: "Directory listing", path: "/kernels/", expectedStatus: http.StatusNotFound},
+		{name: "Hidden folder", path: "/.staging/image.squashfs", expectedStatus: http.StatusNotFound},
+		{name: "Path traversal", path: "/_token/" + token + "/prod/24-08-29-master-a46edbc/../../../etc/passwd", expectedStatus: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+			// Assert
+			assert.Equal(t, test.expectedStatus, recorder.Code)
+			if test.expectedBody != "" {
+				assert.Equal(t, test.expectedBody, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestAssetServerWithoutTokens(t *testing.T) {
+	// Arrange
+	assetsDir := createTestAssets(t)
+	server := &AssetServer{AssetsDirectory: assetsDir, ProtectedChannels: []string{"dev", "prod"}, Stats: NewDownloadStats(24, 64)}
+
+	// Act
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/prod/24-08-29-master-a46edbc/image.squashfs", nil))
+
+	// Assert
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "squashfs", recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/prod/24-08-29-master-a46edbc/image.squashfs", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+}
+
+func TestAssetServerDoesNotRecordHeadRequests(t *testing.T) {
+	// Arrange
+	assetsDir := createTestAssets(t)
+	server := &AssetServer{AssetsDirectory: assetsDir, ProtectedChannels: []string{"dev", "prod"}, Stats: NewDownloadStats(24, 64)}
+
+	// Act
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodHead, "/prod/24-08-29-master-a46edbc/image.squashfs", nil))
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/prod/24-08-29-master-a46edbc/image.squashfs", nil))
+
+	// Assert
+	var metrics strings.Builder
+	server.Stats.WriteMetrics(&metrics)
+	assert.Contains(t, metrics.String(), `netboot_asset_image_downloads_total{channel="prod",image="24-08-29-master-a46edbc"} 1`)
+}
+
+func TestAssetServerServesBootFilesAndMenus(t *testing.T) {
+	// Arrange
+	assetsDir := createTestAssets(t)
+	bootFilesDir := t.TempDir()
+	menusDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(bootFilesDir, "ipxe64.efi"), []byte("efi"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(menusDir, "menu.ipxe"), []byte("#!ipxe"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(menusDir, ".menu.ipxe-123"), []byte("partial"), 0644))
+	validator := &AssetTokenValidator{Secrets: map[string][]byte{"2024b": []byte("secret")}}
+	server := &AssetServer{
+		AssetsDirectory:    assetsDir,
+		TokenValidator:     validator,
+		ProtectedChannels:  []string{"dev", "prod"},
+		Stats:              NewDownloadStats(24, 64),
+		BootFilesDirectory: bootFilesDir,
+		MenusDirectory:     menusDir,
+	}
+
+	tests := []struct {
+		name           string
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "iPXE binary", path: "/boot/ipxe64.efi", expectedStatus: http.StatusOK, expectedBody: "efi"},
+		{name: "Menu", path: "/ipxe/menu.ipxe", expectedStatus: http.StatusOK, expectedBody: "#!ipxe"},
+		{name: "Temporary menu file", path: "/ipxe/.menu.ipxe-123", expectedStatus: http.StatusNotFound},
+		{name: "Missing menu", path: "/ipxe/advancedmenu.ipxe", expectedStatus: http.StatusNotFound},
+		{name: "Traversal out of the menus", path: "/ipxe/../prod/24-08-29-master-a46edbc/image.squashfs", expectedStatus: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+			// Assert
+			assert.Equal(t, test.expectedStatus, recorder.Code)
+			if test.expectedBody != "" {
+				assert.Equal(t, test.expectedBody, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestAssetServerRangeRequest(t *testing.T) {
+	// Arrange
+	assetsDir := createTestAssets(t)
+	server := &AssetServer{AssetsDirectory: assetsDir, Stats: NewDownloadStats(24, 64)}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	request, err := http.NewRequest(http.MethodGet, httpServer.URL+"/prod/24-08-29-master-a46edbc/image.squashfs", nil)
+	require.NoError(t, err)
+	request.Header.Set("Range", "bytes=2-5")
+
+	// Act
+	response, err := http.DefaultClient.Do(request)
+
+	// Assert
+	require.NoError(t, err)
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, response.StatusCode)
+	assert.Equal(t, "uash", string(body))
+
+	var metrics strings.Builder
+	server.Stats.WriteMetrics(&metrics)
+	assert.Contains(t, metrics.String(), `netboot_asset_image_download_bytes_total{channel="prod",image="24-08-29-master-a46edbc"} 4`)
+	assert.Contains(t, metrics.String(), `netboot_asset_subnet_downloads_total{subnet="127.0.0.0/24"} 1`)
+}
+
+// Helper function to create an assets folder with one image per channel
+func createTestAssets(t *testing.T) string {
+	assetsDir := t.TempDir()
+	files := map[string]string{
+		"prod/24-08-29-master-a46edbc/image.squashfs":                      "squashfs",
+		"prod/24-08-29-master-a46edbc/vmlinuz":                             "vmlinuz",
+		"prod/24-08-29-master-a46edbc/24-08-29-master-a46edbc-kernel.json": "{}",
+		"prod/24-08-28-master-a46edbc/image.squashfs":                      "squashfs",
+		"dev/24-08-30-feature-b57fecd/image.squashfs":                      "squashfs",
+		"kernels/latest-kernel-version.json":                               "{}",
+		".staging/image.squashfs":                                          "partial",
+	}
+	for file, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(assetsDir, file)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(assetsDir, file), []byte(content), 0644))
+	}
+	return assetsDir
+}
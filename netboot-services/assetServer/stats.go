@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// downloadCounter counts the completed downloads and the bytes sent
+type downloadCounter struct {
+	Downloads int64
+	Bytes     int64
+}
+
+// DownloadStats aggregates the downloads per image, per channel and per client subnet, the three maps are kept separate
+// so the number of time series stays the sum and not the product of images and subnets.
+type DownloadStats struct {
+	mutex           sync.Mutex
+	perImage        map[[2]string]*downloadCounter
+	perChannel      map[string]*downloadCounter
+	perSubnet       map[string]*downloadCounter
+	activeDownloads int64
+	// activeImageDownloads only counts the squashfs files, which are downloaded by booting clients
+	activeImageDownloads int64
+	// SubnetPrefixLengthIPv4 and SubnetPrefixLengthIPv6 define how client addresses are grouped into subnets
+	SubnetPrefixLengthIPv4 int
+	SubnetPrefixLengthIPv6 int
+}
+
+func NewDownloadStats(subnetPrefixLengthIPv4 int, subnetPrefixLengthIPv6 int) *DownloadStats {
+	return &DownloadStats{
+		perImage:               map[[2]string]*downloadCounter{},
+		perChannel:             map[string]*downloadCounter{},
+		perSubnet:              map[string]*downloadCounter{},
+		SubnetPrefixLengthIPv4: subnetPrefixLengthIPv4,
+		SubnetPrefixLengthIPv6: subnetPrefixLengthIPv6,
+	}
+}
+
+// StartDownload marks a download of the asset as active until the returned function is called
+func (s *DownloadStats) StartDownload(assetPath string) func() {
+	isImage := strings.HasSuffix(assetPath, ".squashfs")
+	s.mutex.Lock()
+	s.activeDownloads++
+	if isImage {
+		s.activeImageDownloads++
+	}
+	s.mutex.Unlock()
+
+	return func() {
+		s.mutex.Lock()
+		s.activeDownloads--
+		if isImage {
+			s.activeImageDownloads--
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// ActiveDownloads returns the number of downloads currently in progress
+func (s *DownloadStats) ActiveDownloads() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.activeDownloads
+}
+
+// ActiveImageDownloads returns the number of squashfs downloads currently in progress
+func (s *DownloadStats) ActiveImageDownloads() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.activeImageDownloads
+}
+
+// Record adds a finished (or aborted) download of the asset to the counters
+func (s *DownloadStats) Record(assetPath string, clientIP string, bytes int64) {
+	channel, image := imageOfAssetPath(assetPath)
+	subnet := s.clientSubnet(clientIP)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	addToCounter(s.perImage, [2]string{channel, image}, bytes)
+	addToCounter(s.perChannel, channel, bytes)
+	addToCounter(s.perSubnet, subnet, bytes)
+}
+
+func addToCounter[K comparable](counters map[K]*downloadCounter, key K, bytes int64) {
+	counter, ok := counters[key]
+	if !ok {
+		counter = &downloadCounter{}
+		counters[key] = counter
+	}
+	counter.Downloads++
+	counter.Bytes += bytes
+}
+
+// imageOfAssetPath returns the channel and the image folder of an asset path like prod/[image folder]/[file].
+// Files directly in a channel folder have no image.
+func imageOfAssetPath(assetPath string) (string, string) {
+	segments := strings.Split(assetPath, "/")
+	if len(segments) < 3 {
+		return segments[0], ""
+	}
+	return segments[0], segments[1]
+}
+
+func (s *DownloadStats) clientSubnet(clientIP string) string {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return "unknown"
+	}
+	if ip.To4() != nil {
+		return (&net.IPNet{IP: ip.Mask(net.CIDRMask(s.SubnetPrefixLengthIPv4, 32)), Mask: net.CIDRMask(s.SubnetPrefixLengthIPv4, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(s.SubnetPrefixLengthIPv6, 128)), Mask: net.CIDRMask(s.SubnetPrefixLengthIPv6, 128)}).String()
+}
+
+// ServeHTTP exports the counters in the Prometheus text format, which can be scraped by the telegraf prometheus input
+func (s *DownloadStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.WriteMetrics(w)
+}
+
+func (s *DownloadStats) WriteMetrics(w io.Writer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	fmt.Fprintln(w, "# HELP netboot_asset_active_downloads Number of downloads currently in progress.")
+	fmt.Fprintln(w, "# TYPE netboot_asset_active_downloads gauge")
+	fmt.Fprintf(w, "netboot_asset_active_downloads %d\n", s.activeDownloads)
+	fmt.Fprintln(w, "# HELP netboot_asset_active_image_downloads Number of squashfs downloads currently in progress.")
+	fmt.Fprintln(w, "# TYPE netboot_asset_active_image_downloads gauge")
+	fmt.Fprintf(w, "netboot_asset_active_image_downloads %d\n", s.activeImageDownloads)
+
+	imageKeys := make([][2]string, 0, len(s.perImage))
+	for key := range s.perImage {
+		imageKeys = append(imageKeys, key)
+	}
+	sort.Slice(imageKeys, func(i, j int) bool {
+		return imageKeys[i][0]+"/"+imageKeys[i][1] < imageKeys[j][0]+"/"+imageKeys[j][1]
+	})
+	writeCounterFamilies(w, "image", imageKeys, func(key [2]string) string {
+		return fmt.Sprintf(`channel="%s",image="%s"`, escapeLabelValue(key[0]), escapeLabelValue(key[1]))
+	}, func(key [2]string) *downloadCounter { return s.perImage[key] })
+
+	writeCounterFamilies(w, "channel", sortedKeys(s.perChannel), func(key string) string {
+		return fmt.Sprintf(`channel="%s"`, escapeLabelValue(key))
+	}, func(key string) *downloadCounter { return s.perChannel[key] })
+
+	writeCounterFamilies(w, "subnet", sortedKeys(s.perSubnet), func(key string) string {
+		return fmt.Sprintf(`subnet="%s"`, escapeLabelValue(key))
+	}, func(key string) *downloadCounter { return s.perSubnet[key] })
+}
+
+func writeCounterFamilies[K any](w io.Writer, dimension string, keys []K, labels func(K) string, counter func(K) *downloadCounter) {
+	fmt.Fprintf(w, "# HELP netboot_asset_%s_downloads_total Number of downloads per %s.\n", dimension, dimension)
+	fmt.Fprintf(w, "# TYPE netboot_asset_%s_downloads_total counter\n", dimension)
+	for _, key := range keys {
+		fmt.Fprintf(w, "netboot_asset_%s_downloads_total{%s} %d\n", dimension, labels(key), counter(key).Downloads)
+	}
+	fmt.Fprintf(w, "# HELP netboot_asset_%s_download_bytes_total Bytes sent per %s.\n", dimension, dimension)
+	fmt.Fprintf(w, "# TYPE netboot_asset_%s_download_bytes_total counter\n", dimension)
+	for _, key := range keys {
+		fmt.Fprintf(w, "netboot_asset_%s_download_bytes_total{%s} %d\n", dimension, labels(key), counter(key).Bytes)
+	}
+}
+
+func sortedKeys(counters map[string]*downloadCounter) []string {
+	keys := make([]string, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
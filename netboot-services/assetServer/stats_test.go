@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadStatsRecord(t *testing.T) {
+	// Arrange
+	stats := NewDownloadStats(24, 64)
+
+	// Act
+	stats.Record("prod/24-08-29-master-a46edbc/image.squashfs", "10.1.2.3", 1000)
+	stats.Record("prod/24-08-29-master-a46edbc/vmlinuz", "10.1.2.200", 10)
+	stats.Record("dev/24-08-30-feature-b57fecd/image.squashfs", "10.1.3.4", 500)
+	stats.Record("kernels/latest-kernel-version.json", "2001:db8::1", 2)
+
+	// Assert
+	var metrics strings.Builder
+	stats.WriteMetrics(&metrics)
+	assert.Contains(t, metrics.String(), `netboot_asset_image_downloads_total{channel="prod",image="24-08-29-master-a46edbc"} 2`)
+	assert.Contains(t, metrics.String(), `netboot_asset_image_download_bytes_total{channel="prod",image="24-08-29-master-a46edbc"} 1010`)
+	assert.Contains(t, metrics.String(), `netboot_asset_channel_download_bytes_total{channel="dev"} 500`)
+	assert.Contains(t, metrics.String(), `netboot_asset_channel_downloads_total{channel="kernels"} 1`)
+	assert.Contains(t, metrics.String(), `netboot_asset_subnet_downloads_total{subnet="10.1.2.0/24"} 2`)
+	assert.Contains(t, metrics.String(), `netboot_asset_subnet_download_bytes_total{subnet="10.1.3.0/24"} 500`)
+	assert.Contains(t, metrics.String(), `netboot_asset_subnet_downloads_total{subnet="2001:db8::/64"} 1`)
+}
+
+func TestDownloadStatsActiveDownloads(t *testing.T) {
+	// Arrange
+	stats := NewDownloadStats(24, 64)
+
+	// Act
+	finishFirst := stats.StartDownload("prod/24-08-29-master-a46edbc/image.squashfs")
+	finishSecond := stats.StartDownload("prod/24-08-29-master-a46edbc/vmlinuz")
+	finishFirst()
+
+	// Assert
+	assert.Equal(t, int64(1), stats.ActiveDownloads())
+	assert.Equal(t, int64(0), stats.ActiveImageDownloads())
+	finishSecond()
+	assert.Equal(t, int64(0), stats.ActiveDownloads())
+}
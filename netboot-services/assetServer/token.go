@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TokenPathPrefix is the first path segment of a token protected asset URL: /_token/[keyID].[expires].[mac]/[channel]/[image folder]/[file]
+// The tokens are created by the ipxeMenuGenerator, see ipxeMenuGenerator/token.go
+const TokenPathPrefix = "_token"
+
+// AssetTokenValidator validates the HMAC tokens of the asset URLs. It accepts every configured secret, so secrets can be rotated without downtime.
+type AssetTokenValidator struct {
+	Secrets map[string][]byte
+}
+
+// parseAssetTokenSecrets parses a comma separated list of [keyID]:[secret]
+func parseAssetTokenSecrets(secrets string) (*AssetTokenValidator, error) {
+	if secrets == "" {
+		return nil, nil
+	}
+
+	validator := &AssetTokenValidator{Secrets: map[string][]byte{}}
+	for _, entry := range strings.Split(secrets, ",") {
+		keyID, secret, found := strings.Cut(entry, ":")
+		keyID = strings.TrimSpace(keyID)
+		if !found || keyID == "" || secret == "" || strings.ContainsAny(keyID, "./") {
+			return nil, fmt.Errorf("ASSET_TOKEN_SECRETS must be a list of [keyID]:[secret] and the key IDs must not contain '.' or '/'")
+		}
+		validator.Secrets[keyID] = []byte(secret)
+	}
+	return validator, nil
+}
+
+// Validate checks that the token was created with one of the secrets for the given scope and has not expired yet
+func (v *AssetTokenValidator) Validate(token string, scope string, now time.Time) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed token")
+	}
+	keyID, expires, mac := parts[0], parts[1], parts[2]
+
+	secret, ok := v.Secrets[keyID]
+	if !ok {
+		return fmt.Errorf("unknown key ID %q", keyID)
+	}
+
+	expiresUnix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed expiry: %w", err)
+	}
+	if now.After(time.Unix(expiresUnix, 0)) {
+		return fmt.Errorf("token expired at %s", time.Unix(expiresUnix, 0))
+	}
+
+	expectedMAC := assetTokenMAC(secret, keyID, expires, scope)
+	if !hmac.Equal([]byte(mac), []byte(expectedMAC)) {
+		return fmt.Errorf("invalid token for %s", scope)
+	}
+	return nil
+}
+
+func assetTokenMAC(secret []byte, keyID string, expires string, scope string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(keyID + "\n" + expires + "\n" + scope))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAssetTokenSecrets(t *testing.T) {
+	// Act
+	validator, err := parseAssetTokenSecrets("2024b:newsecret, 2024a:oldsecret")
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, []byte("newsecret"), validator.Secrets["2024b"])
+	assert.Equal(t, []byte("oldsecret"), validator.Secrets["2024a"])
+
+	validator, err = parseAssetTokenSecrets("")
+	assert.NoError(t, err)
+	assert.Nil(t, validator)
+
+	_, err = parseAssetTokenSecrets("newsecret")
+	assert.Error(t, err)
+
+	_, err = parseAssetTokenSecrets("2024b:newsecret, 2024.a:oldsecret")
+	assert.Error(t, err)
+
+	_, err = parseAssetTokenSecrets("2024/b:newsecret")
+	assert.Error(t, err)
+}
+
+func TestAssetTokenValidatorValidate(t *testing.T) {
+	// Arrange
+	validator := &AssetTokenValidator{Secrets: map[string][]byte{"2024b": []byte("newsecret"), "2024a": []byte("oldsecret")}}
+	now := time.Unix(1724932800, 0)
+	scope := "prod/24-08-29-master-a46edbc/"
+
+	tests := []struct {
+		name        string
+		token       string
+		scope       string
+		expectError bool
+	}{
+		{name: "Valid token", token: "2024b.1724936400." + assetTokenMAC([]byte("newsecret"), "2024b", "1724936400", scope), scope: scope},
+		{name: "Valid token of the previous secret", token: "2024a.1724936400." + assetTokenMAC([]byte("oldsecret"), "2024a", "1724936400", scope), scope: scope},
+		{name: "Expired token", token: "2024b.1724929200." + assetTokenMAC([]byte("newsecret"), "2024b", "1724929200", scope), scope: scope, expectError: true},
+		{name: "Token of another image", token: "2024b.1724936400." + assetTokenMAC([]byte("newsecret"), "2024b", "1724936400", scope), scope: "prod/24-08-28-master-a46edbc/", expectError: true},
+		{name: "Tampered expiry", token: "2024b.1724940000." + assetTokenMAC([]byte("newsecret"), "2024b", "1724936400", scope), scope: scope, expectError: true},
+		{name: "Unknown key ID", token: "2023z.1724936400." + assetTokenMAC([]byte("newsecret"), "2023z", "1724936400", scope), scope: scope, expectError: true},
+		{name: "Malformed token", token: "garbage", scope: scope, expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			err := validator.Validate(test.token, test.scope, now)
+
+			// Assert
+			if test.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// usageFilename is written to the root of the assets directory, the cleaner evicts the files which were not accessed for the longest time
+const usageFilename = ".netboot-usage.json"
+
+// UsageFile maps the asset paths (e.g. prod/[image folder]/[file]) to the time they were last served
+type UsageFile struct {
+	LastAccess map[string]time.Time `json:"lastAccess"`
+}
+
+// UsageTracker records the last access of every served file and writes it to the usage file periodically
+type UsageTracker struct {
+	Path string
+
+	mutex      sync.Mutex
+	lastAccess map[string]time.Time
+	dirty      bool
+}
+
+// NewUsageTracker continues with the access times of an existing usage file
+func NewUsageTracker(usagePath string) *UsageTracker {
+	tracker := &UsageTracker{Path: usagePath, lastAccess: map[string]time.Time{}}
+	content, err := os.ReadFile(usagePath)
+	if err != nil {
+		return tracker
+	}
+	var usage UsageFile
+	if err := json.Unmarshal(content, &usage); err != nil {
+		log.WithFields(log.Fields{"file": usagePath}).WithError(err).Warn("could not parse the usage file, starting over")
+		return tracker
+	}
+	if usage.LastAccess != nil {
+		tracker.lastAccess = usage.LastAccess
+	}
+	return tracker
+}
+
+func (u *UsageTracker) Record(assetPath string, now time.Time) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.lastAccess[assetPath] = now.UTC().Truncate(time.Second)
+	u.dirty = true
+}
+
+// LastAccess returns the time the asset was last served
+func (u *UsageTracker) LastAccess(assetPath string) (time.Time, bool) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	lastAccess, ok := u.lastAccess[assetPath]
+	return lastAccess, ok
+}
+
+// Flush writes the usage file if anything changed, files which were removed by the cleaner are dropped
+func (u *UsageTracker) Flush() error {
+	u.mutex.Lock()
+	if !u.dirty {
+		u.mutex.Unlock()
+		return nil
+	}
+	assetsDirectory := filepath.Dir(u.Path)
+	for assetPath := range u.lastAccess {
+		if _, err := os.Stat(filepath.Join(assetsDirectory, filepath.FromSlash(assetPath))); os.IsNotExist(err) {
+			delete(u.lastAccess, assetPath)
+		}
+	}
+	content, err := json.MarshalIndent(UsageFile{LastAccess: u.lastAccess}, "", "  ")
+	u.dirty = false
+	u.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The usage file is replaced with a rename, so the cleaner never reads a truncated file
+	temporaryPath := u.Path + ".tmp"
+	if err := os.WriteFile(temporaryPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporaryPath, u.Path)
+}
+
+// Run flushes the usage file every interval
+func (u *UsageTracker) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := u.Flush(); err != nil {
+			log.WithFields(log.Fields{"file": u.Path}).WithError(err).Error("could not write the usage file")
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Actions of the audit events
+const (
+	auditActionTrashed = "trashed"
+	auditActionDeleted = "deleted"
+	auditActionPurged  = "purged"
+)
+
+// Rules of the deletions which are not decided by the retention policies
+const (
+	ruleTrashGracePeriod   = "trash-grace-period"
+	ruleStaleFolder        = "stale-folder"
+	ruleUnreferencedKernel = "unreferenced-kernel"
+)
+
+// Payload formats of the webhook
+const (
+	webhookFormatSlack = "slack"
+	webhookFormatTeams = "teams"
+)
+
+const (
+	// auditLogFilename is the default audit log in the state folder of the cleaner
+	auditLogFilename = "audit.log"
+	// maxPendingAuditEvents limits the events kept for the next digest while the webhook is rate limited or unavailable
+	maxPendingAuditEvents = 1000
+	// maxDigestLines is the number of events listed in a digest, the others are only counted
+	maxDigestLines = 20
+)
+
+// audit records every deletion of the cleaner, it is configured by loadConfiguration
+var audit = &AuditLog{}
+
+// AuditEvent is a deletion of the cleaner, one JSON line of the audit log
+type AuditEvent struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	Channel string    `json:"channel"`
+	// Image is the image folder, the stale folder or the kernel version
+	Image     string `json:"image"`
+	SizeBytes int64  `json:"sizeBytes"`
+	Rule      string `json:"rule"`
+	Reason    string `json:"reason"`
+	// The used bytes of the filesystem before and after the deletion
+	DiskUsedBytesBefore int64 `json:"diskUsedBytesBefore"`
+	DiskUsedBytesAfter  int64 `json:"diskUsedBytesAfter"`
+	DiskTotalBytes      int64 `json:"diskTotalBytes"`
+}
+
+// AuditLog appends the deletions to a JSON lines file and sends a digest per cleanup run to a webhook. Both are
+// optional.
+type AuditLog struct {
+	Path    string
+	Webhook *Webhook
+
+	pending []AuditEvent
+	dropped int
+}
+
+// Webhook posts Slack or Teams compatible messages, at most once per MinInterval
+type Webhook struct {
+	URL         string
+	Format      string
+	Title       string
+	MinInterval time.Duration
+	Client      *http.Client
+
+	lastSent time.Time
+}
+
+// loadAuditLog configures the audit log and the webhook from the environment variables. The audit log is written to
+// the state folder unless AUDIT_LOG_FILE is set, an empty AUDIT_LOG_FILE disables it.
+func loadAuditLog(assetsDirectory string) (*AuditLog, error) {
+	auditLog := &AuditLog{Path: filepath.Join(assetsDirectory, stateDirectoryName, auditLogFilename)}
+	if value, ok := os.LookupEnv("AUDIT_LOG_FILE"); ok {
+		auditLog.Path = value
+	}
+	if os.Getenv("WEBHOOK_URL") == "" {
+		return auditLog, nil
+	}
+
+	webhook := &Webhook{
+		URL:         os.Getenv("WEBHOOK_URL"),
+		Format:      webhookFormatSlack,
+		Title:       "Netboot cleaner",
+		MinInterval: time.Hour,
+		Client:      &http.Client{Timeout: 30 * time.Second},
+	}
+	if value := os.Getenv("WEBHOOK_FORMAT"); value != "" {
+		if value != webhookFormatSlack && value != webhookFormatTeams {
+			return nil, fmt.Errorf("invalid WEBHOOK_FORMAT %s, expected slack or teams", value)
+		}
+		webhook.Format = value
+	}
+	if os.Getenv("WEBHOOK_TITLE") != "" {
+		webhook.Title = os.Getenv("WEBHOOK_TITLE")
+	}
+	if value := os.Getenv("WEBHOOK_MIN_INTERVAL_IN_MINUTES"); value != "" {
+		minutes, err := strconv.ParseFloat(value, 64)
+		if err != nil || minutes < 0 {
+			return nil, fmt.Errorf("invalid WEBHOOK_MIN_INTERVAL_IN_MINUTES %s", value)
+		}
+		webhook.MinInterval = time.Duration(minutes * float64(time.Minute))
+	}
+	auditLog.Webhook = webhook
+	return auditLog, nil
+}
+
+// Track runs the deletion of the folder and records it with the disk usage before and after. Nothing is recorded if
+// the deletion fails.
+func (a *AuditLog) Track(event AuditEvent, folderPath string, remove func() error) error {
+	_, usedBefore, total, diskErr := diskSpaceUsage(folderPath)
+	if err := remove(); err != nil {
+		return err
+	}
+	if diskErr == nil {
+		_, usedAfter, _, _ := diskSpaceUsage(folderPath)
+		event.DiskUsedBytesBefore, event.DiskUsedBytesAfter, event.DiskTotalBytes = int64(usedBefore), int64(usedAfter), int64(total)
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	a.Record(event)
+	return nil
+}
+
+// Record appends the event to the audit log and keeps it for the next digest
+func (a *AuditLog) Record(event AuditEvent) {
+	if a.Path != "" {
+		if err := a.append(event); err != nil {
+			log.Errorf("Error writing the audit log %s: %s", a.Path, err)
+		}
+	}
+	if a.Webhook == nil {
+		return
+	}
+	if len(a.pending) >= maxPendingAuditEvents {
+		a.pending = a.pending[1:]
+		a.dropped++
+	}
+	a.pending = append(a.pending, event)
+}
+
+func (a *AuditLog) append(event AuditEvent) error {
+	content, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(a.Path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(a.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(content, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// SendDigest posts the events since the last digest to the webhook. While the webhook is rate limited or fails, the
+// events are kept for the next digest.
+func (a *AuditLog) SendDigest(now time.Time) {
+	if a.Webhook == nil || len(a.pending) == 0 {
+		return
+	}
+	if !a.Webhook.lastSent.IsZero() && now.Sub(a.Webhook.lastSent) < a.Webhook.MinInterval {
+		log.Infof("Rate limiting the webhook, %d deletions are sent with the next digest", len(a.pending))
+		return
+	}
+	if err := a.Webhook.post(digestText(a.pending, a.dropped)); err != nil {
+		log.Errorf("Error sending the digest to the webhook on %s: %s", a.Webhook.host(), err)
+		return
+	}
+	a.Webhook.lastSent = now
+	a.pending, a.dropped = nil, 0
+}
+
+// digestText summarizes the deletions, prod images are listed first as nobody expects them to disappear
+func digestText(events []AuditEvent, dropped int) string {
+	var freedBytes int64
+	for _, event := range events {
+		freedBytes += event.SizeBytes
+	}
+	text := &strings.Builder{}
+	fmt.Fprintf(text, "%d deletions, %.2f GiB freed", len(events)+dropped, bytesToGiB(float64(freedBytes)))
+	if last := events[len(events)-1]; last.DiskTotalBytes > 0 {
+		fmt.Fprintf(text, ", disk used %.2f%%", float64(last.DiskUsedBytesAfter)/float64(last.DiskTotalBytes)*100)
+	}
+	text.WriteString("\n")
+
+	ordered := make([]AuditEvent, 0, len(events))
+	for _, event := range events {
+		if event.Channel == "prod" {
+			ordered = append(ordered, event)
+		}
+	}
+	for _, event := range events {
+		if event.Channel != "prod" {
+			ordered = append(ordered, event)
+		}
+	}
+	for i, event := range ordered {
+		if i == maxDigestLines {
+			fmt.Fprintf(text, "- and %d more, see the audit log\n", len(ordered)-maxDigestLines+dropped)
+			return text.String()
+		}
+		fmt.Fprintf(text, "- %s %s/%s (%.2f GiB), %s: %s\n", event.Action, event.Channel, event.Image, bytesToGiB(float64(event.SizeBytes)), event.Rule, event.Reason)
+	}
+	if dropped > 0 {
+		fmt.Fprintf(text, "- and %d more, see the audit log\n", dropped)
+	}
+	return text.String()
+}
+
+// post sends the text as Slack payload, which Teams incoming webhooks accept as well, or as Teams message card
+func (w *Webhook) post(text string) error {
+	var payload any = map[string]string{"text": "*" + w.Title + "*\n" + text}
+	if w.Format == webhookFormatTeams {
+		payload = map[string]string{
+			"@type":    "MessageCard",
+			"@context": "https://schema.org/extensions",
+			"summary":  w.Title,
+			"title":    w.Title,
+			// Teams renders markdown, the line breaks need two spaces
+			"text": strings.ReplaceAll(text, "\n", "  \n"),
+		}
+	}
+	content, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	response, err := w.Client.Post(w.URL, "application/json", bytes.NewReader(content))
+	if err != nil {
+		// The URL of the webhook is a secret, only the underlying error is returned
+		var urlError *url.Error
+		if errors.As(err, &urlError) {
+			return urlError.Err
+		}
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("webhook responded with %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// host returns the host of the webhook URL, which can be logged unlike the URL itself
+func (w *Webhook) host() string {
+	webhookURL, err := url.Parse(w.URL)
+	if err != nil {
+		return "an invalid URL"
+	}
+	return webhookURL.Host
+}
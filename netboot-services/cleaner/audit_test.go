@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLogTrack(t *testing.T) {
+	// Arrange
+	tempDir := t.TempDir()
+	createTestImageFolder(t, tempDir, "image1", 1)
+	auditLog := &AuditLog{Path: filepath.Join(tempDir, stateDirectoryName, auditLogFilename)}
+	previousDiskSpaceUsage := diskSpaceUsage
+	t.Cleanup(func() { diskSpaceUsage = previousDiskSpaceUsage })
+	usedSpace := 95.0
+	diskSpaceUsage = func(path string) (float64, float64, float64, error) { return 100 - usedSpace, usedSpace, 100, nil }
+	event := AuditEvent{Action: auditActionDeleted, Channel: "dev", Image: "image1", SizeBytes: 4, Rule: ruleMaxImages, Reason: "more than 1 images"}
+
+	// Act
+	err := auditLog.Track(event, tempDir, func() error {
+		usedSpace = 90
+		return os.RemoveAll(filepath.Join(tempDir, "image1"))
+	})
+	failedErr := auditLog.Track(event, tempDir, func() error { return errors.New("permission denied") })
+
+	// Assert
+	require.NoError(t, err)
+	require.Error(t, failedErr)
+	content, err := os.ReadFile(auditLog.Path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 1)
+	var recorded AuditEvent
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &recorded))
+	assert.Equal(t, "image1", recorded.Image)
+	assert.Equal(t, ruleMaxImages, recorded.Rule)
+	assert.Equal(t, int64(95), recorded.DiskUsedBytesBefore)
+	assert.Equal(t, int64(90), recorded.DiskUsedBytesAfter)
+	assert.Equal(t, int64(100), recorded.DiskTotalBytes)
+	assert.False(t, recorded.Time.IsZero())
+}
+
+func TestAuditLogSendDigest(t *testing.T) {
+	// Arrange
+	var payloads []map[string]string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		payloads = append(payloads, payload)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	auditLog := &AuditLog{Webhook: &Webhook{URL: server.URL, Format: webhookFormatSlack, Title: "Netboot cleaner", MinInterval: time.Hour, Client: server.Client()}}
+	now := time.Now()
+
+	// Act
+	auditLog.Record(AuditEvent{Action: auditActionTrashed, Channel: "dev", Image: "dev-image", SizeBytes: 1 << 30, Rule: ruleMaxImages, Reason: "more than 10 images"})
+	auditLog.Record(AuditEvent{Action: auditActionDeleted, Channel: "prod", Image: "prod-image", SizeBytes: 1 << 30, Rule: ruleDiskWatermark, Reason: "disk usage above 90%"})
+	auditLog.SendDigest(now)
+	auditLog.Record(AuditEvent{Action: auditActionPurged, Channel: "dev", Image: "old-image", Rule: ruleTrashGracePeriod})
+	auditLog.SendDigest(now.Add(10 * time.Minute))
+	payloadsWhileRateLimited := len(payloads)
+	status = http.StatusInternalServerError
+	auditLog.SendDigest(now.Add(2 * time.Hour))
+	pendingAfterError := len(auditLog.pending)
+	status = http.StatusOK
+	auditLog.SendDigest(now.Add(3 * time.Hour))
+
+	// Assert
+	assert.Equal(t, 1, payloadsWhileRateLimited)
+	assert.Equal(t, 1, pendingAfterError)
+	assert.Empty(t, auditLog.pending)
+	require.Len(t, payloads, 3)
+	assert.Contains(t, payloads[0]["text"], "2 deletions, 2.00 GiB freed")
+	// prod is listed first
+	assert.Less(t, strings.Index(payloads[0]["text"], "prod/prod-image"), strings.Index(payloads[0]["text"], "dev/dev-image"))
+	assert.Contains(t, payloads[2]["text"], "purged dev/old-image")
+}
+
+func TestWebhookPostTeams(t *testing.T) {
+	// Arrange
+	var payload map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+	}))
+	t.Cleanup(server.Close)
+	webhook := &Webhook{URL: server.URL, Format: webhookFormatTeams, Title: "Netboot cleaner", Client: server.Client()}
+
+	// Act
+	err := webhook.post("1 deletions\n- deleted dev/image1\n")
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, "MessageCard", payload["@type"])
+	assert.Equal(t, "Netboot cleaner", payload["title"])
+	assert.Equal(t, "1 deletions  \n- deleted dev/image1  \n", payload["text"])
+}
+
+func TestAuditLogSendDigestLogsNoWebhookURL(t *testing.T) {
+	// Arrange
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	webhookURL := server.URL + "/services/T000/B000/secret-token"
+	auditLog := &AuditLog{Webhook: &Webhook{URL: webhookURL, Format: webhookFormatSlack, Title: "Netboot cleaner", Client: &http.Client{}}}
+	auditLog.Record(AuditEvent{Action: auditActionDeleted, Channel: "dev", Image: "image1", Rule: ruleMaxImages})
+	output := &bytes.Buffer{}
+	log.SetOutput(output)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	// Act
+	auditLog.SendDigest(time.Now())
+
+	// Assert
+	assert.Len(t, auditLog.pending, 1)
+	assert.Contains(t, output.String(), "Error sending the digest to the webhook on "+strings.TrimPrefix(server.URL, "http://"))
+	assert.NotContains(t, output.String(), "secret-token")
+}
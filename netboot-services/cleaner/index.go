@@ -0,0 +1,220 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FolderIndex holds the images and other folders of a channel folder with their sizes and times. It is built with a
+// single scan per cleanup run and updated as folders are removed, so no decision needs another walk of the folder.
+type FolderIndex struct {
+	FolderPath string
+	// Images are the complete image folders, newest first
+	Images []Image
+	// Folders holds every folder of the channel folder including the partial downloads and the folders in the staging
+	// folder, sorted by path
+	Folders []IndexedFolder
+	// SizeBytes is the size of all files of the channel folder, without the trash
+	SizeBytes int64
+	// KernelSidecars are the paths of the *kernel.json files relative to the channel folder, including the staging
+	// folder. They are not updated as folders are removed.
+	KernelSidecars []string
+}
+
+// IndexedFolder is a folder of a channel folder, Path is relative to the channel folder
+type IndexedFolder struct {
+	Path      string
+	ModTime   time.Time
+	SizeBytes int64
+	// LastChange is the newest modification time of the folder and everything in it
+	LastChange time.Time
+	// Partial is set for folders with downloads in progress, i.e. .azDownload or .partial files
+	Partial bool
+	Tag     string
+	Tagged  bool
+	// PullThrough is set for folders filled by the pull-through cache of the asset server
+	PullThrough bool
+	// MissingBootFiles lists the files which are missing to boot the folder, it is empty for bootable images
+	MissingBootFiles string
+}
+
+// indexFolder scans the channel folder. Hidden folders except the staging folder of the syncer are only counted
+// towards the size, the trash is left out.
+func indexFolder(folderName string) *FolderIndex {
+	index := &FolderIndex{FolderPath: folderName}
+	for _, entry := range readFilesFromFolder(folderName) {
+		path := filepath.Join(folderName, entry.Name())
+		switch {
+		case entry.Name() == trashDirectoryName:
+		case !entry.IsDir():
+			if info, err := entry.Info(); err == nil {
+				index.SizeBytes += info.Size()
+			}
+		case entry.Name() == stagingDirectoryName:
+			for _, stagingEntry := range readFilesFromFolder(path) {
+				if stagingEntry.IsDir() {
+					index.addFolder(filepath.Join(stagingDirectoryName, stagingEntry.Name()))
+				} else if info, err := stagingEntry.Info(); err == nil {
+					index.SizeBytes += info.Size()
+				}
+			}
+		case strings.HasPrefix(entry.Name(), "."):
+			index.SizeBytes += getFolderSizeInBytes(path)
+		default:
+			if folder := index.addFolder(entry.Name()); folder != nil && !folder.Partial {
+				index.Images = append(index.Images, Image{Name: folder.Path, ModTime: folder.ModTime, SizeBytes: folder.SizeBytes, Tag: folder.Tag, Tagged: folder.Tagged})
+			}
+		}
+	}
+	sort.Slice(index.Folders, func(i, j int) bool { return index.Folders[i].Path < index.Folders[j].Path })
+	sort.SliceStable(index.Images, func(i, j int) bool { return index.Images[i].ModTime.After(index.Images[j].ModTime) })
+	return index
+}
+
+// addFolder walks the folder once and adds it to the index, it returns nil if the folder could not be read
+func (index *FolderIndex) addFolder(relativePath string) *IndexedFolder {
+	folderPath := filepath.Join(index.FolderPath, relativePath)
+	folder := IndexedFolder{Path: relativePath}
+	// The boot files are looked for in the folder itself and in its architecture subfolders
+	bootFiles := map[string]map[string]bool{}
+	err := filepath.WalkDir(folderPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if path == folderPath {
+			folder.ModTime = info.ModTime()
+		}
+		if info.ModTime().After(folder.LastChange) {
+			folder.LastChange = info.ModTime()
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		folder.SizeBytes += info.Size()
+		if strings.HasSuffix(entry.Name(), "kernel.json") {
+			index.addKernelSidecar(path)
+		}
+		// azcopy downloads to .azDownload-* files, the syncer and the asset server to *.partial files
+		if strings.HasPrefix(entry.Name(), ".azDownload") || strings.HasSuffix(entry.Name(), ".partial") {
+			folder.Partial = true
+		}
+		directory, _ := filepath.Rel(folderPath, filepath.Dir(path))
+		if directory == "." && entry.Name() == keepFilename {
+			tag, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			folder.Tagged, folder.Tag = true, strings.TrimSpace(string(tag))
+		}
+		if directory == "." && entry.Name() == pullThroughMarkerFilename {
+			folder.PullThrough = true
+		}
+		if directory == "." || (!strings.ContainsRune(directory, filepath.Separator) && !strings.HasPrefix(directory, ".")) {
+			switch {
+			case strings.HasSuffix(entry.Name(), ".squashfs"):
+				addBootFile(bootFiles, directory, "squashfs")
+			case entry.Name() == "vmlinuz" || entry.Name() == "initrd":
+				addBootFile(bootFiles, directory, entry.Name())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Error scanning folder %s: %s", folderPath, err)
+		return nil
+	}
+	folder.MissingBootFiles = missingBootFiles(bootFiles)
+	index.SizeBytes += folder.SizeBytes
+	index.Folders = append(index.Folders, folder)
+	return &index.Folders[len(index.Folders)-1]
+}
+
+func (index *FolderIndex) addKernelSidecar(path string) {
+	if relativePath, err := filepath.Rel(index.FolderPath, path); err == nil {
+		index.KernelSidecars = append(index.KernelSidecars, relativePath)
+	}
+}
+
+func addBootFile(bootFiles map[string]map[string]bool, directory string, file string) {
+	if bootFiles[directory] == nil {
+		bootFiles[directory] = map[string]bool{}
+	}
+	bootFiles[directory][file] = true
+}
+
+// missingBootFiles returns which files are missing to boot the image, or an empty string if the image folder or one of
+// its architecture subfolders has a squashfs, vmlinuz and initrd
+func missingBootFiles(bootFiles map[string]map[string]bool) string {
+	directories := []string{"."}
+	for directory := range bootFiles {
+		if directory != "." {
+			directories = append(directories, directory)
+		}
+	}
+	sort.Strings(directories[1:])
+
+	firstMissing := ""
+	for _, directory := range directories {
+		var missing []string
+		for _, file := range []string{"initrd", "squashfs", "vmlinuz"} {
+			if !bootFiles[directory][file] {
+				missing = append(missing, file)
+			}
+		}
+		if len(missing) == 0 {
+			return ""
+		}
+		// The folder with a squashfs tells best what is missing
+		if firstMissing == "" || bootFiles[directory]["squashfs"] {
+			firstMissing = "missing " + strings.Join(missing, ", ")
+		}
+	}
+	return firstMissing
+}
+
+// folder returns the indexed folder with the path relative to the channel folder
+func (index *FolderIndex) folder(relativePath string) *IndexedFolder {
+	for i := range index.Folders {
+		if index.Folders[i].Path == relativePath {
+			return &index.Folders[i]
+		}
+	}
+	return nil
+}
+
+// remove drops a folder which was deleted or moved to the trash from the index
+func (index *FolderIndex) remove(relativePath string) {
+	for i, folder := range index.Folders {
+		if folder.Path == relativePath {
+			index.SizeBytes -= folder.SizeBytes
+			index.Folders = append(index.Folders[:i], index.Folders[i+1:]...)
+			break
+		}
+	}
+	for i, image := range index.Images {
+		if image.Name == relativePath {
+			index.Images = append(index.Images[:i], index.Images[i+1:]...)
+			break
+		}
+	}
+}
+
+// indexFolders indexes all channel folders
+func indexFolders(folders []folderProperties) []*FolderIndex {
+	indexes := make([]*FolderIndex, len(folders))
+	for i, folder := range folders {
+		indexes[i] = indexFolder(folder.FolderPath)
+	}
+	return indexes
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexFolder(t *testing.T) {
+	// Arrange
+	tempDir := t.TempDir()
+	createTestImageFolder(t, tempDir, "image1", 1)
+	createTestImageFolder(t, tempDir, "image2", 3)
+	createTestImageFolder(t, tempDir, "image3", 2)
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "image1", keepFilename), []byte("release 24.3\n"), 0644))
+	require.NoError(t, os.Chtimes(filepath.Join(tempDir, "image1"), time.Now().Add(time.Hour), time.Now().Add(time.Hour)))
+	// Partial downloads, the staging folder of the syncer and the trash are no images
+	createFiles(t, tempDir, time.Now(), "partial/.azDownload-1234", ".staging/image4/image.squashfs.partial", ".trash/image0/image.squashfs")
+	createFiles(t, tempDir, time.Now(), "arm/arm64/image.squashfs", "arm/arm64/vmlinuz", "arm/arm64/initrd")
+
+	// Act
+	index := indexFolder(tempDir)
+
+	// Assert
+	require.Len(t, index.Images, 4)
+	assert.Equal(t, "image2", index.Images[0].Name)
+	assert.Equal(t, "image3", index.Images[1].Name)
+	assert.Equal(t, "image1", index.Images[2].Name)
+	assert.Equal(t, "arm", index.Images[3].Name)
+	assert.Equal(t, "release 24.3", index.Images[2].Tag)
+	assert.Equal(t, int64(4+len("release 24.3\n")), index.Images[2].SizeBytes)
+	assert.Equal(t, int64(3*4+len("release 24.3\n")+3*4+4+4), index.SizeBytes)
+
+	require.Len(t, index.Folders, 6)
+	assert.Equal(t, filepath.Join(stagingDirectoryName, "image4"), index.Folders[0].Path)
+	assert.Equal(t, "arm", index.Folders[1].Path)
+	assert.Empty(t, index.Folders[1].MissingBootFiles)
+	assert.Equal(t, "missing initrd, vmlinuz", index.folder("image1").MissingBootFiles)
+	assert.True(t, index.folder("partial").Partial)
+}
+
+func TestFolderIndexRemove(t *testing.T) {
+	// Arrange
+	tempDir := t.TempDir()
+	createTestImageFolder(t, tempDir, "image1", 1)
+	createTestImageFolder(t, tempDir, "image2", 2)
+	index := indexFolder(tempDir)
+
+	// Act
+	index.remove("image1")
+
+	// Assert
+	require.Len(t, index.Images, 1)
+	assert.Equal(t, "image2", index.Images[0].Name)
+	assert.Len(t, index.Folders, 1)
+	assert.Equal(t, int64(4), index.SizeBytes)
+	assert.Nil(t, index.folder("image1"))
+}
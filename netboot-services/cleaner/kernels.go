@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	kernelsChannel = "kernels"
+	// stateDirectoryName is the hidden folder in the assets directory the cleaner keeps its state in
+	stateDirectoryName = ".cleaner"
+	// kernelStateFilename remembers since when the kernel versions are unreferenced
+	kernelStateFilename = "kernels.json"
+)
+
+var (
+	// AssetsDirectory holds the channel folders and the kernels folder
+	AssetsDirectory = "/cleaning"
+	// KernelGracePeriod is how long a kernel version has to be unreferenced before it is deleted
+	KernelGracePeriod = 7 * 24 * time.Hour
+	// latestKernelVersionFilenames name the kernel version which is always kept, the sync documentation calls the file
+	// newest-kernel-version.json
+	latestKernelVersionFilenames = []string{"latest-kernel-version.json", "newest-kernel-version.json"}
+)
+
+// kernelState is persisted between the runs, so the grace period survives restarts
+type kernelState struct {
+	UnreferencedSince map[string]time.Time `json:"unreferencedSince"`
+}
+
+// kernelSidecar is the part of the [image]-kernel.json file next to each squashfs the cleaner needs
+type kernelSidecar struct {
+	KernelVersion string `json:"kernelVersion"`
+}
+
+// referencedKernelVersions returns the kernel versions of the sidecars of all images in all channels, mapped to the
+// first sidecar referencing them. Trashed and staged images are included, as they can become images again. The
+// sidecars of the indexed channel folders are taken from their index, only their trash is walked, as images are moved
+// there during the run. Other channel folders are walked completely.
+func referencedKernelVersions(assetsDirectory string, indexes []*FolderIndex) (map[string]string, error) {
+	indexed := map[string]*FolderIndex{}
+	for _, index := range indexes {
+		indexed[filepath.Clean(index.FolderPath)] = index
+	}
+
+	var sidecarPaths []string
+	for _, entry := range readFilesFromFolder(assetsDirectory) {
+		if !entry.IsDir() || entry.Name() == kernelsChannel || entry.Name() == stateDirectoryName {
+			continue
+		}
+		channelPath := filepath.Join(assetsDirectory, entry.Name())
+		walkPath := channelPath
+		if index, ok := indexed[channelPath]; ok {
+			for _, sidecarPath := range index.KernelSidecars {
+				sidecarPaths = append(sidecarPaths, filepath.Join(channelPath, sidecarPath))
+			}
+			walkPath = filepath.Join(channelPath, trashDirectoryName)
+		}
+		err := filepath.WalkDir(walkPath, func(path string, file fs.DirEntry, err error) error {
+			if path == walkPath && errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if !file.IsDir() && strings.HasSuffix(file.Name(), "kernel.json") {
+				sidecarPaths = append(sidecarPaths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	versions := map[string]string{}
+	for _, path := range sidecarPaths {
+		content, err := os.ReadFile(path)
+		// The image was deleted during this run
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var sidecar kernelSidecar
+		if err := json.Unmarshal(content, &sidecar); err != nil {
+			return nil, fmt.Errorf("could not parse kernel sidecar %s: %w", path, err)
+		}
+		if _, ok := versions[sidecar.KernelVersion]; sidecar.KernelVersion != "" && !ok {
+			relativePath, _ := filepath.Rel(assetsDirectory, path)
+			versions[sidecar.KernelVersion] = relativePath
+		}
+	}
+	return versions, nil
+}
+
+// latestKernelVersion reads the kernel version of latest-kernel-version.json. The file holds either a JSON object
+// with a kernelVersion or version field, a JSON string or the plain version. It returns an empty string if there is no
+// such file.
+func latestKernelVersion(kernelsDirectory string) (string, error) {
+	for _, filename := range latestKernelVersionFilenames {
+		content, err := os.ReadFile(filepath.Join(kernelsDirectory, filename))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		var object struct {
+			KernelVersion string `json:"kernelVersion"`
+			Version       string `json:"version"`
+		}
+		if json.Unmarshal(content, &object) == nil {
+			if object.KernelVersion != "" {
+				return object.KernelVersion, nil
+			}
+			if object.Version != "" {
+				return object.Version, nil
+			}
+		}
+		var text string
+		if json.Unmarshal(content, &text) == nil && text != "" {
+			return strings.TrimSpace(text), nil
+		}
+		if fields := strings.Fields(string(content)); len(fields) == 1 && !strings.ContainsAny(fields[0], "{}[]\"") {
+			return fields[0], nil
+		}
+		return "", fmt.Errorf("could not read the kernel version of %s", filename)
+	}
+	return "", nil
+}
+
+// collectKernels deletes the kernel versions which no sidecar referenced for the grace period. The latest kernel
+// version is always kept. If a sidecar or the latest kernel version cannot be read, nothing is deleted.
+func collectKernels(assetsDirectory string, indexes []*FolderIndex, now time.Time, dryRun bool) {
+	kernelsDirectory := filepath.Join(assetsDirectory, kernelsChannel)
+	entries, err := os.ReadDir(kernelsDirectory)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Errorf("Error reading folder %s: %s", kernelsDirectory, err)
+		}
+		return
+	}
+	referenced, err := referencedKernelVersions(assetsDirectory, indexes)
+	if err != nil {
+		log.Errorf("Not collecting any kernels, the kernel sidecars could not be read: %s", err)
+		return
+	}
+	latest, err := latestKernelVersion(kernelsDirectory)
+	if err != nil {
+		log.Errorf("Not collecting any kernels, the latest kernel version could not be read: %s", err)
+		return
+	}
+
+	statePath := filepath.Join(assetsDirectory, stateDirectoryName, kernelStateFilename)
+	state, err := readKernelState(statePath)
+	if err != nil {
+		log.Errorf("Not collecting any kernels, the state could not be read: %s", err)
+		return
+	}
+	unreferencedSince := map[string]time.Time{}
+	var versions []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			versions = append(versions, entry.Name())
+		}
+	}
+	sort.Strings(versions)
+
+	for _, version := range versions {
+		if _, ok := referenced[version]; ok || version == latest {
+			continue
+		}
+		since, ok := state.UnreferencedSince[version]
+		if !ok {
+			since = now
+		}
+		fields := log.Fields{"kernelVersion": version, "unreferencedSince": since.Format(time.RFC3339)}
+		switch {
+		case now.Sub(since) < KernelGracePeriod:
+			log.WithFields(fields).Info("Keeping unreferenced kernel until its grace period is over")
+			unreferencedSince[version] = since
+		case dryRun:
+			log.WithFields(fields).Info("Would delete unreferenced kernel")
+			unreferencedSince[version] = since
+		default:
+			log.WithFields(fields).Info("Deleting unreferenced kernel")
+			kernelPath := filepath.Join(kernelsDirectory, version)
+			event := AuditEvent{Action: auditActionDeleted, Channel: kernelsChannel, Image: version, SizeBytes: getFolderSizeInBytes(kernelPath), Rule: ruleUnreferencedKernel,
+				Reason: fmt.Sprintf("not referenced by any image since %s", since.Format(time.RFC3339))}
+			if err := audit.Track(event, kernelsDirectory, func() error { return os.RemoveAll(kernelPath) }); err != nil {
+				log.Errorf("Error deleting kernel %s: %s", version, err)
+				unreferencedSince[version] = since
+			}
+		}
+	}
+
+	if err := writeState(statePath, kernelState{UnreferencedSince: unreferencedSince}); err != nil {
+		log.Errorf("Error writing the kernel state: %s", err)
+	}
+}
+
+func readKernelState(statePath string) (kernelState, error) {
+	state := kernelState{UnreferencedSince: map[string]time.Time{}}
+	content, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(content, &state); err != nil {
+		return state, err
+	}
+	if state.UnreferencedSince == nil {
+		state.UnreferencedSince = map[string]time.Time{}
+	}
+	return state, nil
+}
+
+// writeState replaces a state file of the cleaner atomically, so a crash never leaves a truncated state behind
+func writeState(statePath string, state any) error {
+	if err := os.MkdirAll(filepath.Dir(statePath), 0755); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporaryPath := statePath + ".tmp"
+	if err := os.WriteFile(temporaryPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporaryPath, statePath)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatestKernelVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+		hasError bool
+	}{
+		{name: "Object with kernelVersion", content: `{"kernelVersion": "6.8.0-40-generic"}`, expected: "6.8.0-40-generic"},
+		{name: "Object with version", content: `{"version": "6.8.0-40-generic"}`, expected: "6.8.0-40-generic"},
+		{name: "JSON string", content: `"6.8.0-40-generic"`, expected: "6.8.0-40-generic"},
+		{name: "Plain version", content: "6.8.0-40-generic\n", expected: "6.8.0-40-generic"},
+		{name: "Unknown object", content: `{"kernel": "6.8.0-40-generic"}`, hasError: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			tempDir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(tempDir, "latest-kernel-version.json"), []byte(test.content), 0644))
+
+			// Act
+			version, err := latestKernelVersion(tempDir)
+
+			// Assert
+			if test.hasError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, version)
+		})
+	}
+}
+
+func TestCollectKernels(t *testing.T) {
+	// Arrange
+	assetsDir := t.TempDir()
+	kernelsDir := filepath.Join(assetsDir, kernelsChannel)
+	for _, version := range []string{"6.8.0-37-generic", "6.8.0-38-generic", "6.8.0-39-generic", "6.8.0-40-generic", "6.8.0-41-generic", "6.8.0-42-generic"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(kernelsDir, version), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(kernelsDir, version, "vmlinuz"), []byte("blub"), 0644))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(kernelsDir, "latest-kernel-version.json"), []byte(`{"kernelVersion": "6.8.0-42-generic"}`), 0644))
+	writeSidecar := func(relativePath string, version string) {
+		path := filepath.Join(assetsDir, filepath.FromSlash(relativePath))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(`{"kernelVersion": "`+version+`"}`), 0644))
+	}
+	writeSidecar("prod/24-08-29-master-a46edbc/24-08-29-master-a46edbc-kernel.json", "6.8.0-40-generic")
+	writeSidecar("dev/24-08-30-master-b57fecd/arm64/24-08-30-master-b57fecd-kernel.json", "6.8.0-41-generic")
+	writeSidecar("dev/.trash/24-08-01-master-c68fedc/24-08-01-master-c68fedc-kernel.json", "6.8.0-39-generic")
+	writeSidecar("test/24-08-28-master-d00d000/24-08-28-master-d00d000-kernel.json", "6.8.0-38-generic")
+	previousGracePeriod := KernelGracePeriod
+	t.Cleanup(func() { KernelGracePeriod = previousGracePeriod })
+	KernelGracePeriod = 24 * time.Hour
+	now := time.Now()
+	// The test channel is not indexed, it is walked
+	folders := []folderProperties{{FolderPath: filepath.Join(assetsDir, "dev")}, {FolderPath: filepath.Join(assetsDir, "prod")}}
+
+	// Act
+	collectKernels(assetsDir, indexFolders(folders), now, false)
+	afterFirstRun := readKernelVersions(t, kernelsDir)
+	collectKernels(assetsDir, indexFolders(folders), now.Add(2*time.Hour), true)
+	afterDryRun := readKernelVersions(t, kernelsDir)
+	collectKernels(assetsDir, indexFolders(folders), now.Add(25*time.Hour), false)
+	afterGracePeriod := readKernelVersions(t, kernelsDir)
+
+	// Assert
+	assert.Len(t, afterFirstRun, 6)
+	assert.Len(t, afterDryRun, 6)
+	assert.Equal(t, []string{"6.8.0-38-generic", "6.8.0-39-generic", "6.8.0-40-generic", "6.8.0-41-generic", "6.8.0-42-generic"}, afterGracePeriod)
+	state, err := readKernelState(filepath.Join(assetsDir, stateDirectoryName, kernelStateFilename))
+	require.NoError(t, err)
+	assert.Empty(t, state.UnreferencedSince)
+}
+
+func TestCollectKernelsInvalidSidecar(t *testing.T) {
+	// Arrange
+	assetsDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(assetsDir, kernelsChannel, "6.8.0-40-generic"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(assetsDir, "prod", "image1"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(assetsDir, "prod", "image1", "image1-kernel.json"), []byte("{"), 0644))
+	previousGracePeriod := KernelGracePeriod
+	t.Cleanup(func() { KernelGracePeriod = previousGracePeriod })
+	KernelGracePeriod = 0
+
+	// Act
+	collectKernels(assetsDir, indexFolders([]folderProperties{{FolderPath: filepath.Join(assetsDir, "prod")}}), time.Now(), false)
+
+	// Assert
+	assert.DirExists(t, filepath.Join(assetsDir, kernelsChannel, "6.8.0-40-generic"))
+}
+
+func TestReferencedKernelVersionsReusesTheIndex(t *testing.T) {
+	// Arrange
+	assetsDir := t.TempDir()
+	prodDir := filepath.Join(assetsDir, "prod")
+	writeSidecar := func(relativePath string, version string) {
+		path := filepath.Join(prodDir, filepath.FromSlash(relativePath))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(`{"kernelVersion": "`+version+`"}`), 0644))
+	}
+	writeSidecar("image1/image1-kernel.json", "6.8.0-40-generic")
+	writeSidecar("image2/arm64/image2-kernel.json", "6.8.0-41-generic")
+	index := indexFolder(prodDir)
+	// Only the trash is walked again, images are moved there during the run
+	writeSidecar("image3/image3-kernel.json", "6.8.0-42-generic")
+	writeSidecar(".trash/image0/image0-kernel.json", "6.8.0-39-generic")
+
+	// Act
+	versions, err := referencedKernelVersions(assetsDir, []*FolderIndex{index})
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join("image1", "image1-kernel.json"), filepath.Join("image2", "arm64", "image2-kernel.json")}, index.KernelSidecars)
+	assert.Equal(t, map[string]string{
+		"6.8.0-40-generic": filepath.Join("prod", "image1", "image1-kernel.json"),
+		"6.8.0-41-generic": filepath.Join("prod", "image2", "arm64", "image2-kernel.json"),
+		"6.8.0-39-generic": filepath.Join("prod", trashDirectoryName, "image0", "image0-kernel.json"),
+	}, versions)
+}
+
+func readKernelVersions(t *testing.T, kernelsDir string) []string {
+	entries, err := os.ReadDir(kernelsDir)
+	require.NoError(t, err)
+	var versions []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			versions = append(versions, entry.Name())
+		}
+	}
+	return versions
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io/fs"
 	"math"
 	"os"
 	"path/filepath"
-	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -19,139 +19,299 @@ type folderProperties struct {
 	FolderPath              string
 	ThresholdMaxImagesCount int     // max number of images to keep in the folder.
 	MaxFolderSizeInGiB      float64 // max folder size in GiB
+	MinImagesCount          int     // images are never evicted below this count
+	KeepNewestPerBranch     int     // number of the newest images of every branch which are always kept
+	KeepWeeklyImagesWeeks   int     // one image per week is kept for this number of weeks
+	MaxImageAgeInDays       float64 // images older than this are evicted
 }
 
+// keepFilename marks a tagged image which is never evicted, the content of the file is the tag, e.g. "release 24.3"
+const keepFilename = ".keep"
+
+// pullThroughMarkerFilename marks an image folder filled by the pull-through cache of the asset server, it only holds
+// the files booted so far
+const pullThroughMarkerFilename = ".pull-through-cache"
+
 var (
 	propertiesDev = folderProperties{
 		FolderPath:              "/cleaning/dev",
 		ThresholdMaxImagesCount: 10, // default value that will be overwritten by environment variables, if set
 		MaxFolderSizeInGiB:      15, // default value that will be overwritten by environment variables, if set
-
+		MinImagesCount:          1,
 	}
 	propertiesProd = folderProperties{
 		FolderPath:              "/cleaning/prod",
 		ThresholdMaxImagesCount: 5,  // default value that will be overwritten by environment variables, if set
 		MaxFolderSizeInGiB:      10, // default value that will be overwritten by environment variables, if set
+		MinImagesCount:          1,
 	}
+	// watermarks evict images across the folders when the disk runs full
+	watermarks = Watermarks{Priority: []string{"dev", "prod"}}
+	// pinnedImages are the names of the image folders in PINNED_IMAGES, which are never evicted
+	pinnedImages = map[string]bool{}
+	// The images referenced by the menus matching protectedMenus are never evicted. The advanced menu lists every image,
+	// so folders over their limits are reported as such instead of evicting images a client can still boot.
+	MenusDirectory = "/menus"
+	protectedMenus = []string{"menu.ipxe", "advancedmenu.ipxe", "MAC-*.ipxe"}
 )
 
-type ByModTime []fs.DirEntry
-
-func (b ByModTime) Len() int      { return len(b) }
-func (b ByModTime) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
-func (b ByModTime) Less(i, j int) bool {
-	infoI, err := b[i].Info()
-	if err != nil {
-		log.Errorf("Error getting file info for %s: %s", b[i].Name(), err)
-	}
-	infoJ, err := b[j].Info()
-	if err != nil {
-		log.Errorf("Error getting file info for %s: %s", b[j].Name(), err)
-	}
-	return infoI.ModTime().After(infoJ.ModTime())
-}
-
 func main() {
 	log.SetLevel(log.InfoLevel)
 	log.SetFormatter(&log.JSONFormatter{})
 
-	var err error
-	ThresholdMaxImagesCountDevEnv := os.Getenv("THRESHOLD_MAX_IMAGES_COUNT_DEV")
-	if ThresholdMaxImagesCountDevEnv != "" {
-		propertiesDev.ThresholdMaxImagesCount, err = strconv.Atoi(ThresholdMaxImagesCountDevEnv)
-		if err != nil {
+	if len(os.Args) > 1 && os.Args[1] == "plan" {
+		if err := loadConfiguration(); err != nil {
 			log.Fatal(err)
 		}
-	}
-
-	thresholdMaxImagesCountProdEnv := os.Getenv("THRESHOLD_MAX_IMAGES_COUNT_PROD")
-	if thresholdMaxImagesCountProdEnv != "" {
-		propertiesProd.ThresholdMaxImagesCount, err = strconv.Atoi(thresholdMaxImagesCountProdEnv)
-		if err != nil {
+		if err := runPlanCommand(os.Args[2:], os.Stdout); err != nil {
 			log.Fatal(err)
 		}
+		return
 	}
-
-	maxFolderSizeInGiBdevEnv := os.Getenv("MAX_FOLDER_SIZE_IN_GIB_DEV")
-	if maxFolderSizeInGiBdevEnv != "" {
-		propertiesDev.MaxFolderSizeInGiB, err = strconv.ParseFloat(maxFolderSizeInGiBdevEnv, 64)
-
-		if err != nil {
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		if err := loadConfiguration(); err != nil {
 			log.Fatal(err)
 		}
-	}
-
-	maxFolderSizeInGiBProdEnv := os.Getenv("MAX_FOLDER_SIZE_IN_GIB_PROD")
-	if maxFolderSizeInGiBProdEnv != "" {
-		propertiesProd.MaxFolderSizeInGiB, err = strconv.ParseFloat(maxFolderSizeInGiBProdEnv, 64)
-		if err != nil {
+		if err := runRestoreCommand(os.Args[2:], os.Stdout); err != nil {
 			log.Fatal(err)
 		}
+		return
+	}
+
+	flags := flag.NewFlagSet("netboot-cleaner", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", os.Getenv("DRY_RUN") == "true", "Log the images which would be evicted without deleting them")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadConfiguration(); err != nil {
+		log.Fatal(err)
+	}
+	if *dryRun {
+		log.Warn("Dry run, no images are deleted")
 	}
 
 	// display the current configuration
-	log.Infof("Dev folder: %s, ThresholdMaxImagesCount: %d, MaxFolderSizeInGiB: %.2f", propertiesDev.FolderPath, propertiesDev.ThresholdMaxImagesCount, propertiesDev.MaxFolderSizeInGiB)
-	log.Infof("Prod folder: %s, ThresholdMaxImagesCount: %d, MaxFolderSizeInGiB: %.2f", propertiesProd.FolderPath, propertiesProd.ThresholdMaxImagesCount, propertiesProd.MaxFolderSizeInGiB)
+	log.Infof("Eviction order: %s", EvictionOrder)
+	log.Infof("Audit log: %s, webhook: %t", audit.Path, audit.Webhook != nil)
+	log.Infof("Trash grace period: %s", TrashGracePeriod)
+	log.Infof("Kernel grace period: %s", KernelGracePeriod)
+	log.Infof("Stale folder max age: %s, action: %s", StaleFolderMaxAge, StaleFolderAction)
+	log.Infof("Disk usage high watermark: %.2f%%, low watermark: %.2f%%, eviction priority: %s", watermarks.HighPercent, watermarks.LowPercent, strings.Join(watermarks.Priority, ","))
+	for _, properties := range []folderProperties{propertiesDev, propertiesProd} {
+		log.Infof("Folder: %s, ThresholdMaxImagesCount: %d, MaxFolderSizeInGiB: %.2f, MinImagesCount: %d, KeepNewestPerBranch: %d, KeepWeeklyImagesWeeks: %d, MaxImageAgeInDays: %.1f",
+			properties.FolderPath, properties.ThresholdMaxImagesCount, properties.MaxFolderSizeInGiB, properties.MinImagesCount, properties.KeepNewestPerBranch, properties.KeepWeeklyImagesWeeks, properties.MaxImageAgeInDays)
+	}
 
 	var folderProperties = []folderProperties{
 		propertiesDev,
 		propertiesProd,
 	}
 
+	staleTracker := NewStaleTracker()
 	for {
-		// Get disk usage for the root directory
-		freeSpace, usedSpace, totalSpace, err := calculateDiskSpaceUsage()
-		if err != nil {
-			log.Errorf("Error calculating disk space usage: %s", err)
-		} else {
-			log.Infof("Disk free: %.2f%% (%.2f GiB), Disk used: %.2f%% (%.2f GiB), Disk Space total: %.2f GiB", (freeSpace/totalSpace)*100, bytesToGiB(freeSpace), (usedSpace/totalSpace)*100, bytesToGiB(usedSpace), bytesToGiB(totalSpace))
+		logDiskSpaceUsage(diskUsagePath(folderProperties))
+
+		// The folders are scanned once per run, the indexes are updated as folders are removed
+		indexes := indexFolders(folderProperties)
+		log.Infof("Image count before deletion: images dev (%d) , images prod (%d)", len(indexes[0].Images), len(indexes[1].Images))
+
+		// Aborted downloads and folders without bootable content are never counted as images, so they are cleaned up apart
+		cleanupStaleFolders(indexes, staleTracker, time.Now(), *dryRun)
+
+		// The trash is purged first, under disk pressure it frees space before any image is evicted
+		purgeTrash(folderProperties, watermarks, time.Now(), *dryRun)
+
+		applyImageUsage(indexes, true)
+
+		// Evict the images the retention policies and the disk watermarks select
+		for _, plan := range planCleanup(folderProperties, indexes, watermarks, time.Now()) {
+			applyPlan(plan, *dryRun)
 		}
 
-		log.Infof("Image count before deletion: images dev (%d) , images prod (%d)", len(getImagesSortedByModifiedDate(propertiesDev.FolderPath)), len(getImagesSortedByModifiedDate(propertiesProd.FolderPath)))
+		// The kernels are collected after the evictions, the kernels of the purged images are unreferenced from now on
+		collectKernels(AssetsDirectory, indexes, time.Now(), *dryRun)
 
-		// Delete oldest images until the folder size is below the threshold
-		for _, folderProperty := range folderProperties {
-			images := getImagesSortedByModifiedDate(folderProperty.FolderPath)
+		// One message per run summarizes the deletions, unless the webhook was notified within its minimum interval
+		audit.SendDigest(time.Now())
 
-			folderSizeInGiB := getCurrentFolderSizeInGiB(folderProperty.FolderPath)
+		log.Infof("Image count after deletion: images dev (%d) , images prod (%d)", len(indexes[0].Images), len(indexes[1].Images))
 
-			for i := len(images) - 1; folderNeedsCleanup(folderProperty, folderSizeInGiB, images); i-- {
-				err := deleteImage(folderProperty.FolderPath, images[i])
-				if err != nil {
-					log.Errorf("Error deleting image %s: %s", images[i], err)
-				}
-				images = getImagesSortedByModifiedDate(folderProperty.FolderPath)
-				folderSizeInGiB = getCurrentFolderSizeInGiB(folderProperty.FolderPath)
-			}
+		logDiskSpaceUsage(diskUsagePath(folderProperties))
+
+		time.Sleep(5 * time.Minute)
+	}
+}
+
+// loadConfiguration reads the folder properties and the protected images from the environment variables
+func loadConfiguration() error {
+	if err := loadFolderProperties(&propertiesDev, "DEV"); err != nil {
+		return err
+	}
+	if err := loadFolderProperties(&propertiesProd, "PROD"); err != nil {
+		return err
+	}
+	if os.Getenv("MENUS_DIRECTORY") != "" {
+		MenusDirectory = os.Getenv("MENUS_DIRECTORY")
+	}
+	// A missing menus directory is a misconfiguration, not a transient error which keeps every image until it is fixed
+	if info, err := os.Stat(MenusDirectory); err != nil || !info.IsDir() {
+		return fmt.Errorf("MENUS_DIRECTORY %s must be the directory of the published menus", MenusDirectory)
+	}
+	if os.Getenv("PROTECTED_MENUS") != "" {
+		protectedMenus = strings.Split(os.Getenv("PROTECTED_MENUS"), ",")
+	}
+	for _, imageName := range strings.Split(os.Getenv("PINNED_IMAGES"), ",") {
+		if imageName = strings.TrimSpace(imageName); imageName != "" {
+			pinnedImages[imageName] = true
+		}
+	}
+	if value := os.Getenv("TRASH_GRACE_PERIOD_IN_DAYS"); value != "" {
+		days, err := strconv.ParseFloat(value, 64)
+		if err != nil || days < 0 {
+			return fmt.Errorf("invalid TRASH_GRACE_PERIOD_IN_DAYS %s", value)
+		}
+		TrashGracePeriod = time.Duration(days * float64(24*time.Hour))
+	}
+	if os.Getenv("ASSETS_DIRECTORY") != "" {
+		AssetsDirectory = os.Getenv("ASSETS_DIRECTORY")
+	}
+	if value := os.Getenv("EVICTION_ORDER"); value != "" {
+		if value != evictionOrderOldest && value != evictionOrderLeastRecentlyUsed {
+			return fmt.Errorf("invalid EVICTION_ORDER %s, expected oldest or least-recently-used", value)
 		}
+		EvictionOrder = value
+	}
+	UsageFilePath = filepath.Join(AssetsDirectory, ".netboot-usage.json")
+	if value, ok := os.LookupEnv("USAGE_FILE"); ok {
+		UsageFilePath = value
+	}
+	AccessLogPath = os.Getenv("ACCESS_LOG_FILE")
+	if value := os.Getenv("KERNEL_GRACE_PERIOD_IN_DAYS"); value != "" {
+		days, err := strconv.ParseFloat(value, 64)
+		if err != nil || days < 0 {
+			return fmt.Errorf("invalid KERNEL_GRACE_PERIOD_IN_DAYS %s", value)
+		}
+		KernelGracePeriod = time.Duration(days * float64(24*time.Hour))
+	}
+	if value := os.Getenv("STALE_FOLDER_MAX_AGE_IN_HOURS"); value != "" {
+		hours, err := strconv.ParseFloat(value, 64)
+		if err != nil || hours < 0 {
+			return fmt.Errorf("invalid STALE_FOLDER_MAX_AGE_IN_HOURS %s", value)
+		}
+		StaleFolderMaxAge = time.Duration(hours * float64(time.Hour))
+	}
+	if value := os.Getenv("STALE_FOLDER_ACTION"); value != "" {
+		if value != staleActionReport && value != staleActionTrash && value != staleActionDelete {
+			return fmt.Errorf("invalid STALE_FOLDER_ACTION %s, expected report, trash or delete", value)
+		}
+		StaleFolderAction = value
+	}
+	var err error
+	if audit, err = loadAuditLog(AssetsDirectory); err != nil {
+		return err
+	}
+	watermarks, err = loadWatermarks(os.Getenv("DISK_USAGE_HIGH_WATERMARK_PERCENT"), os.Getenv("DISK_USAGE_LOW_WATERMARK_PERCENT"), os.Getenv("EVICTION_PRIORITY"))
+	return err
+}
 
-		log.Infof("Image count after deletion: images dev (%d) , images prod (%d)", len(getImagesSortedByModifiedDate(propertiesDev.FolderPath)), len(getImagesSortedByModifiedDate(propertiesProd.FolderPath)))
+// loadFolderProperties overrides the defaults with the environment variables of the folder, e.g. THRESHOLD_MAX_IMAGES_COUNT_DEV
+func loadFolderProperties(properties *folderProperties, suffix string) error {
+	intSettings := map[string]*int{
+		"THRESHOLD_MAX_IMAGES_COUNT_": &properties.ThresholdMaxImagesCount,
+		"MIN_IMAGES_COUNT_":           &properties.MinImagesCount,
+		"KEEP_NEWEST_PER_BRANCH_":     &properties.KeepNewestPerBranch,
+		"KEEP_WEEKLY_IMAGES_WEEKS_":   &properties.KeepWeeklyImagesWeeks,
+	}
+	for prefix, setting := range intSettings {
+		if value := os.Getenv(prefix + suffix); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				return fmt.Errorf("invalid %s%s %s", prefix, suffix, value)
+			}
+			*setting = parsed
+		}
+	}
 
-		freeSpace, usedSpace, totalSpace, err = calculateDiskSpaceUsage()
-		if err != nil {
-			log.Errorf("Error calculating disk space usage: %s", err)
-		} else {
-			log.Infof("Disk free: %.2f%% (%.2f GiB), Disk used: %.2f%% (%.2f GiB), Disk Space total: %.2f GiB", (freeSpace/totalSpace)*100, bytesToGiB(freeSpace), (usedSpace/totalSpace)*100, bytesToGiB(usedSpace), bytesToGiB(totalSpace))
+	floatSettings := map[string]*float64{
+		"MAX_FOLDER_SIZE_IN_GIB_": &properties.MaxFolderSizeInGiB,
+		"MAX_IMAGE_AGE_IN_DAYS_":  &properties.MaxImageAgeInDays,
+	}
+	for prefix, setting := range floatSettings {
+		if value := os.Getenv(prefix + suffix); value != "" {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil || parsed < 0 {
+				return fmt.Errorf("invalid %s%s %s", prefix, suffix, value)
+			}
+			*setting = parsed
 		}
+	}
+	return nil
+}
 
-		time.Sleep(5 * time.Minute)
+// retentionPolicy returns the retention rules of the folder
+func (p folderProperties) retentionPolicy() RetentionPolicy {
+	return RetentionPolicy{
+		MaxImagesCount:      p.ThresholdMaxImagesCount,
+		MaxFolderSizeBytes:  int64(p.MaxFolderSizeInGiB * math.Pow(1024, 3)),
+		MinImagesCount:      p.MinImagesCount,
+		KeepNewestPerBranch: p.KeepNewestPerBranch,
+		KeepWeeklyWeeks:     p.KeepWeeklyImagesWeeks,
+		MaxImageAge:         time.Duration(p.MaxImageAgeInDays * float64(24*time.Hour)),
+		PinnedImages:        pinnedImages,
+		LeastRecentlyUsed:   EvictionOrder == evictionOrderLeastRecentlyUsed,
 	}
 }
 
-func folderNeedsCleanup(folderProperties folderProperties, currentFolderSize float64, allImages []fs.DirEntry) bool {
-	if folderProperties.MaxFolderSizeInGiB < currentFolderSize || folderProperties.ThresholdMaxImagesCount < len(allImages) {
-		if len(allImages) <= 1 {
-			log.Errorf("We only have one bootable image left on this Netboot Server, yet the folderSize is over the defined threshold. Maybe there are some old temp '.azDownload' that weren't cleaned up by azcopy because of some issue. Folderpath: %s", folderProperties.FolderPath)
-			return false
+// applyPlan logs the decision for every image of the folder and moves the evicted images to the trash. Images evicted
+// because the disk runs full are deleted right away. In a dry run, nothing is moved or deleted.
+func applyPlan(plan FolderPlan, dryRun bool) {
+	for _, image := range plan.Images {
+		fields := log.Fields{
+			"channel":   plan.Channel,
+			"image":     image.Name,
+			"rule":      image.Rule,
+			"reason":    image.Reason,
+			"sizeInGiB": fmt.Sprintf("%.2f", bytesToGiB(float64(image.SizeBytes))),
+		}
+		switch {
+		case image.Action == actionKeep:
+			log.WithFields(fields).Info("Keeping image")
+		case dryRun:
+			log.WithFields(fields).Info("Would evict image")
+		default:
+			log.WithFields(fields).Info("Evicting image")
+			event := AuditEvent{Action: auditActionDeleted, Channel: plan.Channel, Image: image.Name, SizeBytes: image.SizeBytes, Rule: image.Rule, Reason: image.Reason}
+			trash := TrashGracePeriod > 0 && image.Rule != ruleDiskWatermark
+			if trash {
+				event.Action = auditActionTrashed
+			}
+			err := audit.Track(event, plan.FolderPath, func() error {
+				if trash {
+					return moveToTrash(plan.FolderPath, image.Name, time.Now())
+				}
+				return deleteImage(plan.FolderPath, image.Name)
+			})
+			if err != nil {
+				log.Errorf("Error evicting image %s: %s", image.Name, err)
+			} else if plan.index != nil {
+				plan.index.remove(image.Name)
+			}
 		}
-		return true
 	}
-	return false
+
+	if plan.OverLimits && len(plan.ReferencedByMenus) > 0 {
+		log.WithFields(log.Fields{"channel": plan.Channel, "images": plan.ReferencedByMenus}).Errorf("Folder %s is over its limits with %.2f GiB, but the images referenced by the published menus are never deleted. Raise the limits or publish menus pointing to a smaller image.",
+			plan.FolderPath, bytesToGiB(float64(plan.ResultingSizeBytes)))
+	} else if plan.OverLimits {
+		log.Errorf("Folder %s is still over its limits with %d images and %.2f GiB, the remaining images are kept by %s. Relax these retention rules or raise the limits.",
+			plan.FolderPath, plan.ResultingImages, bytesToGiB(float64(plan.ResultingSizeBytes)), plan.keptByRules())
+	}
 }
 
-func calculateDiskSpaceUsage() (float64, float64, float64, error) {
+// calculateDiskSpaceUsage returns the free, used and total bytes of the filesystem the path is on
+func calculateDiskSpaceUsage(path string) (float64, float64, float64, error) {
 	fs := syscall.Statfs_t{}
-	err := syscall.Statfs("/", &fs)
+	err := syscall.Statfs(path, &fs)
 	if err != nil {
 		return 0, 0, 0, err
 	}
@@ -163,6 +323,16 @@ func calculateDiskSpaceUsage() (float64, float64, float64, error) {
 	return freeSpace, usedSpace, totalSpace, nil
 }
 
+// logDiskSpaceUsage logs the usage of the filesystem of the folders, which is the mounted volume and not the root of the container
+func logDiskSpaceUsage(path string) {
+	freeSpace, usedSpace, totalSpace, err := diskSpaceUsage(path)
+	if err != nil {
+		log.Errorf("Error calculating disk space usage: %s", err)
+		return
+	}
+	log.Infof("Disk free: %.2f%% (%.2f GiB), Disk used: %.2f%% (%.2f GiB), Disk Space total: %.2f GiB", (freeSpace/totalSpace)*100, bytesToGiB(freeSpace), (usedSpace/totalSpace)*100, bytesToGiB(usedSpace), bytesToGiB(totalSpace))
+}
+
 // func to convert bytes to GiB
 func bytesToGiB(bytes float64) float64 {
 	return bytes / math.Pow(1024, 3)
@@ -176,56 +346,21 @@ func readFilesFromFolder(folderName string) []fs.DirEntry {
 	return files
 }
 
-// returns all images in Folder with newest modified image first and oldest last
-func getImagesSortedByModifiedDate(folderName string) []fs.DirEntry {
-	squashfsFiles := getFilesInFolders(folderName)
-	sort.Sort(ByModTime(squashfsFiles))
-	return squashfsFiles
-}
-
-func getFilesInFolders(folderName string) []fs.DirEntry {
-	files := readFilesFromFolder(folderName)
-
-	var squashfsFiles []fs.DirEntry
-	for _, file := range files {
-		if file.Type() == os.ModeDir {
-			//during the image sync process, the syncer creates a temporary file with the name ".azDownload...", therefore we should exclude it
-			squashfsFilename := getFilename(folderName, file.Name())
-			if strings.Contains(squashfsFilename, ".azDownload") {
-				fmt.Println("will not append struct, could be file in sync with .AzDownload:", file.Name())
-				continue
-			}
-			squashfsFiles = append(squashfsFiles, file)
-		}
-	}
-
-	return squashfsFiles
-}
-
-func getFilename(folderName string, newImageFolderName string) string {
-	newFolderToSearch := fmt.Sprintf("%s/%s", folderName, newImageFolderName)
-	files, err := os.ReadDir(newFolderToSearch)
-	if err != nil {
-		log.Error("Error:", err)
-	}
-
-	for _, file := range files {
-		if strings.HasPrefix(file.Name(), ".azDownload") {
-			return file.Name()
-		}
-		if strings.HasSuffix(file.Name(), ".squashfs") {
-			return file.Name()
-		}
-	}
-	return ""
+func getCurrentFolderSizeInGiB(folderName string) float64 {
+	return bytesToGiB(float64(getFolderSizeInBytes(folderName)))
 }
 
-func getCurrentFolderSizeInGiB(folderName string) float64 {
+// getFolderSizeInBytes returns the size of the files in the folder. The trash of a channel folder is left out, so
+// evictions shrink the folder.
+func getFolderSizeInBytes(folderName string) int64 {
 	var totalSize int64
 	err := filepath.Walk(folderName, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if info.IsDir() && info.Name() == trashDirectoryName && path != folderName {
+			return filepath.SkipDir
+		}
 		if !info.IsDir() {
 			totalSize += info.Size()
 		}
@@ -236,11 +371,11 @@ func getCurrentFolderSizeInGiB(folderName string) float64 {
 		log.Errorf("Error calculating folder size: %s", err)
 	}
 
-	return bytesToGiB(float64(totalSize))
+	return totalSize
 }
 
-func deleteImage(folderName string, image fs.DirEntry) error {
-	squashFsFilePathtoDelete := fmt.Sprintf("%s/%s", folderName, image.Name())
+func deleteImage(folderName string, imageName string) error {
+	squashFsFilePathtoDelete := fmt.Sprintf("%s/%s", folderName, imageName)
 	log.Infof("Deleting image %s", squashFsFilePathtoDelete)
 	err := os.RemoveAll(squashFsFilePathtoDelete)
 	if err != nil {
@@ -10,23 +10,6 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func TestGetImagesSortedByModifiedDate(t *testing.T) {
-	// Arrange
-	tempDir := t.TempDir()
-	createTestImageFolder(t, tempDir, "image1", 1)
-	createTestImageFolder(t, tempDir, "image2", 2)
-	createTestImageFolder(t, tempDir, "image3", 3)
-
-	// Act
-	images := getImagesSortedByModifiedDate(tempDir)
-
-	// Assert
-	assert.Len(t, images, 3)
-	assert.Equal(t, "image3", images[0].Name())
-	assert.Equal(t, "image2", images[1].Name())
-	assert.Equal(t, "image1", images[2].Name())
-}
-
 func TestGetCurrentFolderSizeInGiB(t *testing.T) {
 	// Arrange
 	tempDir := t.TempDir()
@@ -41,29 +24,55 @@ func TestGetCurrentFolderSizeInGiB(t *testing.T) {
 	assert.Less(t, size, 1.0) // Assuming test files are small
 }
 
-func TestFolderNeedsCleanup(t *testing.T) {
+func TestApplyPlan(t *testing.T) {
 	// Arrange
+	setTestMenusDirectory(t)
 	tempDir := t.TempDir()
 	properties := folderProperties{
 		FolderPath:              tempDir,
 		ThresholdMaxImagesCount: 2,
 		MaxFolderSizeInGiB:      0.1,
+		MinImagesCount:          1,
 	}
 	createTestImageFolder(t, tempDir, "image1", 1)
 	createTestImageFolder(t, tempDir, "image2", 2)
 	createTestImageFolder(t, tempDir, "image3", 3)
+	// A tagged image is kept, even if it is the oldest
+	createTestImageFolder(t, tempDir, "image0", 0)
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "image0", keepFilename), []byte("release 24.3\n"), 0644))
+	require.NoError(t, os.Chtimes(filepath.Join(tempDir, "image0"), time.Now(), time.Now()))
 
-	// Act & Assert
-	images := getImagesSortedByModifiedDate(tempDir)
-	folderSize := getCurrentFolderSizeInGiB(tempDir)
-	assert.True(t, folderNeedsCleanup(properties, folderSize, images))
+	// Act
+	applyPlan(planFolder(properties, indexFolder(properties.FolderPath), time.Now(), 0), false)
 
-	err := os.RemoveAll(filepath.Join(tempDir, "image3"))
-	require.NoError(t, err)
+	// Assert
+	images := indexFolder(tempDir).Images
+	require.Len(t, images, 2)
+	assert.Equal(t, "image3", images[0].Name)
+	assert.Equal(t, "image0", images[1].Name)
+	assert.Equal(t, "release 24.3", images[1].Tag)
+}
 
-	images = getImagesSortedByModifiedDate(tempDir)
-	folderSize = getCurrentFolderSizeInGiB(tempDir)
-	assert.False(t, folderNeedsCleanup(properties, folderSize, images))
+func TestLoadFolderProperties(t *testing.T) {
+	// Arrange
+	t.Setenv("THRESHOLD_MAX_IMAGES_COUNT_DEV", "7")
+	t.Setenv("MAX_FOLDER_SIZE_IN_GIB_DEV", "12.5")
+	t.Setenv("KEEP_NEWEST_PER_BRANCH_DEV", "2")
+	t.Setenv("MAX_IMAGE_AGE_IN_DAYS_DEV", "30")
+	t.Setenv("KEEP_WEEKLY_IMAGES_WEEKS_PROD", "invalid")
+	properties := propertiesDev
+
+	// Act
+	err := loadFolderProperties(&properties, "DEV")
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, 7, properties.ThresholdMaxImagesCount)
+	assert.Equal(t, 12.5, properties.MaxFolderSizeInGiB)
+	assert.Equal(t, 2, properties.KeepNewestPerBranch)
+	assert.Equal(t, 30.0, properties.MaxImageAgeInDays)
+	assert.Equal(t, 1, properties.MinImagesCount)
+	assert.Error(t, loadFolderProperties(&properties, "PROD"))
 }
 
 func TestDeleteImage(t *testing.T) {
@@ -73,9 +82,9 @@ func TestDeleteImage(t *testing.T) {
 	createTestImageFolder(t, tempDir, imageName, 1)
 
 	// Act
-	images := getImagesSortedByModifiedDate(tempDir)
+	images := indexFolder(tempDir).Images
 	require.Len(t, images, 1)
-	err := deleteImage(tempDir, images[0])
+	err := deleteImage(tempDir, images[0].Name)
 
 	// Assert
 	assert.NoError(t, err)
@@ -83,6 +92,14 @@ func TestDeleteImage(t *testing.T) {
 	assert.True(t, os.IsNotExist(err))
 }
 
+// setTestMenusDirectory points the cleaner to an empty menus folder, without readable menus no image is evicted
+func setTestMenusDirectory(t *testing.T) string {
+	previousMenusDirectory := MenusDirectory
+	t.Cleanup(func() { MenusDirectory = previousMenusDirectory })
+	MenusDirectory = t.TempDir()
+	return MenusDirectory
+}
+
 // Helper function to create test image folders
 func createTestImageFolder(t *testing.T, baseDir, folderName string, timeInHours int) {
 	folderPath := filepath.Join(baseDir, folderName)
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// referencedImages returns the image folders of the channel which the published menus matching the patterns point to,
+// mapped to the first menu referencing them. The menus reference the images in URLs like
+// http://[server]/[optional token path]/prod/[image folder]/[file].
+func referencedImages(menusDirectory string, menuPatterns []string, channel string) (map[string]string, error) {
+	entries, err := os.ReadDir(menusDirectory)
+	if err != nil {
+		return nil, err
+	}
+	imagePattern := regexp.MustCompile(`/` + regexp.QuoteMeta(channel) + `/([A-Za-z0-9][^/\s"'$]*)/`)
+
+	var menuFiles []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || !matchesAny(entry.Name(), menuPatterns) {
+			continue
+		}
+		menuFiles = append(menuFiles, entry.Name())
+	}
+	sort.Strings(menuFiles)
+
+	images := map[string]string{}
+	for _, menuFile := range menuFiles {
+		content, err := os.ReadFile(filepath.Join(menusDirectory, menuFile))
+		if err != nil {
+			return nil, fmt.Errorf("could not read menu %s: %w", menuFile, err)
+		}
+		for _, match := range imagePattern.FindAllStringSubmatch(string(content), -1) {
+			if _, ok := images[match[1]]; !ok {
+				images[match[1]] = menuFile
+			}
+		}
+	}
+	return images, nil
+}
+
+func matchesAny(fileName string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, fileName); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReferencedImages(t *testing.T) {
+	// Arrange
+	menusDir := t.TempDir()
+	menus := map[string]string{
+		"menu.ipxe": "set squash_url ${http-protocol}://${url}/_token/2024a.1724936400.abc/prod/24-08-29-master-a46edbc/image.squashfs\n" +
+			"set kernel_url ${http-protocol}://${url}/prod/24-08-29-master-a46edbc/arm64/\n" +
+			"goto dg-thinclient-prod-${arch}\n",
+		"MAC-001122334455.ipxe":     "kernel http://10.1.2.3/prod/24-07-01-master-b57fecd/vmlinuz\ninitrd http://10.1.2.3/dev/24-08-30-feature-c0ffee0/initrd\n",
+		"advancedmenu.ipxe":         "set squash_url ${http-protocol}://${url}/prod/24-08-28-master-a46edbc/image.squashfs\n",
+		"MAC-001122334455.ipxe.sig": "prod/24-06-01-master-deadbee/",
+	}
+	for name, content := range menus {
+		require.NoError(t, os.WriteFile(filepath.Join(menusDir, name), []byte(content), 0644))
+	}
+
+	// Act
+	prodImages, err := referencedImages(menusDir, []string{"menu.ipxe", "MAC-*.ipxe"}, "prod")
+	require.NoError(t, err)
+	devImages, err := referencedImages(menusDir, []string{"menu.ipxe", "MAC-*.ipxe"}, "dev")
+	require.NoError(t, err)
+
+	// Assert
+	assert.Equal(t, map[string]string{"24-08-29-master-a46edbc": "menu.ipxe", "24-07-01-master-b57fecd": "MAC-001122334455.ipxe"}, prodImages)
+	assert.Equal(t, map[string]string{"24-08-30-feature-c0ffee0": "MAC-001122334455.ipxe"}, devImages)
+}
+
+func TestReferencedImagesWithoutMenus(t *testing.T) {
+	// Act
+	_, err := referencedImages(filepath.Join(t.TempDir(), "missing"), []string{"menu.ipxe"}, "prod")
+
+	// Assert
+	assert.Error(t, err)
+}
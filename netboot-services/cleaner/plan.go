@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	actionEvict = "evict"
+	actionKeep  = "keep"
+)
+
+// FolderPlan lists the images of a folder in the order they are evicted, followed by the kept images
+type FolderPlan struct {
+	Channel            string `json:"channel"`
+	FolderPath         string `json:"folderPath"`
+	FolderSizeBytes    int64  `json:"folderSizeBytes"`
+	ReclaimedBytes     int64  `json:"reclaimedBytes"`
+	ResultingSizeBytes int64  `json:"resultingSizeBytes"`
+	ResultingImages    int    `json:"resultingImages"`
+	// ReclaimTargetBytes is the space this folder has to free while the disk usage is above the high watermark
+	ReclaimTargetBytes int64          `json:"reclaimTargetBytes,omitempty"`
+	OverLimits         bool           `json:"overLimits"`
+	ReferencedByMenus  []string       `json:"referencedByMenus,omitempty"`
+	Images             []PlannedImage `json:"images"`
+	// StaleFolders are the partial downloads and orphaned folders, which are cleaned up according to STALE_FOLDER_ACTION
+	StaleFolders []StaleFolder `json:"staleFolders,omitempty"`
+
+	// index is updated as the plan is applied
+	index *FolderIndex
+}
+
+// PlannedImage is the decision for an image. FolderSizeAfterBytes is the size of the folder once the image and all
+// images evicted before it are deleted.
+type PlannedImage struct {
+	Order                int       `json:"order,omitempty"`
+	Name                 string    `json:"name"`
+	Action               string    `json:"action"`
+	Rule                 string    `json:"rule"`
+	Reason               string    `json:"reason"`
+	ModTime              time.Time `json:"modTime"`
+	SizeBytes            int64     `json:"sizeBytes"`
+	FolderSizeAfterBytes int64     `json:"folderSizeAfterBytes"`
+}
+
+// planCleanup plans the evictions of all folders. If the disk usage is above the high watermark, the folders free the
+// missing space in the order of the eviction priority, each down to its protected images and minimum image count.
+func planCleanup(folders []folderProperties, indexes []*FolderIndex, watermarks Watermarks, now time.Time) []FolderPlan {
+	var reclaimBytes int64
+	_, usedSpace, totalSpace, err := diskSpaceUsage(diskUsagePath(folders))
+	if err != nil {
+		log.Errorf("Error calculating disk space usage: %s", err)
+	} else if reclaimBytes = watermarks.bytesToReclaim(usedSpace, totalSpace); reclaimBytes > 0 {
+		log.Warnf("Disk usage %.2f%% is above the high watermark of %.2f%%, freeing %.2f GiB in the order %s", usedSpace/totalSpace*100, watermarks.HighPercent, bytesToGiB(float64(reclaimBytes)), strings.Join(watermarks.Priority, ","))
+	}
+
+	plans := make([]FolderPlan, len(folders))
+	for _, index := range watermarks.folderOrder(folders) {
+		folderReclaimBytes := int64(0)
+		if watermarks.hasPriority(folders[index]) {
+			folderReclaimBytes = reclaimBytes
+		}
+		plans[index] = planFolder(folders[index], indexes[index], now, folderReclaimBytes)
+		if folderReclaimBytes > 0 {
+			reclaimBytes -= plans[index].ReclaimedBytes
+		}
+	}
+	if reclaimBytes > 0 {
+		log.Errorf("Disk usage stays above the low watermark, %.2f GiB more would have to be freed, but the remaining images are protected", bytesToGiB(float64(reclaimBytes)))
+	}
+	return plans
+}
+
+// planFolder evaluates the retention policy for the indexed images of the folder, without deleting anything
+func planFolder(properties folderProperties, index *FolderIndex, now time.Time, reclaimBytes int64) FolderPlan {
+	plan := FolderPlan{
+		Channel:            filepath.Base(properties.FolderPath),
+		FolderPath:         properties.FolderPath,
+		FolderSizeBytes:    index.SizeBytes,
+		ReclaimTargetBytes: reclaimBytes,
+		index:              index,
+	}
+	images := index.Images
+	policy := properties.retentionPolicy()
+	policy.ReclaimBytes = reclaimBytes
+	var err error
+	policy.ReferencedImages, err = referencedImages(MenusDirectory, protectedMenus, plan.Channel)
+	if err != nil {
+		log.Errorf("Could not read the published menus, the images of %s are only evicted to free disk space: %s", plan.Channel, err)
+		policy.MenusUnreadable = true
+	}
+	evaluation := policy.Evaluate(images, plan.FolderSizeBytes, now)
+
+	folderSize := plan.FolderSizeBytes
+	for _, decision := range evaluation.Decisions {
+		image := PlannedImage{
+			Name:                 decision.Image.Name,
+			Action:               actionKeep,
+			Rule:                 decision.Rule,
+			Reason:               decision.Reason,
+			ModTime:              decision.Image.ModTime,
+			SizeBytes:            decision.Image.SizeBytes,
+			FolderSizeAfterBytes: folderSize,
+		}
+		if decision.Evict {
+			folderSize -= decision.Image.SizeBytes
+			image.Action = actionEvict
+			image.Order = len(plan.Images) + 1
+			image.FolderSizeAfterBytes = folderSize
+			plan.ReclaimedBytes += decision.Image.SizeBytes
+		}
+		if decision.Rule == ruleReferencedByMenu {
+			plan.ReferencedByMenus = append(plan.ReferencedByMenus, decision.Image.Name)
+		}
+		plan.Images = append(plan.Images, image)
+	}
+	plan.ResultingSizeBytes = evaluation.RemainingSizeBytes
+	plan.ResultingImages = evaluation.RemainingImages
+	plan.OverLimits = evaluation.OverLimits
+	plan.StaleFolders = findStaleFolders(index, nil, now)
+	return plan
+}
+
+// runPlanCommand prints which images the cleaner would evict, in which order and why, and exits without deleting anything
+func runPlanCommand(args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("plan", flag.ContinueOnError)
+	format := flags.String("format", "table", "Output format, table or json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 || (*format != "table" && *format != "json") {
+		return fmt.Errorf("usage: netboot-cleaner plan [--format table|json]")
+	}
+
+	folders := []folderProperties{propertiesDev, propertiesProd}
+	indexes := indexFolders(folders)
+	// The plan reads the usage without remembering the access log position
+	applyImageUsage(indexes, false)
+	plans := planCleanup(folders, indexes, watermarks, time.Now())
+	if *format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plans)
+	}
+	return writePlanTable(w, plans)
+}
+
+// keptByRules counts the kept images per rule, e.g. "keep-newest-per-branch: 3, min-images: 2"
+func (plan FolderPlan) keptByRules() string {
+	counts := map[string]int{}
+	for _, image := range plan.Images {
+		if image.Action == actionKeep {
+			counts[image.Rule]++
+		}
+	}
+	rules := make([]string, 0, len(counts))
+	for rule, count := range counts {
+		rules = append(rules, fmt.Sprintf("%s: %d", rule, count))
+	}
+	sort.Strings(rules)
+	return strings.Join(rules, ", ")
+}
+
+func writePlanTable(w io.Writer, plans []FolderPlan) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, plan := range plans {
+		fmt.Fprintf(table, "%s: %.2f GiB, %.2f GiB reclaimed, %.2f GiB and %d images after the cleanup\n",
+			plan.FolderPath, bytesToGiB(float64(plan.FolderSizeBytes)), bytesToGiB(float64(plan.ReclaimedBytes)), bytesToGiB(float64(plan.ResultingSizeBytes)), plan.ResultingImages)
+		if plan.ReclaimTargetBytes > 0 {
+			fmt.Fprintf(table, "The disk usage is above the high watermark, %.2f GiB have to be freed\n", bytesToGiB(float64(plan.ReclaimTargetBytes)))
+		}
+		if plan.OverLimits {
+			fmt.Fprintf(table, "The folder stays over its limits, the remaining images are kept by %s\n", plan.keptByRules())
+		}
+		fmt.Fprintln(table, "ORDER\tACTION\tIMAGE\tMODIFIED\tSIZE GIB\tFOLDER GIB AFTER\tRULE\tREASON")
+		for _, image := range plan.Images {
+			order := "-"
+			if image.Order > 0 {
+				order = fmt.Sprint(image.Order)
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%.2f\t%.2f\t%s\t%s\n",
+				order, image.Action, image.Name, image.ModTime.Format("2006-01-02 15:04"), bytesToGiB(float64(image.SizeBytes)), bytesToGiB(float64(image.FolderSizeAfterBytes)), image.Rule, image.Reason)
+		}
+		for _, staleFolder := range plan.StaleFolders {
+			fmt.Fprintf(table, "-\t%s\t%s\t%s\t%.2f\t-\t%s\t%s\n",
+				StaleFolderAction, staleFolder.Path, staleFolder.LastChange.Format("2006-01-02 15:04"), bytesToGiB(float64(staleFolder.SizeBytes)), staleFolder.Kind, staleFolder.Reason)
+		}
+		fmt.Fprintln(table)
+	}
+	return table.Flush()
+}
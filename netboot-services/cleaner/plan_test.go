@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyPlanDryRun(t *testing.T) {
+	// Arrange
+	setTestMenusDirectory(t)
+	tempDir := t.TempDir()
+	properties := folderProperties{FolderPath: tempDir, ThresholdMaxImagesCount: 1, MaxFolderSizeInGiB: 1, MinImagesCount: 1}
+	createTestImageFolder(t, tempDir, "image1", 1)
+	createTestImageFolder(t, tempDir, "image2", 2)
+	createTestImageFolder(t, tempDir, "image3", 3)
+
+	// Act
+	plan := planFolder(properties, indexFolder(properties.FolderPath), time.Now(), 0)
+	applyPlan(plan, true)
+
+	// Assert
+	assert.Len(t, indexFolder(tempDir).Images, 3)
+	require.Len(t, plan.Images, 3)
+	assert.Equal(t, "image1", plan.Images[0].Name)
+	assert.Equal(t, 1, plan.Images[0].Order)
+	assert.Equal(t, actionEvict, plan.Images[0].Action)
+	assert.Equal(t, ruleMaxImages, plan.Images[0].Rule)
+	assert.Equal(t, "image2", plan.Images[1].Name)
+	assert.Equal(t, 2, plan.Images[1].Order)
+	assert.Equal(t, actionKeep, plan.Images[2].Action)
+	assert.Equal(t, int64(8), plan.ReclaimedBytes)
+	assert.Equal(t, plan.FolderSizeBytes-4, plan.Images[0].FolderSizeAfterBytes)
+	assert.Equal(t, plan.FolderSizeBytes-8, plan.ResultingSizeBytes)
+	assert.Equal(t, 1, plan.ResultingImages)
+}
+
+func TestPlanFolderWithUnreadableMenus(t *testing.T) {
+	// Arrange
+	previousMenusDirectory := MenusDirectory
+	t.Cleanup(func() { MenusDirectory = previousMenusDirectory })
+	MenusDirectory = filepath.Join(t.TempDir(), "missing")
+	tempDir := t.TempDir()
+	properties := folderProperties{FolderPath: tempDir, ThresholdMaxImagesCount: 1, MinImagesCount: 1}
+	createTestImageFolder(t, tempDir, "image1", 1)
+	createTestImageFolder(t, tempDir, "image2", 2)
+
+	// Act
+	plan := planFolder(properties, indexFolder(properties.FolderPath), time.Now(), 0)
+
+	// Assert
+	assert.Zero(t, plan.ReclaimedBytes)
+	require.Len(t, plan.Images, 2)
+	for _, image := range plan.Images {
+		assert.Equal(t, actionKeep, image.Action)
+		assert.Equal(t, ruleMenusUnreadable, image.Rule)
+	}
+	assert.True(t, plan.OverLimits)
+	assert.Equal(t, "menus-unreadable: 2", plan.keptByRules())
+}
+
+func TestRunPlanCommand(t *testing.T) {
+	// Arrange
+	setTestMenusDirectory(t)
+	devDir, prodDir := t.TempDir(), t.TempDir()
+	createTestImageFolder(t, devDir, "24-08-29-master-a46edbc", 1)
+	createTestImageFolder(t, prodDir, "24-08-28-master-a46edbc", 1)
+	createTestImageFolder(t, prodDir, "24-08-29-master-b57fecd", 2)
+	previousDev, previousProd := propertiesDev, propertiesProd
+	t.Cleanup(func() { propertiesDev, propertiesProd = previousDev, previousProd })
+	propertiesDev = folderProperties{FolderPath: devDir, ThresholdMaxImagesCount: 5, MaxFolderSizeInGiB: 1, MinImagesCount: 1}
+	propertiesProd = folderProperties{FolderPath: prodDir, ThresholdMaxImagesCount: 1, MaxFolderSizeInGiB: 1, MinImagesCount: 1}
+
+	// Act
+	jsonOutput := &bytes.Buffer{}
+	err := runPlanCommand([]string{"--format", "json"}, jsonOutput)
+	require.NoError(t, err)
+	tableOutput := &bytes.Buffer{}
+	err = runPlanCommand(nil, tableOutput)
+	require.NoError(t, err)
+
+	// Assert
+	var plans []FolderPlan
+	require.NoError(t, json.Unmarshal(jsonOutput.Bytes(), &plans))
+	require.Len(t, plans, 2)
+	assert.Len(t, plans[0].Images, 1)
+	assert.Equal(t, "24-08-28-master-a46edbc", plans[1].Images[0].Name)
+	assert.Equal(t, actionEvict, plans[1].Images[0].Action)
+	assert.Contains(t, tableOutput.String(), "ORDER  ACTION  IMAGE")
+	assert.Contains(t, tableOutput.String(), "1      evict   24-08-28-master-a46edbc")
+	assert.Len(t, indexFolder(prodDir).Images, 2)
+	assert.Error(t, runPlanCommand([]string{"--format", "yaml"}, jsonOutput))
+}
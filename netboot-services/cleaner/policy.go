@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Names of the retention rules, they are logged with every decision
+const (
+	ruleReferencedByMenu    = "referenced-by-menu"
+	ruleMenusUnreadable     = "menus-unreadable"
+	rulePinned              = "pinned"
+	ruleTagged              = "tagged"
+	ruleKeepNewestPerBranch = "keep-newest-per-branch"
+	ruleKeepWeekly          = "keep-weekly"
+	ruleMinImages           = "min-images"
+	ruleMaxAge              = "max-age"
+	ruleMaxImages           = "max-images"
+	ruleMaxFolderSize       = "max-folder-size"
+	ruleDiskWatermark       = "disk-watermark"
+	ruleWithinLimits        = "within-limits"
+)
+
+// imageNamePattern matches image folders like 24-08-29-master-a46edbc, the second group is the branch
+var imageNamePattern = regexp.MustCompile(`^(\d{2}-\d{2}-\d{2})-(.+)-[0-9a-f]{7,40}$`)
+
+// Image is an image folder of a channel
+type Image struct {
+	Name      string
+	ModTime   time.Time
+	SizeBytes int64
+	// Tag is the content of the .keep file of a tagged image, e.g. "release 24.3"
+	Tag    string
+	Tagged bool
+	// LastAccess is the last time a client booted the image, it is zero if the usage is unknown
+	LastAccess time.Time
+}
+
+// lastUsed returns when the image was last booted or synced, an image which was never booted counts as used when it
+// was synced
+func (i Image) lastUsed() time.Time {
+	if i.LastAccess.After(i.ModTime) {
+		return i.LastAccess
+	}
+	return i.ModTime
+}
+
+// Decision tells whether an image is kept or evicted and which rule decided it
+type Decision struct {
+	Image  Image
+	Evict  bool
+	Rule   string
+	Reason string
+}
+
+// RetentionPolicy combines the retention rules of a channel. The keep rules (images of the published menus, pinned and
+// tagged images, the newest images per branch and one image per week) protect images, the eviction rules (maximum age,
+// count and folder size) then evict the oldest unprotected images, but never more than down to MinImagesCount images.
+// A value of 0 disables a rule.
+type RetentionPolicy struct {
+	MaxImagesCount      int
+	MaxFolderSizeBytes  int64
+	MinImagesCount      int
+	KeepNewestPerBranch int
+	KeepWeeklyWeeks     int
+	MaxImageAge         time.Duration
+	PinnedImages        map[string]bool
+	// ReferencedImages maps the images the published menus point to to the menu referencing them
+	ReferencedImages map[string]string
+	// MenusUnreadable is set if the published menus could not be read. Any image could be referenced, so the images are
+	// only evicted while the disk usage is above the high watermark.
+	MenusUnreadable bool
+	// ReclaimBytes is set while the disk usage is above the high watermark, the oldest unprotected images are evicted
+	// until this many bytes are freed
+	ReclaimBytes int64
+	// LeastRecentlyUsed evicts the images which were not booted for the longest time first instead of the oldest
+	LeastRecentlyUsed bool
+}
+
+// Evaluation is the result of a policy for all images of a channel
+type Evaluation struct {
+	// Decisions holds the evictions in the order they are done, followed by the kept images, newest first
+	Decisions          []Decision
+	RemainingImages    int
+	RemainingSizeBytes int64
+	// OverLimits is set if the protected images or the minimum image count keep the channel over its limits
+	OverLimits bool
+}
+
+// Evaluate applies the policy to the images, sorted newest first. The folder size includes files outside of the
+// image folders, e.g. the staging folder of the syncer.
+func (p RetentionPolicy) Evaluate(images []Image, folderSizeBytes int64, now time.Time) Evaluation {
+	kept := make([]*Decision, len(images))
+	imagesPerBranch := map[string]int{}
+	keptWeeks := map[[2]int]bool{}
+	for i, image := range images {
+		branch := branchOfImage(image.Name)
+		imagesPerBranch[branch]++
+		year, week := image.ModTime.ISOWeek()
+
+		menu, referenced := p.ReferencedImages[image.Name]
+		switch {
+		case referenced:
+			kept[i] = &Decision{Image: image, Rule: ruleReferencedByMenu, Reason: "referenced by " + menu}
+		case p.PinnedImages[image.Name]:
+			kept[i] = &Decision{Image: image, Rule: rulePinned, Reason: "listed in PINNED_IMAGES"}
+		case image.Tagged:
+			kept[i] = &Decision{Image: image, Rule: ruleTagged, Reason: fmt.Sprintf("tagged %q", image.Tag)}
+		case imagesPerBranch[branch] <= p.KeepNewestPerBranch:
+			kept[i] = &Decision{Image: image, Rule: ruleKeepNewestPerBranch, Reason: fmt.Sprintf("one of the %d newest images of branch %s", p.KeepNewestPerBranch, branch)}
+		case p.KeepWeeklyWeeks > 0 && now.Sub(image.ModTime) < time.Duration(p.KeepWeeklyWeeks)*7*24*time.Hour && !keptWeeks[[2]int{year, week}]:
+			kept[i] = &Decision{Image: image, Rule: ruleKeepWeekly, Reason: fmt.Sprintf("newest image of week %d-W%02d", year, week)}
+		}
+		if p.KeepWeeklyWeeks > 0 && now.Sub(image.ModTime) < time.Duration(p.KeepWeeklyWeeks)*7*24*time.Hour {
+			keptWeeks[[2]int{year, week}] = true
+		}
+	}
+
+	evaluation := Evaluation{RemainingImages: len(images), RemainingSizeBytes: folderSizeBytes}
+	// The oldest or least recently used unprotected image is evicted first
+	evictionOrder := make([]int, len(images))
+	for i := range evictionOrder {
+		evictionOrder[i] = len(images) - 1 - i
+	}
+	if p.LeastRecentlyUsed {
+		sort.SliceStable(evictionOrder, func(a, b int) bool {
+			return images[evictionOrder[a]].lastUsed().Before(images[evictionOrder[b]].lastUsed())
+		})
+	}
+	watermarkReason := fmt.Sprintf("disk usage is above the high watermark, %.2f GiB have to be freed", bytesToGiB(float64(p.ReclaimBytes)))
+	for _, i := range evictionOrder {
+		if kept[i] != nil {
+			continue
+		}
+		image := images[i]
+		decision := Decision{Image: image}
+		reclaiming := p.ReclaimBytes > 0 && folderSizeBytes-evaluation.RemainingSizeBytes < p.ReclaimBytes
+		// An old image which is still booted is not evicted for its age in the least recently used order
+		age, ageReason := now.Sub(image.ModTime), fmt.Sprintf("older than %s", p.MaxImageAge)
+		if p.LeastRecentlyUsed {
+			age, ageReason = now.Sub(image.lastUsed()), fmt.Sprintf("unused for more than %s", p.MaxImageAge)
+		}
+		switch {
+		case evaluation.RemainingImages <= p.MinImagesCount:
+			decision.Rule, decision.Reason = ruleMinImages, fmt.Sprintf("only %d images left", evaluation.RemainingImages)
+		case p.MenusUnreadable && !reclaiming:
+			decision.Rule, decision.Reason = ruleMenusUnreadable, "the published menus could not be read"
+		case p.MenusUnreadable:
+			decision.Evict, decision.Rule, decision.Reason = true, ruleDiskWatermark, watermarkReason
+		case p.MaxImageAge > 0 && age > p.MaxImageAge:
+			decision.Evict, decision.Rule, decision.Reason = true, ruleMaxAge, ageReason
+		case p.MaxImagesCount > 0 && evaluation.RemainingImages > p.MaxImagesCount:
+			decision.Evict, decision.Rule, decision.Reason = true, ruleMaxImages, fmt.Sprintf("%d images, at most %d allowed", evaluation.RemainingImages, p.MaxImagesCount)
+		case p.MaxFolderSizeBytes > 0 && evaluation.RemainingSizeBytes > p.MaxFolderSizeBytes:
+			decision.Evict, decision.Rule, decision.Reason = true, ruleMaxFolderSize, fmt.Sprintf("folder has %.2f GiB, at most %.2f GiB allowed", bytesToGiB(float64(evaluation.RemainingSizeBytes)), bytesToGiB(float64(p.MaxFolderSizeBytes)))
+		case reclaiming:
+			decision.Evict, decision.Rule, decision.Reason = true, ruleDiskWatermark, watermarkReason
+		default:
+			decision.Rule, decision.Reason = ruleWithinLimits, "channel is within its limits"
+		}
+
+		if decision.Evict && p.LeastRecentlyUsed {
+			decision.Reason += ", " + lastBootedReason(image)
+		}
+		if decision.Evict {
+			evaluation.Decisions = append(evaluation.Decisions, decision)
+			evaluation.RemainingImages--
+			evaluation.RemainingSizeBytes -= image.SizeBytes
+		} else {
+			kept[i] = &decision
+		}
+	}
+
+	for _, decision := range kept {
+		if decision != nil {
+			evaluation.Decisions = append(evaluation.Decisions, *decision)
+		}
+	}
+	evaluation.OverLimits = (p.MaxImagesCount > 0 && evaluation.RemainingImages > p.MaxImagesCount) ||
+		(p.MaxFolderSizeBytes > 0 && evaluation.RemainingSizeBytes > p.MaxFolderSizeBytes)
+	return evaluation
+}
+
+func lastBootedReason(image Image) string {
+	if image.LastAccess.IsZero() {
+		return "never booted, synced " + image.ModTime.Format(time.RFC3339)
+	}
+	return "last booted " + image.LastAccess.Format(time.RFC3339)
+}
+
+// branchOfImage returns the branch of image folders named [yy-mm-dd]-[branch]-[commit], other folders are their own branch
+func branchOfImage(imageName string) string {
+	match := imageNamePattern.FindStringSubmatch(imageName)
+	if match == nil {
+		return imageName
+	}
+	return match[2]
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetentionPolicyEvaluate(t *testing.T) {
+	now := time.Date(2024, 9, 2, 12, 0, 0, 0, time.UTC)
+	// Newest first, one image per day, all of 1 GiB
+	images := []Image{
+		{Name: "24-09-01-master-aaaaaaa"},
+		{Name: "24-08-31-feature-bbbbbbb"},
+		{Name: "24-08-30-master-ccccccc"},
+		{Name: "24-08-29-feature-ddddddd"},
+		{Name: "24-08-22-master-eeeeeee", Tagged: true, Tag: "release"},
+		{Name: "24-08-15-master-fffffff"},
+	}
+	for i := range images {
+		date, _ := time.Parse("06-01-02", images[i].Name[:8])
+		images[i].ModTime = date.Add(12 * time.Hour)
+		images[i].SizeBytes = 1 << 30
+	}
+
+	tests := []struct {
+		name            string
+		policy          RetentionPolicy
+		expectedEvicted map[string]string
+		expectedKept    map[string]string
+		expectOverLimit bool
+	}{
+		{
+			name:            "Maximum count evicts the oldest",
+			policy:          RetentionPolicy{MaxImagesCount: 4, MinImagesCount: 1},
+			expectedEvicted: map[string]string{"24-08-15-master-fffffff": ruleMaxImages, "24-08-29-feature-ddddddd": ruleMaxImages},
+			expectedKept:    map[string]string{"24-08-22-master-eeeeeee": ruleTagged, "24-09-01-master-aaaaaaa": ruleWithinLimits},
+		},
+		{
+			name:            "Folder size",
+			policy:          RetentionPolicy{MaxFolderSizeBytes: 5 << 30, MinImagesCount: 1},
+			expectedEvicted: map[string]string{"24-08-15-master-fffffff": ruleMaxFolderSize},
+			expectedKept:    map[string]string{"24-08-29-feature-ddddddd": ruleWithinLimits},
+		},
+		{
+			name:            "Newest per branch and pinned",
+			policy:          RetentionPolicy{MaxImagesCount: 2, MinImagesCount: 1, KeepNewestPerBranch: 1, PinnedImages: map[string]bool{"24-08-15-master-fffffff": true}},
+			expectedEvicted: map[string]string{"24-08-30-master-ccccccc": ruleMaxImages, "24-08-29-feature-ddddddd": ruleMaxImages},
+			expectedKept:    map[string]string{"24-09-01-master-aaaaaaa": ruleKeepNewestPerBranch, "24-08-31-feature-bbbbbbb": ruleKeepNewestPerBranch, "24-08-15-master-fffffff": rulePinned},
+			expectOverLimit: true,
+		},
+		{
+			name:            "Referenced by the menus",
+			policy:          RetentionPolicy{MaxFolderSizeBytes: 4 << 30, MinImagesCount: 1, ReferencedImages: map[string]string{"24-08-15-master-fffffff": "menu.ipxe"}},
+			expectedEvicted: map[string]string{"24-08-29-feature-ddddddd": ruleMaxFolderSize, "24-08-30-master-ccccccc": ruleMaxFolderSize},
+			expectedKept:    map[string]string{"24-08-15-master-fffffff": ruleReferencedByMenu, "24-08-22-master-eeeeeee": ruleTagged},
+		},
+		{
+			name:            "Weekly images and maximum age",
+			policy:          RetentionPolicy{MinImagesCount: 1, KeepWeeklyWeeks: 2, MaxImageAge: 2 * 24 * time.Hour},
+			expectedEvicted: map[string]string{"24-08-15-master-fffffff": ruleMaxAge, "24-08-29-feature-ddddddd": ruleMaxAge, "24-08-30-master-ccccccc": ruleMaxAge},
+			// The week of the tagged image is already kept
+			expectedKept: map[string]string{"24-09-01-master-aaaaaaa": ruleKeepWeekly, "24-08-31-feature-bbbbbbb": ruleWithinLimits, "24-08-22-master-eeeeeee": ruleTagged},
+		},
+		{
+			name:            "Minimum count",
+			policy:          RetentionPolicy{MinImagesCount: 4, MaxImageAge: time.Hour},
+			expectedEvicted: map[string]string{"24-08-15-master-fffffff": ruleMaxAge, "24-08-29-feature-ddddddd": ruleMaxAge},
+			expectedKept:    map[string]string{"24-08-30-master-ccccccc": ruleMinImages, "24-09-01-master-aaaaaaa": ruleMinImages},
+		},
+		{
+			name:            "Unreadable menus",
+			policy:          RetentionPolicy{MaxImagesCount: 2, MinImagesCount: 1, MaxImageAge: time.Hour, MenusUnreadable: true},
+			expectedEvicted: map[string]string{},
+			expectedKept:    map[string]string{"24-08-15-master-fffffff": ruleMenusUnreadable, "24-08-22-master-eeeeeee": ruleTagged},
+			expectOverLimit: true,
+		},
+		{
+			name:            "Unreadable menus above the high watermark",
+			policy:          RetentionPolicy{MaxImagesCount: 2, MinImagesCount: 1, ReclaimBytes: 2 << 30, MenusUnreadable: true},
+			expectedEvicted: map[string]string{"24-08-15-master-fffffff": ruleDiskWatermark, "24-08-29-feature-ddddddd": ruleDiskWatermark},
+			expectedKept:    map[string]string{"24-08-30-master-ccccccc": ruleMenusUnreadable, "24-08-22-master-eeeeeee": ruleTagged},
+			expectOverLimit: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			evaluation := test.policy.Evaluate(images, 6<<30, now)
+
+			// Assert
+			assert.Len(t, evaluation.Decisions, len(images))
+			evicted := map[string]string{}
+			kept := map[string]string{}
+			for _, decision := range evaluation.Decisions {
+				if decision.Evict {
+					evicted[decision.Image.Name] = decision.Rule
+				} else {
+					kept[decision.Image.Name] = decision.Rule
+				}
+			}
+			assert.Equal(t, test.expectedEvicted, evicted)
+			for name, rule := range test.expectedKept {
+				assert.Equal(t, rule, kept[name], name)
+			}
+			assert.Equal(t, test.expectOverLimit, evaluation.OverLimits)
+			assert.Equal(t, len(images)-len(evicted), evaluation.RemainingImages)
+		})
+	}
+}
+
+func TestRetentionPolicyLeastRecentlyUsed(t *testing.T) {
+	// Arrange
+	now := time.Date(2024, 9, 2, 12, 0, 0, 0, time.UTC)
+	images := []Image{
+		{Name: "24-09-01-master-aaaaaaa", ModTime: now.Add(-24 * time.Hour), SizeBytes: 1},
+		{Name: "24-08-31-feature-bbbbbbb", ModTime: now.Add(-48 * time.Hour), SizeBytes: 1},
+		// The oldest image is still booted every day
+		{Name: "24-08-15-master-ccccccc", ModTime: now.Add(-18 * 24 * time.Hour), SizeBytes: 1, LastAccess: now.Add(-time.Hour)},
+	}
+	policy := RetentionPolicy{MaxImagesCount: 2, MinImagesCount: 1, LeastRecentlyUsed: true}
+
+	// Act
+	evaluation := policy.Evaluate(images, 3, now)
+
+	// Assert
+	assert.True(t, evaluation.Decisions[0].Evict)
+	assert.Equal(t, "24-08-31-feature-bbbbbbb", evaluation.Decisions[0].Image.Name)
+	assert.Equal(t, "3 images, at most 2 allowed, never booted, synced 2024-08-31T12:00:00Z", evaluation.Decisions[0].Reason)
+	assert.Equal(t, 2, evaluation.RemainingImages)
+	assert.False(t, evaluation.Decisions[2].Evict)
+	assert.Equal(t, "24-08-15-master-ccccccc", evaluation.Decisions[2].Image.Name)
+}
+
+func TestRetentionPolicyLeastRecentlyUsedMaxAge(t *testing.T) {
+	// Arrange
+	now := time.Date(2024, 9, 2, 12, 0, 0, 0, time.UTC)
+	images := []Image{
+		{Name: "24-09-01-master-aaaaaaa", ModTime: now.Add(-24 * time.Hour), SizeBytes: 1},
+		// The old images are synced a month ago, only one of them is still booted
+		{Name: "24-08-02-master-bbbbbbb", ModTime: now.Add(-31 * 24 * time.Hour), SizeBytes: 1, LastAccess: now.Add(-time.Hour)},
+		{Name: "24-08-01-master-ccccccc", ModTime: now.Add(-32 * 24 * time.Hour), SizeBytes: 1, LastAccess: now.Add(-20 * 24 * time.Hour)},
+	}
+	policy := RetentionPolicy{MinImagesCount: 1, MaxImageAge: 14 * 24 * time.Hour, LeastRecentlyUsed: true}
+
+	// Act
+	evaluation := policy.Evaluate(images, 3, now)
+
+	// Assert
+	require.Len(t, evaluation.Decisions, 3)
+	assert.True(t, evaluation.Decisions[0].Evict)
+	assert.Equal(t, "24-08-01-master-ccccccc", evaluation.Decisions[0].Image.Name)
+	assert.Equal(t, ruleMaxAge, evaluation.Decisions[0].Rule)
+	assert.Equal(t, "unused for more than 336h0m0s, last booted 2024-08-13T12:00:00Z", evaluation.Decisions[0].Reason)
+	assert.False(t, evaluation.Decisions[2].Evict)
+	assert.Equal(t, "24-08-02-master-bbbbbbb", evaluation.Decisions[2].Image.Name)
+	assert.Equal(t, ruleWithinLimits, evaluation.Decisions[2].Rule)
+}
+
+func TestBranchOfImage(t *testing.T) {
+	assert.Equal(t, "master", branchOfImage("24-08-29-master-a46edbc"))
+	assert.Equal(t, "feature-arm64-boot", branchOfImage("24-08-29-feature-arm64-boot-a46edbc"))
+	assert.Equal(t, "custom-image", branchOfImage("custom-image"))
+}
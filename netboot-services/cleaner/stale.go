@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	staleKindPartial = "partial-download"
+	staleKindOrphan  = "orphan"
+
+	staleActionReport = "report"
+	staleActionTrash  = "trash"
+	staleActionDelete = "delete"
+
+	// stagingDirectoryName is the hidden folder of a channel the syncer downloads the images to
+	stagingDirectoryName = ".staging"
+)
+
+var (
+	// StaleFolderMaxAge is how long a partial download or an orphaned folder has to be unchanged before it is stale
+	StaleFolderMaxAge = 24 * time.Hour
+	// StaleFolderAction is what happens to stale folders: report, trash or delete
+	StaleFolderAction = staleActionTrash
+)
+
+// StaleFolder is a partial download which is not progressing anymore or a folder without bootable content. Neither is
+// listed in the menus or counted as image, so the retention rules never evict them.
+type StaleFolder struct {
+	Channel string `json:"channel"`
+	// Path is relative to the channel folder, e.g. 24-08-29-master-a46edbc or .staging/24-08-29-master-a46edbc
+	Path       string    `json:"path"`
+	Kind       string    `json:"kind"`
+	Reason     string    `json:"reason"`
+	SizeBytes  int64     `json:"sizeBytes"`
+	LastChange time.Time `json:"lastChange"`
+}
+
+// StaleTracker remembers the sizes of the partial downloads and orphaned folders between the runs, so a folder is only
+// stale once its size did not change since the previous run
+type StaleTracker struct {
+	sizes map[string]int64
+}
+
+func NewStaleTracker() *StaleTracker {
+	return &StaleTracker{sizes: map[string]int64{}}
+}
+
+// observe records the size of the folder and returns whether it is the same as in the previous run.
+// Without a tracker, e.g. for the plan command, the size counts as unchanged.
+func (t *StaleTracker) observe(path string, size int64, seen map[string]bool) bool {
+	if t == nil {
+		return true
+	}
+	seen[path] = true
+	previous, ok := t.sizes[path]
+	t.sizes[path] = size
+	return ok && previous == size
+}
+
+// forget drops the folders of the channel folder which were not seen in this run
+func (t *StaleTracker) forget(folderName string, seen map[string]bool) {
+	if t == nil {
+		return
+	}
+	for path := range t.sizes {
+		if strings.HasPrefix(path, folderName+string(filepath.Separator)) && !seen[path] {
+			delete(t.sizes, path)
+		}
+	}
+}
+
+// findStaleFolders returns the stale partial downloads and orphaned folders of the indexed channel folder. Partial
+// downloads are image folders with .azDownload or .partial files and the folders in the staging folder of the syncer,
+// orphaned folders are image folders without a squashfs, vmlinuz and initrd in the same folder. Folders of the
+// pull-through cache are never orphaned, it only downloads the files which are booted.
+func findStaleFolders(index *FolderIndex, tracker *StaleTracker, now time.Time) []StaleFolder {
+	var staleFolders []StaleFolder
+	seen := map[string]bool{}
+	for _, folder := range index.Folders {
+		staleFolder := StaleFolder{Channel: filepath.Base(index.FolderPath), Path: folder.Path, SizeBytes: folder.SizeBytes, LastChange: folder.LastChange}
+		switch {
+		case folder.Partial || strings.HasPrefix(folder.Path, stagingDirectoryName):
+			staleFolder.Kind = staleKindPartial
+			staleFolder.Reason = fmt.Sprintf("download did not progress for %s", now.Sub(folder.LastChange).Round(time.Minute))
+		case folder.MissingBootFiles != "" && !folder.PullThrough:
+			staleFolder.Kind = staleKindOrphan
+			staleFolder.Reason = "no bootable content, " + folder.MissingBootFiles
+		default:
+			continue
+		}
+
+		unchanged := tracker.observe(filepath.Join(index.FolderPath, folder.Path), folder.SizeBytes, seen)
+		if unchanged && now.Sub(folder.LastChange) >= StaleFolderMaxAge {
+			staleFolders = append(staleFolders, staleFolder)
+		}
+	}
+	tracker.forget(index.FolderPath, seen)
+	return staleFolders
+}
+
+// cleanupStaleFolders reports the stale folders of all channel folders and trashes or deletes them according to
+// StaleFolderAction. Orphaned folders which are pinned, tagged or referenced by the published menus are only reported.
+func cleanupStaleFolders(indexes []*FolderIndex, tracker *StaleTracker, now time.Time, dryRun bool) {
+	for _, index := range indexes {
+		var referenced map[string]string
+		var referencedErr error
+		for _, staleFolder := range findStaleFolders(index, tracker, now) {
+			fields := log.Fields{
+				"channel":    staleFolder.Channel,
+				"path":       staleFolder.Path,
+				"kind":       staleFolder.Kind,
+				"reason":     staleFolder.Reason,
+				"lastChange": staleFolder.LastChange.Format(time.RFC3339),
+				"sizeInGiB":  fmt.Sprintf("%.2f", bytesToGiB(float64(staleFolder.SizeBytes))),
+			}
+			if staleFolder.Kind == staleKindOrphan {
+				if referenced == nil && referencedErr == nil {
+					referenced, referencedErr = referencedImages(MenusDirectory, protectedMenus, staleFolder.Channel)
+				}
+				if referencedErr != nil {
+					log.WithFields(fields).WithError(referencedErr).Error("Found stale folder, it is not removed as the published menus could not be read")
+					continue
+				}
+				_, isReferenced := referenced[staleFolder.Path]
+				if isReferenced || pinnedImages[staleFolder.Path] || index.folder(staleFolder.Path).Tagged {
+					log.WithFields(fields).Error("Found stale folder, it is not removed as it is pinned, tagged or referenced by the published menus")
+					continue
+				}
+			}
+
+			switch {
+			case StaleFolderAction == staleActionReport:
+				log.WithFields(fields).Warn("Found stale folder")
+			case dryRun:
+				log.WithFields(fields).Infof("Would %s stale folder", StaleFolderAction)
+			default:
+				log.WithFields(fields).Infof("Removing stale folder, action %s", StaleFolderAction)
+				path := filepath.Join(index.FolderPath, staleFolder.Path)
+				// Partial downloads in the staging folder cannot be restored as images, they are always deleted
+				trash := StaleFolderAction == staleActionTrash && !strings.HasPrefix(staleFolder.Path, stagingDirectoryName)
+				event := AuditEvent{Action: auditActionDeleted, Channel: staleFolder.Channel, Image: staleFolder.Path, SizeBytes: staleFolder.SizeBytes, Rule: ruleStaleFolder, Reason: staleFolder.Kind + ", " + staleFolder.Reason}
+				if trash {
+					event.Action = auditActionTrashed
+				}
+				err := audit.Track(event, index.FolderPath, func() error {
+					if trash {
+						return moveToTrash(index.FolderPath, staleFolder.Path, now)
+					}
+					return os.RemoveAll(path)
+				})
+				if err != nil {
+					log.Errorf("Error removing stale folder %s: %s", path, err)
+					continue
+				}
+				index.remove(staleFolder.Path)
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindStaleFolders(t *testing.T) {
+	// Arrange
+	tempDir := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+	createFiles(t, tempDir, old, "partial/.azDownload-1234", ".staging/24-08-29-master-a46edbc/image.squashfs.partial", "orphan/vmlinuz",
+		"bootable/x86_64/image.squashfs", "bootable/x86_64/vmlinuz", "bootable/x86_64/initrd")
+	// The asset server caches the kernel and initrd on the first boot, the squashfs is only fetched by the booted client
+	createFiles(t, tempDir, old, "pull-through/"+pullThroughMarkerFilename, "pull-through/vmlinuz", "pull-through/initrd")
+	createFiles(t, tempDir, time.Now(), "fresh/.azDownload-5678")
+	tracker := NewStaleTracker()
+	now := time.Now()
+
+	// Act
+	firstRun := findStaleFolders(indexFolder(tempDir), tracker, now)
+	secondRun := findStaleFolders(indexFolder(tempDir), tracker, now)
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "partial", ".azDownload-1234"), []byte("grown"), 0644))
+	require.NoError(t, os.Chtimes(filepath.Join(tempDir, "partial", ".azDownload-1234"), old, old))
+	thirdRun := findStaleFolders(indexFolder(tempDir), tracker, now)
+
+	// Assert
+	assert.Empty(t, firstRun, "the size has to be unchanged since the previous run")
+	require.Len(t, secondRun, 3)
+	assert.Equal(t, filepath.Join(stagingDirectoryName, "24-08-29-master-a46edbc"), secondRun[0].Path)
+	assert.Equal(t, staleKindPartial, secondRun[0].Kind)
+	assert.Equal(t, "orphan", secondRun[1].Path)
+	assert.Equal(t, staleKindOrphan, secondRun[1].Kind)
+	assert.Equal(t, "no bootable content, missing initrd, squashfs", secondRun[1].Reason)
+	assert.Equal(t, "partial", secondRun[2].Path)
+	assert.Equal(t, staleKindPartial, secondRun[2].Kind)
+	require.Len(t, thirdRun, 2)
+	assert.Equal(t, "orphan", thirdRun[1].Path)
+}
+
+func TestCleanupStaleFolders(t *testing.T) {
+	// Arrange
+	setTestMenusDirectory(t)
+	tempDir := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+	createFiles(t, tempDir, old, ".staging/24-08-29-master-a46edbc/image.squashfs.partial", "orphan/image.squashfs", "pinned-orphan/image.squashfs")
+	previousAction, previousPinned := StaleFolderAction, pinnedImages
+	t.Cleanup(func() { StaleFolderAction, pinnedImages = previousAction, previousPinned })
+	StaleFolderAction = staleActionTrash
+	pinnedImages = map[string]bool{"pinned-orphan": true}
+	folders := []folderProperties{{FolderPath: tempDir}}
+
+	// Act
+	cleanupStaleFolders(indexFolders(folders), nil, time.Now(), true)
+	afterDryRun := listTrash(tempDir)
+	cleanupStaleFolders(indexFolders(folders), nil, time.Now(), false)
+
+	// Assert
+	assert.Empty(t, afterDryRun)
+	assert.NoDirExists(t, filepath.Join(tempDir, stagingDirectoryName, "24-08-29-master-a46edbc"))
+	assert.NoDirExists(t, filepath.Join(tempDir, "orphan"))
+	assert.DirExists(t, filepath.Join(tempDir, "pinned-orphan"))
+	trash := listTrash(tempDir)
+	require.Len(t, trash, 1)
+	assert.Equal(t, "orphan", trash[0].Name)
+}
+
+func TestCleanupStaleFoldersWithUnreadableMenus(t *testing.T) {
+	// Arrange
+	previousMenusDirectory, previousAction := MenusDirectory, StaleFolderAction
+	t.Cleanup(func() { MenusDirectory, StaleFolderAction = previousMenusDirectory, previousAction })
+	MenusDirectory = filepath.Join(t.TempDir(), "missing")
+	StaleFolderAction = staleActionDelete
+	tempDir := t.TempDir()
+	createFiles(t, tempDir, time.Now().Add(-48*time.Hour), ".staging/24-08-29-master-a46edbc/image.squashfs.partial", "orphan/image.squashfs")
+
+	// Act
+	cleanupStaleFolders(indexFolders([]folderProperties{{FolderPath: tempDir}}), nil, time.Now(), false)
+
+	// Assert
+	assert.NoDirExists(t, filepath.Join(tempDir, stagingDirectoryName, "24-08-29-master-a46edbc"))
+	assert.DirExists(t, filepath.Join(tempDir, "orphan"))
+}
+
+// createFiles creates the files relative to the base directory and sets the time of all files and folders to modTime
+func createFiles(t *testing.T, baseDir string, modTime time.Time, files ...string) {
+	for _, file := range files {
+		path := filepath.Join(baseDir, filepath.FromSlash(file))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte("blub"), 0644))
+	}
+	for _, file := range files {
+		root := filepath.Join(baseDir, filepath.FromSlash(file))
+		for filepath.Dir(root) != filepath.Clean(baseDir) {
+			root = filepath.Dir(root)
+		}
+		require.NoError(t, filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Chtimes(path, modTime, modTime)
+		}))
+	}
+}
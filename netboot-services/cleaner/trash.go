@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// trashDirectoryName is the hidden folder of a channel the evicted images are moved to. It is on the same filesystem,
+	// so moving and restoring an image is a rename, and it is hidden, so neither the menus nor the syncer see it.
+	trashDirectoryName = ".trash"
+	// trashedAtFilename is written into a trashed image folder and holds the time it was evicted
+	trashedAtFilename = ".trashed-at"
+)
+
+// TrashGracePeriod is how long evicted images stay in the trash before they are purged, 0 deletes them immediately
+var TrashGracePeriod = 7 * 24 * time.Hour
+
+// TrashedImage is an evicted image in the trash of a channel folder
+type TrashedImage struct {
+	FolderPath string
+	Name       string
+	TrashedAt  time.Time
+	SizeBytes  int64
+}
+
+// moveToTrash moves the image folder into the trash of its channel folder. The modification time of the image folder
+// is kept, so a restored image is sorted like before.
+func moveToTrash(folderName string, imageName string, now time.Time) error {
+	imagePath := filepath.Join(folderName, imageName)
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		return err
+	}
+	trashDirectory := filepath.Join(folderName, trashDirectoryName)
+	if err := os.MkdirAll(trashDirectory, 0755); err != nil {
+		return err
+	}
+	// An image evicted before with the same name is replaced
+	trashPath := filepath.Join(trashDirectory, imageName)
+	if err := os.RemoveAll(trashPath); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(imagePath, trashedAtFilename), []byte(now.UTC().Format(time.RFC3339)+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := os.Chtimes(imagePath, info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+	log.Infof("Moving image %s to the trash", imagePath)
+	return os.Rename(imagePath, trashPath)
+}
+
+// listTrash returns the trashed images of the folder, the longest trashed first
+func listTrash(folderName string) []TrashedImage {
+	trashDirectory := filepath.Join(folderName, trashDirectoryName)
+	entries, err := os.ReadDir(trashDirectory)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Errorf("Error reading trash %s: %s", trashDirectory, err)
+		}
+		return nil
+	}
+
+	var images []TrashedImage
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		imagePath := filepath.Join(trashDirectory, entry.Name())
+		image := TrashedImage{FolderPath: folderName, Name: entry.Name(), SizeBytes: getFolderSizeInBytes(imagePath)}
+		// Without a readable time the image was trashed by a crashed run, the folder time is the best guess
+		content, err := os.ReadFile(filepath.Join(imagePath, trashedAtFilename))
+		if err == nil {
+			image.TrashedAt, err = time.Parse(time.RFC3339, strings.TrimSpace(string(content)))
+		}
+		if err != nil {
+			if info, infoErr := entry.Info(); infoErr == nil {
+				image.TrashedAt = info.ModTime()
+			}
+		}
+		images = append(images, image)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].TrashedAt.Before(images[j].TrashedAt) })
+	return images
+}
+
+// purgeTrash deletes the trashed images whose grace period is over. While the disk usage is above the high watermark,
+// the longest trashed images are deleted as well, before any image is evicted. It returns the purged bytes.
+func purgeTrash(folders []folderProperties, watermarks Watermarks, now time.Time, dryRun bool) int64 {
+	var trash []TrashedImage
+	for _, folder := range folders {
+		trash = append(trash, listTrash(folder.FolderPath)...)
+	}
+	if len(trash) == 0 {
+		return 0
+	}
+	sort.SliceStable(trash, func(i, j int) bool { return trash[i].TrashedAt.Before(trash[j].TrashedAt) })
+
+	var reclaimBytes int64
+	_, usedSpace, totalSpace, err := diskSpaceUsage(diskUsagePath(folders))
+	if err != nil {
+		log.Errorf("Error calculating disk space usage: %s", err)
+	} else {
+		reclaimBytes = watermarks.bytesToReclaim(usedSpace, totalSpace)
+	}
+
+	var purgedBytes int64
+	for _, image := range trash {
+		fields := log.Fields{
+			"channel":   filepath.Base(image.FolderPath),
+			"image":     image.Name,
+			"trashedAt": image.TrashedAt.Format(time.RFC3339),
+			"sizeInGiB": fmt.Sprintf("%.2f", bytesToGiB(float64(image.SizeBytes))),
+		}
+		event := AuditEvent{Action: auditActionPurged, Channel: filepath.Base(image.FolderPath), Image: image.Name, SizeBytes: image.SizeBytes}
+		switch {
+		case now.Sub(image.TrashedAt) >= TrashGracePeriod:
+			event.Rule, event.Reason = ruleTrashGracePeriod, fmt.Sprintf("in the trash for more than %s", TrashGracePeriod)
+		case reclaimBytes > purgedBytes:
+			event.Rule, event.Reason = ruleDiskWatermark, "disk usage is above the high watermark"
+		default:
+			continue
+		}
+		fields["reason"] = event.Reason
+		if dryRun {
+			log.WithFields(fields).Info("Would purge image from the trash")
+			continue
+		}
+		log.WithFields(fields).Info("Purging image from the trash")
+		err := audit.Track(event, image.FolderPath, func() error {
+			return os.RemoveAll(filepath.Join(image.FolderPath, trashDirectoryName, image.Name))
+		})
+		if err != nil {
+			log.Errorf("Error purging image %s: %s", image.Name, err)
+			continue
+		}
+		purgedBytes += image.SizeBytes
+	}
+	return purgedBytes
+}
+
+// restoreImage moves a trashed image back into its channel folder. If the image is in the trash of several folders,
+// the channel has to be given.
+func restoreImage(folders []folderProperties, imageName string, channel string) (string, error) {
+	var matches []string
+	for _, folder := range folders {
+		if channel != "" && filepath.Base(folder.FolderPath) != channel {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(folder.FolderPath, trashDirectoryName, imageName)); err == nil {
+			matches = append(matches, folder.FolderPath)
+		}
+	}
+	switch {
+	case len(matches) == 0:
+		return "", fmt.Errorf("image %s is not in the trash", imageName)
+	case len(matches) > 1:
+		return "", fmt.Errorf("image %s is in the trash of several folders, choose one with --channel", imageName)
+	}
+
+	folderName := matches[0]
+	imagePath := filepath.Join(folderName, imageName)
+	if _, err := os.Stat(imagePath); err == nil {
+		return "", fmt.Errorf("image %s already exists in %s", imageName, folderName)
+	}
+	trashPath := filepath.Join(folderName, trashDirectoryName, imageName)
+	info, err := os.Stat(trashPath)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Remove(filepath.Join(trashPath, trashedAtFilename)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	if err := os.Chtimes(trashPath, info.ModTime(), info.ModTime()); err != nil {
+		return "", err
+	}
+	if err := os.Rename(trashPath, imagePath); err != nil {
+		return "", err
+	}
+	return imagePath, nil
+}
+
+// runRestoreCommand moves a trashed image back, so the next menu build lists it again
+func runRestoreCommand(args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	channel := flags.String("channel", "", "Folder of the image, e.g. dev or prod, if it is in the trash of several folders")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: restore [--channel dev|prod] <image>")
+	}
+
+	imagePath, err := restoreImage([]folderProperties{propertiesDev, propertiesProd}, flags.Arg(0), *channel)
+	if err != nil {
+		return err
+	}
+	// The image could be evicted again by the next run, which does not change the rules
+	_, err = fmt.Fprintf(w, "Restored %s, pin or tag it to keep it from being evicted again\n", imagePath)
+	return err
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMoveToTrashAndRestore(t *testing.T) {
+	// Arrange
+	root := t.TempDir()
+	devDir, prodDir := filepath.Join(root, "dev"), filepath.Join(root, "prod")
+	createTestImageFolder(t, devDir, "image1", -2)
+	createTestImageFolder(t, prodDir, "image2", -1)
+	info, err := os.Stat(filepath.Join(devDir, "image1"))
+	require.NoError(t, err)
+	now := time.Now()
+
+	// Act
+	err = moveToTrash(devDir, "image1", now)
+	require.NoError(t, err)
+	trash := listTrash(devDir)
+	_, restoreMissingErr := restoreImage([]folderProperties{{FolderPath: devDir}, {FolderPath: prodDir}}, "image2", "")
+	imagePath, err := restoreImage([]folderProperties{{FolderPath: devDir}, {FolderPath: prodDir}}, "image1", "")
+	require.NoError(t, err)
+
+	// Assert
+	require.Len(t, trash, 1)
+	assert.Equal(t, "image1", trash[0].Name)
+	assert.Equal(t, now.UTC().Truncate(time.Second), trash[0].TrashedAt.UTC())
+	assert.Equal(t, int64(4+len(now.UTC().Format(time.RFC3339))+1), trash[0].SizeBytes)
+	assert.Error(t, restoreMissingErr)
+	assert.Equal(t, filepath.Join(devDir, "image1"), imagePath)
+	restored, err := os.Stat(imagePath)
+	require.NoError(t, err)
+	assert.Equal(t, info.ModTime(), restored.ModTime(), "the image is sorted like before")
+	assert.NoFileExists(t, filepath.Join(imagePath, trashedAtFilename))
+	assert.Empty(t, listTrash(devDir))
+}
+
+func TestGetFolderSizeInBytesSkipsTrash(t *testing.T) {
+	// Arrange
+	tempDir := t.TempDir()
+	createTestImageFolder(t, tempDir, "image1", 1)
+	createTestImageFolder(t, tempDir, "image2", 2)
+	require.NoError(t, moveToTrash(tempDir, "image2", time.Now()))
+
+	// Act
+	size := getFolderSizeInBytes(tempDir)
+
+	// Assert
+	assert.Equal(t, int64(4), size)
+}
+
+func TestPurgeTrash(t *testing.T) {
+	// Arrange
+	tempDir := t.TempDir()
+	now := time.Now()
+	for i, imageName := range []string{"expired", "oldest", "newest"} {
+		createTestImageFolder(t, tempDir, imageName, i)
+	}
+	require.NoError(t, moveToTrash(tempDir, "expired", now.Add(-8*24*time.Hour)))
+	require.NoError(t, moveToTrash(tempDir, "oldest", now.Add(-2*time.Hour)))
+	require.NoError(t, moveToTrash(tempDir, "newest", now.Add(-1*time.Hour)))
+	folders := []folderProperties{{FolderPath: tempDir}}
+	previousDiskSpaceUsage, previousGracePeriod := diskSpaceUsage, TrashGracePeriod
+	t.Cleanup(func() { diskSpaceUsage, TrashGracePeriod = previousDiskSpaceUsage, previousGracePeriod })
+	TrashGracePeriod = 7 * 24 * time.Hour
+	usedSpace := 80.0
+	diskSpaceUsage = func(path string) (float64, float64, float64, error) { return 100 - usedSpace, usedSpace, 100, nil }
+	watermarks := Watermarks{HighPercent: 90, LowPercent: 85, Priority: []string{filepath.Base(tempDir)}}
+
+	// Act
+	dryRunBytes := purgeTrash(folders, watermarks, now, true)
+	afterDryRun := len(listTrash(tempDir))
+	purgedByGracePeriod := purgeTrash(folders, watermarks, now, false)
+	afterGracePeriod := listTrash(tempDir)
+	usedSpace = 95
+	purgedByPressure := purgeTrash(folders, watermarks, now, false)
+	afterPressure := listTrash(tempDir)
+
+	// Assert
+	assert.Equal(t, int64(0), dryRunBytes)
+	assert.Equal(t, 3, afterDryRun)
+	assert.Greater(t, purgedByGracePeriod, int64(0))
+	require.Len(t, afterGracePeriod, 2)
+	assert.Equal(t, "oldest", afterGracePeriod[0].Name)
+	// 10 bytes have to be freed, the longest trashed image is enough
+	assert.Greater(t, purgedByPressure, int64(10))
+	require.Len(t, afterPressure, 1)
+	assert.Equal(t, "newest", afterPressure[0].Name)
+}
+
+func TestPurgeTrashWithoutDevFolder(t *testing.T) {
+	// Arrange
+	root := t.TempDir()
+	devDir, prodDir := filepath.Join(root, "dev"), filepath.Join(root, "prod")
+	now := time.Now()
+	createTestImageFolder(t, prodDir, "image1", 1)
+	require.NoError(t, moveToTrash(prodDir, "image1", now.Add(-time.Hour)))
+	folders := []folderProperties{{FolderPath: devDir}, {FolderPath: prodDir}}
+	previousDiskSpaceUsage := diskSpaceUsage
+	t.Cleanup(func() { diskSpaceUsage = previousDiskSpaceUsage })
+	diskSpaceUsage = func(path string) (float64, float64, float64, error) {
+		if _, err := os.Stat(path); err != nil {
+			return 0, 0, 0, err
+		}
+		return 5, 95, 100, nil
+	}
+
+	// Act
+	purgedBytes := purgeTrash(folders, Watermarks{HighPercent: 90, LowPercent: 85, Priority: []string{"dev", "prod"}}, now, false)
+
+	// Assert
+	assert.Greater(t, purgedBytes, int64(0))
+	assert.Empty(t, listTrash(prodDir))
+}
+
+func TestRunRestoreCommand(t *testing.T) {
+	// Arrange
+	devDir, prodDir := t.TempDir(), t.TempDir()
+	createTestImageFolder(t, devDir, "24-08-29-master-a46edbc", 1)
+	createTestImageFolder(t, prodDir, "24-08-29-master-a46edbc", 1)
+	require.NoError(t, moveToTrash(devDir, "24-08-29-master-a46edbc", time.Now()))
+	require.NoError(t, moveToTrash(prodDir, "24-08-29-master-a46edbc", time.Now()))
+	previousDev, previousProd := propertiesDev, propertiesProd
+	t.Cleanup(func() { propertiesDev, propertiesProd = previousDev, previousProd })
+	propertiesDev = folderProperties{FolderPath: devDir}
+	propertiesProd = folderProperties{FolderPath: prodDir}
+
+	// Act
+	output := &bytes.Buffer{}
+	ambiguousErr := runRestoreCommand([]string{"24-08-29-master-a46edbc"}, output)
+	err := runRestoreCommand([]string{"--channel", filepath.Base(prodDir), "24-08-29-master-a46edbc"}, output)
+
+	// Assert
+	require.Error(t, ambiguousErr)
+	assert.Contains(t, ambiguousErr.Error(), "--channel")
+	require.NoError(t, err)
+	assert.Contains(t, output.String(), "Restored "+filepath.Join(prodDir, "24-08-29-master-a46edbc"))
+	assert.DirExists(t, filepath.Join(prodDir, "24-08-29-master-a46edbc"))
+	assert.Len(t, listTrash(devDir), 1)
+}
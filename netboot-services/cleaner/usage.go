@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	evictionOrderOldest            = "oldest"
+	evictionOrderLeastRecentlyUsed = "least-recently-used"
+
+	// usageStateFilename holds the last access per image folder, it is kept in the state folder of the cleaner
+	usageStateFilename = "usage.json"
+)
+
+var (
+	// EvictionOrder is oldest or least-recently-used
+	EvictionOrder = evictionOrderOldest
+	// UsageFilePath is the usage file of the asset server, it maps the served files to their last access
+	UsageFilePath = "/cleaning/.netboot-usage.json"
+	// AccessLogPath is optional, it is read instead of or in addition to the usage file
+	AccessLogPath = ""
+)
+
+// nginxAccessLogPattern matches the time, request path and status of the combined log format of the nginx container
+var nginxAccessLogPattern = regexp.MustCompile(`\[([^\]]+)\] "(?:GET|HEAD) ([^ "]+)[^"]*" (\d{3}) `)
+
+// usageState is persisted between the runs, so the usage survives restarts of the cleaner and the asset server as well
+// as rotated access logs
+type usageState struct {
+	// LastAccess is keyed by [channel]/[image folder]
+	LastAccess map[string]time.Time `json:"lastAccess"`
+	// AccessLogOffset is the position in the access log up to which it was read
+	AccessLogOffset int64 `json:"accessLogOffset"`
+}
+
+// updateImageUsage merges the usage file of the asset server and the new lines of the access log into the usage per
+// image folder. Images which neither exist in their channel folder nor in its trash are dropped. If persist is set,
+// the usage is written to the state folder in the assets directory.
+func updateImageUsage(assetsDirectory string, persist bool) map[string]time.Time {
+	statePath := filepath.Join(assetsDirectory, stateDirectoryName, usageStateFilename)
+	state := usageState{LastAccess: map[string]time.Time{}}
+	if content, err := os.ReadFile(statePath); err == nil {
+		if err := json.Unmarshal(content, &state); err != nil {
+			log.Warnf("Could not parse the usage state %s, starting over: %s", statePath, err)
+		}
+		if state.LastAccess == nil {
+			state.LastAccess = map[string]time.Time{}
+		}
+	}
+
+	if UsageFilePath != "" {
+		if err := readUsageFile(UsageFilePath, state.LastAccess); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Errorf("Error reading the usage file %s: %s", UsageFilePath, err)
+		}
+	}
+	if AccessLogPath != "" {
+		offset, err := readAccessLog(AccessLogPath, state.AccessLogOffset, state.LastAccess)
+		if err != nil {
+			log.Errorf("Error reading the access log %s: %s", AccessLogPath, err)
+		} else {
+			state.AccessLogOffset = offset
+		}
+	}
+
+	for image := range state.LastAccess {
+		channel, imageName, _ := strings.Cut(image, "/")
+		_, err := os.Stat(filepath.Join(assetsDirectory, channel, imageName))
+		_, trashErr := os.Stat(filepath.Join(assetsDirectory, channel, trashDirectoryName, imageName))
+		if errors.Is(err, os.ErrNotExist) && errors.Is(trashErr, os.ErrNotExist) {
+			delete(state.LastAccess, image)
+		}
+	}
+
+	if persist {
+		if err := writeState(statePath, state); err != nil {
+			log.Errorf("Error writing the usage state: %s", err)
+		}
+	}
+	return state.LastAccess
+}
+
+// readUsageFile merges the usage file of the asset server, which is keyed by the asset path, into the usage per image
+func readUsageFile(usagePath string, lastAccess map[string]time.Time) error {
+	content, err := os.ReadFile(usagePath)
+	if err != nil {
+		return err
+	}
+	var usage struct {
+		LastAccess map[string]time.Time `json:"lastAccess"`
+	}
+	if err := json.Unmarshal(content, &usage); err != nil {
+		return err
+	}
+	for assetPath, accessTime := range usage.LastAccess {
+		recordAccess(lastAccess, assetPath, accessTime)
+	}
+	return nil
+}
+
+// readAccessLog merges the successful requests of the access log from the offset on and returns the new offset. It
+// reads the JSON access log of the asset server as well as the combined log format of nginx. A log which is shorter
+// than the offset was rotated and is read from the start.
+func readAccessLog(accessLogPath string, offset int64, lastAccess map[string]time.Time) (int64, error) {
+	file, err := os.Open(accessLogPath)
+	if err != nil {
+		return offset, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return offset, err
+	}
+	if info.Size() < offset {
+		offset = 0
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		// An incomplete last line is read again in the next run
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return offset, nil
+			}
+			return offset, err
+		}
+		offset += int64(len(line))
+		if assetPath, accessTime, ok := parseAccessLogLine(line); ok {
+			recordAccess(lastAccess, assetPath, accessTime)
+		}
+	}
+}
+
+// parseAccessLogLine returns the asset path and the time of a successful request
+func parseAccessLogLine(line string) (string, time.Time, bool) {
+	if strings.HasPrefix(strings.TrimSpace(line), "{") {
+		var entry struct {
+			Type   string    `json:"type"`
+			Path   string    `json:"path"`
+			Status int       `json:"status"`
+			Time   time.Time `json:"time"`
+		}
+		if json.Unmarshal([]byte(line), &entry) != nil || entry.Type != "access" {
+			return "", time.Time{}, false
+		}
+		return entry.Path, entry.Time, entry.Status == 200 || entry.Status == 206
+	}
+
+	match := nginxAccessLogPattern.FindStringSubmatch(line)
+	if match == nil || (match[3] != "200" && match[3] != "206") {
+		return "", time.Time{}, false
+	}
+	accessTime, err := time.Parse("02/Jan/2006:15:04:05 -0700", match[1])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	assetPath, _, _ := strings.Cut(match[2], "?")
+	return strings.TrimPrefix(assetPath, "/"), accessTime, true
+}
+
+// recordAccess records the access of a file of an image folder, [channel]/[image folder]/[file], for its image
+func recordAccess(lastAccess map[string]time.Time, assetPath string, accessTime time.Time) {
+	segments := strings.Split(assetPath, "/")
+	if len(segments) < 3 || segments[0] == kernelsChannel || strings.HasPrefix(segments[0], ".") || strings.HasPrefix(segments[1], ".") {
+		return
+	}
+	image := segments[0] + "/" + segments[1]
+	if accessTime.After(lastAccess[image]) {
+		lastAccess[image] = accessTime.UTC()
+	}
+}
+
+// applyImageUsage sets the last access of the indexed images if the least recently used images are evicted first
+func applyImageUsage(indexes []*FolderIndex, persist bool) {
+	if EvictionOrder != evictionOrderLeastRecentlyUsed {
+		return
+	}
+	lastAccess := updateImageUsage(AssetsDirectory, persist)
+	for _, index := range indexes {
+		index.applyUsage(lastAccess)
+	}
+}
+
+// applyUsage sets the last access of the indexed images
+func (index *FolderIndex) applyUsage(lastAccess map[string]time.Time) {
+	channel := filepath.Base(index.FolderPath)
+	for i := range index.Images {
+		index.Images[i].LastAccess = lastAccess[channel+"/"+index.Images[i].Name]
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAccessLogLine(t *testing.T) {
+	tests := []struct {
+		name         string
+		line         string
+		expectedPath string
+		expectedTime time.Time
+		expectedOK   bool
+	}{
+		{
+			name:         "Asset server",
+			line:         `{"type":"access","path":"prod/24-08-29-master-a46edbc/vmlinuz","status":200,"time":"2024-08-30T07:12:03Z","msg":"request"}`,
+			expectedPath: "prod/24-08-29-master-a46edbc/vmlinuz",
+			expectedTime: time.Date(2024, 8, 30, 7, 12, 3, 0, time.UTC),
+			expectedOK:   true,
+		},
+		{
+			name: "Asset server not found",
+			line: `{"type":"access","path":"prod/24-08-29-master-a46edbc/vmlinuz","status":404,"time":"2024-08-30T07:12:03Z"}`,
+		},
+		{
+			name: "Other log line",
+			line: `{"level":"info","msg":"Serving /assets on :80","time":"2024-08-30T07:12:03Z"}`,
+		},
+		{
+			name:         "nginx",
+			line:         `10.0.0.17 - - [30/Aug/2024:09:12:03 +0200] "GET /dev/24-08-29-master-a46edbc/image.squashfs HTTP/1.1" 206 1048576 "-" "curl/8.0"`,
+			expectedPath: "dev/24-08-29-master-a46edbc/image.squashfs",
+			expectedTime: time.Date(2024, 8, 30, 7, 12, 3, 0, time.UTC),
+			expectedOK:   true,
+		},
+		{
+			name: "nginx not found",
+			line: `10.0.0.17 - - [30/Aug/2024:09:12:03 +0200] "GET /dev/missing/vmlinuz HTTP/1.1" 404 153 "-" "iPXE/1.21.1"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			assetPath, accessTime, ok := parseAccessLogLine(test.line)
+
+			// Assert
+			assert.Equal(t, test.expectedOK, ok)
+			if test.expectedOK {
+				assert.Equal(t, test.expectedPath, assetPath)
+				assert.True(t, test.expectedTime.Equal(accessTime))
+			}
+		})
+	}
+}
+
+func TestUpdateImageUsage(t *testing.T) {
+	// Arrange
+	assetsDir := t.TempDir()
+	createTestImageFolder(t, filepath.Join(assetsDir, "prod"), "24-08-29-master-a46edbc", 1)
+	createTestImageFolder(t, filepath.Join(assetsDir, "prod"), "24-08-30-master-b57fecd", 1)
+	createTestImageFolder(t, filepath.Join(assetsDir, "dev"), "24-08-31-master-c68fedc", 1)
+	require.NoError(t, os.WriteFile(filepath.Join(assetsDir, ".netboot-usage.json"), []byte(`{"lastAccess": {
+		"prod/24-08-29-master-a46edbc/vmlinuz": "2024-08-30T07:00:00Z",
+		"prod/24-08-29-master-a46edbc/image.squashfs": "2024-08-30T07:01:00Z",
+		"prod/24-08-01-master-deleted/vmlinuz": "2024-08-02T07:00:00Z",
+		"kernels/6.8.0-40-generic/vmlinuz": "2024-08-30T07:00:00Z"}}`), 0644))
+	accessLog := filepath.Join(assetsDir, "access.log")
+	require.NoError(t, os.WriteFile(accessLog, []byte(
+		`10.0.0.17 - - [30/Aug/2024:10:00:00 +0000] "GET /prod/24-08-30-master-b57fecd/vmlinuz HTTP/1.1" 200 4 "-" "iPXE/1.21.1"`+"\n"), 0644))
+	previousUsageFile, previousAccessLog := UsageFilePath, AccessLogPath
+	t.Cleanup(func() { UsageFilePath, AccessLogPath = previousUsageFile, previousAccessLog })
+	UsageFilePath = filepath.Join(assetsDir, ".netboot-usage.json")
+	AccessLogPath = accessLog
+
+	// Act
+	firstRun := updateImageUsage(assetsDir, true)
+	// The access log is rotated and the usage file of the asset server is gone
+	require.NoError(t, os.WriteFile(accessLog, []byte(
+		`10.0.0.17 - - [31/Aug/2024:10:00:00 +0000] "GET /dev/24-08-31-master-c68fedc/initrd HTTP/1.1" 200 4 "-" "iPXE/1.21.1"`+"\n"), 0644))
+	require.NoError(t, os.Remove(UsageFilePath))
+	secondRun := updateImageUsage(assetsDir, true)
+
+	// Assert
+	assert.Equal(t, map[string]time.Time{
+		"prod/24-08-29-master-a46edbc": time.Date(2024, 8, 30, 7, 1, 0, 0, time.UTC),
+		"prod/24-08-30-master-b57fecd": time.Date(2024, 8, 30, 10, 0, 0, 0, time.UTC),
+	}, firstRun)
+	assert.Len(t, secondRun, 3, "the usage is persisted")
+	assert.Equal(t, time.Date(2024, 8, 31, 10, 0, 0, 0, time.UTC), secondRun["dev/24-08-31-master-c68fedc"])
+}
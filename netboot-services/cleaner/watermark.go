@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// diskSpaceUsage is replaced in tests
+var diskSpaceUsage = calculateDiskSpaceUsage
+
+// Watermarks evict images across the folders once the disk usage of the filesystem of the folders rises above
+// HighPercent, until it is back at LowPercent. The folders are cleaned in the order of Priority, folders which are not
+// listed are never cleaned for the watermarks. A HighPercent of 0 disables the watermarks.
+type Watermarks struct {
+	HighPercent float64
+	LowPercent  float64
+	Priority    []string
+}
+
+// loadWatermarks reads DISK_USAGE_HIGH_WATERMARK_PERCENT, DISK_USAGE_LOW_WATERMARK_PERCENT and EVICTION_PRIORITY
+func loadWatermarks(high string, low string, priority string) (Watermarks, error) {
+	watermarks := Watermarks{Priority: []string{"dev", "prod"}}
+	var err error
+	if high != "" {
+		if watermarks.HighPercent, err = strconv.ParseFloat(high, 64); err != nil || watermarks.HighPercent < 0 || watermarks.HighPercent > 100 {
+			return watermarks, fmt.Errorf("invalid DISK_USAGE_HIGH_WATERMARK_PERCENT %s", high)
+		}
+	}
+	watermarks.LowPercent = watermarks.HighPercent
+	if low != "" {
+		if watermarks.LowPercent, err = strconv.ParseFloat(low, 64); err != nil || watermarks.LowPercent < 0 || watermarks.LowPercent > watermarks.HighPercent {
+			return watermarks, fmt.Errorf("invalid DISK_USAGE_LOW_WATERMARK_PERCENT %s, it must be below the high watermark", low)
+		}
+	}
+	if priority != "" {
+		watermarks.Priority = nil
+		for _, channel := range strings.Split(priority, ",") {
+			if channel = strings.TrimSpace(channel); channel != "" {
+				watermarks.Priority = append(watermarks.Priority, channel)
+			}
+		}
+	}
+	return watermarks, nil
+}
+
+// diskUsagePath returns the folder the disk usage is measured on, the first existing channel folder or the assets
+// directory. Servers which only sync prod have no dev folder.
+func diskUsagePath(folders []folderProperties) string {
+	for _, folder := range folders {
+		if _, err := os.Stat(folder.FolderPath); err == nil {
+			return folder.FolderPath
+		}
+	}
+	return AssetsDirectory
+}
+
+// bytesToReclaim returns the bytes to free to get the usage down to the low watermark, if it is above the high watermark
+func (w Watermarks) bytesToReclaim(usedSpace float64, totalSpace float64) int64 {
+	if w.HighPercent <= 0 || totalSpace <= 0 || usedSpace/totalSpace*100 <= w.HighPercent {
+		return 0
+	}
+	return int64(usedSpace - w.LowPercent/100*totalSpace)
+}
+
+// folderOrder returns the indexes of the folders in the order of the eviction priority, followed by the other folders
+func (w Watermarks) folderOrder(folders []folderProperties) []int {
+	var order []int
+	added := map[int]bool{}
+	for _, channel := range w.Priority {
+		for i, folder := range folders {
+			if filepath.Base(folder.FolderPath) == channel && !added[i] {
+				order = append(order, i)
+				added[i] = true
+			}
+		}
+	}
+	for i := range folders {
+		if !added[i] {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+func (w Watermarks) hasPriority(folder folderProperties) bool {
+	for _, channel := range w.Priority {
+		if filepath.Base(folder.FolderPath) == channel {
+			return true
+		}
+	}
+	return false
+}
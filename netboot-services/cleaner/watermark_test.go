@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBytesToReclaim(t *testing.T) {
+	tests := []struct {
+		name       string
+		watermarks Watermarks
+		usedSpace  float64
+		expected   int64
+	}{
+		{"disabled", Watermarks{}, 99, 0},
+		{"below high watermark", Watermarks{HighPercent: 90, LowPercent: 80}, 85, 0},
+		{"at high watermark", Watermarks{HighPercent: 90, LowPercent: 80}, 90, 0},
+		{"above high watermark", Watermarks{HighPercent: 90, LowPercent: 80}, 95, 15},
+		{"low equals high", Watermarks{HighPercent: 90, LowPercent: 90}, 95, 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			reclaimBytes := test.watermarks.bytesToReclaim(test.usedSpace, 100)
+
+			// Assert
+			assert.Equal(t, test.expected, reclaimBytes)
+		})
+	}
+}
+
+func TestLoadWatermarks(t *testing.T) {
+	// Act
+	watermarks, err := loadWatermarks("90", "80", "prod, dev")
+	require.NoError(t, err)
+	_, err = loadWatermarks("80", "90", "")
+
+	// Assert
+	assert.Error(t, err)
+	assert.Equal(t, Watermarks{HighPercent: 90, LowPercent: 80, Priority: []string{"prod", "dev"}}, watermarks)
+}
+
+func TestPlanCleanupWatermarks(t *testing.T) {
+	// Arrange
+	setTestMenusDirectory(t)
+	root := t.TempDir()
+	devDir, prodDir := root+"/dev", root+"/prod"
+	for _, folder := range []string{devDir, prodDir} {
+		createTestImageFolder(t, folder, "image1", 1)
+		createTestImageFolder(t, folder, "image2", 2)
+		createTestImageFolder(t, folder, "image3", 3)
+	}
+	folders := []folderProperties{
+		{FolderPath: devDir, MinImagesCount: 1},
+		{FolderPath: prodDir, MinImagesCount: 1},
+	}
+	previousDiskSpaceUsage := diskSpaceUsage
+	t.Cleanup(func() { diskSpaceUsage = previousDiskSpaceUsage })
+	// 10 bytes have to be freed to get from 95% down to 85%, every test image has 4 bytes
+	diskSpaceUsage = func(path string) (float64, float64, float64, error) { return 5, 95, 100, nil }
+	now := time.Now()
+
+	// Act
+	devFirst := planCleanup(folders, indexFolders(folders), Watermarks{HighPercent: 90, LowPercent: 85, Priority: []string{"dev", "prod"}}, now)
+	prodOnly := planCleanup(folders, indexFolders(folders), Watermarks{HighPercent: 90, LowPercent: 85, Priority: []string{"prod"}}, now)
+
+	// Assert
+	require.Len(t, devFirst, 2)
+	assert.Equal(t, int64(10), devFirst[0].ReclaimTargetBytes)
+	assert.Equal(t, int64(8), devFirst[0].ReclaimedBytes, "dev keeps its minimum of one image")
+	assert.Equal(t, ruleMinImages, devFirst[0].Images[2].Rule)
+	assert.Equal(t, int64(2), devFirst[1].ReclaimTargetBytes)
+	assert.Equal(t, int64(4), devFirst[1].ReclaimedBytes)
+	assert.Equal(t, ruleDiskWatermark, devFirst[1].Images[0].Rule)
+	assert.Equal(t, "image1", devFirst[1].Images[0].Name)
+
+	require.Len(t, prodOnly, 2)
+	assert.Equal(t, int64(0), prodOnly[0].ReclaimedBytes)
+	assert.Equal(t, int64(8), prodOnly[1].ReclaimedBytes)
+	assert.Len(t, indexFolder(devDir).Images, 3, "planning deletes nothing")
+}
+
+func TestPlanCleanupWatermarksWithoutDevFolder(t *testing.T) {
+	// Arrange
+	setTestMenusDirectory(t)
+	root := t.TempDir()
+	devDir, prodDir := filepath.Join(root, "dev"), filepath.Join(root, "prod")
+	createTestImageFolder(t, prodDir, "image1", 1)
+	createTestImageFolder(t, prodDir, "image2", 2)
+	folders := []folderProperties{
+		{FolderPath: devDir, MinImagesCount: 1},
+		{FolderPath: prodDir, MinImagesCount: 1},
+	}
+	previousDiskSpaceUsage := diskSpaceUsage
+	t.Cleanup(func() { diskSpaceUsage = previousDiskSpaceUsage })
+	diskSpaceUsage = func(path string) (float64, float64, float64, error) {
+		if _, err := os.Stat(path); err != nil {
+			return 0, 0, 0, err
+		}
+		return 5, 95, 100, nil
+	}
+
+	// Act
+	plans := planCleanup(folders, indexFolders(folders), Watermarks{HighPercent: 90, LowPercent: 85, Priority: []string{"dev", "prod"}}, time.Now())
+
+	// Assert
+	require.Len(t, plans, 2)
+	assert.Equal(t, int64(10), plans[1].ReclaimTargetBytes)
+	assert.Equal(t, int64(4), plans[1].ReclaimedBytes)
+	assert.Equal(t, ruleDiskWatermark, plans[1].Images[0].Rule)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultArchitecture is assumed for images that neither ship a kernel sidecar with an architecture nor use an architecture subfolder.
+const DefaultArchitecture = "x86_64"
+
+// architectureAliases maps the names used by distributions and build pipelines to the values iPXE reports in ${buildarch}.
+var architectureAliases = map[string]string{
+	"x86_64":  "x86_64",
+	"amd64":   "x86_64",
+	"x64":     "x86_64",
+	"i386":    "i386",
+	"i686":    "i386",
+	"x86":     "i386",
+	"arm64":   "arm64",
+	"aarch64": "arm64",
+}
+
+// KernelSidecar is the content of the [image]-kernel.json file that is published next to each squashfs.
+type KernelSidecar struct {
+	KernelVersion string `json:"kernelVersion"`
+	Architecture  string `json:"architecture"`
+	// Cmdline holds additional kernel parameters keyed by the iPXE ${platform} (pcbios, efi)
+	Cmdline map[string]string `json:"cmdline"`
+}
+
+// normalizeArchitecture returns the iPXE ${buildarch} name for the given architecture, or an empty string if it is unknown.
+func normalizeArchitecture(architecture string) string {
+	return architectureAliases[strings.ToLower(strings.TrimSpace(architecture))]
+}
+
+// readKernelSidecar reads the first *kernel.json file found in the given folder. It returns nil if there is none.
+func readKernelSidecar(folderPath string) (*KernelSidecar, error) {
+	files, err := os.ReadDir(folderPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), "kernel.json") {
+			continue
+		}
+		content, err := os.ReadFile(fmt.Sprintf("%s/%s", folderPath, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var sidecar KernelSidecar
+		err = json.Unmarshal(content, &sidecar)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse kernel sidecar %s/%s: %w", folderPath, file.Name(), err)
+		}
+		return &sidecar, nil
+	}
+	return nil, nil
+}
+
+// applyKernelSidecar sets the architecture and the platform specific kernel parameters of the image based on its kernel sidecar.
+// Images without a (valid) architecture keep the one derived from the folder layout, or DefaultArchitecture.
+func applyKernelSidecar(image *SquashfsPaths, folderPath string) {
+	sidecar, err := readKernelSidecar(folderPath)
+	if err != nil {
+		log.Warn(err)
+	}
+	applySidecar(image, sidecar, folderPath)
+}
+
+// applySidecar applies the kernel sidecar read from folderPath, which can be nil
+func applySidecar(image *SquashfsPaths, sidecar *KernelSidecar, folderPath string) {
+	if sidecar != nil {
+		if sidecar.Architecture != "" {
+			architecture := normalizeArchitecture(sidecar.Architecture)
+			if architecture == "" {
+				log.Warnf("Unknown architecture %q in kernel sidecar of %s", sidecar.Architecture, folderPath)
+			} else if image.Architecture != "" && image.Architecture != architecture {
+				log.Warnf("Kernel sidecar of %s declares %s but the image is located in the %s folder, using %s", folderPath, architecture, image.ArchFolder, image.Architecture)
+			} else {
+				image.Architecture = architecture
+			}
+		}
+		image.PcbiosCmdline = sidecar.Cmdline["pcbios"]
+		image.EfiCmdline = sidecar.Cmdline["efi"]
+	}
+
+	if image.Architecture == "" {
+		image.Architecture = DefaultArchitecture
+	}
+}
+
+// withDefaults fills the fields of the image that are derived from the others, so the templates do not need to distinguish between the folder layouts.
+func (s SquashfsPaths) withDefaults() SquashfsPaths {
+	if s.Architecture == "" {
+		s.Architecture = DefaultArchitecture
+	}
+	s.ImagePath = s.SquashfsFoldername
+	if s.ArchFolder != "" {
+		s.ImagePath = fmt.Sprintf("%s/%s", s.SquashfsFoldername, s.ArchFolder)
+	}
+	return s
+}
+
+func imagesWithDefaults(images []SquashfsPaths) []SquashfsPaths {
+	result := []SquashfsPaths{}
+	for _, image := range images {
+		result = append(result, image.withDefaults())
+	}
+	return result
+}
+
+// getMostRecentImagePerArchitecture returns the first image of every architecture. The images are expected to be sorted with the newest image first.
+func getMostRecentImagePerArchitecture(images []SquashfsPaths) []SquashfsPaths {
+	seen := map[string]bool{}
+	var mostRecentImages []SquashfsPaths
+	for _, image := range images {
+		image = image.withDefaults()
+		if seen[image.Architecture] {
+			continue
+		}
+		seen[image.Architecture] = true
+		mostRecentImages = append(mostRecentImages, image)
+	}
+	return mostRecentImages
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeArchitecture(t *testing.T) {
+	tests := []struct {
+		architecture   string
+		expectedResult string
+	}{
+		{architecture: "x86_64", expectedResult: "x86_64"},
+		{architecture: "amd64", expectedResult: "x86_64"},
+		{architecture: "AARCH64", expectedResult: "arm64"},
+		{architecture: "i686", expectedResult: "i386"},
+		{architecture: "riscv64", expectedResult: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.architecture, func(t *testing.T) {
+			assert.Equal(t, test.expectedResult, normalizeArchitecture(test.architecture))
+		})
+	}
+}
+
+func TestGetImagesWithArchitectures(t *testing.T) {
+	// Arrange
+	tempDir := t.TempDir()
+
+	// An older image that declares its architecture and platform options in the kernel sidecar
+	sidecarFolder := filepath.Join(tempDir, "24-08-28-master-a46edbc")
+	require.NoError(t, os.Mkdir(sidecarFolder, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(sidecarFolder, "image.squashfs"), []byte("blub"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(sidecarFolder, "24-08-28-master-a46edbc-kernel.json"), []byte(`{"kernelVersion": "6.8.0-40-generic", "architecture": "aarch64", "cmdline": {"efi": "console=ttyAMA0"}}`), 0644))
+	require.NoError(t, os.Chtimes(sidecarFolder, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)))
+
+	// A newer image that ships one build per architecture in subfolders
+	multiArchFolder := filepath.Join(tempDir, "24-08-29-master-b57fecd")
+	for _, architecture := range []string{"x86_64", "arm64"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(multiArchFolder, architecture), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(multiArchFolder, architecture, "image.squashfs"), []byte("blub"), 0644))
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(multiArchFolder, "docs"), 0755))
+
+	// Act
+	images, err := getImages(tempDir)
+
+	// Assert
+	assert.NoError(t, err)
+	require.Len(t, images, 3)
+	assert.Equal(t, "arm64", images[0].Architecture)
+	assert.Equal(t, "24-08-29-master-b57fecd/arm64", images[0].ImagePath)
+	assert.Equal(t, "x86_64", images[1].Architecture)
+	assert.Equal(t, "24-08-29-master-b57fecd/x86_64", images[1].ImagePath)
+	assert.Equal(t, "arm64", images[2].Architecture)
+	assert.Equal(t, "24-08-28-master-a46edbc", images[2].ImagePath)
+	assert.Equal(t, "console=ttyAMA0", images[2].EfiCmdline)
+
+	mostRecent := getMostRecentImagePerArchitecture(images)
+	require.Len(t, mostRecent, 2)
+	assert.Equal(t, "24-08-29-master-b57fecd/arm64", mostRecent[0].ImagePath)
+	assert.Equal(t, "24-08-29-master-b57fecd/x86_64", mostRecent[1].ImagePath)
+}
+
+func TestRenderMenusWithArchitectures(t *testing.T) {
+	// Arrange
+	tempDir := t.TempDir()
+	menusDir := filepath.Join(tempDir, "menus")
+	require.NoError(t, os.Mkdir(menusDir, 0755))
+	for _, template := range []string{"menu.ipxe.j2", "advancedmenu.ipxe.j2"} {
+		content, err := os.ReadFile(template)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(tempDir, template), content, 0644))
+	}
+
+	images := []SquashfsPaths{
+		{SquashfsFilename: "image.squashfs", SquashfsFoldername: "24-08-29-master-b57fecd", ArchFolder: "arm64", Architecture: "arm64", EfiCmdline: "console=ttyAMA0"},
+		{SquashfsFilename: "image.squashfs", SquashfsFoldername: "24-08-29-master-b57fecd", ArchFolder: "x86_64", Architecture: "x86_64"},
+	}
+
+	// Act
+	err := renderMenuIpxe(RenderMenuData{
+		BasicData: RenderBaseData{
+			JinjaTemplateFile: "menu.ipxe.j2",
+			MenusDirectory:    menusDir,
+			WorkingDirectory:  tempDir,
+		},
+		NetbootServerIP: "192.168.1.1",
+	}, images)
+	require.NoError(t, err)
+
+	err = renderAdvancedMenu(RenderAdvancedMenuData{
+		BasicData: RenderBaseData{
+			JinjaTemplateFile: "advancedmenu.ipxe.j2",
+			MenusDirectory:    menusDir,
+			WorkingDirectory:  tempDir,
+		},
+		NetbootServerIP: "192.168.1.1",
+		prodImages:      images,
+	})
+	require.NoError(t, err)
+
+	// Assert
+	menu, err := os.ReadFile(filepath.Join(menusDir, "menu.ipxe"))
+	require.NoError(t, err)
+	assert.Contains(t, string(menu), "goto dg-thinclient-prod-${arch} || goto no_image_for_arch")
+	assert.Contains(t, string(menu), ":dg-thinclient-prod-arm64\nset squash_url ${http-protocol}://${url}/prod/24-08-29-master-b57fecd/arm64/image.squashfs")
+	assert.Contains(t, string(menu), "iseq ${platform} efi && set platform_cmdline console=ttyAMA0 ||")
+	assert.Contains(t, string(menu), ":dg-thinclient-prod-x86_64\nset squash_url ${http-protocol}://${url}/prod/24-08-29-master-b57fecd/x86_64/image.squashfs")
+
+	advancedMenu, err := os.ReadFile(filepath.Join(menusDir, "advancedmenu.ipxe"))
+	require.NoError(t, err)
+	assert.Contains(t, string(advancedMenu), "iseq ${arch} arm64 && item thinclient-24-08-29-master-b57fecd-arm64 ${sp} 24-08-29-master-b57fecd (arm64) ||")
+	assert.Contains(t, string(advancedMenu), ":thinclient-24-08-29-master-b57fecd-x86_64\nset squash_url ${http-protocol}://${url}/prod/24-08-29-master-b57fecd/x86_64/image.squashfs")
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// BootFile is the iPXE binary the DHCP server hands out to the clients of the given architectures (option 93).
+// Clients of the HTTPArchitectures use UEFI HTTP Boot and download the binary from the asset server.
+type BootFile struct {
+	Tag               string
+	Architectures     []uint16
+	HTTPArchitectures []uint16
+	File              string
+}
+
+// BootFiles are the iPXE binaries served by the TFTP server and the asset server
+var BootFiles = []BootFile{
+	{Tag: "bios", Architectures: []uint16{0}, File: "undionly.kpxe"},
+	{Tag: "efi32", Architectures: []uint16{6}, HTTPArchitectures: []uint16{15}, File: "ipxe32.efi"},
+	{Tag: "efi64", Architectures: []uint16{7, 9}, HTTPArchitectures: []uint16{16}, File: "ipxe64.efi"},
+}
+
+// DHCPConfigSettings are the settings of the site the DHCP configuration is generated for
+type DHCPConfigSettings struct {
+	NetbootServerIP string
+	// MenuURL is handed to clients that already run iPXE
+	MenuURL string
+	// HTTPBootURL is the URL of the folder with the iPXE binaries for UEFI HTTP Boot clients
+	HTTPBootURL string
+}
+
+// loadDHCPConfigSettings reads the same environment variables as the menu rendering
+func loadDHCPConfigSettings() (DHCPConfigSettings, error) {
+	netbootServerIP := os.Getenv("NETBOOT_SERVER_IP")
+	if net.ParseIP(netbootServerIP).To4() == nil {
+		return DHCPConfigSettings{}, fmt.Errorf("NETBOOT_SERVER_IP must be an IPv4 address")
+	}
+
+	menuProtocol, err := loadMenuProtocol()
+	if err != nil {
+		return DHCPConfigSettings{}, err
+	}
+
+	// The certificate is not checked here, the configuration is generated once and not on every render
+	assetLocation := AssetLocation{Protocol: "http", Host: netbootServerIP}
+	httpsConfig := loadHTTPSConfig(netbootServerIP)
+	if httpsConfig.Enabled {
+		assetLocation.Protocol = "https"
+		if httpsConfig.NetbootServerName != "" {
+			assetLocation.Host = httpsConfig.NetbootServerName
+		}
+	}
+
+	settings := DHCPConfigSettings{
+		NetbootServerIP: netbootServerIP,
+		MenuURL:         menuBaseURL(menuProtocol, assetLocation, netbootServerIP) + "/menu.ipxe",
+		// UEFI firmwares only download via HTTPS if the CA was enrolled, so HTTP is used by default
+		HTTPBootURL: fmt.Sprintf("http://%s/boot", netbootServerIP),
+	}
+	if os.Getenv("MENU_URL") != "" {
+		settings.MenuURL = os.Getenv("MENU_URL")
+	}
+	if os.Getenv("HTTP_BOOT_URL") != "" {
+		settings.HTTPBootURL = strings.TrimSuffix(os.Getenv("HTTP_BOOT_URL"), "/")
+	}
+	return settings, nil
+}
+
+// runDHCPConfigCommand implements the dhcp-config subcommand, which prints the boot options for the DHCP server of the site
+func runDHCPConfigCommand(args []string, output io.Writer) error {
+	flags := flag.NewFlagSet("dhcp-config", flag.ContinueOnError)
+	format := flags.String("format", "dnsmasq", "Format of the configuration, dnsmasq or kea")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	settings, err := loadDHCPConfigSettings()
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "dnsmasq":
+		return writeDnsmasqConfig(output, settings)
+	case "kea":
+		return writeKeaConfig(output, settings)
+	default:
+		return fmt.Errorf("unknown format %s, expected dnsmasq or kea", *format)
+	}
+}
+
+// writeDnsmasqConfig writes a dnsmasq configuration file, which can be placed in /etc/dnsmasq.d/
+func writeDnsmasqConfig(output io.Writer, settings DHCPConfigSettings) error {
+	lines := []string{
+		fmt.Sprintf("# Netboot configuration for %s, generated by menubuilder dhcp-config", settings.NetbootServerIP),
+		"# iPXE sends the user class iPXE and its own options (175)",
+		"dhcp-userclass=set:ipxe,iPXE",
+		"dhcp-match=set:ipxe,175",
+	}
+	for _, bootFile := range BootFiles {
+		for _, architecture := range bootFile.Architectures {
+			lines = append(lines, fmt.Sprintf("dhcp-match=set:%s,option:client-arch,%d", bootFile.Tag, architecture))
+		}
+		for _, architecture := range bootFile.HTTPArchitectures {
+			lines = append(lines, fmt.Sprintf("dhcp-match=set:%s-http,option:client-arch,%d", bootFile.Tag, architecture))
+		}
+	}
+	for _, bootFile := range BootFiles {
+		lines = append(lines, fmt.Sprintf("dhcp-boot=tag:!ipxe,tag:%s,%s,,%s", bootFile.Tag, bootFile.File, settings.NetbootServerIP))
+	}
+	lines = append(lines, "# UEFI HTTP Boot clients only accept answers with the vendor class HTTPClient")
+	lines = append(lines, "dhcp-vendorclass=set:httpclient,HTTPClient")
+	lines = append(lines, "dhcp-option-force=tag:httpclient,vendor-class,HTTPClient")
+	for _, bootFile := range BootFiles {
+		if len(bootFile.HTTPArchitectures) > 0 {
+			lines = append(lines, fmt.Sprintf("dhcp-boot=tag:!ipxe,tag:httpclient,tag:%s-http,%s/%s", bootFile.Tag, settings.HTTPBootURL, bootFile.File))
+		}
+	}
+	lines = append(lines, fmt.Sprintf("dhcp-boot=tag:ipxe,%s,,%s", settings.MenuURL, settings.NetbootServerIP))
+
+	_, err := fmt.Fprintln(output, strings.Join(lines, "\n"))
+	return err
+}
+
+type keaClientClass struct {
+	Name         string          `json:"name"`
+	Test         string          `json:"test"`
+	NextServer   string          `json:"next-server"`
+	BootFileName string          `json:"boot-file-name"`
+	OptionData   []keaOptionData `json:"option-data,omitempty"`
+}
+
+type keaOptionData struct {
+	Name string `json:"name"`
+	Data string `json:"data"`
+}
+
+// writeKeaConfig writes the client-classes of the Dhcp4 configuration of Kea. The classes are evaluated in order,
+// so the iPXE class has to come first.
+func writeKeaConfig(output io.Writer, settings DHCPConfigSettings) error {
+	classes := []keaClientClass{{
+		Name:         "ipxe",
+		Test:         "option[77].text == 'iPXE' or option[175].exists",
+		NextServer:   settings.NetbootServerIP,
+		BootFileName: settings.MenuURL,
+	}}
+	for _, bootFile := range BootFiles {
+		var architectureTests []string
+		for _, architecture := range bootFile.Architectures {
+			architectureTests = append(architectureTests, fmt.Sprintf("option[93].hex == 0x%04x", architecture))
+		}
+		classes = append(classes, keaClientClass{
+			Name:         "pxe-" + bootFile.Tag,
+			Test:         fmt.Sprintf("not member('ipxe') and (%s)", strings.Join(architectureTests, " or ")),
+			NextServer:   settings.NetbootServerIP,
+			BootFileName: bootFile.File,
+		})
+	}
+	for _, bootFile := range BootFiles {
+		if len(bootFile.HTTPArchitectures) == 0 {
+			continue
+		}
+		var architectureTests []string
+		for _, architecture := range bootFile.HTTPArchitectures {
+			architectureTests = append(architectureTests, fmt.Sprintf("option[93].hex == 0x%04x", architecture))
+		}
+		classes = append(classes, keaClientClass{
+			Name:         "httpclient-" + bootFile.Tag,
+			Test:         fmt.Sprintf("not member('ipxe') and substring(option[60].hex,0,10) == 'HTTPClient' and (%s)", strings.Join(architectureTests, " or ")),
+			NextServer:   settings.NetbootServerIP,
+			BootFileName: settings.HTTPBootURL + "/" + bootFile.File,
+			// UEFI HTTP Boot clients only accept answers with the vendor class HTTPClient
+			OptionData: []keaOptionData{{Name: "vendor-class-identifier", Data: "HTTPClient"}},
+		})
+	}
+
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(map[string][]keaClientClass{"client-classes": classes})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunDHCPConfigCommandDnsmasq(t *testing.T) {
+	// Arrange
+	t.Setenv("NETBOOT_SERVER_IP", "192.168.1.1")
+	t.Setenv("MENU_URL", "")
+	var output bytes.Buffer
+
+	// Act
+	err := runDHCPConfigCommand([]string{"--format", "dnsmasq"}, &output)
+
+	// Assert
+	require.NoError(t, err)
+	assert.Contains(t, output.String(), "dhcp-userclass=set:ipxe,iPXE\n")
+	assert.Contains(t, output.String(), "dhcp-match=set:efi64,option:client-arch,7\n")
+	assert.Contains(t, output.String(), "dhcp-match=set:efi64,option:client-arch,9\n")
+	assert.Contains(t, output.String(), "dhcp-boot=tag:!ipxe,tag:bios,undionly.kpxe,,192.168.1.1\n")
+	assert.Contains(t, output.String(), "dhcp-boot=tag:!ipxe,tag:efi32,ipxe32.efi,,192.168.1.1\n")
+	assert.Contains(t, output.String(), "dhcp-boot=tag:ipxe,tftp://192.168.1.1/ipxe/menu.ipxe,,192.168.1.1\n")
+	assert.Contains(t, output.String(), "dhcp-match=set:efi64-http,option:client-arch,16\n")
+	assert.Contains(t, output.String(), "dhcp-boot=tag:!ipxe,tag:httpclient,tag:efi64-http,http://192.168.1.1/boot/ipxe64.efi\n")
+}
+
+func TestRunDHCPConfigCommandMenuProtocol(t *testing.T) {
+	tests := []struct {
+		name            string
+		menuProtocol    string
+		httpProtocol    string
+		expectedMenuURL string
+	}{
+		{name: "TFTP", menuProtocol: "tftp", expectedMenuURL: "tftp://192.168.1.1/ipxe/menu.ipxe"},
+		{name: "HTTP", menuProtocol: "http", expectedMenuURL: "http://192.168.1.1/ipxe/menu.ipxe"},
+		{name: "HTTPS", menuProtocol: "http", httpProtocol: "https", expectedMenuURL: "https://netboot.example.com/ipxe/menu.ipxe"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			t.Setenv("NETBOOT_SERVER_IP", "192.168.1.1")
+			t.Setenv("NETBOOT_SERVER_HOSTNAME", "netboot.example.com")
+			t.Setenv("MENU_URL", "")
+			t.Setenv("MENU_PROTOCOL", test.menuProtocol)
+			t.Setenv("HTTP_PROTOCOL", test.httpProtocol)
+
+			// Act
+			settings, err := loadDHCPConfigSettings()
+
+			// Assert
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedMenuURL, settings.MenuURL)
+		})
+	}
+}
+
+func TestRunDHCPConfigCommandKea(t *testing.T) {
+	// Arrange
+	t.Setenv("NETBOOT_SERVER_IP", "192.168.1.1")
+	t.Setenv("MENU_URL", "http://netboot.example.com/ipxe/menu.ipxe")
+	var output bytes.Buffer
+
+	// Act
+	err := runDHCPConfigCommand([]string{"--format=kea"}, &output)
+
+	// Assert
+	require.NoError(t, err)
+	var config map[string][]keaClientClass
+	require.NoError(t, json.Unmarshal(output.Bytes(), &config))
+	classes := config["client-classes"]
+	require.Len(t, classes, 6)
+	assert.Equal(t, keaClientClass{
+		Name:         "ipxe",
+		Test:         "option[77].text == 'iPXE' or option[175].exists",
+		NextServer:   "192.168.1.1",
+		BootFileName: "http://netboot.example.com/ipxe/menu.ipxe",
+	}, classes[0])
+	assert.Equal(t, "not member('ipxe') and (option[93].hex == 0x0007 or option[93].hex == 0x0009)", classes[3].Test)
+	assert.Equal(t, "ipxe64.efi", classes[3].BootFileName)
+	assert.Equal(t, "http://192.168.1.1/boot/ipxe64.efi", classes[5].BootFileName)
+	assert.Equal(t, []keaOptionData{{Name: "vendor-class-identifier", Data: "HTTPClient"}}, classes[5].OptionData)
+}
+
+func TestRunDHCPConfigCommandErrors(t *testing.T) {
+	tests := []struct {
+		name            string
+		netbootServerIP string
+		args            []string
+	}{
+		{name: "Unknown format", netbootServerIP: "192.168.1.1", args: []string{"--format", "isc"}},
+		{name: "Missing server IP", args: []string{"--format", "kea"}},
+		{name: "Server IP is no IPv4 address", netbootServerIP: "fe80::1", args: []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			t.Setenv("NETBOOT_SERVER_IP", test.netbootServerIP)
+			var output bytes.Buffer
+
+			// Act
+			err := runDHCPConfigCommand(test.args, &output)
+
+			// Assert
+			assert.Error(t, err)
+			assert.Empty(t, output.String())
+		})
+	}
+}
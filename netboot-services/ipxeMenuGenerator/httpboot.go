@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The menus chain each other either via TFTP or, for networks blocking TFTP, via HTTP from the asset server
+const (
+	MenuProtocolTFTP = "tftp"
+	MenuProtocolHTTP = "http"
+	nextServerHost   = "${next-server}"
+)
+
+func loadMenuProtocol() (string, error) {
+	menuProtocol := strings.ToLower(os.Getenv("MENU_PROTOCOL"))
+	switch menuProtocol {
+	case "":
+		return MenuProtocolTFTP, nil
+	case MenuProtocolTFTP, MenuProtocolHTTP:
+		return menuProtocol, nil
+	default:
+		return "", fmt.Errorf("MENU_PROTOCOL must be %s or %s", MenuProtocolTFTP, MenuProtocolHTTP)
+	}
+}
+
+// forHTTPBoot replaces the ${next-server} host of the asset location with the IP of the netboot server, as clients booted
+// via UEFI HTTP Boot might not have received a next-server.
+func (l AssetLocation) forHTTPBoot(netbootServerIP string) AssetLocation {
+	if l.Protocol == "" {
+		l.Protocol = "http"
+	}
+	if l.Host == "" || l.Host == nextServerHost {
+		l.Host = netbootServerIP
+	}
+	return l
+}
+
+// menuBaseURL returns the URL of the folder the menus are chained from, without trailing slash
+func menuBaseURL(menuProtocol string, location AssetLocation, netbootServerIP string) string {
+	if menuProtocol != MenuProtocolHTTP {
+		return fmt.Sprintf("tftp://%s/ipxe", netbootServerIP)
+	}
+	location = location.forHTTPBoot(netbootServerIP)
+	return fmt.Sprintf("%s://%s/ipxe", location.Protocol, location.Host)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMenuBaseURL(t *testing.T) {
+	tests := []struct {
+		name         string
+		menuProtocol string
+		location     AssetLocation
+		expectedURL  string
+	}{
+		{name: "TFTP", menuProtocol: MenuProtocolTFTP, location: AssetLocation{Protocol: "https", Host: "netboot.example.com"}, expectedURL: "tftp://192.168.1.1/ipxe"},
+		{name: "HTTP without next-server", menuProtocol: MenuProtocolHTTP, location: AssetLocation{Protocol: "http", Host: nextServerHost}, expectedURL: "http://192.168.1.1/ipxe"},
+		{name: "HTTPS", menuProtocol: MenuProtocolHTTP, location: AssetLocation{Protocol: "https", Host: "netboot.example.com"}, expectedURL: "https://netboot.example.com/ipxe"},
+		{name: "Unresolved location", menuProtocol: MenuProtocolHTTP, location: AssetLocation{}, expectedURL: "http://192.168.1.1/ipxe"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			url := menuBaseURL(test.menuProtocol, test.location, "192.168.1.1")
+
+			// Assert
+			assert.Equal(t, test.expectedURL, url)
+		})
+	}
+}
+
+func TestLoadMenuProtocol(t *testing.T) {
+	tests := []struct {
+		name             string
+		value            string
+		expectedProtocol string
+		expectError      bool
+	}{
+		{name: "Default", value: "", expectedProtocol: MenuProtocolTFTP},
+		{name: "HTTP", value: "HTTP", expectedProtocol: MenuProtocolHTTP},
+		{name: "Invalid", value: "ftp", expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			t.Setenv("MENU_PROTOCOL", test.value)
+
+			// Act
+			menuProtocol, err := loadMenuProtocol()
+
+			// Assert
+			if test.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectedProtocol, menuProtocol)
+		})
+	}
+}
+
+func TestRenderMenusWithoutTFTP(t *testing.T) {
+	// Arrange
+	tempDir := t.TempDir()
+	menusDir := filepath.Join(tempDir, "menus")
+	require.NoError(t, os.Mkdir(menusDir, 0755))
+	for _, template := range []string{"menu.ipxe.j2", "advancedmenu.ipxe.j2"} {
+		content, err := os.ReadFile(template)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(tempDir, template), content, 0644))
+	}
+	location := AssetLocation{Protocol: "http", Host: nextServerHost}.forHTTPBoot("192.168.1.1")
+	images := []SquashfsPaths{{SquashfsFilename: "image.squashfs", SquashfsFoldername: "folder1"}}
+
+	// Act
+	err := renderMenuIpxe(RenderMenuData{
+		BasicData:       RenderBaseData{JinjaTemplateFile: "menu.ipxe.j2", MenusDirectory: menusDir, WorkingDirectory: tempDir},
+		NetbootServerIP: "192.168.1.1",
+		MenuBaseURL:     menuBaseURL(MenuProtocolHTTP, location, "192.168.1.1"),
+		AssetLocation:   location,
+	}, images)
+	require.NoError(t, err)
+	err = renderAdvancedMenu(RenderAdvancedMenuData{
+		BasicData:       RenderBaseData{JinjaTemplateFile: "advancedmenu.ipxe.j2", MenusDirectory: menusDir, WorkingDirectory: tempDir},
+		NetbootServerIP: "192.168.1.1",
+		MenuBaseURL:     menuBaseURL(MenuProtocolHTTP, location, "192.168.1.1"),
+		prodImages:      images,
+	})
+	require.NoError(t, err)
+
+	// Assert
+	menu, err := os.ReadFile(filepath.Join(menusDir, "menu.ipxe"))
+	require.NoError(t, err)
+	advancedMenu, err := os.ReadFile(filepath.Join(menusDir, "advancedmenu.ipxe"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(menu), "tftp://")
+	assert.NotContains(t, string(advancedMenu), "tftp://")
+	assert.Contains(t, string(menu), "chain --autofree http://192.168.1.1/ipxe/advancedmenu.ipxe")
+	assert.Contains(t, string(menu), "set url 192.168.1.1 &&")
+	assert.Contains(t, string(advancedMenu), "chain http://192.168.1.1/ipxe/netinfo.ipxe")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certificateExpiryWarning defines how long before the expiry of the HTTPS certificate a warning is logged on every render
+const certificateExpiryWarning = 14 * 24 * time.Hour
+
+// HTTPSConfig defines how the clients download the kernels and squashfs files of this site
+type HTTPSConfig struct {
+	Enabled           bool
+	CertificateFile   string
+	NetbootServerIP   string
+	NetbootServerName string
+	AllowHTTPFallback bool
+}
+
+// AssetLocation is the protocol and host that are rendered into the menus as ${http-protocol} and ${url}
+type AssetLocation struct {
+	Protocol string
+	Host     string
+}
+
+func loadHTTPSConfig(netbootServerIP string) HTTPSConfig {
+	return HTTPSConfig{
+		Enabled:           strings.EqualFold(os.Getenv("HTTP_PROTOCOL"), "https"),
+		CertificateFile:   os.Getenv("HTTPS_CERTIFICATE_FILE"),
+		NetbootServerIP:   netbootServerIP,
+		NetbootServerName: os.Getenv("NETBOOT_SERVER_HOSTNAME"),
+		AllowHTTPFallback: strings.EqualFold(os.Getenv("HTTPS_ALLOW_HTTP_FALLBACK"), "true"),
+	}
+}
+
+// resolveAssetLocation returns the protocol and host the menus should use. HTTPS is only used if the configured certificate is valid
+// for the host the clients connect to. Otherwise an error is returned, unless falling back to plain HTTP is explicitly allowed.
+func resolveAssetLocation(config HTTPSConfig, now time.Time) (AssetLocation, error) {
+	httpLocation := AssetLocation{Protocol: "http", Host: nextServerHost}
+	if !config.Enabled {
+		return httpLocation, nil
+	}
+
+	host := config.NetbootServerName
+	if host == "" {
+		host = config.NetbootServerIP
+	}
+
+	err := verifyCertificate(config.CertificateFile, host, now)
+	if err != nil {
+		if config.AllowHTTPFallback {
+			log.Warnf("Falling back to http for the asset URLs: %s", err)
+			return httpLocation, nil
+		}
+		return AssetLocation{}, err
+	}
+
+	return AssetLocation{Protocol: "https", Host: host}, nil
+}
+
+// verifyCertificate checks that the leaf certificate in the PEM file covers the host and is valid at the given time
+func verifyCertificate(certificateFile string, host string, now time.Time) error {
+	if certificateFile == "" {
+		return fmt.Errorf("HTTP_PROTOCOL is https, but HTTPS_CERTIFICATE_FILE is not set")
+	}
+
+	content, err := os.ReadFile(certificateFile)
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return fmt.Errorf("no PEM encoded certificate found in %s", certificateFile)
+	}
+
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	if now.Before(certificate.NotBefore) {
+		return fmt.Errorf("certificate %s is not valid before %s", certificateFile, certificate.NotBefore)
+	}
+	if now.After(certificate.NotAfter) {
+		return fmt.Errorf("certificate %s expired on %s", certificateFile, certificate.NotAfter)
+	}
+
+	err = certificate.VerifyHostname(host)
+	if err != nil {
+		return fmt.Errorf("certificate %s does not cover %s: %w", certificateFile, host, err)
+	}
+
+	if certificate.NotAfter.Sub(now) < certificateExpiryWarning {
+		log.Warnf("Certificate %s expires on %s", certificateFile, certificate.NotAfter)
+	}
+
+	return nil
+}
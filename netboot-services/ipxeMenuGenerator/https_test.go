@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveAssetLocation(t *testing.T) {
+	// Arrange
+	tempDir := t.TempDir()
+	now := time.Now()
+	validCertificate := writeTestCertificate(t, tempDir, "valid.pem", now.Add(-time.Hour), now.Add(90*24*time.Hour))
+	expiredCertificate := writeTestCertificate(t, tempDir, "expired.pem", now.Add(-48*time.Hour), now.Add(-24*time.Hour))
+
+	tests := []struct {
+		name             string
+		config           HTTPSConfig
+		expectedLocation AssetLocation
+		expectError      bool
+	}{
+		{
+			name:             "HTTPS disabled",
+			config:           HTTPSConfig{NetbootServerIP: "192.168.1.1"},
+			expectedLocation: AssetLocation{Protocol: "http", Host: "${next-server}"},
+		},
+		{
+			name:             "Certificate covers the hostname",
+			config:           HTTPSConfig{Enabled: true, CertificateFile: validCertificate, NetbootServerIP: "192.168.1.1", NetbootServerName: "netboot.example.com"},
+			expectedLocation: AssetLocation{Protocol: "https", Host: "netboot.example.com"},
+		},
+		{
+			name:             "Certificate covers the IP",
+			config:           HTTPSConfig{Enabled: true, CertificateFile: validCertificate, NetbootServerIP: "192.168.1.1"},
+			expectedLocation: AssetLocation{Protocol: "https", Host: "192.168.1.1"},
+		},
+		{
+			name:        "Certificate does not cover the hostname",
+			config:      HTTPSConfig{Enabled: true, CertificateFile: validCertificate, NetbootServerIP: "192.168.1.1", NetbootServerName: "other.example.com"},
+			expectError: true,
+		},
+		{
+			name:        "Expired certificate",
+			config:      HTTPSConfig{Enabled: true, CertificateFile: expiredCertificate, NetbootServerIP: "192.168.1.1"},
+			expectError: true,
+		},
+		{
+			name:             "Expired certificate with http fallback",
+			config:           HTTPSConfig{Enabled: true, CertificateFile: expiredCertificate, NetbootServerIP: "192.168.1.1", AllowHTTPFallback: true},
+			expectedLocation: AssetLocation{Protocol: "http", Host: "${next-server}"},
+		},
+		{
+			name:        "Missing certificate",
+			config:      HTTPSConfig{Enabled: true, NetbootServerIP: "192.168.1.1"},
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			location, err := resolveAssetLocation(test.config, now)
+
+			// Assert
+			if test.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectedLocation, location)
+		})
+	}
+}
+
+func TestRenderMenuIpxeWithHTTPS(t *testing.T) {
+	// Arrange
+	tempDir := t.TempDir()
+	menusDir := filepath.Join(tempDir, "menus")
+	require.NoError(t, os.Mkdir(menusDir, 0755))
+	content, err := os.ReadFile("menu.ipxe.j2")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "menu.ipxe.j2"), content, 0644))
+
+	// Act
+	err = renderMenuIpxe(RenderMenuData{
+		BasicData: RenderBaseData{
+			JinjaTemplateFile: "menu.ipxe.j2",
+			MenusDirectory:    menusDir,
+			WorkingDirectory:  tempDir,
+		},
+		NetbootServerIP: "192.168.1.1",
+		AssetLocation:   AssetLocation{Protocol: "https", Host: "netboot.example.com"},
+	}, []SquashfsPaths{{SquashfsFilename: "image.squashfs", SquashfsFoldername: "folder1"}})
+
+	// Assert
+	assert.NoError(t, err)
+	renderedContent, err := os.ReadFile(filepath.Join(menusDir, "menu.ipxe"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(renderedContent), "set http-protocol https && set url netboot.example.com")
+}
+
+// Helper function to create a self-signed certificate for netboot.example.com and 192.168.1.1
+func writeTestCertificate(t *testing.T, dir string, name string, notBefore time.Time, notAfter time.Time) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "netboot.example.com"},
+		DNSNames:     []string{"netboot.example.com"},
+		IPAddresses:  []net.IP{net.ParseIP("192.168.1.1")},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	return path
+}
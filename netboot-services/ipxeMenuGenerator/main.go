@@ -1,9 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"time"
@@ -23,82 +25,164 @@ var (
 type SquashfsPaths struct {
 	SquashfsFilename   string `json:"squashfsFilename"`
 	SquashfsFoldername string `json:"squashfsFoldername"`
+	// ArchFolder is set for images that keep their files in an architecture subfolder, e.g. [folder]/arm64/
+	ArchFolder    string `json:"archFolder"`
+	Architecture  string `json:"architecture"`
+	PcbiosCmdline string `json:"pcbiosCmdline"`
+	EfiCmdline    string `json:"efiCmdline"`
+	// ImagePath is the path of the image files relative to the channel folder, it is derived by withDefaults
+	ImagePath string `json:"imagePath"`
+	// TokenPath is put in front of the channel in the asset URLs if asset tokens are enabled, see withAssetTokens
+	TokenPath string `json:"tokenPath"`
 }
 
 type RenderMenuData struct {
 	BasicData       RenderBaseData
 	NetbootServerIP string
+	// MenuBaseURL is the URL the other menus are chained from, it defaults to the TFTP server
+	MenuBaseURL      string
+	AssetLocation    AssetLocation
+	AssetTokenSigner *AssetTokenSigner
 }
 
 type RenderAdvancedMenuData struct {
-	BasicData       RenderBaseData
-	NetbootServerIP string
-	devImages       []SquashfsPaths
-	prodImages      []SquashfsPaths
+	BasicData        RenderBaseData
+	NetbootServerIP  string
+	MenuBaseURL      string
+	AssetTokenSigner *AssetTokenSigner
+	devImages        []SquashfsPaths
+	prodImages       []SquashfsPaths
 }
 
 type RenderBaseData struct {
 	JinjaTemplateFile string
 	MenusDirectory    string
 	WorkingDirectory  string
+	// Signer is optional, if set every menu is published together with its detached signature
+	Signer *MenuSigner
+	// MenuStore is optional, if set the published menus are served from memory by the built-in TFTP server
+	MenuStore *MenuStore
 }
 
 func main() {
 	log.SetLevel(log.InfoLevel)
 	log.SetFormatter(&log.JSONFormatter{})
 
-	for {
-		netbootServerIP := os.Getenv("NETBOOT_SERVER_IP")
-		if netbootServerIP == "" {
-			log.Fatal("NETBOOT_SERVER_IP not set")
+	if len(os.Args) > 1 && os.Args[1] == "dhcp-config" {
+		err := runDHCPConfigCommand(os.Args[2:], os.Stdout)
+		if err != nil {
+			log.Fatal(err)
 		}
+		return
+	}
 
-		mostRecentSquashfsFoldername, err := getMostRecentSquashfsImageFolder(ProdFolder)
+	var signer *MenuSigner
+	var signedCustomMenus []string
+	var err error
+	if os.Getenv("SIGNING_CERTIFICATE_FILE") != "" {
+		signer, err = loadMenuSigner(os.Getenv("SIGNING_CERTIFICATE_FILE"), os.Getenv("SIGNING_KEY_FILE"))
 		if err != nil {
 			log.Fatal(err)
 		}
-
-		mostRecentSquashfsImage := SquashfsPaths{
-			SquashfsFilename:   getSquashfsFileName(ProdFolder, mostRecentSquashfsFoldername),
-			SquashfsFoldername: mostRecentSquashfsFoldername,
+		signedCustomMenus, err = parseSignedCustomMenus(os.Getenv("SIGNED_CUSTOM_MENUS"))
+		if err != nil {
+			log.Fatal(err)
 		}
+		log.Infof("Menus are signed and verified with imgverify, signed custom menus: %s", strings.Join(signedCustomMenus, ","))
+	}
 
-		if mostRecentSquashfsImage.SquashfsFoldername == "" || mostRecentSquashfsImage.SquashfsFilename == "" {
-			log.Fatalf("No recent SquashFS File or Folder found on %s", ProdFolder)
-		}
+	assetTokenSigner, err := loadAssetTokenSigner()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		err = renderMenuIpxe(
-			RenderMenuData{
-				BasicData: RenderBaseData{
-					JinjaTemplateFile: "menu.ipxe.j2",
-					MenusDirectory:    MenusDirectory,
-					WorkingDirectory:  WorkingDirectory,
-				},
-				NetbootServerIP: netbootServerIP,
-			}, mostRecentSquashfsImage)
+	menuProtocol, err := loadMenuProtocol()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	Upstream, err = loadUpstream()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var menuStore *MenuStore
+	if os.Getenv("TFTP_ENABLED") == "true" {
+		menuStore, err = startTFTPServer()
 		if err != nil {
 			log.Fatal(err)
 		}
+	}
+
+	for {
+		netbootServerIP := os.Getenv("NETBOOT_SERVER_IP")
+		if netbootServerIP == "" {
+			log.Fatal("NETBOOT_SERVER_IP not set")
+		}
 
 		prodImages, err := getImages(ProdFolder)
 		if err != nil {
 			log.Error(err)
 		}
 
+		mostRecentSquashfsImages := getMostRecentImagePerArchitecture(prodImages)
+		if len(mostRecentSquashfsImages) == 0 {
+			log.Fatalf("No recent SquashFS File or Folder found on %s", ProdFolder)
+		}
+
 		devImages, err := getImages(DevFolder)
 		if err != nil {
 			log.Error(err)
 		}
 
+		// The signatures of the kernels and MAC specific menus have to exist before a menu verifying them is published
+		if signer != nil {
+			signKernelsAndCustomMenus(signer, prodImages, devImages, signedCustomMenus)
+		}
+
+		// The certificate is checked on every render, so a renewed or expired certificate is picked up without a restart
+		// The other menus only chain menus, without a valid asset location they are chained from the netboot server IP
+		menusURL := menuBaseURL(menuProtocol, AssetLocation{}, netbootServerIP)
+		assetLocation, err := resolveAssetLocation(loadHTTPSConfig(netbootServerIP), time.Now())
+		if err != nil {
+			log.Errorf("Not rendering menu.ipxe, the HTTPS configuration is invalid and the http fallback is not allowed: %s", err)
+		} else {
+			if menuProtocol == MenuProtocolHTTP {
+				assetLocation = assetLocation.forHTTPBoot(netbootServerIP)
+			}
+			menusURL = menuBaseURL(menuProtocol, assetLocation, netbootServerIP)
+			err = renderMenuIpxe(
+				RenderMenuData{
+					BasicData: RenderBaseData{
+						JinjaTemplateFile: "menu.ipxe.j2",
+						MenusDirectory:    MenusDirectory,
+						WorkingDirectory:  WorkingDirectory,
+						Signer:            signer,
+						MenuStore:         menuStore,
+					},
+					NetbootServerIP:  netbootServerIP,
+					MenuBaseURL:      menusURL,
+					AssetLocation:    assetLocation,
+					AssetTokenSigner: assetTokenSigner,
+				}, mostRecentSquashfsImages)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
 		err = renderAdvancedMenu(RenderAdvancedMenuData{
 			BasicData: RenderBaseData{
 				JinjaTemplateFile: "advancedmenu.ipxe.j2",
 				MenusDirectory:    MenusDirectory,
 				WorkingDirectory:  WorkingDirectory,
+				Signer:            signer,
+				MenuStore:         menuStore,
 			},
-			NetbootServerIP: netbootServerIP,
-			devImages:       devImages,
-			prodImages:      prodImages,
+			NetbootServerIP:  netbootServerIP,
+			MenuBaseURL:      menusURL,
+			AssetTokenSigner: assetTokenSigner,
+			devImages:        devImages,
+			prodImages:       prodImages,
 		})
 		if err != nil {
 			log.Error(err)
@@ -108,6 +192,8 @@ func main() {
 			JinjaTemplateFile: "netinfo.ipxe.j2",
 			MenusDirectory:    MenusDirectory,
 			WorkingDirectory:  WorkingDirectory,
+			Signer:            signer,
+			MenuStore:         menuStore,
 		})
 		if err != nil {
 			log.Error(err)
@@ -132,32 +218,22 @@ func (b ByModTime) Less(i, j int) bool {
 	return infoI.ModTime().After(infoJ.ModTime())
 }
 
-func getMostRecentSquashfsImageFolder(folderName string) (string, error) {
-	files, err := os.ReadDir(folderName)
-	if err != nil {
-		log.Fatal(err)
+// renderMenuIpxe renders the main menu, which boots the most recent production image of the client's architecture
+func renderMenuIpxe(menuData RenderMenuData, mostRecentSquashFS []SquashfsPaths) error {
+	if menuData.AssetLocation.Protocol == "" {
+		menuData.AssetLocation = AssetLocation{Protocol: "http", Host: nextServerHost}
 	}
-
-	var matches []fs.DirEntry
-	for _, file := range files {
-		squashfsFileName := getSquashfsFileName(folderName, file.Name())
-		if strings.HasSuffix(squashfsFileName, ".squashfs") {
-			matches = append(matches, file)
-		}
+	if menuData.MenuBaseURL == "" {
+		menuData.MenuBaseURL = menuBaseURL(MenuProtocolTFTP, menuData.AssetLocation, menuData.NetbootServerIP)
 	}
 
-	sort.Sort(ByModTime(matches))
-
-	if len(matches) > 0 {
-		return strings.TrimSuffix(matches[0].Name(), ".squashfs"), nil
-	}
-	return "", nil
-}
-
-func renderMenuIpxe(menuData RenderMenuData, mostRecentSquashFS SquashfsPaths) error {
 	j2, err := jinja2.NewJinja2("menu.ipxe", 1,
 		jinja2.WithGlobal("netbootServerIP", menuData.NetbootServerIP),
-		jinja2.WithGlobal("imageName", mostRecentSquashFS),
+		jinja2.WithGlobal("menuBaseURL", menuData.MenuBaseURL),
+		jinja2.WithGlobal("httpProtocol", menuData.AssetLocation.Protocol),
+		jinja2.WithGlobal("assetHost", menuData.AssetLocation.Host),
+		jinja2.WithGlobal("signed", menuData.BasicData.Signer != nil),
+		jinja2.WithGlobal("images", withAssetTokens(imagesWithDefaults(mostRecentSquashFS), "prod", menuData.AssetTokenSigner, time.Now())),
 	)
 	if err != nil {
 		return err
@@ -169,8 +245,7 @@ func renderMenuIpxe(menuData RenderMenuData, mostRecentSquashFS SquashfsPaths) e
 		return err
 	}
 
-	filePath := fmt.Sprintf("%s/%s", menuData.BasicData.MenusDirectory, strings.ReplaceAll(menuData.BasicData.JinjaTemplateFile, ".j2", ""))
-	err = os.WriteFile(filePath, []byte(renderedString), 0644)
+	err = publishMenu(menuData.BasicData.MenusDirectory, strings.ReplaceAll(menuData.BasicData.JinjaTemplateFile, ".j2", ""), []byte(renderedString), menuData.BasicData.Signer, menuData.BasicData.MenuStore)
 	if err != nil {
 		return err
 	}
@@ -180,39 +255,98 @@ func renderMenuIpxe(menuData RenderMenuData, mostRecentSquashFS SquashfsPaths) e
 	return nil
 }
 
+// getImages returns the images of the channel folder, the newest first. On a pull-through caching server, the images of
+// the upstream which are not cached yet are added.
 func getImages(folderName string) ([]SquashfsPaths, error) {
 	folders, err := os.ReadDir(folderName)
-	if err != nil {
-		fmt.Println("Error:", err)
-		return nil, err
+	// A new caching server has not cached any image of the channel yet
+	if err != nil && !(Upstream != nil && errors.Is(err, fs.ErrNotExist)) {
+		return nil, fmt.Errorf("could not read the images of %s: %w", folderName, err)
 	}
 
 	var squashfsFiles []fs.DirEntry
+	imagesByFolder := map[string][]SquashfsPaths{}
 	for _, folder := range folders {
-		if folder.Type() == os.ModeDir {
-			squashfsFilename := getSquashfsFileName(folderName, folder.Name())
-			if squashfsFilename == "" {
-				fmt.Println("not APPENDING folder due to active .azDownload Sync: ", folder.Name())
+		// Hidden folders like .staging hold images which are still being synced
+		if folder.Type() == os.ModeDir && !strings.HasPrefix(folder.Name(), ".") {
+			images := getImagesInFolder(folderName, folder.Name())
+			if len(images) == 0 {
+				log.Warnf("Skipping image folder %s/%s, neither the folder nor an architecture subfolder has a complete squashfs, e.g. while it is synced", folderName, folder.Name())
 				continue
 			}
+			imagesByFolder[folder.Name()] = images
 			squashfsFiles = append(squashfsFiles, folder)
 		}
 	}
 
 	sort.Sort(ByModTime(squashfsFiles))
 
-	var squashfsPaths []SquashfsPaths
+	imageFolders := make([]imageFolder, 0, len(squashfsFiles))
 	for _, file := range squashfsFiles {
-		SquashfsPath := SquashfsPaths{
-			SquashfsFilename:   getSquashfsFileName(folderName, file.Name()),
-			SquashfsFoldername: file.Name(),
+		folder := imageFolder{Name: file.Name(), Images: imagesByFolder[file.Name()]}
+		if info, err := file.Info(); err == nil {
+			folder.ModTime = info.ModTime()
 		}
-		squashfsPaths = append(squashfsPaths, SquashfsPath)
+		imageFolders = append(imageFolders, folder)
+	}
+	if Upstream != nil {
+		upstreamFolders, err := Upstream.imageFolders(filepath.Base(folderName))
+		if err != nil {
+			log.Errorf("Only rendering the cached images: %s", err)
+		} else {
+			imageFolders = addUpstreamFolders(imageFolders, upstreamFolders)
+		}
+	}
+
+	var squashfsPaths []SquashfsPaths
+	for _, folder := range imageFolders {
+		squashfsPaths = append(squashfsPaths, folder.Images...)
 	}
 
 	return squashfsPaths, nil
 }
 
+// getImagesInFolder returns the image stored directly in the image folder as well as the images in its architecture subfolders ([folder]/arm64/...)
+func getImagesInFolder(folderName string, imageFolderName string) []SquashfsPaths {
+	imageFolderPath := fmt.Sprintf("%s/%s", folderName, imageFolderName)
+
+	var images []SquashfsPaths
+	squashfsFilename := getSquashfsFileName(folderName, imageFolderName)
+	if squashfsFilename != "" {
+		image := SquashfsPaths{
+			SquashfsFilename:   squashfsFilename,
+			SquashfsFoldername: imageFolderName,
+		}
+		applyKernelSidecar(&image, imageFolderPath)
+		images = append(images, image.withDefaults())
+	}
+
+	files, err := os.ReadDir(imageFolderPath)
+	if err != nil {
+		log.Error("Error:", err)
+	}
+	for _, file := range files {
+		architecture := normalizeArchitecture(file.Name())
+		if !file.IsDir() || architecture == "" {
+			continue
+		}
+		squashfsFilename := getSquashfsFileName(imageFolderPath, file.Name())
+		if squashfsFilename == "" {
+			continue
+		}
+		image := SquashfsPaths{
+			SquashfsFilename:   squashfsFilename,
+			SquashfsFoldername: imageFolderName,
+			ArchFolder:         file.Name(),
+			Architecture:       architecture,
+		}
+		applyKernelSidecar(&image, fmt.Sprintf("%s/%s", imageFolderPath, file.Name()))
+		images = append(images, image.withDefaults())
+	}
+
+	return images
+}
+
 func getSquashfsFileName(folderName string, newImageFolderName string) string {
 	newFolderToSearch := fmt.Sprintf("%s/%s", folderName, newImageFolderName)
 	files, err := os.ReadDir(newFolderToSearch)
@@ -232,10 +366,16 @@ func getSquashfsFileName(folderName string, newImageFolderName string) string {
 }
 
 func renderAdvancedMenu(advancedMenuData RenderAdvancedMenuData) error {
+	if advancedMenuData.MenuBaseURL == "" {
+		advancedMenuData.MenuBaseURL = menuBaseURL(MenuProtocolTFTP, AssetLocation{}, advancedMenuData.NetbootServerIP)
+	}
+
 	j2, err := jinja2.NewJinja2("advancedmenu.ipxe", 1,
 		jinja2.WithGlobal("netbootServerIP", advancedMenuData.NetbootServerIP),
-		jinja2.WithGlobal("prod", advancedMenuData.prodImages),
-		jinja2.WithGlobal("dev", advancedMenuData.devImages),
+		jinja2.WithGlobal("menuBaseURL", advancedMenuData.MenuBaseURL),
+		jinja2.WithGlobal("prod", withAssetTokens(imagesWithDefaults(advancedMenuData.prodImages), "prod", advancedMenuData.AssetTokenSigner, time.Now())),
+		jinja2.WithGlobal("dev", withAssetTokens(imagesWithDefaults(advancedMenuData.devImages), "dev", advancedMenuData.AssetTokenSigner, time.Now())),
+		jinja2.WithGlobal("signed", advancedMenuData.BasicData.Signer != nil),
 	)
 
 	if err != nil {
@@ -248,8 +388,7 @@ func renderAdvancedMenu(advancedMenuData RenderAdvancedMenuData) error {
 		return err
 	}
 
-	filePath := fmt.Sprintf("%s/%s", advancedMenuData.BasicData.MenusDirectory, strings.ReplaceAll(advancedMenuData.BasicData.JinjaTemplateFile, ".j2", ""))
-	err = os.WriteFile(filePath, []byte(renderedString), 0644)
+	err = publishMenu(advancedMenuData.BasicData.MenusDirectory, strings.ReplaceAll(advancedMenuData.BasicData.JinjaTemplateFile, ".j2", ""), []byte(renderedString), advancedMenuData.BasicData.Signer, advancedMenuData.BasicData.MenuStore)
 	if err != nil {
 		return err
 	}
@@ -270,8 +409,7 @@ func renderNetinfoMenu(netInfoData RenderBaseData) error {
 		return err
 	}
 
-	filePath := fmt.Sprintf("%s/%s", netInfoData.MenusDirectory, strings.ReplaceAll(netInfoData.JinjaTemplateFile, ".j2", ""))
-	err = os.WriteFile(filePath, []byte(renderedString), 0644)
+	err = publishMenu(netInfoData.MenusDirectory, strings.ReplaceAll(netInfoData.JinjaTemplateFile, ".j2", ""), []byte(renderedString), netInfoData.Signer, netInfoData.MenuStore)
 	if err != nil {
 		return err
 	}
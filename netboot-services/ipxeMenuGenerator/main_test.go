@@ -12,7 +12,7 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func TestGetMostRecentSquashfsImageFolder(t *testing.T) {
+func TestGetMostRecentImagePerArchitecture(t *testing.T) {
 	// Arrange
 	tempDir := t.TempDir()
 	folders := []string{"24-08-27-master-a46edbc", "24-08-28-master-a46edbc", "24-08-29-master-a46edbc"}
@@ -28,11 +28,14 @@ func TestGetMostRecentSquashfsImageFolder(t *testing.T) {
 	}
 
 	// Act
-	result, err := getMostRecentSquashfsImageFolder(tempDir)
+	images, err := getImages(tempDir)
+	result := getMostRecentImagePerArchitecture(images)
 
 	// Assert
 	assert.NoError(t, err)
-	assert.Equal(t, "24-08-29-master-a46edbc", result)
+	require.Len(t, result, 1)
+	assert.Equal(t, "24-08-29-master-a46edbc", result[0].SquashfsFoldername)
+	assert.Equal(t, DefaultArchitecture, result[0].Architecture)
 }
 
 func TestGetSquashfsFileName(t *testing.T) {
@@ -86,7 +89,7 @@ func TestGetSquashfsFileName(t *testing.T) {
 func TestGetImages(t *testing.T) {
 	// Arrange
 	tempDir := t.TempDir()
-	folders := []string{"24-08-27-master-a46edbc", "24-08-28-master-a46edbc", "24-08-29-master-a46edbc", "azDownloadFolder"}
+	folders := []string{"24-08-27-master-a46edbc", "24-08-28-master-a46edbc", "24-08-29-master-a46edbc", "azDownloadFolder", ".staging"}
 	for i, folder := range folders {
 		folderPath := filepath.Join(tempDir, folder)
 		require.NoError(t, os.Mkdir(folderPath, 0755))
@@ -113,9 +116,10 @@ func TestGetImages(t *testing.T) {
 	assert.Equal(t, "24-08-28-master-a46edbc", images[1].SquashfsFoldername)
 	assert.Equal(t, "24-08-27-master-a46edbc", images[2].SquashfsFoldername)
 
-	// Assert that azDownloadFolder is not included
+	// Assert that azDownloadFolder and the staging folder of the syncer are not included
 	for _, image := range images {
 		assert.NotEqual(t, "azDownloadFolder", image.SquashfsFoldername)
+		assert.NotEqual(t, ".staging", image.SquashfsFoldername)
 	}
 }
 
@@ -148,7 +152,7 @@ func TestRenderMenuIpxe(t *testing.T) {
 	}
 
 	// Act
-	err = renderMenuIpxe(renderData, squashfsImage)
+	err = renderMenuIpxe(renderData, []SquashfsPaths{squashfsImage})
 
 	// Assert
 	assert.NoError(t, err)
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SignatureSuffix is appended to the name of a file to get the name of its detached signature, as expected by imgverify
+const SignatureSuffix = ".sig"
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA2 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+// The following structures are the subset of RFC 5652 (CMS) needed for a detached signature without signed attributes,
+// which is the same as "openssl cms -sign -binary -noattr -outform DER" produces.
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"optional"`
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo cmsContentInfo
+	Certificates     asn1.RawValue   `asn1:"optional"`
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+type cmsIssuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	SID                cmsIssuerAndSerialNumber
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+// MenuSigner creates detached CMS signatures for the rendered menus, so the clients can check them with imgverify
+type MenuSigner struct {
+	certificates []*x509.Certificate
+	key          crypto.Signer
+}
+
+// loadMenuSigner loads the signing certificate (followed by its optional intermediate certificates) and the matching private key from PEM files
+func loadMenuSigner(certificateFile string, keyFile string) (*MenuSigner, error) {
+	content, err := os.ReadFile(certificateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var certificates []*x509.Certificate
+	for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("no PEM encoded certificate found in %s", certificateFile)
+	}
+
+	content, err = os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded key found in %s", keyFile)
+	}
+
+	var key crypto.Signer
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		var parsedKey any
+		parsedKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err == nil {
+			var ok bool
+			key, ok = parsedKey.(crypto.Signer)
+			if !ok {
+				err = fmt.Errorf("unsupported key type %T", parsedKey)
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse key %s: %w", keyFile, err)
+	}
+
+	if !publicKeysEqual(certificates[0].PublicKey, key.Public()) {
+		return nil, fmt.Errorf("key %s does not match certificate %s", keyFile, certificateFile)
+	}
+
+	return &MenuSigner{certificates: certificates, key: key}, nil
+}
+
+func publicKeysEqual(a crypto.PublicKey, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
+
+// Sign returns the DER encoded detached CMS signature of the content
+func (s *MenuSigner) Sign(content []byte) ([]byte, error) {
+	digest := sha256.Sum256(content)
+
+	var signatureAlgorithm pkix.AlgorithmIdentifier
+	switch s.key.(type) {
+	case *rsa.PrivateKey:
+		signatureAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}
+	case *ecdsa.PrivateKey:
+		signatureAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA2}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", s.key)
+	}
+
+	signature, err := s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	var rawCertificates []byte
+	for _, certificate := range s.certificates {
+		rawCertificates = append(rawCertificates, certificate.Raw...)
+	}
+
+	signedData, err := asn1.Marshal(cmsSignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: oidSHA256}},
+		EncapContentInfo: cmsContentInfo{ContentType: oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: rawCertificates},
+		SignerInfos: []cmsSignerInfo{{
+			Version: 1,
+			SID: cmsIssuerAndSerialNumber{
+				Issuer:       asn1.RawValue{FullBytes: s.certificates[0].RawIssuer},
+				SerialNumber: s.certificates[0].SerialNumber,
+			},
+			DigestAlgorithm:    pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			SignatureAlgorithm: signatureAlgorithm,
+			Signature:          signature,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(cmsContentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData},
+	})
+}
+
+// publishMenu writes the menu and, if a signer is configured, its signature to the menus directory. The files are only published once the
+// signature was created successfully, so the TFTP server never serves a partially written or unsigned menu.
+// An unsigned menu is written to a temporary file and renamed into place. A signed menu and its signature are written to a new hidden version
+// folder, [file] and [file].sig are symlinks through the hidden [file].current symlink to it, which is swapped with a single rename. So a menu
+// and its signature always change together, a client fetching them across an update fails imgverify and retries.
+// If a MenuStore is given, the built-in TFTP server serves the published menu from memory.
+func publishMenu(menusDirectory string, fileName string, content []byte, signer *MenuSigner, store *MenuStore) error {
+	if signer == nil {
+		tempMenuPath, err := writeTempFile(menusDirectory, fileName, content)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tempMenuPath)
+
+		if err := os.Rename(tempMenuPath, filepath.Join(menusDirectory, fileName)); err != nil {
+			return err
+		}
+		if store != nil {
+			store.Put(fileName, content)
+		}
+		return nil
+	}
+
+	signature, err := signer.Sign(content)
+	if err != nil {
+		return fmt.Errorf("could not sign %s: %w", fileName, err)
+	}
+
+	versionPath, err := os.MkdirTemp(menusDirectory, fmt.Sprintf(".%s-*", fileName))
+	if err != nil {
+		return err
+	}
+	published := false
+	defer func() {
+		if !published {
+			os.RemoveAll(versionPath)
+		}
+	}()
+	// MkdirTemp uses 0700, but the TFTP server runs as a different user
+	if err := os.Chmod(versionPath, 0755); err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(versionPath, fileName), content); err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(versionPath, fileName+SignatureSuffix), signature); err != nil {
+		return err
+	}
+
+	currentName := "." + fileName + ".current"
+	currentPath := filepath.Join(menusDirectory, currentName)
+	previousVersion, _ := os.Readlink(currentPath)
+	if err := replaceSymlink(filepath.Base(versionPath), currentPath); err != nil {
+		return err
+	}
+	published = true
+	if previousVersion != "" && !strings.ContainsRune(previousVersion, filepath.Separator) {
+		os.RemoveAll(filepath.Join(menusDirectory, previousVersion))
+	}
+
+	// The links of the menu and its signature are only replaced when a regular file is migrated or signing was enabled
+	for _, name := range []string{fileName, fileName + SignatureSuffix} {
+		target := filepath.Join(currentName, name)
+		if existing, err := os.Readlink(filepath.Join(menusDirectory, name)); err == nil && existing == target {
+			continue
+		}
+		if err := replaceSymlink(target, filepath.Join(menusDirectory, name)); err != nil {
+			return err
+		}
+	}
+
+	if store != nil {
+		store.PutPair(fileName, content, fileName+SignatureSuffix, signature)
+	}
+	return nil
+}
+
+// replaceSymlink atomically points the link at the target, an existing file or link is replaced with a rename
+func replaceSymlink(target string, linkPath string) error {
+	tempLinkPath := filepath.Join(filepath.Dir(linkPath), fmt.Sprintf(".%s-%d.tmp", filepath.Base(linkPath), os.Getpid()))
+	os.Remove(tempLinkPath)
+	if err := os.Symlink(target, tempLinkPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tempLinkPath, linkPath); err != nil {
+		os.Remove(tempLinkPath)
+		return err
+	}
+	return nil
+}
+
+// writeFile writes the content readable for the TFTP server, which runs as a different user
+func writeFile(filePath string, content []byte) error {
+	if err := os.WriteFile(filePath, content, 0644); err != nil {
+		return err
+	}
+	return os.Chmod(filePath, 0644)
+}
+
+func writeTempFile(directory string, fileName string, content []byte) (string, error) {
+	file, err := os.CreateTemp(directory, fmt.Sprintf(".%s-*", fileName))
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(content)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	err = file.Close()
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	// CreateTemp uses 0600, but the TFTP server runs as a different user
+	err = os.Chmod(file.Name(), 0644)
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// signFilesIfOutdated creates signatures for the matching files in the folder that have no signature, or one that is older than the file.
+// This is used for the kernels and the MAC specific menus, which are not rendered by the generator but are verified by the menus.
+func signFilesIfOutdated(folderPath string, signer *MenuSigner, match func(fileName string) bool) error {
+	files, err := os.ReadDir(folderPath)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || strings.HasSuffix(file.Name(), SignatureSuffix) || !match(file.Name()) {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			return err
+		}
+		signatureInfo, err := os.Stat(filepath.Join(folderPath, file.Name()+SignatureSuffix))
+		if err == nil && !signatureInfo.ModTime().Before(info.ModTime()) {
+			continue
+		}
+
+		content, err := os.ReadFile(filepath.Join(folderPath, file.Name()))
+		if err != nil {
+			return err
+		}
+		signature, err := signer.Sign(content)
+		if err != nil {
+			return fmt.Errorf("could not sign %s/%s: %w", folderPath, file.Name(), err)
+		}
+		tempSignaturePath, err := writeTempFile(folderPath, file.Name()+SignatureSuffix, signature)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(tempSignaturePath, filepath.Join(folderPath, file.Name()+SignatureSuffix))
+		if err != nil {
+			os.Remove(tempSignaturePath)
+			return err
+		}
+		log.Infof("Signed %s/%s", folderPath, file.Name())
+	}
+	return nil
+}
+
+// signKernelsAndCustomMenus signs the kernels and initial ramdisks of all images as well as the allowed MAC specific menus, which are verified before
+// they are executed. Only the custom menus listed by name are signed, a file somebody dropped into the menus directory never gets a trusted signature.
+func signKernelsAndCustomMenus(signer *MenuSigner, prodImages []SquashfsPaths, devImages []SquashfsPaths, customMenus []string) {
+	isKernel := func(fileName string) bool { return fileName == "vmlinuz" || fileName == "initrd" }
+
+	for _, image := range prodImages {
+		err := signFilesIfOutdated(filepath.Join(ProdFolder, image.withDefaults().ImagePath), signer, isKernel)
+		// Images of the upstream which are not cached yet come with the signatures of the upstream
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Error(err)
+		}
+	}
+	for _, image := range devImages {
+		err := signFilesIfOutdated(filepath.Join(DevFolder, image.withDefaults().ImagePath), signer, isKernel)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Error(err)
+		}
+	}
+
+	if len(customMenus) == 0 {
+		return
+	}
+	err := signFilesIfOutdated(MenusDirectory, signer, func(fileName string) bool {
+		for _, customMenu := range customMenus {
+			if fileName == customMenu {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// parseSignedCustomMenus parses the comma separated file names of the MAC specific menus to sign, e.g. MAC-001122334455.ipxe
+func parseSignedCustomMenus(value string) ([]string, error) {
+	var customMenus []string
+	for _, fileName := range strings.Split(value, ",") {
+		fileName = strings.TrimSpace(fileName)
+		if fileName == "" {
+			continue
+		}
+		if !strings.HasPrefix(fileName, "MAC-") || !strings.HasSuffix(fileName, ".ipxe") || strings.ContainsAny(fileName, "/*?[") {
+			return nil, fmt.Errorf("invalid custom menu %s in SIGNED_CUSTOM_MENUS, expected a file name like MAC-001122334455.ipxe", fileName)
+		}
+		customMenus = append(customMenus, fileName)
+	}
+	return customMenus, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMenuSignerSign(t *testing.T) {
+	// Arrange
+	tempDir := t.TempDir()
+	certificateFile, keyFile := writeTestSigningCertificate(t, tempDir)
+	signer, err := loadMenuSigner(certificateFile, keyFile)
+	require.NoError(t, err)
+	content := []byte("#!ipxe\necho hello\n")
+
+	// Act
+	signature, err := signer.Sign(content)
+
+	// Assert
+	require.NoError(t, err)
+
+	var contentInfo cmsContentInfo
+	_, err = asn1.Unmarshal(signature, &contentInfo)
+	require.NoError(t, err)
+	assert.True(t, contentInfo.ContentType.Equal(oidSignedData))
+
+	var signedData cmsSignedData
+	_, err = asn1.Unmarshal(contentInfo.Content.Bytes, &signedData)
+	require.NoError(t, err)
+	assert.True(t, signedData.EncapContentInfo.ContentType.Equal(oidData))
+	assert.Empty(t, signedData.EncapContentInfo.Content.Bytes, "the signature must be detached")
+	require.Len(t, signedData.SignerInfos, 1)
+
+	signerInfo := signedData.SignerInfos[0]
+	assert.Equal(t, signer.certificates[0].SerialNumber, signerInfo.SID.SerialNumber)
+	assert.Equal(t, signer.certificates[0].RawIssuer, signerInfo.SID.Issuer.FullBytes)
+
+	digest := sha256.Sum256(content)
+	publicKey := signer.certificates[0].PublicKey.(*rsa.PublicKey)
+	assert.NoError(t, rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signerInfo.Signature))
+	assert.Error(t, rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:1], signerInfo.Signature))
+}
+
+func TestLoadMenuSignerKeyMismatch(t *testing.T) {
+	// Arrange
+	tempDir := t.TempDir()
+	certificateFile, _ := writeTestSigningCertificate(t, tempDir)
+	otherDir := t.TempDir()
+	_, otherKeyFile := writeTestSigningCertificate(t, otherDir)
+
+	// Act
+	_, err := loadMenuSigner(certificateFile, otherKeyFile)
+
+	// Assert
+	assert.Error(t, err)
+}
+
+func TestPublishMenuSigned(t *testing.T) {
+	// Arrange
+	tempDir := t.TempDir()
+	menusDir := filepath.Join(tempDir, "menus")
+	require.NoError(t, os.Mkdir(menusDir, 0755))
+	certificateFile, keyFile := writeTestSigningCertificate(t, tempDir)
+	signer, err := loadMenuSigner(certificateFile, keyFile)
+	require.NoError(t, err)
+
+	// A menu published before the signatures were swapped through a symlink is migrated
+	require.NoError(t, os.WriteFile(filepath.Join(menusDir, "menu.ipxe"), []byte("#!ipxe\nold\n"), 0644))
+
+	// Act
+	store := NewMenuStore()
+	firstErr := publishMenu(menusDir, "menu.ipxe", []byte("#!ipxe\nfirst\n"), signer, store)
+	err = publishMenu(menusDir, "menu.ipxe", []byte("#!ipxe\n"), signer, store)
+
+	// Assert
+	require.NoError(t, firstErr)
+	require.NoError(t, err)
+	files, err := os.ReadDir(menusDir)
+	require.NoError(t, err)
+	require.Len(t, files, 4, "no temporary files or previous versions must be left behind")
+	assert.Equal(t, ".menu.ipxe.current", files[1].Name())
+	assert.Equal(t, "menu.ipxe", files[2].Name())
+	assert.Equal(t, "menu.ipxe.sig", files[3].Name())
+	content, err := os.ReadFile(filepath.Join(menusDir, "menu.ipxe"))
+	require.NoError(t, err)
+	assert.Equal(t, "#!ipxe\n", string(content))
+	// The signature is read through the same version folder as the menu
+	versionPath, err := filepath.EvalSymlinks(filepath.Join(menusDir, "menu.ipxe"))
+	require.NoError(t, err)
+	signaturePath, err := filepath.EvalSymlinks(filepath.Join(menusDir, "menu.ipxe.sig"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Dir(versionPath), filepath.Dir(signaturePath))
+	storedMenu, _ := store.Get("menu.ipxe")
+	storedSignature, _ := store.Get("menu.ipxe.sig")
+	assert.Equal(t, "#!ipxe\n", string(storedMenu))
+	signature, err := os.ReadFile(filepath.Join(menusDir, "menu.ipxe.sig"))
+	require.NoError(t, err)
+	assert.Equal(t, signature, storedSignature)
+	info, err := os.Stat(filepath.Join(menusDir, "menu.ipxe"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+	info, err = os.Stat(filepath.Dir(versionPath))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+}
+
+func TestSignKernelsAndCustomMenusOnlySignsAllowedMenus(t *testing.T) {
+	// Arrange
+	tempDir := t.TempDir()
+	previousMenusDirectory := MenusDirectory
+	t.Cleanup(func() { MenusDirectory = previousMenusDirectory })
+	MenusDirectory = filepath.Join(tempDir, "menus")
+	require.NoError(t, os.Mkdir(MenusDirectory, 0755))
+	for _, menu := range []string{"MAC-001122334455.ipxe", "MAC-66778899aabb.ipxe"} {
+		require.NoError(t, os.WriteFile(filepath.Join(MenusDirectory, menu), []byte("#!ipxe\n"), 0644))
+	}
+	certificateFile, keyFile := writeTestSigningCertificate(t, tempDir)
+	signer, err := loadMenuSigner(certificateFile, keyFile)
+	require.NoError(t, err)
+	customMenus, err := parseSignedCustomMenus("MAC-001122334455.ipxe, ")
+	require.NoError(t, err)
+
+	// Act
+	signKernelsAndCustomMenus(signer, nil, nil, customMenus)
+
+	// Assert
+	assert.FileExists(t, filepath.Join(MenusDirectory, "MAC-001122334455.ipxe.sig"))
+	assert.NoFileExists(t, filepath.Join(MenusDirectory, "MAC-66778899aabb.ipxe.sig"))
+	_, err = parseSignedCustomMenus("MAC-*.ipxe")
+	assert.Error(t, err)
+}
+
+func TestSignFilesIfOutdated(t *testing.T) {
+	// Arrange
+	tempDir := t.TempDir()
+	imageDir := filepath.Join(tempDir, "image")
+	require.NoError(t, os.Mkdir(imageDir, 0755))
+	for _, file := range []string{"vmlinuz", "initrd", "image.squashfs"} {
+		require.NoError(t, os.WriteFile(filepath.Join(imageDir, file), []byte("blub"), 0644))
+	}
+	certificateFile, keyFile := writeTestSigningCertificate(t, tempDir)
+	signer, err := loadMenuSigner(certificateFile, keyFile)
+	require.NoError(t, err)
+
+	// Act
+	err = signFilesIfOutdated(imageDir, signer, func(fileName string) bool { return fileName == "vmlinuz" || fileName == "initrd" })
+
+	// Assert
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(imageDir, "vmlinuz.sig"))
+	assert.FileExists(t, filepath.Join(imageDir, "initrd.sig"))
+	assert.NoFileExists(t, filepath.Join(imageDir, "image.squashfs.sig"))
+}
+
+func TestRenderMenusSigned(t *testing.T) {
+	// Arrange
+	tempDir := t.TempDir()
+	menusDir := filepath.Join(tempDir, "menus")
+	require.NoError(t, os.Mkdir(menusDir, 0755))
+	for _, template := range []string{"menu.ipxe.j2", "advancedmenu.ipxe.j2"} {
+		content, err := os.ReadFile(template)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(tempDir, template), content, 0644))
+	}
+	certificateFile, keyFile := writeTestSigningCertificate(t, tempDir)
+	signer, err := loadMenuSigner(certificateFile, keyFile)
+	require.NoError(t, err)
+	images := []SquashfsPaths{{SquashfsFilename: "image.squashfs", SquashfsFoldername: "folder1"}}
+
+	// Act
+	err = renderMenuIpxe(RenderMenuData{
+		BasicData: RenderBaseData{
+			JinjaTemplateFile: "menu.ipxe.j2",
+			MenusDirectory:    menusDir,
+			WorkingDirectory:  tempDir,
+			Signer:            signer,
+		},
+		NetbootServerIP: "192.168.1.1",
+	}, images)
+	require.NoError(t, err)
+	err = renderAdvancedMenu(RenderAdvancedMenuData{
+		BasicData: RenderBaseData{
+			JinjaTemplateFile: "advancedmenu.ipxe.j2",
+			MenusDirectory:    menusDir,
+			WorkingDirectory:  tempDir,
+			Signer:            signer,
+		},
+		NetbootServerIP: "192.168.1.1",
+		prodImages:      images,
+	})
+	require.NoError(t, err)
+
+	// Assert
+	menu, err := os.ReadFile(filepath.Join(menusDir, "menu.ipxe"))
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(menusDir, "menu.ipxe.sig"))
+	assert.Contains(t, string(menu), "imgverify advancedmenu tftp://192.168.1.1/ipxe/advancedmenu.ipxe.sig && chain --autofree advancedmenu")
+	assert.Contains(t, string(menu), "imgverify vmlinuz ${kernel_url}vmlinuz.sig")
+	assert.Contains(t, string(menu), "imgverify initrd ${kernel_url}initrd.sig")
+	assert.NotContains(t, string(menu), "chain --autofree tftp://192.168.1.1/ipxe/advancedmenu.ipxe")
+
+	advancedMenu, err := os.ReadFile(filepath.Join(menusDir, "advancedmenu.ipxe"))
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(menusDir, "advancedmenu.ipxe.sig"))
+	assert.Contains(t, string(advancedMenu), "imgverify netinfo tftp://192.168.1.1/ipxe/netinfo.ipxe.sig && chain --autofree netinfo")
+	assert.Contains(t, string(advancedMenu), "imgverify vmlinuz ${kernel_url}vmlinuz.sig")
+}
+
+// Helper function to create a code signing certificate and its RSA key
+func writeTestSigningCertificate(t *testing.T, dir string) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "netboot menu signing"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	certificateFile := filepath.Join(dir, "codesign.crt")
+	require.NoError(t, os.WriteFile(certificateFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	keyFile := filepath.Join(dir, "codesign.key")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600))
+	return certificateFile, keyFile
+}
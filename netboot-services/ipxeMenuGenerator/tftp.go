@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TFTP opcodes and error codes as defined in RFC 1350 and RFC 2347
+const (
+	tftpOpcodeRRQ   = 1
+	tftpOpcodeWRQ   = 2
+	tftpOpcodeDATA  = 3
+	tftpOpcodeACK   = 4
+	tftpOpcodeERROR = 5
+	tftpOpcodeOACK  = 6
+
+	tftpErrorNotDefined       = 0
+	tftpErrorFileNotFound     = 1
+	tftpErrorAccessViolation  = 2
+	tftpErrorIllegalOperation = 4
+	tftpErrorUnknownTID       = 5
+	tftpErrorOptionRejected   = 8
+
+	tftpDefaultBlockSize = 512
+	tftpMinBlockSize     = 8
+	// tftpMaxBlockSize is the largest block that fits into a UDP datagram, see RFC 2348
+	tftpMaxBlockSize  = 65464
+	tftpMaxWindowSize = 65535
+)
+
+var (
+	TFTPListenAddress        = ":69"
+	TFTPRoot                 = "/srv/tftp"
+	TFTPMetricsListenAddress = ":9069"
+	// TFTPMaxBlockSize keeps the data packets below an Ethernet MTU of 1500 bytes
+	TFTPMaxBlockSize = 1468
+)
+
+// MenuStore holds the most recently rendered menus, so the TFTP server always serves the latest render without reading the menus from disk
+type MenuStore struct {
+	mutex sync.RWMutex
+	menus map[string][]byte
+}
+
+func NewMenuStore() *MenuStore {
+	return &MenuStore{menus: map[string][]byte{}}
+}
+
+func (m *MenuStore) Put(fileName string, content []byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.menus[fileName] = content
+}
+
+// PutPair stores a menu together with its signature, so a request never gets the signature of another render
+func (m *MenuStore) PutPair(fileName string, content []byte, signatureName string, signature []byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.menus[fileName] = content
+	m.menus[signatureName] = signature
+}
+
+func (m *MenuStore) Get(fileName string) ([]byte, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	content, ok := m.menus[fileName]
+	return content, ok
+}
+
+// TFTPServer is a read-only TFTP server supporting the blksize, tsize, timeout and windowsize options (RFC 2347, 2348, 2349 and 7440).
+// Requests for ipxe/[file] are answered with the rendered menus from the MenuStore and fall back to the MenusDirectory (e.g. for MAC specific menus),
+// all other files (the iPXE binaries) are served from Root.
+type TFTPServer struct {
+	Root           string
+	MenusDirectory string
+	Menus          *MenuStore
+	Stats          *TFTPStats
+	// MaxBlockSize caps the block size a client can negotiate, e.g. to stay below the MTU
+	MaxBlockSize int
+	Timeout      time.Duration
+	Retries      int
+}
+
+type tftpRequest struct {
+	fileName   string
+	blockSize  int
+	windowSize int
+	timeout    time.Duration
+	// options holds the accepted options, which are acknowledged with an OACK
+	options map[string]string
+	// optionOrder keeps the order of the options of the request for the OACK
+	optionOrder []string
+}
+
+type tftpError struct {
+	code    uint16
+	message string
+}
+
+func (e *tftpError) Error() string {
+	return e.message
+}
+
+// startTFTPServer starts the built-in TFTP server and its metrics endpoint, the returned MenuStore has to be passed to the render functions
+func startTFTPServer() (*MenuStore, error) {
+	if os.Getenv("TFTP_LISTEN_ADDRESS") != "" {
+		TFTPListenAddress = os.Getenv("TFTP_LISTEN_ADDRESS")
+	}
+	if os.Getenv("TFTP_ROOT") != "" {
+		TFTPRoot = os.Getenv("TFTP_ROOT")
+	}
+	if os.Getenv("TFTP_METRICS_LISTEN_ADDRESS") != "" {
+		TFTPMetricsListenAddress = os.Getenv("TFTP_METRICS_LISTEN_ADDRESS")
+	}
+	if os.Getenv("TFTP_MAX_BLOCKSIZE") != "" {
+		maxBlockSize, err := strconv.Atoi(os.Getenv("TFTP_MAX_BLOCKSIZE"))
+		if err != nil || maxBlockSize < tftpMinBlockSize || maxBlockSize > tftpMaxBlockSize {
+			return nil, fmt.Errorf("TFTP_MAX_BLOCKSIZE must be a number between %d and %d", tftpMinBlockSize, tftpMaxBlockSize)
+		}
+		TFTPMaxBlockSize = maxBlockSize
+	}
+
+	conn, err := net.ListenPacket("udp", TFTPListenAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &TFTPServer{
+		Root:           TFTPRoot,
+		MenusDirectory: MenusDirectory,
+		Menus:          NewMenuStore(),
+		Stats:          NewTFTPStats(),
+		MaxBlockSize:   TFTPMaxBlockSize,
+		Timeout:        time.Second,
+		Retries:        5,
+	}
+
+	go func() {
+		log.Fatal(server.Serve(conn))
+	}()
+	go func() {
+		log.Fatal(http.ListenAndServe(TFTPMetricsListenAddress, server.Stats))
+	}()
+
+	log.Infof("Serving TFTP on %s from %s, metrics on %s", TFTPListenAddress, TFTPRoot, TFTPMetricsListenAddress)
+	return server.Menus, nil
+}
+
+// Serve reads requests from the listener, every transfer is handled in its own goroutine with its own UDP port (TID)
+func (s *TFTPServer) Serve(conn net.PacketConn) error {
+	buffer := make([]byte, 65536)
+	for {
+		n, client, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+		packet := make([]byte, n)
+		copy(packet, buffer[:n])
+		go s.handleRequest(packet, client)
+	}
+}
+
+func (s *TFTPServer) handleRequest(packet []byte, client net.Addr) {
+	start := time.Now()
+	clientIP := clientIPOfAddr(client)
+
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		log.Errorf("Could not open a transfer socket for %s: %s", client, err)
+		return
+	}
+	defer conn.Close()
+
+	request, err := s.parseRequest(packet)
+	if err != nil {
+		var requestError *tftpError
+		if !errors.As(err, &requestError) {
+			requestError = &tftpError{code: tftpErrorNotDefined, message: err.Error()}
+		}
+		sendTFTPError(conn, client, requestError)
+		s.Stats.Record(invalidRequestLabel, clientIP, 0, false)
+		log.WithFields(log.Fields{"type": "tftp", "client": clientIP, "error": err.Error()}).Warn("rejected request")
+		return
+	}
+
+	content, size, err := s.open(request.fileName)
+	if err != nil {
+		sendTFTPError(conn, client, &tftpError{code: tftpErrorFileNotFound, message: "file not found"})
+		s.Stats.Record(request.fileName, clientIP, 0, false)
+		log.WithFields(log.Fields{"type": "tftp", "client": clientIP, "file": request.fileName}).Warn("file not found")
+		return
+	}
+	if closer, ok := content.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	if _, ok := request.options["tsize"]; ok {
+		request.options["tsize"] = strconv.FormatInt(size, 10)
+	}
+
+	bytesSent, err := s.transfer(conn, client, request, content, size)
+	s.Stats.Record(request.fileName, clientIP, bytesSent, err == nil)
+
+	fields := log.Fields{
+		"type":        "tftp",
+		"client":      clientIP,
+		"file":        request.fileName,
+		"blksize":     request.blockSize,
+		"windowsize":  request.windowSize,
+		"bytes":       bytesSent,
+		"duration_ms": time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		log.WithFields(fields).WithField("error", err.Error()).Warn("transfer failed")
+		return
+	}
+	log.WithFields(fields).Info("transfer completed")
+}
+
+// parseRequest parses a read request and negotiates its options. Unknown options are ignored as required by RFC 2347.
+func (s *TFTPServer) parseRequest(packet []byte) (*tftpRequest, error) {
+	if len(packet) < 2 {
+		return nil, &tftpError{code: tftpErrorIllegalOperation, message: "packet too short"}
+	}
+	opcode := binary.BigEndian.Uint16(packet)
+	if opcode == tftpOpcodeWRQ {
+		return nil, &tftpError{code: tftpErrorAccessViolation, message: "write requests are not supported"}
+	}
+	if opcode != tftpOpcodeRRQ {
+		return nil, &tftpError{code: tftpErrorIllegalOperation, message: "expected a read request"}
+	}
+
+	fields := strings.Split(string(packet[2:]), "\x00")
+	// The packet ends with a zero byte, so the last field is always empty
+	if len(fields) < 3 || fields[len(fields)-1] != "" {
+		return nil, &tftpError{code: tftpErrorIllegalOperation, message: "malformed read request"}
+	}
+	fields = fields[:len(fields)-1]
+
+	mode := strings.ToLower(fields[1])
+	if mode != "octet" && mode != "netascii" {
+		return nil, &tftpError{code: tftpErrorIllegalOperation, message: fmt.Sprintf("unsupported mode %s", mode)}
+	}
+
+	request := &tftpRequest{
+		// Clients request the same file with and without leading slash, the cleaned name is used for the metrics
+		fileName:   strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(fields[0], "\\", "/")), "/"),
+		blockSize:  tftpDefaultBlockSize,
+		windowSize: 1,
+		timeout:    s.Timeout,
+		options:    map[string]string{},
+	}
+
+	for i := 2; i+1 < len(fields); i += 2 {
+		name := strings.ToLower(fields[i])
+		if name != "blksize" && name != "windowsize" && name != "timeout" && name != "tsize" {
+			continue
+		}
+		value, err := strconv.Atoi(fields[i+1])
+		if err != nil {
+			return nil, &tftpError{code: tftpErrorOptionRejected, message: fmt.Sprintf("invalid value for option %s", name)}
+		}
+
+		switch name {
+		case "blksize":
+			if value < tftpMinBlockSize || value > tftpMaxBlockSize {
+				return nil, &tftpError{code: tftpErrorOptionRejected, message: "invalid blksize"}
+			}
+			if value > s.MaxBlockSize {
+				value = s.MaxBlockSize
+			}
+			request.blockSize = value
+		case "windowsize":
+			if value < 1 || value > tftpMaxWindowSize {
+				return nil, &tftpError{code: tftpErrorOptionRejected, message: "invalid windowsize"}
+			}
+			request.windowSize = value
+		case "timeout":
+			if value < 1 || value > 255 {
+				return nil, &tftpError{code: tftpErrorOptionRejected, message: "invalid timeout"}
+			}
+			request.timeout = time.Duration(value) * time.Second
+		case "tsize":
+			// the value is replaced with the file size once the file is opened
+		}
+		request.options[name] = strconv.Itoa(value)
+		request.optionOrder = append(request.optionOrder, name)
+	}
+
+	return request, nil
+}
+
+// open returns the content and the size of the requested file, the file name has to be cleaned by parseRequest
+func (s *TFTPServer) open(fileName string) (io.ReaderAt, int64, error) {
+	for _, segment := range strings.Split(fileName, "/") {
+		// Hidden files are the temporary files of publishMenu
+		if strings.HasPrefix(segment, ".") {
+			return nil, 0, os.ErrNotExist
+		}
+	}
+
+	if menuName, isMenu := strings.CutPrefix(fileName, "ipxe/"); isMenu {
+		if content, ok := s.Menus.Get(menuName); ok {
+			return bytes.NewReader(content), int64(len(content)), nil
+		}
+		return openRegularFile(filepath.Join(s.MenusDirectory, filepath.FromSlash(menuName)))
+	}
+
+	return openRegularFile(filepath.Join(s.Root, filepath.FromSlash(fileName)))
+}
+
+func openRegularFile(filePath string) (io.ReaderAt, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		file.Close()
+		return nil, 0, os.ErrNotExist
+	}
+	return file, info.Size(), nil
+}
+
+// transfer sends the file to the client and returns the number of bytes that were acknowledged
+func (s *TFTPServer) transfer(conn net.PacketConn, client net.Addr, request *tftpRequest, content io.ReaderAt, size int64) (int64, error) {
+	if len(request.options) > 0 {
+		oack := []byte{0, tftpOpcodeOACK}
+		for _, name := range request.optionOrder {
+			oack = append(oack, name...)
+			oack = append(oack, 0)
+			oack = append(oack, request.options[name]...)
+			oack = append(oack, 0)
+		}
+		// The OACK is acknowledged with block number 0
+		_, err := s.sendWindow(conn, client, request, [][]byte{oack}, -1)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	blockSize := int64(request.blockSize)
+	// A file that is a multiple of the block size ends with an empty block
+	totalBlocks := size/blockSize + 1
+	buffer := make([]byte, blockSize)
+
+	base := int64(1)
+	for base <= totalBlocks {
+		last := base + int64(request.windowSize) - 1
+		if last > totalBlocks {
+			last = totalBlocks
+		}
+
+		var window [][]byte
+		for block := base; block <= last; block++ {
+			n, err := content.ReadAt(buffer, (block-1)*blockSize)
+			if err != nil && err != io.EOF {
+				sendTFTPError(conn, client, &tftpError{code: tftpErrorNotDefined, message: "read error"})
+				return (base - 1) * blockSize, err
+			}
+			packet := make([]byte, 4+n)
+			binary.BigEndian.PutUint16(packet, tftpOpcodeDATA)
+			binary.BigEndian.PutUint16(packet[2:], uint16(block))
+			copy(packet[4:], buffer[:n])
+			window = append(window, packet)
+		}
+
+		acknowledged, err := s.sendWindow(conn, client, request, window, base-1)
+		if err != nil {
+			return (base - 1) * blockSize, err
+		}
+		base += acknowledged
+	}
+
+	return size, nil
+}
+
+// sendWindow sends the packets following the block number previous and waits until at least one of them is acknowledged.
+// It returns the number of acknowledged packets, packets after the acknowledged one have to be sent again (RFC 7440).
+func (s *TFTPServer) sendWindow(conn net.PacketConn, client net.Addr, request *tftpRequest, window [][]byte, previous int64) (int64, error) {
+	buffer := make([]byte, 516)
+	for attempt := 0; attempt <= s.Retries; attempt++ {
+		for _, packet := range window {
+			_, err := conn.WriteTo(packet, client)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		deadline := time.Now().Add(request.timeout)
+		for {
+			err := conn.SetReadDeadline(deadline)
+			if err != nil {
+				return 0, err
+			}
+			n, sender, err := conn.ReadFrom(buffer)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return 0, err
+			}
+			if sender.String() != client.String() {
+				sendTFTPError(conn, sender, &tftpError{code: tftpErrorUnknownTID, message: "unknown transfer ID"})
+				continue
+			}
+			if n < 4 {
+				continue
+			}
+
+			switch binary.BigEndian.Uint16(buffer) {
+			case tftpOpcodeERROR:
+				return 0, fmt.Errorf("client aborted the transfer: %s", strings.TrimRight(string(buffer[4:n]), "\x00"))
+			case tftpOpcodeACK:
+				// Block numbers wrap around after 65535, so the distance to the previous block is calculated in uint16
+				acknowledged := int64(binary.BigEndian.Uint16(buffer[2:]) - uint16(previous))
+				if acknowledged > int64(len(window)) {
+					// an old, duplicate acknowledgement
+					continue
+				}
+				if acknowledged > 0 {
+					return acknowledged, nil
+				}
+				// The client did not receive the first block of the window. With a window size of 1, duplicate
+				// acknowledgements are ignored to avoid the Sorcerer's Apprentice Syndrome and the timeout triggers the retransmission.
+				if len(window) > 1 {
+					deadline = time.Now()
+				}
+			}
+		}
+	}
+	return 0, fmt.Errorf("no acknowledgement after %d retries", s.Retries)
+}
+
+func sendTFTPError(conn net.PacketConn, client net.Addr, tftpErr *tftpError) {
+	packet := make([]byte, 4, 5+len(tftpErr.message))
+	binary.BigEndian.PutUint16(packet, tftpOpcodeERROR)
+	binary.BigEndian.PutUint16(packet[2:], tftpErr.code)
+	packet = append(packet, tftpErr.message...)
+	packet = append(packet, 0)
+	_, err := conn.WriteTo(packet, client)
+	if err != nil {
+		log.Warnf("Could not send TFTP error to %s: %s", client, err)
+	}
+}
+
+func clientIPOfAddr(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
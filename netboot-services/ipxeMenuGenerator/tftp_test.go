@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tftpResult is what the test client received for a read request
+type tftpResult struct {
+	content   []byte
+	options   map[string]string
+	errorCode int
+}
+
+func startTestTFTPServer(t *testing.T, server *TFTPServer) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go server.Serve(conn)
+	return conn.LocalAddr().String()
+}
+
+func newTestTFTPServer(t *testing.T) *TFTPServer {
+	return &TFTPServer{
+		Root:           t.TempDir(),
+		MenusDirectory: t.TempDir(),
+		Menus:          NewMenuStore(),
+		Stats:          NewTFTPStats(),
+		MaxBlockSize:   1468,
+		Timeout:        time.Second,
+		Retries:        2,
+	}
+}
+
+// tftpGet is a minimal TFTP client, it acknowledges every block in order and therefore works with any window size
+func tftpGet(t *testing.T, serverAddress string, fileName string, options ...string) tftpResult {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	request := []byte{0, tftpOpcodeRRQ}
+	request = append(request, fileName+"\x00octet\x00"...)
+	for _, option := range options {
+		request = append(request, option+"\x00"...)
+	}
+	address, err := net.ResolveUDPAddr("udp", serverAddress)
+	require.NoError(t, err)
+	_, err = conn.WriteTo(request, address)
+	require.NoError(t, err)
+
+	result := tftpResult{options: map[string]string{}, errorCode: -1}
+	blockSize := 512
+	expectedBlock := uint16(1)
+	buffer := make([]byte, 65536)
+	for {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, sender, err := conn.ReadFrom(buffer)
+		require.NoError(t, err)
+
+		switch binary.BigEndian.Uint16(buffer) {
+		case tftpOpcodeERROR:
+			result.errorCode = int(binary.BigEndian.Uint16(buffer[2:]))
+			return result
+		case tftpOpcodeOACK:
+			fields := strings.Split(strings.TrimSuffix(string(buffer[2:n]), "\x00"), "\x00")
+			for i := 0; i+1 < len(fields); i += 2 {
+				result.options[fields[i]] = fields[i+1]
+			}
+			if result.options["blksize"] != "" {
+				fmt.Sscan(result.options["blksize"], &blockSize)
+			}
+			_, err = conn.WriteTo([]byte{0, tftpOpcodeACK, 0, 0}, sender)
+			require.NoError(t, err)
+		case tftpOpcodeDATA:
+			block := binary.BigEndian.Uint16(buffer[2:])
+			if block != expectedBlock {
+				continue
+			}
+			result.content = append(result.content, buffer[4:n]...)
+			_, err = conn.WriteTo([]byte{0, tftpOpcodeACK, byte(block >> 8), byte(block)}, sender)
+			require.NoError(t, err)
+			if n-4 < blockSize {
+				return result
+			}
+			expectedBlock++
+		}
+	}
+}
+
+func TestTFTPServerServesMenusFromMemory(t *testing.T) {
+	// Arrange
+	server := newTestTFTPServer(t)
+	menu := bytes.Repeat([]byte("#!ipxe\n"), 1000)
+	server.Menus.Put("menu.ipxe", menu)
+	require.NoError(t, os.WriteFile(filepath.Join(server.MenusDirectory, "menu.ipxe"), []byte("outdated"), 0644))
+	address := startTestTFTPServer(t, server)
+
+	// Act
+	result := tftpGet(t, address, "ipxe/menu.ipxe", "blksize", "1024", "tsize", "0", "windowsize", "4")
+
+	// Assert
+	assert.Equal(t, -1, result.errorCode)
+	assert.Equal(t, menu, result.content)
+	assert.Equal(t, map[string]string{"blksize": "1024", "tsize": fmt.Sprint(len(menu)), "windowsize": "4"}, result.options)
+}
+
+func TestTFTPServerServesFilesFromDisk(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileName string
+		options  []string
+		size     int
+	}{
+		{name: "iPXE binary without options", fileName: "undionly.kpxe", size: 1500},
+		{name: "Size is a multiple of the block size", fileName: "undionly.kpxe", size: 2048, options: []string{"blksize", "512"}},
+		{name: "Block size is capped", fileName: "ipxe64.efi", size: 5000, options: []string{"blksize", "8192", "windowsize", "8"}},
+		{name: "Leading slash", fileName: "/ipxe64.efi", size: 100},
+		{name: "MAC specific menu", fileName: "ipxe/MAC-020000000001.ipxe", size: 100},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			server := newTestTFTPServer(t)
+			content := make([]byte, test.size)
+			for i := range content {
+				content[i] = byte(i % 251)
+			}
+			directory := server.Root
+			fileName := strings.TrimPrefix(test.fileName, "/")
+			if strings.HasPrefix(fileName, "ipxe/") {
+				directory = server.MenusDirectory
+				fileName = strings.TrimPrefix(fileName, "ipxe/")
+			}
+			require.NoError(t, os.WriteFile(filepath.Join(directory, fileName), content, 0644))
+			address := startTestTFTPServer(t, server)
+
+			// Act
+			result := tftpGet(t, address, test.fileName, test.options...)
+
+			// Assert
+			assert.Equal(t, -1, result.errorCode)
+			assert.Equal(t, content, result.content)
+			if len(test.options) > 0 && test.options[1] == "8192" {
+				assert.Equal(t, "1468", result.options["blksize"])
+			}
+		})
+	}
+}
+
+func TestTFTPServerRejectsRequests(t *testing.T) {
+	tests := []struct {
+		name              string
+		fileName          string
+		expectedErrorCode int
+	}{
+		{name: "Missing file", fileName: "missing.efi", expectedErrorCode: tftpErrorFileNotFound},
+		{name: "Path traversal", fileName: "../secret", expectedErrorCode: tftpErrorFileNotFound},
+		{name: "Temporary menu file", fileName: "ipxe/.menu.ipxe-123", expectedErrorCode: tftpErrorFileNotFound},
+		{name: "Directory", fileName: "ipxe", expectedErrorCode: tftpErrorFileNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			server := newTestTFTPServer(t)
+			server.Root = filepath.Join(t.TempDir(), "tftp")
+			require.NoError(t, os.MkdirAll(filepath.Join(server.Root, "ipxe"), 0755))
+			require.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(server.Root), "secret"), []byte("secret"), 0644))
+			require.NoError(t, os.WriteFile(filepath.Join(server.MenusDirectory, ".menu.ipxe-123"), []byte("partial"), 0644))
+			address := startTestTFTPServer(t, server)
+
+			// Act
+			result := tftpGet(t, address, test.fileName)
+
+			// Assert
+			assert.Equal(t, test.expectedErrorCode, result.errorCode)
+			assert.Empty(t, result.content)
+		})
+	}
+}
+
+func TestTFTPServerParseRequest(t *testing.T) {
+	tests := []struct {
+		name               string
+		packet             string
+		expectedBlockSize  int
+		expectedWindowSize int
+		expectedErrorCode  uint16
+	}{
+		{name: "Defaults", packet: "\x00\x01menu.ipxe\x00octet\x00", expectedBlockSize: 512, expectedWindowSize: 1},
+		{name: "Unknown options are ignored", packet: "\x00\x01menu.ipxe\x00octet\x00multicast\x00\x00blksize\x001200\x00", expectedBlockSize: 1200, expectedWindowSize: 1},
+		{name: "Option names are case insensitive", packet: "\x00\x01menu.ipxe\x00OCTET\x00WindowSize\x0016\x00", expectedBlockSize: 512, expectedWindowSize: 16},
+		{name: "Write request", packet: "\x00\x02menu.ipxe\x00octet\x00", expectedErrorCode: tftpErrorAccessViolation},
+		{name: "Unsupported mode", packet: "\x00\x01menu.ipxe\x00mail\x00", expectedErrorCode: tftpErrorIllegalOperation},
+		{name: "Missing terminator", packet: "\x00\x01menu.ipxe\x00octet", expectedErrorCode: tftpErrorIllegalOperation},
+		{name: "Block size too small", packet: "\x00\x01menu.ipxe\x00octet\x00blksize\x004\x00", expectedErrorCode: tftpErrorOptionRejected},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			server := newTestTFTPServer(t)
+
+			// Act
+			request, err := server.parseRequest([]byte(test.packet))
+
+			// Assert
+			if test.expectedErrorCode != 0 {
+				var requestError *tftpError
+				require.ErrorAs(t, err, &requestError)
+				assert.Equal(t, test.expectedErrorCode, requestError.code)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "menu.ipxe", request.fileName)
+			assert.Equal(t, test.expectedBlockSize, request.blockSize)
+			assert.Equal(t, test.expectedWindowSize, request.windowSize)
+		})
+	}
+}
+
+func TestTFTPStatsWriteMetrics(t *testing.T) {
+	// Arrange
+	server := newTestTFTPServer(t)
+	server.Menus.Put("menu.ipxe", []byte("#!ipxe\n"))
+	address := startTestTFTPServer(t, server)
+	tftpGet(t, address, "ipxe/menu.ipxe")
+	tftpGet(t, address, "missing.efi")
+
+	// Act
+	var metrics bytes.Buffer
+	// The transfer is recorded once the server received the last acknowledgement
+	assert.Eventually(t, func() bool {
+		metrics.Reset()
+		server.Stats.WriteMetrics(&metrics)
+		return strings.Contains(metrics.String(), `netboot_tftp_client_requests_total{client="127.0.0.1"} 2`)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Assert
+	assert.Contains(t, metrics.String(), `netboot_tftp_file_requests_total{file="ipxe/menu.ipxe"} 1`)
+	assert.Contains(t, metrics.String(), `netboot_tftp_file_bytes_total{file="ipxe/menu.ipxe"} 7`)
+	assert.Contains(t, metrics.String(), `netboot_tftp_file_failed_requests_total{file="missing.efi"} 1`)
+	assert.Contains(t, metrics.String(), `netboot_tftp_client_requests_total{client="127.0.0.1"} 2`)
+	assert.Contains(t, metrics.String(), `netboot_tftp_client_failed_requests_total{client="127.0.0.1"} 1`)
+}
+
+func TestTFTPStatsLimitsFileSeries(t *testing.T) {
+	// Arrange
+	stats := NewTFTPStats()
+	for i := 0; i < maxFileSeries; i++ {
+		stats.Record(fmt.Sprintf("missing-%d.efi", i), "127.0.0.1", 0, false)
+	}
+
+	// Act
+	stats.Record("missing.efi", "127.0.0.1", 0, false)
+	stats.Record(invalidRequestLabel, "127.0.0.1", 0, false)
+	stats.Record("missing-1.efi", "127.0.0.1", 0, false)
+
+	// Assert
+	var metrics bytes.Buffer
+	stats.WriteMetrics(&metrics)
+	assert.Contains(t, metrics.String(), `netboot_tftp_file_failed_requests_total{file="other-files"} 1`)
+	assert.Contains(t, metrics.String(), `netboot_tftp_file_failed_requests_total{file="invalid-request"} 1`)
+	assert.Contains(t, metrics.String(), `netboot_tftp_file_failed_requests_total{file="missing-1.efi"} 2`)
+	assert.NotContains(t, metrics.String(), `file="missing.efi"`)
+}
+
+func TestPublishMenuUpdatesMenuStore(t *testing.T) {
+	// Arrange
+	menusDir := t.TempDir()
+	store := NewMenuStore()
+
+	// Act
+	err := publishMenu(menusDir, "menu.ipxe", []byte("#!ipxe\n"), nil, store)
+
+	// Assert
+	assert.NoError(t, err)
+	content, ok := store.Get("menu.ipxe")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("#!ipxe\n"), content)
+	_, ok = store.Get("menu.ipxe" + SignatureSuffix)
+	assert.False(t, ok)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// tftpCounter counts the requests, the failed requests and the bytes sent
+type tftpCounter struct {
+	Requests int64
+	Failures int64
+	Bytes    int64
+}
+
+const (
+	// invalidRequestLabel is the file label of the requests which could not be parsed
+	invalidRequestLabel = "invalid-request"
+	// otherFilesLabel collects the files once maxFileSeries files are counted, so scanning clients can not create an
+	// unbounded number of time series
+	otherFilesLabel = "other-files"
+	maxFileSeries   = 1000
+)
+
+// TFTPStats aggregates the TFTP requests per file and per client
+type TFTPStats struct {
+	mutex     sync.Mutex
+	perFile   map[string]*tftpCounter
+	perClient map[string]*tftpCounter
+}
+
+func NewTFTPStats() *TFTPStats {
+	return &TFTPStats{
+		perFile:   map[string]*tftpCounter{},
+		perClient: map[string]*tftpCounter{},
+	}
+}
+
+// Record adds a request to the counters. Requests which could not be parsed are recorded with invalidRequestLabel,
+// files beyond the first maxFileSeries with otherFilesLabel.
+func (s *TFTPStats) Record(fileName string, clientIP string, bytes int64, success bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.perFile[fileName]; !ok && fileName != invalidRequestLabel && len(s.perFile) >= maxFileSeries {
+		fileName = otherFilesLabel
+	}
+
+	for _, counter := range []*tftpCounter{counterOf(s.perFile, fileName), counterOf(s.perClient, clientIP)} {
+		counter.Requests++
+		counter.Bytes += bytes
+		if !success {
+			counter.Failures++
+		}
+	}
+}
+
+func counterOf(counters map[string]*tftpCounter, key string) *tftpCounter {
+	counter, ok := counters[key]
+	if !ok {
+		counter = &tftpCounter{}
+		counters[key] = counter
+	}
+	return counter
+}
+
+// ServeHTTP exports the counters in the Prometheus text format
+func (s *TFTPStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.WriteMetrics(w)
+}
+
+func (s *TFTPStats) WriteMetrics(w io.Writer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	writeTFTPCounterFamilies(w, "file", s.perFile)
+	writeTFTPCounterFamilies(w, "client", s.perClient)
+}
+
+func writeTFTPCounterFamilies(w io.Writer, dimension string, counters map[string]*tftpCounter) {
+	keys := make([]string, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	families := []struct {
+		name  string
+		help  string
+		value func(*tftpCounter) int64
+	}{
+		{name: "requests_total", help: "Number of read requests", value: func(c *tftpCounter) int64 { return c.Requests }},
+		{name: "failed_requests_total", help: "Number of read requests that were rejected or aborted", value: func(c *tftpCounter) int64 { return c.Failures }},
+		{name: "bytes_total", help: "Bytes sent", value: func(c *tftpCounter) int64 { return c.Bytes }},
+	}
+	for _, family := range families {
+		fmt.Fprintf(w, "# HELP netboot_tftp_%s_%s %s per %s.\n", dimension, family.name, family.help, dimension)
+		fmt.Fprintf(w, "# TYPE netboot_tftp_%s_%s counter\n", dimension, family.name)
+		for _, key := range keys {
+			fmt.Fprintf(w, "netboot_tftp_%s_%s{%s=\"%s\"} %d\n", dimension, family.name, dimension, escapeLabelValue(key), family.value(counters[key]))
+		}
+	}
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TokenPathPrefix is the first path segment of a token protected asset URL: /_token/[keyID].[expires].[mac]/[channel]/[image folder]/[file]
+// The token is part of the path (and not a query parameter), because the menus build the kernel and initrd URLs by appending to ${kernel_url}.
+const TokenPathPrefix = "_token"
+
+// defaultAssetTokenLifetime has to cover the time between rendering a menu and the client downloading the squashfs after the kernel booted
+const defaultAssetTokenLifetime = 2 * time.Hour
+
+// AssetTokenSigner creates the HMAC tokens the asset server validates before serving an image
+type AssetTokenSigner struct {
+	KeyID    string
+	Secret   []byte
+	Lifetime time.Duration
+}
+
+// loadAssetTokenSigner returns nil if no secrets are configured. ASSET_TOKEN_SECRETS is a comma separated list of [keyID]:[secret],
+// the first entry is used to sign. The asset server accepts all entries, so a new secret can be rolled out before the old one is removed.
+func loadAssetTokenSigner() (*AssetTokenSigner, error) {
+	secrets := os.Getenv("ASSET_TOKEN_SECRETS")
+	if secrets == "" {
+		return nil, nil
+	}
+
+	keyID, secret, found := strings.Cut(strings.Split(secrets, ",")[0], ":")
+	keyID = strings.TrimSpace(keyID)
+	if !found || keyID == "" || secret == "" || strings.ContainsAny(keyID, "./") {
+		return nil, fmt.Errorf("ASSET_TOKEN_SECRETS must be a list of [keyID]:[secret] and the key ID must not contain '.' or '/'")
+	}
+
+	lifetime := defaultAssetTokenLifetime
+	if os.Getenv("ASSET_TOKEN_LIFETIME") != "" {
+		var err error
+		lifetime, err = time.ParseDuration(os.Getenv("ASSET_TOKEN_LIFETIME"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &AssetTokenSigner{KeyID: keyID, Secret: []byte(secret), Lifetime: lifetime}, nil
+}
+
+// TokenPath returns the path segments to put in front of the scope, e.g. "_token/2024a.1724936400.abc/" for "prod/24-08-29-master-a46edbc/".
+// The token is valid for all files below the scope, which is the image folder of the channel.
+func (s *AssetTokenSigner) TokenPath(scope string, now time.Time) string {
+	expires := strconv.FormatInt(now.Add(s.Lifetime).Unix(), 10)
+	return fmt.Sprintf("%s/%s.%s.%s/", TokenPathPrefix, s.KeyID, expires, assetTokenMAC(s.Secret, s.KeyID, expires, scope))
+}
+
+func assetTokenMAC(secret []byte, keyID string, expires string, scope string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(keyID + "\n" + expires + "\n" + scope))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// withAssetTokens sets the token path of every image of the channel. Without a signer the images are returned unchanged.
+func withAssetTokens(images []SquashfsPaths, channel string, signer *AssetTokenSigner, now time.Time) []SquashfsPaths {
+	if signer == nil {
+		return images
+	}
+
+	result := []SquashfsPaths{}
+	for _, image := range images {
+		image.TokenPath = signer.TokenPath(fmt.Sprintf("%s/%s/", channel, image.SquashfsFoldername), now)
+		result = append(result, image)
+	}
+	return result
+}
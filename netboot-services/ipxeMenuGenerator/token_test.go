@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadAssetTokenSigner(t *testing.T) {
+	tests := []struct {
+		name          string
+		secrets       string
+		lifetime      string
+		expectedKeyID string
+		expectError   bool
+	}{
+		{name: "Disabled", secrets: ""},
+		{name: "First secret is used to sign", secrets: "2024b:newsecret,2024a:oldsecret", lifetime: "30m", expectedKeyID: "2024b"},
+		{name: "Missing key ID", secrets: "newsecret", expectError: true},
+		{name: "Invalid key ID", secrets: "2024.b:newsecret", expectError: true},
+		{name: "Invalid lifetime", secrets: "2024b:newsecret", lifetime: "forever", expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			t.Setenv("ASSET_TOKEN_SECRETS", test.secrets)
+			t.Setenv("ASSET_TOKEN_LIFETIME", test.lifetime)
+
+			// Act
+			signer, err := loadAssetTokenSigner()
+
+			// Assert
+			if test.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			if test.expectedKeyID == "" {
+				assert.Nil(t, signer)
+				return
+			}
+			assert.Equal(t, test.expectedKeyID, signer.KeyID)
+			assert.Equal(t, 30*time.Minute, signer.Lifetime)
+		})
+	}
+}
+
+func TestAssetTokenSignerTokenPath(t *testing.T) {
+	// Arrange
+	signer := &AssetTokenSigner{KeyID: "2024b", Secret: []byte("secret"), Lifetime: time.Hour}
+	now := time.Unix(1724932800, 0)
+
+	// Act
+	tokenPath := signer.TokenPath("prod/24-08-29-master-a46edbc/", now)
+
+	// Assert
+	expectedMAC := assetTokenMAC([]byte("secret"), "2024b", "1724936400", "prod/24-08-29-master-a46edbc/")
+	assert.Equal(t, "_token/2024b.1724936400."+expectedMAC+"/", tokenPath)
+	assert.NotEqual(t, expectedMAC, assetTokenMAC([]byte("secret"), "2024b", "1724936400", "prod/24-08-28-master-a46edbc/"))
+}
+
+func TestRenderAdvancedMenuWithAssetTokens(t *testing.T) {
+	// Arrange
+	tempDir := t.TempDir()
+	menusDir := filepath.Join(tempDir, "menus")
+	require.NoError(t, os.Mkdir(menusDir, 0755))
+	content, err := os.ReadFile("advancedmenu.ipxe.j2")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "advancedmenu.ipxe.j2"), content, 0644))
+
+	// Act
+	err = renderAdvancedMenu(RenderAdvancedMenuData{
+		BasicData: RenderBaseData{
+			JinjaTemplateFile: "advancedmenu.ipxe.j2",
+			MenusDirectory:    menusDir,
+			WorkingDirectory:  tempDir,
+		},
+		NetbootServerIP:  "192.168.1.1",
+		AssetTokenSigner: &AssetTokenSigner{KeyID: "2024b", Secret: []byte("secret"), Lifetime: time.Hour},
+		prodImages:       []SquashfsPaths{{SquashfsFilename: "prod1.squashfs", SquashfsFoldername: "24-08-01-master-abcdef"}},
+		devImages:        []SquashfsPaths{{SquashfsFilename: "dev1.squashfs", SquashfsFoldername: "24-08-02-feature-ghijkl"}},
+	})
+
+	// Assert
+	assert.NoError(t, err)
+	renderedContent, err := os.ReadFile(filepath.Join(menusDir, "advancedmenu.ipxe"))
+	require.NoError(t, err)
+	assert.Regexp(t, `set squash_url \$\{http-protocol\}://\$\{url\}/_token/2024b\.\d+\.[\w-]+/prod/24-08-01-master-abcdef/prod1\.squashfs`, string(renderedContent))
+	assert.Regexp(t, `set kernel_url \$\{http-protocol\}://\$\{url\}/_token/2024b\.\d+\.[\w-]+/dev/24-08-02-feature-ghijkl/\n`, string(renderedContent))
+}
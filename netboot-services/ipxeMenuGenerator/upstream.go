@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// manifestFilename is the manifest the publish command of the sync service uploads to every channel
+const manifestFilename = "manifest.json"
+
+// Upstream is set on pull-through caching servers, see loadUpstream
+var Upstream *UpstreamImages
+
+// UpstreamImages lists the images of the upstream of a pull-through caching server. The images which are not cached
+// yet are rendered into the menus as well, the asset server downloads their files on the first boot.
+type UpstreamImages struct {
+	// URL is the base URL the asset path is appended to, its query (e.g. a SAS token) is kept
+	URL    *url.URL
+	Client *http.Client
+
+	// sidecars caches the kernel sidecars by their path and modification time, they never change
+	sidecars map[string]*KernelSidecar
+}
+
+// imageFolder is an image folder of a channel with the images it contains
+type imageFolder struct {
+	Name    string
+	ModTime time.Time
+	Images  []SquashfsPaths
+}
+
+// upstreamManifest is the part of the manifest of the sync service the menus need
+type upstreamManifest struct {
+	Images []struct {
+		Name  string         `json:"name"`
+		Files []upstreamFile `json:"files"`
+	} `json:"images"`
+}
+
+// upstreamFile is a file of an image folder, its path is relative to the image folder
+type upstreamFile struct {
+	Path    string    `json:"path"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// loadUpstream reads UPSTREAM_URL, the same upstream the asset server of a caching server pulls the images from
+func loadUpstream() (*UpstreamImages, error) {
+	value := os.Getenv("UPSTREAM_URL")
+	if value == "" {
+		return nil, nil
+	}
+	upstreamURL, err := url.Parse(value)
+	if err != nil || (upstreamURL.Scheme != "http" && upstreamURL.Scheme != "https") {
+		return nil, fmt.Errorf("invalid UPSTREAM_URL %s", strings.SplitN(value, "?", 2)[0])
+	}
+	return &UpstreamImages{URL: upstreamURL, Client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+// imageFolders returns the image folders of the channel listed in the upstream manifest, with the modification time of
+// their newest file
+func (u *UpstreamImages) imageFolders(channel string) ([]imageFolder, error) {
+	var manifest upstreamManifest
+	if err := u.getJSON(channel+"/"+manifestFilename, &manifest); err != nil {
+		return nil, fmt.Errorf("could not load the upstream manifest of %s: %w", channel, err)
+	}
+
+	var folders []imageFolder
+	for _, manifestImage := range manifest.Images {
+		folder := imageFolder{Name: manifestImage.Name}
+		// The squashfs files and kernel sidecars by the folder they are in, "" is the image folder itself
+		squashfsFiles := map[string]string{}
+		sidecars := map[string]upstreamFile{}
+		var archFolders []string
+		for _, file := range manifestImage.Files {
+			if file.ModTime.After(folder.ModTime) {
+				folder.ModTime = file.ModTime
+			}
+			directory, fileName := path.Split(file.Path)
+			directory = strings.TrimSuffix(directory, "/")
+			if strings.Contains(directory, "/") || (directory != "" && normalizeArchitecture(directory) == "") {
+				continue
+			}
+			switch {
+			case strings.HasSuffix(fileName, ".squashfs") && squashfsFiles[directory] == "":
+				squashfsFiles[directory] = fileName
+				if directory != "" {
+					archFolders = append(archFolders, directory)
+				}
+			case strings.HasSuffix(fileName, "kernel.json") && sidecars[directory].Path == "":
+				sidecars[directory] = file
+			}
+		}
+
+		// The same order as the subfolders of a local image folder
+		sort.Strings(archFolders)
+		for _, archFolder := range append([]string{""}, archFolders...) {
+			if squashfsFiles[archFolder] == "" {
+				continue
+			}
+			image := SquashfsPaths{
+				SquashfsFilename:   squashfsFiles[archFolder],
+				SquashfsFoldername: manifestImage.Name,
+				ArchFolder:         archFolder,
+				Architecture:       normalizeArchitecture(archFolder),
+			}
+			sidecarPath := channel + "/" + path.Join(manifestImage.Name, archFolder)
+			applySidecar(&image, u.sidecar(channel, manifestImage.Name, sidecars[archFolder]), sidecarPath)
+			folder.Images = append(folder.Images, image.withDefaults())
+		}
+		if len(folder.Images) > 0 {
+			folders = append(folders, folder)
+		}
+	}
+	return folders, nil
+}
+
+// sidecar downloads the kernel sidecar of the image, it returns nil if the image has none
+func (u *UpstreamImages) sidecar(channel string, imageName string, file upstreamFile) *KernelSidecar {
+	if file.Path == "" {
+		return nil
+	}
+	sidecarPath := channel + "/" + imageName + "/" + file.Path
+	cacheKey := sidecarPath + "@" + file.ModTime.String()
+	if sidecar, ok := u.sidecars[cacheKey]; ok {
+		return sidecar
+	}
+	var sidecar KernelSidecar
+	if err := u.getJSON(sidecarPath, &sidecar); err != nil {
+		log.Warnf("Could not load the kernel sidecar of %s/%s from the upstream: %s", channel, imageName, err)
+		return nil
+	}
+	if u.sidecars == nil {
+		u.sidecars = map[string]*KernelSidecar{}
+	}
+	u.sidecars[cacheKey] = &sidecar
+	return &sidecar
+}
+
+func (u *UpstreamImages) getJSON(assetPath string, value any) error {
+	upstreamURL := *u.URL
+	upstreamURL.Path = strings.TrimSuffix(upstreamURL.Path, "/") + "/" + assetPath
+	upstreamURL.RawPath = ""
+	response, err := u.Client.Get(upstreamURL.String())
+	if err != nil {
+		return redactURLError(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("upstream responded with %s", response.Status)
+	}
+	return json.NewDecoder(io.LimitReader(response.Body, 64<<20)).Decode(value)
+}
+
+// redactURLError leaves the query out of the URL of a failed request, it contains the SAS token of the upstream
+func redactURLError(err error) error {
+	var urlError *url.Error
+	if !errors.As(err, &urlError) {
+		return err
+	}
+	return &url.Error{Op: urlError.Op, URL: strings.SplitN(urlError.URL, "?", 2)[0], Err: urlError.Err}
+}
+
+// addUpstreamFolders adds the upstream image folders which are not cached locally. The cached folders are sorted by
+// their upstream modification time as well, the local one is the time they were cached.
+func addUpstreamFolders(local []imageFolder, upstream []imageFolder) []imageFolder {
+	upstreamModTimes := map[string]time.Time{}
+	for _, folder := range upstream {
+		upstreamModTimes[folder.Name] = folder.ModTime
+	}
+	cached := map[string]bool{}
+	merged := make([]imageFolder, 0, len(local)+len(upstream))
+	for _, folder := range local {
+		if modTime, ok := upstreamModTimes[folder.Name]; ok {
+			folder.ModTime = modTime
+		}
+		cached[folder.Name] = true
+		merged = append(merged, folder)
+	}
+	for _, folder := range upstream {
+		if !cached[folder.Name] {
+			merged = append(merged, folder)
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].ModTime.After(merged[j].ModTime) })
+	return merged
+}
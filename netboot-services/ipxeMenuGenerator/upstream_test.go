@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testUpstreamManifest = `{"images": [
+	{"name": "24-08-28-master-a46edbc", "files": [
+		{"path": "image.squashfs", "modTime": "2024-08-28T10:00:00Z"}
+	]},
+	{"name": "24-08-30-master-c0ffee0", "files": [
+		{"path": "image.squashfs", "modTime": "2024-08-30T10:00:00Z"},
+		{"path": "24-08-30-master-c0ffee0-kernel.json", "modTime": "2024-08-30T10:00:00Z"}
+	]},
+	{"name": "24-08-29-master-b57fecd", "files": [
+		{"path": "x86_64/image.squashfs", "modTime": "2024-08-29T10:00:00Z"},
+		{"path": "arm64/image.squashfs", "modTime": "2024-08-29T10:00:00Z"},
+		{"path": "docs/image.squashfs", "modTime": "2024-08-29T10:00:00Z"}
+	]},
+	{"name": "24-08-31-master-d00d000", "files": [
+		{"path": "vmlinuz", "modTime": "2024-08-31T10:00:00Z"}
+	]}
+]}`
+
+func newTestUpstream(t *testing.T) *atomic.Int64 {
+	var sidecarRequests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sig") != "secret" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/netboot/prod/manifest.json":
+			w.Write([]byte(testUpstreamManifest))
+		case "/netboot/prod/24-08-30-master-c0ffee0/24-08-30-master-c0ffee0-kernel.json":
+			sidecarRequests.Add(1)
+			w.Write([]byte(`{"architecture": "aarch64", "cmdline": {"efi": "console=ttyAMA0"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	upstreamURL, err := url.Parse(server.URL + "/netboot?sig=secret")
+	require.NoError(t, err)
+	previousUpstream := Upstream
+	t.Cleanup(func() { Upstream = previousUpstream })
+	Upstream = &UpstreamImages{URL: upstreamURL, Client: server.Client()}
+	return &sidecarRequests
+}
+
+func TestGetImagesFromUpstream(t *testing.T) {
+	// Arrange
+	sidecarRequests := newTestUpstream(t)
+	prodDir := filepath.Join(t.TempDir(), "prod")
+	// The oldest image is cached, the time it was cached is newer than the upstream images
+	cachedFolder := filepath.Join(prodDir, "24-08-28-master-a46edbc")
+	require.NoError(t, os.MkdirAll(cachedFolder, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(cachedFolder, "image.squashfs"), []byte("blub"), 0644))
+
+	// Act
+	images, err := getImages(prodDir)
+	_, secondErr := getImages(prodDir)
+
+	// Assert
+	require.NoError(t, err)
+	require.NoError(t, secondErr)
+	require.Len(t, images, 4)
+	assert.Equal(t, "24-08-30-master-c0ffee0", images[0].ImagePath)
+	assert.Equal(t, "arm64", images[0].Architecture)
+	assert.Equal(t, "console=ttyAMA0", images[0].EfiCmdline)
+	assert.Equal(t, "24-08-29-master-b57fecd/arm64", images[1].ImagePath)
+	assert.Equal(t, "24-08-29-master-b57fecd/x86_64", images[2].ImagePath)
+	assert.Equal(t, "24-08-28-master-a46edbc", images[3].ImagePath)
+	assert.Equal(t, "image.squashfs", images[3].SquashfsFilename)
+	// The sidecars never change, they are only downloaded once
+	assert.Equal(t, int64(1), sidecarRequests.Load())
+}
+
+func TestGetImagesFromUpstreamWithoutLocalFolder(t *testing.T) {
+	// Arrange
+	newTestUpstream(t)
+	devDir := filepath.Join(t.TempDir(), "dev")
+	prodDir := filepath.Join(t.TempDir(), "prod")
+
+	// Act
+	devImages, devErr := getImages(devDir)
+	prodImages, prodErr := getImages(prodDir)
+
+	// Assert
+	require.NoError(t, devErr)
+	assert.Empty(t, devImages)
+	require.NoError(t, prodErr)
+	mostRecent := getMostRecentImagePerArchitecture(prodImages)
+	require.Len(t, mostRecent, 2)
+	assert.Equal(t, "24-08-30-master-c0ffee0", mostRecent[0].ImagePath)
+	assert.Equal(t, "24-08-29-master-b57fecd/x86_64", mostRecent[1].ImagePath)
+}
+
+func TestLoadUpstreamRedactsTheQuery(t *testing.T) {
+	// Arrange
+	t.Setenv("UPSTREAM_URL", "ftp://example.com/netboot?sig=secret")
+
+	// Act
+	upstream, err := loadUpstream()
+
+	// Assert
+	assert.Nil(t, upstream)
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "secret")
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+)
+
+// BOOTP operations, DHCP message types and the DHCP options used by PXE clients
+const (
+	bootRequest = 1
+	bootReply   = 2
+
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpAck      = 5
+	dhcpInform   = 8
+
+	optionPad                   = 0
+	optionVendorSpecific        = 43
+	optionMessageType           = 53
+	optionServerIdentifier      = 54
+	optionVendorClass           = 60
+	optionUserClass             = 77
+	optionClientArchitecture    = 93
+	optionClientMachineID       = 97
+	optionIPXEEncapsulated      = 175
+	optionEnd                   = 255
+	pxeOptionDiscoveryControl   = 6
+	pxeDiscoveryUseBootFile     = 0x08
+	dhcpMagicCookie             = 0x63825363
+	dhcpFixedHeaderLength       = 236
+	dhcpMinimumPacketLength     = 300
+	dhcpServerNameFieldLength   = 64
+	dhcpBootFileNameFieldLength = 128
+)
+
+// maxBootFileLength is the longest boot file name, the file field of the header is null-terminated
+const maxBootFileLength = dhcpBootFileNameFieldLength - 1
+
+// DHCPPacket is a BOOTP packet with DHCP options (RFC 2131 and RFC 2132)
+type DHCPPacket struct {
+	Op      byte
+	HType   byte
+	HLen    byte
+	Hops    byte
+	XID     uint32
+	Secs    uint16
+	Flags   uint16
+	CIAddr  net.IP
+	YIAddr  net.IP
+	SIAddr  net.IP
+	GIAddr  net.IP
+	CHAddr  net.HardwareAddr
+	SName   string
+	File    string
+	Options map[byte][]byte
+}
+
+func parseDHCPPacket(data []byte) (*DHCPPacket, error) {
+	if len(data) < dhcpFixedHeaderLength+4 {
+		return nil, errors.New("packet too short")
+	}
+	if binary.BigEndian.Uint32(data[dhcpFixedHeaderLength:]) != dhcpMagicCookie {
+		return nil, errors.New("missing DHCP magic cookie")
+	}
+
+	hardwareAddressLength := int(data[2])
+	if hardwareAddressLength > 16 {
+		return nil, errors.New("invalid hardware address length")
+	}
+
+	packet := &DHCPPacket{
+		Op:      data[0],
+		HType:   data[1],
+		HLen:    data[2],
+		Hops:    data[3],
+		XID:     binary.BigEndian.Uint32(data[4:]),
+		Secs:    binary.BigEndian.Uint16(data[8:]),
+		Flags:   binary.BigEndian.Uint16(data[10:]),
+		CIAddr:  net.IP(append([]byte{}, data[12:16]...)),
+		YIAddr:  net.IP(append([]byte{}, data[16:20]...)),
+		SIAddr:  net.IP(append([]byte{}, data[20:24]...)),
+		GIAddr:  net.IP(append([]byte{}, data[24:28]...)),
+		CHAddr:  net.HardwareAddr(append([]byte{}, data[28:28+hardwareAddressLength]...)),
+		SName:   nullTerminatedString(data[44:108]),
+		File:    nullTerminatedString(data[108:236]),
+		Options: map[byte][]byte{},
+	}
+
+	options := data[dhcpFixedHeaderLength+4:]
+	for i := 0; i < len(options); {
+		code := options[i]
+		if code == optionEnd {
+			break
+		}
+		if code == optionPad {
+			i++
+			continue
+		}
+		if i+1 >= len(options) || i+2+int(options[i+1]) > len(options) {
+			return nil, errors.New("truncated option")
+		}
+		length := int(options[i+1])
+		// Options longer than 255 bytes are split into multiple options with the same code (RFC 3396)
+		packet.Options[code] = append(packet.Options[code], options[i+2:i+2+length]...)
+		i += 2 + length
+	}
+
+	return packet, nil
+}
+
+func nullTerminatedString(data []byte) string {
+	if index := bytes.IndexByte(data, 0); index >= 0 {
+		return string(data[:index])
+	}
+	return string(data)
+}
+
+// MessageType returns the DHCP message type, or 0 for a plain BOOTP packet
+func (p *DHCPPacket) MessageType() byte {
+	if len(p.Options[optionMessageType]) != 1 {
+		return 0
+	}
+	return p.Options[optionMessageType][0]
+}
+
+// Marshal encodes the packet, the message type is written as first option as some PXE firmwares expect it there
+func (p *DHCPPacket) Marshal() []byte {
+	data := make([]byte, dhcpFixedHeaderLength+4, dhcpMinimumPacketLength)
+	data[0] = p.Op
+	data[1] = p.HType
+	data[2] = byte(len(p.CHAddr))
+	data[3] = p.Hops
+	binary.BigEndian.PutUint32(data[4:], p.XID)
+	binary.BigEndian.PutUint16(data[8:], p.Secs)
+	binary.BigEndian.PutUint16(data[10:], p.Flags)
+	copy(data[12:16], p.CIAddr.To4())
+	copy(data[16:20], p.YIAddr.To4())
+	copy(data[20:24], p.SIAddr.To4())
+	copy(data[24:28], p.GIAddr.To4())
+	copy(data[28:44], p.CHAddr)
+	copy(data[44:44+dhcpServerNameFieldLength-1], p.SName)
+	copy(data[108:108+maxBootFileLength], p.File)
+	binary.BigEndian.PutUint32(data[dhcpFixedHeaderLength:], dhcpMagicCookie)
+
+	codes := make([]int, 0, len(p.Options))
+	for code := range p.Options {
+		if code != optionMessageType {
+			codes = append(codes, int(code))
+		}
+	}
+	sort.Ints(codes)
+	if _, ok := p.Options[optionMessageType]; ok {
+		codes = append([]int{optionMessageType}, codes...)
+	}
+
+	for _, code := range codes {
+		value := p.Options[byte(code)]
+		for {
+			chunk := value
+			if len(chunk) > 255 {
+				chunk = chunk[:255]
+			}
+			data = append(data, byte(code), byte(len(chunk)))
+			data = append(data, chunk...)
+			value = value[len(chunk):]
+			if len(value) == 0 {
+				break
+			}
+		}
+	}
+	data = append(data, optionEnd)
+
+	// Some relay agents and firmwares drop packets shorter than the minimal BOOTP packet
+	for len(data) < dhcpMinimumPacketLength {
+		data = append(data, optionPad)
+	}
+	return data
+}
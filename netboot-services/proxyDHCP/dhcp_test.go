@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDHCPPacketMarshalAndParse(t *testing.T) {
+	// Arrange
+	packet := &DHCPPacket{
+		Op:     bootReply,
+		HType:  ethernetHardwareAddress,
+		XID:    0xdeadbeef,
+		Flags:  dhcpBroadcastFlag,
+		CIAddr: net.IPv4zero,
+		YIAddr: net.IPv4zero,
+		SIAddr: net.IPv4(192, 168, 1, 1),
+		GIAddr: net.IPv4(10, 0, 0, 1),
+		CHAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		File:   "undionly.kpxe",
+		Options: map[byte][]byte{
+			optionVendorClass: []byte(pxeClientVendorClass),
+			optionMessageType: {dhcpOffer},
+			// Longer than a single option
+			optionUserClass: bytes.Repeat([]byte("a"), 300),
+		},
+	}
+
+	// Act
+	data := packet.Marshal()
+	parsedPacket, err := parseDHCPPacket(data)
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, byte(optionMessageType), data[dhcpFixedHeaderLength+4])
+	assert.Equal(t, packet.XID, parsedPacket.XID)
+	assert.Equal(t, packet.Flags, parsedPacket.Flags)
+	assert.Equal(t, "192.168.1.1", parsedPacket.SIAddr.String())
+	assert.Equal(t, "10.0.0.1", parsedPacket.GIAddr.String())
+	assert.Equal(t, packet.CHAddr, parsedPacket.CHAddr)
+	assert.Equal(t, "undionly.kpxe", parsedPacket.File)
+	assert.Equal(t, packet.Options, parsedPacket.Options)
+	assert.Equal(t, byte(dhcpOffer), parsedPacket.MessageType())
+}
+
+func TestParseDHCPPacketRejectsInvalidPackets(t *testing.T) {
+	valid := (&DHCPPacket{Op: bootRequest, HType: ethernetHardwareAddress, CHAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}}).Marshal()
+
+	tests := []struct {
+		name   string
+		packet func() []byte
+	}{
+		{name: "Too short", packet: func() []byte { return valid[:100] }},
+		{name: "Missing magic cookie", packet: func() []byte {
+			packet := append([]byte{}, valid...)
+			packet[dhcpFixedHeaderLength] = 0
+			return packet
+		}},
+		{name: "Truncated option", packet: func() []byte {
+			return append(append([]byte{}, valid[:dhcpFixedHeaderLength+4]...), optionVendorClass, 20, 'P')
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			_, err := parseDHCPPacket(test.packet())
+
+			// Assert
+			assert.Error(t, err)
+		})
+	}
+}
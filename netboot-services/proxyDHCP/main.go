@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	log.SetLevel(log.InfoLevel)
+	log.SetFormatter(&log.JSONFormatter{})
+
+	proxy, err := loadProxyDHCP()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serveErrors := make(chan error)
+	for _, port := range []int{proxyDHCPPort, pxeBootServerPort} {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func(conn *net.UDPConn, port int) {
+			serveErrors <- proxy.Serve(conn, port)
+		}(conn, port)
+	}
+
+	log.Infof("Answering PXE clients on ports %d and %d with boot server %s", proxyDHCPPort, pxeBootServerPort, proxy.ServerIP)
+	log.Fatal(<-serveErrors)
+}
+
+// loadProxyDHCP reads the configuration from the environment variables
+func loadProxyDHCP() (*ProxyDHCP, error) {
+	serverIP := net.ParseIP(os.Getenv("NETBOOT_SERVER_IP")).To4()
+	if serverIP == nil {
+		return nil, fmt.Errorf("NETBOOT_SERVER_IP must be an IPv4 address")
+	}
+
+	proxy := &ProxyDHCP{
+		ServerIP:  serverIP,
+		BootFiles: defaultBootFiles(),
+		MenuURL:   fmt.Sprintf("tftp://%s/ipxe/menu.ipxe", serverIP),
+		// The iPXE binaries are served by the asset server, UEFI firmwares only trust HTTPS with an enrolled CA
+		HTTPBootFiles: defaultHTTPBootFiles(),
+		HTTPBootURL:   fmt.Sprintf("http://%s/boot", serverIP),
+	}
+
+	if os.Getenv("MENU_URL") != "" {
+		proxy.MenuURL = os.Getenv("MENU_URL")
+	}
+	if os.Getenv("HTTP_BOOT_URL") != "" {
+		proxy.HTTPBootURL = strings.TrimSuffix(os.Getenv("HTTP_BOOT_URL"), "/")
+	}
+	if os.Getenv("BOOT_FILE_BIOS") != "" {
+		proxy.BootFiles[architectureBIOS] = os.Getenv("BOOT_FILE_BIOS")
+	}
+	if os.Getenv("BOOT_FILE_EFI32") != "" {
+		proxy.BootFiles[architectureEFIIA32] = os.Getenv("BOOT_FILE_EFI32")
+		proxy.HTTPBootFiles[architectureEFIIA32HTTP] = os.Getenv("BOOT_FILE_EFI32")
+	}
+	if os.Getenv("BOOT_FILE_EFI64") != "" {
+		proxy.BootFiles[architectureEFIBC] = os.Getenv("BOOT_FILE_EFI64")
+		proxy.BootFiles[architectureEFIX8664] = os.Getenv("BOOT_FILE_EFI64")
+		proxy.HTTPBootFiles[architectureEFIX64HTTP] = os.Getenv("BOOT_FILE_EFI64")
+	}
+
+	if err := proxy.validateBootFiles(); err != nil {
+		return nil, err
+	}
+	return proxy, nil
+}
+
+// validateBootFiles rejects boot files which do not fit into the file field of the DHCP header, the clients would get
+// a truncated name
+func (p *ProxyDHCP) validateBootFiles() error {
+	bootFiles := map[string]string{"MENU_URL": p.MenuURL}
+	for architecture, bootFile := range p.BootFiles {
+		bootFiles[fmt.Sprintf("boot file of architecture %d", architecture)] = bootFile
+	}
+	for architecture, bootFile := range p.HTTPBootFiles {
+		bootFiles[fmt.Sprintf("HTTP boot URL of architecture %d", architecture)] = p.HTTPBootURL + "/" + bootFile
+	}
+	for name, bootFile := range bootFiles {
+		if len(bootFile) > maxBootFileLength {
+			return fmt.Errorf("the %s %s is %d bytes long, the DHCP boot file field only holds %d", name, bootFile, len(bootFile), maxBootFileLength)
+		}
+	}
+	return nil
+}
+
+// Serve answers the requests received on the port until reading from the connection fails
+func (p *ProxyDHCP) Serve(conn *net.UDPConn, port int) error {
+	buffer := make([]byte, 1500)
+	for {
+		n, source, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return err
+		}
+
+		request, err := parseDHCPPacket(buffer[:n])
+		if err != nil {
+			log.Debugf("Ignoring invalid packet from %s: %s", source, err)
+			continue
+		}
+
+		reply, err := p.Respond(request, port)
+		if err != nil {
+			log.Warnf("Not answering %s: %s", request.CHAddr, err)
+			continue
+		}
+		if reply == nil {
+			continue
+		}
+
+		_, err = conn.WriteToUDP(reply.Marshal(), replyAddress(request, source, port))
+		if err != nil {
+			log.Errorf("Could not answer %s: %s", request.CHAddr, err)
+		}
+	}
+}
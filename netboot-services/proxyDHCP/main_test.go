@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadProxyDHCPRejectsLongBootFiles(t *testing.T) {
+	tests := []struct {
+		name          string
+		variable      string
+		value         string
+		expectedError string
+	}{
+		{name: "Longest menu URL", variable: "MENU_URL", value: "http://" + strings.Repeat("a", maxBootFileLength-len("http://"))},
+		{name: "Menu URL too long", variable: "MENU_URL", value: "http://" + strings.Repeat("a", maxBootFileLength), expectedError: "the MENU_URL"},
+		{name: "Boot file too long", variable: "BOOT_FILE_BIOS", value: strings.Repeat("a", maxBootFileLength+1), expectedError: "the boot file of architecture 0"},
+		{name: "HTTP boot URL too long", variable: "HTTP_BOOT_URL", value: "http://" + strings.Repeat("a", maxBootFileLength), expectedError: "HTTP boot URL of architecture"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			t.Setenv("NETBOOT_SERVER_IP", "192.168.1.1")
+			t.Setenv(test.variable, test.value)
+
+			// Act
+			proxy, err := loadProxyDHCP()
+
+			// Assert
+			if test.expectedError == "" {
+				require.NoError(t, err)
+				assert.Equal(t, test.value, proxy.MenuURL)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.expectedError)
+			assert.Nil(t, proxy)
+		})
+	}
+}
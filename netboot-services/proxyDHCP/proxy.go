@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Client system architecture types of option 93 (RFC 4578 and the IANA registry)
+const (
+	architectureBIOS        = 0
+	architectureEFIIA32     = 6
+	architectureEFIBC       = 7
+	architectureEFIX8664    = 9
+	architectureEFIIA32HTTP = 15
+	architectureEFIX64HTTP  = 16
+	proxyDHCPPort           = 67
+	pxeBootServerPort       = 4011
+	dhcpClientPort          = 68
+	pxeClientVendorClass    = "PXEClient"
+	httpClientVendorClass   = "HTTPClient"
+	ipxeUserClass           = "iPXE"
+	dhcpBroadcastFlag       = 0x8000
+	ethernetHardwareAddress = 1
+)
+
+// ProxyDHCP answers PXE clients with the boot server and the boot file of their architecture. It never assigns
+// addresses: yiaddr stays empty and no lease time, netmask or router are sent, the address is left to the DHCP server of the site.
+type ProxyDHCP struct {
+	ServerIP net.IP
+	// BootFiles maps the client architecture (option 93) to the iPXE binary on the TFTP server
+	BootFiles map[uint16]string
+	// MenuURL is handed to clients that already run iPXE, so they load the menu instead of iPXE again
+	MenuURL string
+	// HTTPBootFiles maps the architectures of UEFI HTTP Boot clients to the iPXE binary, which is downloaded from HTTPBootURL
+	HTTPBootFiles map[uint16]string
+	HTTPBootURL   string
+}
+
+func defaultHTTPBootFiles() map[uint16]string {
+	return map[uint16]string{
+		architectureEFIIA32HTTP: "ipxe32.efi",
+		architectureEFIX64HTTP:  "ipxe64.efi",
+	}
+}
+
+func defaultBootFiles() map[uint16]string {
+	return map[uint16]string{
+		architectureBIOS:     "undionly.kpxe",
+		architectureEFIIA32:  "ipxe32.efi",
+		architectureEFIBC:    "ipxe64.efi",
+		architectureEFIX8664: "ipxe64.efi",
+	}
+}
+
+// Respond returns the reply to a request received on the given port, or nil if the request is not for us
+func (p *ProxyDHCP) Respond(request *DHCPPacket, port int) (*DHCPPacket, error) {
+	if request.Op != bootRequest || request.HType != ethernetHardwareAddress {
+		return nil, nil
+	}
+
+	var replyType byte
+	switch {
+	case port == proxyDHCPPort && request.MessageType() == dhcpDiscover:
+		replyType = dhcpOffer
+	case port == pxeBootServerPort && (request.MessageType() == dhcpRequest || request.MessageType() == dhcpInform):
+		replyType = dhcpAck
+	default:
+		// Requests to the DHCP server of the site are none of our business
+		return nil, nil
+	}
+
+	vendorClass := string(request.Options[optionVendorClass])
+	httpClient := strings.HasPrefix(vendorClass, httpClientVendorClass)
+	if !httpClient && !strings.HasPrefix(vendorClass, pxeClientVendorClass) {
+		return nil, nil
+	}
+	// UEFI HTTP Boot clients only use DHCP on port 67
+	if httpClient && port != proxyDHCPPort {
+		return nil, nil
+	}
+
+	architecture, err := clientArchitecture(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var bootFile string
+	var ok bool
+	switch {
+	case isIPXEClient(request):
+		bootFile, ok = p.MenuURL, true
+	case httpClient:
+		bootFile, ok = p.HTTPBootFiles[architecture]
+		bootFile = p.HTTPBootURL + "/" + bootFile
+	default:
+		bootFile, ok = p.BootFiles[architecture]
+	}
+	if !ok {
+		return nil, fmt.Errorf("no boot file for client architecture %d", architecture)
+	}
+
+	reply := &DHCPPacket{
+		Op:     bootReply,
+		HType:  request.HType,
+		XID:    request.XID,
+		Flags:  request.Flags,
+		CIAddr: request.CIAddr,
+		YIAddr: net.IPv4zero,
+		SIAddr: p.ServerIP,
+		GIAddr: request.GIAddr,
+		CHAddr: request.CHAddr,
+		File:   bootFile,
+		Options: map[byte][]byte{
+			optionMessageType:      {replyType},
+			optionServerIdentifier: p.ServerIP.To4(),
+		},
+	}
+	if httpClient {
+		// UEFI HTTP Boot clients only accept answers with their vendor class
+		reply.Options[optionVendorClass] = []byte(httpClientVendorClass)
+	} else {
+		reply.Options[optionVendorClass] = []byte(pxeClientVendorClass)
+		// Boot the file of this reply instead of discovering boot servers with multicast or broadcast
+		reply.Options[optionVendorSpecific] = []byte{pxeOptionDiscoveryControl, 1, pxeDiscoveryUseBootFile, optionEnd}
+	}
+	// Some UEFI firmwares ignore replies without their machine ID
+	if machineID, ok := request.Options[optionClientMachineID]; ok {
+		reply.Options[optionClientMachineID] = machineID
+	}
+
+	log.WithFields(log.Fields{
+		"type":         "dhcp",
+		"mac":          request.CHAddr.String(),
+		"architecture": architecture,
+		"ipxe":         isIPXEClient(request),
+		"file":         bootFile,
+		"port":         port,
+	}).Info("answered PXE client")
+
+	return reply, nil
+}
+
+func clientArchitecture(request *DHCPPacket) (uint16, error) {
+	option, ok := request.Options[optionClientArchitecture]
+	if !ok {
+		// Option 93 is mandatory for PXE clients, very old BIOS ROMs omit it
+		return architectureBIOS, nil
+	}
+	if len(option) < 2 {
+		return 0, fmt.Errorf("invalid client architecture option %x", option)
+	}
+	return binary.BigEndian.Uint16(option), nil
+}
+
+// isIPXEClient detects iPXE by its user class (option 77) or its encapsulated options (option 175)
+func isIPXEClient(request *DHCPPacket) bool {
+	if _, ok := request.Options[optionIPXEEncapsulated]; ok {
+		return true
+	}
+	return bytes.Contains(request.Options[optionUserClass], []byte(ipxeUserClass))
+}
+
+// replyAddress returns the address a reply has to be sent to. Clients asking on port 67 have no address yet,
+// they are answered via the relay agent or with a broadcast.
+func replyAddress(request *DHCPPacket, source *net.UDPAddr, port int) *net.UDPAddr {
+	if port == pxeBootServerPort {
+		return source
+	}
+	if !request.GIAddr.IsUnspecified() {
+		return &net.UDPAddr{IP: request.GIAddr, Port: proxyDHCPPort}
+	}
+	if !request.CIAddr.IsUnspecified() && request.Flags&dhcpBroadcastFlag == 0 {
+		return &net.UDPAddr{IP: request.CIAddr, Port: dhcpClientPort}
+	}
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpClientPort}
+}
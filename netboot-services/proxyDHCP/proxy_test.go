@@ -0,0 +1,213 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRequest(messageType byte, architecture uint16, userClass string) *DHCPPacket {
+	request := &DHCPPacket{
+		Op:     bootRequest,
+		HType:  ethernetHardwareAddress,
+		XID:    0x12345678,
+		CIAddr: net.IPv4zero,
+		YIAddr: net.IPv4zero,
+		SIAddr: net.IPv4zero,
+		GIAddr: net.IPv4zero,
+		CHAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		Options: map[byte][]byte{
+			optionMessageType:        {messageType},
+			optionVendorClass:        []byte("PXEClient:Arch:00007:UNDI:003016"),
+			optionClientArchitecture: {byte(architecture >> 8), byte(architecture)},
+			optionClientMachineID:    {0, 1, 2, 3},
+		},
+	}
+	if userClass != "" {
+		request.Options[optionUserClass] = []byte(userClass)
+	}
+	return request
+}
+
+func newTestProxyDHCP() *ProxyDHCP {
+	return &ProxyDHCP{
+		ServerIP:      net.IPv4(192, 168, 1, 1).To4(),
+		BootFiles:     defaultBootFiles(),
+		MenuURL:       "tftp://192.168.1.1/ipxe/menu.ipxe",
+		HTTPBootFiles: defaultHTTPBootFiles(),
+		HTTPBootURL:   "http://192.168.1.1/boot",
+	}
+}
+
+func TestProxyDHCPRespond(t *testing.T) {
+	tests := []struct {
+		name             string
+		request          *DHCPPacket
+		port             int
+		expectedType     byte
+		expectedBootFile string
+	}{
+		{name: "BIOS discover", request: newTestRequest(dhcpDiscover, architectureBIOS, ""), port: 67, expectedType: dhcpOffer, expectedBootFile: "undionly.kpxe"},
+		{name: "32-bit UEFI discover", request: newTestRequest(dhcpDiscover, architectureEFIIA32, ""), port: 67, expectedType: dhcpOffer, expectedBootFile: "ipxe32.efi"},
+		{name: "64-bit UEFI discover", request: newTestRequest(dhcpDiscover, architectureEFIBC, ""), port: 67, expectedType: dhcpOffer, expectedBootFile: "ipxe64.efi"},
+		{name: "x86-64 UEFI request on boot server port", request: newTestRequest(dhcpRequest, architectureEFIX8664, ""), port: 4011, expectedType: dhcpAck, expectedBootFile: "ipxe64.efi"},
+		{name: "iPXE gets the menu", request: newTestRequest(dhcpRequest, architectureBIOS, "iPXE"), port: 4011, expectedType: dhcpAck, expectedBootFile: "tftp://192.168.1.1/ipxe/menu.ipxe"},
+		{name: "Request to the site's DHCP server", request: newTestRequest(dhcpRequest, architectureBIOS, ""), port: 67},
+		{name: "Discover on boot server port", request: newTestRequest(dhcpDiscover, architectureBIOS, ""), port: 4011},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			proxy := newTestProxyDHCP()
+
+			// Act
+			reply, err := proxy.Respond(test.request, test.port)
+
+			// Assert
+			require.NoError(t, err)
+			if test.expectedType == 0 {
+				assert.Nil(t, reply)
+				return
+			}
+			require.NotNil(t, reply)
+			assert.Equal(t, test.expectedType, reply.MessageType())
+			assert.Equal(t, test.expectedBootFile, reply.File)
+			assert.Equal(t, test.request.XID, reply.XID)
+			assert.Equal(t, "192.168.1.1", reply.SIAddr.String())
+			assert.Equal(t, []byte{0, 1, 2, 3}, reply.Options[optionClientMachineID])
+		})
+	}
+}
+
+func TestProxyDHCPRespondToHTTPClient(t *testing.T) {
+	tests := []struct {
+		name             string
+		architecture     uint16
+		port             int
+		expectedBootFile string
+	}{
+		{name: "x64 UEFI HTTP Boot", architecture: architectureEFIX64HTTP, port: 67, expectedBootFile: "http://192.168.1.1/boot/ipxe64.efi"},
+		{name: "x86 UEFI HTTP Boot", architecture: architectureEFIIA32HTTP, port: 67, expectedBootFile: "http://192.168.1.1/boot/ipxe32.efi"},
+		{name: "Boot server port", architecture: architectureEFIX64HTTP, port: 4011},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			proxy := newTestProxyDHCP()
+			request := newTestRequest(dhcpDiscover, test.architecture, "")
+			request.Options[optionVendorClass] = []byte("HTTPClient:Arch:00016:UNDI:003001")
+
+			// Act
+			reply, err := proxy.Respond(request, test.port)
+
+			// Assert
+			require.NoError(t, err)
+			if test.expectedBootFile == "" {
+				assert.Nil(t, reply)
+				return
+			}
+			require.NotNil(t, reply)
+			assert.Equal(t, test.expectedBootFile, reply.File)
+			assert.Equal(t, []byte("HTTPClient"), reply.Options[optionVendorClass])
+			assert.NotContains(t, reply.Options, byte(optionVendorSpecific))
+		})
+	}
+}
+
+func TestProxyDHCPNeverHandsOutLeases(t *testing.T) {
+	// Arrange
+	proxy := newTestProxyDHCP()
+
+	// Act
+	reply, err := proxy.Respond(newTestRequest(dhcpDiscover, architectureBIOS, ""), 67)
+
+	// Assert
+	require.NoError(t, err)
+	parsedReply, err := parseDHCPPacket(reply.Marshal())
+	require.NoError(t, err)
+	assert.True(t, parsedReply.YIAddr.IsUnspecified())
+	// Lease time, subnet mask and router
+	for _, option := range []byte{51, 1, 3} {
+		assert.NotContains(t, parsedReply.Options, option)
+	}
+}
+
+func TestProxyDHCPIgnoresOtherClients(t *testing.T) {
+	tests := []struct {
+		name    string
+		request func() *DHCPPacket
+	}{
+		{name: "No PXE vendor class", request: func() *DHCPPacket {
+			request := newTestRequest(dhcpDiscover, architectureBIOS, "")
+			request.Options[optionVendorClass] = []byte("MSFT 5.0")
+			return request
+		}},
+		{name: "Reply", request: func() *DHCPPacket {
+			request := newTestRequest(dhcpDiscover, architectureBIOS, "")
+			request.Op = bootReply
+			return request
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			proxy := newTestProxyDHCP()
+
+			// Act
+			reply, err := proxy.Respond(test.request(), 67)
+
+			// Assert
+			assert.NoError(t, err)
+			assert.Nil(t, reply)
+		})
+	}
+}
+
+func TestProxyDHCPUnknownArchitecture(t *testing.T) {
+	// Arrange
+	proxy := newTestProxyDHCP()
+
+	// Act
+	reply, err := proxy.Respond(newTestRequest(dhcpDiscover, 11, ""), 67)
+
+	// Assert
+	assert.Error(t, err)
+	assert.Nil(t, reply)
+}
+
+func TestReplyAddress(t *testing.T) {
+	source := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 68}
+
+	tests := []struct {
+		name            string
+		port            int
+		giaddr          net.IP
+		ciaddr          net.IP
+		expectedAddress string
+	}{
+		{name: "Broadcast", port: 67, giaddr: net.IPv4zero, ciaddr: net.IPv4zero, expectedAddress: "255.255.255.255:68"},
+		{name: "Relay agent", port: 67, giaddr: net.IPv4(10, 0, 0, 1), ciaddr: net.IPv4zero, expectedAddress: "10.0.0.1:67"},
+		{name: "Client with address", port: 67, giaddr: net.IPv4zero, ciaddr: net.IPv4(10, 0, 0, 5), expectedAddress: "10.0.0.5:68"},
+		{name: "Boot server port", port: 4011, giaddr: net.IPv4(10, 0, 0, 1), ciaddr: net.IPv4(10, 0, 0, 5), expectedAddress: "10.0.0.5:68"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			request := newTestRequest(dhcpDiscover, architectureBIOS, "")
+			request.GIAddr = test.giaddr
+			request.CIAddr = test.ciaddr
+
+			// Act
+			address := replyAddress(request, source, test.port)
+
+			// Assert
+			assert.Equal(t, test.expectedAddress, address.String())
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// AzureBackend reads the images from Azure Blob Storage with a SAS token. If the blob URL has no container,
+// every channel is a container (https://[account].blob.core.windows.net/prod/...), otherwise the channels are folders in the container.
+type AzureBackend struct {
+	AccountURL string
+	Container  string
+	Prefix     string
+	SASToken   string
+	Client     *http.Client
+}
+
+type azureBlobList struct {
+	Blobs []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			LastModified  string `xml:"Last-Modified"`
+			ContentLength int64  `xml:"Content-Length"`
+		} `xml:"Properties"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+func newAzureBackend(blobURL string, sasToken string, client *http.Client) (*AzureBackend, error) {
+	parsedURL, err := url.Parse(blobURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SYNC_BLOB_URL: %w", err)
+	}
+	container, prefix, _ := strings.Cut(strings.Trim(parsedURL.Path, "/"), "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &AzureBackend{
+		AccountURL: parsedURL.Scheme + "://" + parsedURL.Host,
+		Container:  container,
+		Prefix:     prefix,
+		SASToken:   strings.TrimPrefix(sasToken, "?"),
+		Client:     client,
+	}, nil
+}
+
+// location returns the container and the blob name prefix of a channel
+func (b *AzureBackend) location(channel string) (string, string) {
+	if b.Container == "" {
+		return channel, ""
+	}
+	return b.Container, b.Prefix + channel + "/"
+}
+
+func (b *AzureBackend) List(ctx context.Context, channel string) ([]RemoteFile, error) {
+	container, prefix := b.location(channel)
+
+	var files []RemoteFile
+	marker := ""
+	for {
+		query := url.Values{"restype": {"container"}, "comp": {"list"}}
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		listURL := fmt.Sprintf("%s/%s?%s&%s", b.AccountURL, url.PathEscape(container), query.Encode(), b.SASToken)
+
+		body, err := getWithContext(ctx, b.Client, listURL)
+		if err != nil {
+			var statusError *httpStatusError
+			// A channel that does not exist yet is not an error, the container is created with the first upload
+			if errors.As(err, &statusError) && statusError.StatusCode == http.StatusNotFound {
+				return files, nil
+			}
+			return nil, err
+		}
+		var list azureBlobList
+		err = xml.NewDecoder(body).Decode(&list)
+		body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not parse the blob list of %s: %w", channel, err)
+		}
+
+		for _, blob := range list.Blobs {
+			modTime, err := time.Parse(http.TimeFormat, blob.Properties.LastModified)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Last-Modified of %s: %w", blob.Name, err)
+			}
+			files = append(files, RemoteFile{
+				Path:    strings.TrimPrefix(blob.Name, prefix),
+				Size:    blob.Properties.ContentLength,
+				ModTime: modTime,
+			})
+		}
+
+		if list.NextMarker == "" {
+			return files, nil
+		}
+		marker = list.NextMarker
+	}
+}
+
+func (b *AzureBackend) Open(ctx context.Context, channel string, path string) (io.ReadCloser, error) {
+	return getWithContext(ctx, b.Client, b.blobURL(channel, path))
+}
+
+func (b *AzureBackend) OpenRange(ctx context.Context, channel string, path string, offset int64, length int64) (io.ReadCloser, error) {
+	return getRange(ctx, b.Client, b.blobURL(channel, path), offset, length)
+}
+
+func (b *AzureBackend) blobURL(channel string, path string) string {
+	container, prefix := b.location(channel)
+	return fmt.Sprintf("%s/%s/%s?%s", b.AccountURL, url.PathEscape(container), escapePath(prefix+path), b.SASToken)
+}
+
+// escapePath escapes every segment of a slash separated path
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
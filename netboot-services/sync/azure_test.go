@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAzureBackend(t *testing.T) {
+	tests := []struct {
+		name              string
+		blobURL           string
+		expectedContainer string
+		expectedLocation  [2]string
+	}{
+		{name: "Container per channel", blobURL: "https://account.blob.core.windows.net", expectedLocation: [2]string{"prod", ""}},
+		{name: "Channels in a container", blobURL: "https://account.blob.core.windows.net/netboot/", expectedContainer: "netboot", expectedLocation: [2]string{"netboot", "prod/"}},
+		{name: "Channels in a folder", blobURL: "https://account.blob.core.windows.net/netboot/images", expectedContainer: "netboot", expectedLocation: [2]string{"netboot", "images/prod/"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			backend, err := newAzureBackend(test.blobURL, "?sv=1&sig=secret", http.DefaultClient)
+
+			// Assert
+			require.NoError(t, err)
+			assert.Equal(t, "https://account.blob.core.windows.net", backend.AccountURL)
+			assert.Equal(t, test.expectedContainer, backend.Container)
+			assert.Equal(t, "sv=1&sig=secret", backend.SASToken)
+			container, prefix := backend.location("prod")
+			assert.Equal(t, test.expectedLocation, [2]string{container, prefix})
+		})
+	}
+}
+
+func TestAzureBackendList(t *testing.T) {
+	// Arrange
+	pages := map[string]string{
+		"": `<?xml version="1.0" encoding="utf-8"?><EnumerationResults><Blobs>
+<Blob><Name>prod/image1/image1.squashfs</Name><Properties><Last-Modified>Mon, 01 Jan 2024 10:00:00 GMT</Last-Modified><Content-Length>1024</Content-Length></Properties></Blob>
+</Blobs><NextMarker>page2</NextMarker></EnumerationResults>`,
+		"page2": `<?xml version="1.0" encoding="utf-8"?><EnumerationResults><Blobs>
+<Blob><Name>prod/image1/vmlinuz</Name><Properties><Last-Modified>Mon, 01 Jan 2024 11:00:00 GMT</Last-Modified><Content-Length>10</Content-Length></Properties></Blob>
+</Blobs><NextMarker /></EnumerationResults>`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/netboot" || r.URL.Query().Get("prefix") != "prod/" || r.URL.Query().Get("sig") != "secret" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, pages[r.URL.Query().Get("marker")])
+	}))
+	defer server.Close()
+	backend, err := newAzureBackend(server.URL+"/netboot", "sig=secret", server.Client())
+	require.NoError(t, err)
+
+	// Act
+	files, err := backend.List(context.Background(), "prod")
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, []RemoteFile{
+		{Path: "image1/image1.squashfs", Size: 1024, ModTime: time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)},
+		{Path: "image1/vmlinuz", Size: 10, ModTime: time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC)},
+	}, files)
+}
+
+func TestAzureBackendMissingChannel(t *testing.T) {
+	// Arrange
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	backend, err := newAzureBackend(server.URL, "sig=secret", server.Client())
+	require.NoError(t, err)
+
+	// Act
+	files, err := backend.List(context.Background(), "dev")
+
+	// Assert
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestAzureBackendOpen(t *testing.T) {
+	// Arrange
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/prod/image 1/vmlinuz" && r.URL.Query().Get("sig") == "secret" {
+			fmt.Fprint(w, "kernel")
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+	backend, err := newAzureBackend(server.URL, "sig=secret", server.Client())
+	require.NoError(t, err)
+
+	// Act
+	body, err := backend.Open(context.Background(), "prod", "image 1/vmlinuz")
+	require.NoError(t, err)
+	content, _ := io.ReadAll(body)
+	body.Close()
+	_, forbiddenErr := backend.Open(context.Background(), "prod", "other/vmlinuz")
+
+	// Assert
+	assert.Equal(t, "kernel", string(content))
+	require.Error(t, forbiddenErr)
+	assert.NotContains(t, forbiddenErr.Error(), "secret")
+}
+
+func TestAzureBackendOpenUnreachable(t *testing.T) {
+	// Arrange
+	server := httptest.NewServer(http.NotFoundHandler())
+	backend, err := newAzureBackend(server.URL, "sv=2020&sig=secret", server.Client())
+	require.NoError(t, err)
+	server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Act
+	_, err = backend.Open(context.Background(), "prod", "image1/vmlinuz")
+	_, rangeErr := backend.OpenRange(context.Background(), "prod", "image1/image1.squashfs", 0, 10)
+	_, canceledErr := backend.Open(ctx, "prod", "image1/vmlinuz")
+
+	// Assert
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "secret")
+	assert.Contains(t, err.Error(), "/prod/image1/vmlinuz")
+	require.Error(t, rangeErr)
+	assert.NotContains(t, rangeErr.Error(), "secret")
+	assert.ErrorIs(t, canceledErr, context.Canceled)
+}
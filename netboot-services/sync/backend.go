@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// RemoteFile is a file of a channel in the storage, its path is relative to the channel and uses slashes, e.g. [image folder]/vmlinuz
+type RemoteFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	// SHA256 is only known for files of a published manifest
+	SHA256 string `json:"sha256,omitempty"`
+	// ChunkSize and Chunks are the SHA-256 hashes of the consecutive chunks of the file, each chunk is verified when it is downloaded
+	ChunkSize int64    `json:"chunkSize,omitempty"`
+	Chunks    []string `json:"chunks,omitempty"`
+}
+
+// Backend is a storage the images are synced from
+type Backend interface {
+	// List returns all files of the channel, it returns an empty list for a channel that does not exist
+	List(ctx context.Context, channel string) ([]RemoteFile, error)
+	// Open returns the content of a file of the channel
+	Open(ctx context.Context, channel string, path string) (io.ReadCloser, error)
+	// OpenRange returns length bytes of a file of the channel, starting at offset
+	OpenRange(ctx context.Context, channel string, path string, offset int64, length int64) (io.ReadCloser, error)
+}
+
+// newBackendFromEnv creates the backend configured with SYNC_BACKEND, which defaults to Azure Blob Storage
+func newBackendFromEnv() (Backend, error) {
+	// No timeout, downloading a squashfs file takes hours on slow links
+	httpClient := &http.Client{}
+
+	switch os.Getenv("SYNC_BACKEND") {
+	case "", "azure":
+		if os.Getenv("SYNC_BLOB_URL") == "" || os.Getenv("SYNC_SAS_TOKEN") == "" {
+			return nil, fmt.Errorf("SYNC_BLOB_URL and SYNC_SAS_TOKEN have to be set for the azure backend")
+		}
+		backend, err := newAzureBackend(os.Getenv("SYNC_BLOB_URL"), os.Getenv("SYNC_SAS_TOKEN"), httpClient)
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	case "s3":
+		backend := &S3Backend{
+			Endpoint:        strings.TrimSuffix(os.Getenv("SYNC_S3_ENDPOINT"), "/"),
+			Bucket:          os.Getenv("SYNC_S3_BUCKET"),
+			Prefix:          os.Getenv("SYNC_S3_PREFIX"),
+			Region:          os.Getenv("SYNC_S3_REGION"),
+			AccessKeyID:     os.Getenv("SYNC_S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("SYNC_S3_SECRET_ACCESS_KEY"),
+			Client:          httpClient,
+		}
+		if backend.Endpoint == "" || backend.Bucket == "" || backend.AccessKeyID == "" || backend.SecretAccessKey == "" {
+			return nil, fmt.Errorf("SYNC_S3_ENDPOINT, SYNC_S3_BUCKET, SYNC_S3_ACCESS_KEY_ID and SYNC_S3_SECRET_ACCESS_KEY have to be set for the s3 backend")
+		}
+		if backend.Region == "" {
+			backend.Region = "us-east-1"
+		}
+		return backend, nil
+	case "http":
+		if os.Getenv("SYNC_HTTP_URL") == "" {
+			return nil, fmt.Errorf("SYNC_HTTP_URL has to be set for the http backend")
+		}
+		return &HTTPManifestBackend{BaseURL: strings.TrimSuffix(os.Getenv("SYNC_HTTP_URL"), "/"), Client: httpClient}, nil
+	case "local":
+		if os.Getenv("SYNC_SOURCE_DIRECTORY") == "" {
+			return nil, fmt.Errorf("SYNC_SOURCE_DIRECTORY has to be set for the local backend")
+		}
+		return &LocalBackend{Directory: os.Getenv("SYNC_SOURCE_DIRECTORY")}, nil
+	default:
+		return nil, fmt.Errorf("unknown SYNC_BACKEND %s, expected azure, s3, http or local", os.Getenv("SYNC_BACKEND"))
+	}
+}
+
+// getWithContext sends a GET request and returns the body of a successful response
+func getWithContext(ctx context.Context, client *http.Client, url string) (io.ReadCloser, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return doRequest(client, request)
+}
+
+// getRange sends a GET request for length bytes of the file, starting at offset
+func getRange(ctx context.Context, client *http.Client, url string, offset int64, length int64) (io.ReadCloser, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	return doRangeRequest(client, request, offset, length)
+}
+
+func doRequest(client *http.Client, request *http.Request) (io.ReadCloser, error) {
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, redactURLError(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, &httpStatusError{StatusCode: response.StatusCode, URL: request.URL.Redacted()}
+	}
+	return response.Body, nil
+}
+
+func doRangeRequest(client *http.Client, request *http.Request, offset int64, length int64) (io.ReadCloser, error) {
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, redactURLError(err)
+	}
+	switch {
+	case response.StatusCode == http.StatusPartialContent:
+		return response.Body, nil
+	case response.StatusCode == http.StatusOK && offset == 0:
+		// The server ignored the range, the start of the file can still be cut from the full response
+		return &limitedReadCloser{Reader: io.LimitReader(response.Body, length), Closer: response.Body}, nil
+	default:
+		response.Body.Close()
+		return nil, &httpStatusError{StatusCode: response.StatusCode, URL: request.URL.Redacted()}
+	}
+}
+
+// redactURLError leaves the query out of the URL of a failed request, it contains the SAS token. The wrapped error is
+// kept, so a canceled context is still detected.
+func redactURLError(err error) error {
+	var urlError *url.Error
+	if !errors.As(err, &urlError) {
+		return err
+	}
+	return &url.Error{Op: urlError.Op, URL: strings.SplitN(urlError.URL, "?", 2)[0], Err: urlError.Err}
+}
+
+// limitedReadCloser closes the underlying file or response body of a limited reader
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type httpStatusError struct {
+	StatusCode int
+	URL        string
+}
+
+func (e *httpStatusError) Error() string {
+	// The query is left out, it contains the SAS token
+	return fmt.Sprintf("GET %s returned %d", strings.SplitN(e.URL, "?", 2)[0], e.StatusCode)
+}
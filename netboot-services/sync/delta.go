@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// deltaIndexSuffix is appended to a squashfs file for its block index
+	deltaIndexSuffix = ".blocks"
+	deltaIndexMagic  = "NBDELTA1"
+	deltaFileSuffix  = ".delta"
+)
+
+// DeltaIndex holds a weak rolling checksum and a strong hash for every block of a file, like a zsync control file.
+// It is generated by the publish command next to every squashfs file and lets the syncer find the blocks of a new image
+// at any offset in a local image, so only the blocks which are not available locally have to be downloaded.
+type DeltaIndex struct {
+	BlockSize int64
+	FileSize  int64
+	SHA256    [sha256.Size]byte
+	Blocks    []DeltaBlock
+}
+
+type DeltaBlock struct {
+	Weak   uint32
+	Strong [16]byte
+}
+
+// DeltaResult reports how much of a file was taken from the seed and how much was downloaded
+type DeltaResult struct {
+	Seed            string
+	ReusedBytes     int64
+	DownloadedBytes int64
+}
+
+// weakChecksum is the rolling checksum of rsync, it can be moved forward by one byte without reading the whole block
+type weakChecksum struct {
+	a, b      uint32
+	blockSize uint32
+}
+
+func newWeakChecksum(block []byte) weakChecksum {
+	checksum := weakChecksum{blockSize: uint32(len(block))}
+	for i, value := range block {
+		checksum.a += uint32(value)
+		checksum.b += uint32(len(block)-i) * uint32(value)
+	}
+	return checksum
+}
+
+// roll removes the first byte of the block and appends the next one
+func (c *weakChecksum) roll(out byte, in byte) {
+	c.a = c.a - uint32(out) + uint32(in)
+	c.b = c.b - c.blockSize*uint32(out) + c.a
+}
+
+func (c weakChecksum) sum() uint32 {
+	return c.a&0xffff | c.b<<16
+}
+
+func strongHash(block []byte) [16]byte {
+	var strong [16]byte
+	hash := sha256.Sum256(block)
+	copy(strong[:], hash[:16])
+	return strong
+}
+
+// createDeltaIndex reads the file block by block and computes its index
+func createDeltaIndex(filePath string, blockSize int64) (*DeltaIndex, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	index := &DeltaIndex{BlockSize: blockSize}
+	fileHash := sha256.New()
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(file, block)
+		if n > 0 {
+			fileHash.Write(block[:n])
+			index.Blocks = append(index.Blocks, DeltaBlock{Weak: newWeakChecksum(block[:n]).sum(), Strong: strongHash(block[:n])})
+			index.FileSize += int64(n)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	copy(index.SHA256[:], fileHash.Sum(nil))
+	return index, nil
+}
+
+// WriteTo writes the index in its binary format: magic, block size, file size, file hash and the checksums of all blocks
+func (index *DeltaIndex) WriteTo(w io.Writer) (int64, error) {
+	buffer := &bytes.Buffer{}
+	buffer.WriteString(deltaIndexMagic)
+	binary.Write(buffer, binary.BigEndian, uint32(index.BlockSize))
+	binary.Write(buffer, binary.BigEndian, uint64(index.FileSize))
+	buffer.Write(index.SHA256[:])
+	for _, block := range index.Blocks {
+		binary.Write(buffer, binary.BigEndian, block.Weak)
+		buffer.Write(block.Strong[:])
+	}
+	return buffer.WriteTo(w)
+}
+
+func readDeltaIndex(indexPath string) (*DeltaIndex, error) {
+	file, err := os.Open(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	magic := make([]byte, len(deltaIndexMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != deltaIndexMagic {
+		return nil, fmt.Errorf("%s is no block index", indexPath)
+	}
+	var blockSize uint32
+	var fileSize uint64
+	index := &DeltaIndex{}
+	if err := binary.Read(reader, binary.BigEndian, &blockSize); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(reader, binary.BigEndian, &fileSize); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(reader, index.SHA256[:]); err != nil {
+		return nil, err
+	}
+	if blockSize == 0 {
+		return nil, fmt.Errorf("%s has an invalid block size", indexPath)
+	}
+	index.BlockSize = int64(blockSize)
+	index.FileSize = int64(fileSize)
+
+	blockCount := (index.FileSize + index.BlockSize - 1) / index.BlockSize
+	index.Blocks = make([]DeltaBlock, blockCount)
+	for i := range index.Blocks {
+		if err := binary.Read(reader, binary.BigEndian, &index.Blocks[i].Weak); err != nil {
+			return nil, fmt.Errorf("%s is truncated: %w", indexPath, err)
+		}
+		if _, err := io.ReadFull(reader, index.Blocks[i].Strong[:]); err != nil {
+			return nil, fmt.Errorf("%s is truncated: %w", indexPath, err)
+		}
+	}
+	return index, nil
+}
+
+// writeDeltaIndexes creates the missing or outdated block indexes of all squashfs files in the image folder
+func writeDeltaIndexes(imageDirectory string, blockSize int64) error {
+	return filepath.WalkDir(imageDirectory, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || !strings.HasSuffix(entry.Name(), ".squashfs") {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		indexPath := filePath + deltaIndexSuffix
+		if indexInfo, err := os.Stat(indexPath); err == nil && !indexInfo.ModTime().Before(info.ModTime()) {
+			if index, err := readDeltaIndex(indexPath); err == nil && index.BlockSize == blockSize && index.FileSize == info.Size() {
+				return nil
+			}
+		}
+
+		index, err := createDeltaIndex(filePath, blockSize)
+		if err != nil {
+			return err
+		}
+		output, err := os.Create(indexPath)
+		if err != nil {
+			return err
+		}
+		_, err = index.WriteTo(output)
+		if closeErr := output.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	})
+}
+
+// findDeltaSeed returns the local squashfs file sharing the most blocks with the index. Files with a block index are
+// compared by their block hashes, without one the newest squashfs file of the channel is taken.
+func (s *Syncer) findDeltaSeed(channel string, index *DeltaIndex) string {
+	strongHashes := map[[16]byte]bool{}
+	for _, block := range index.Blocks {
+		strongHashes[block.Strong] = true
+	}
+
+	var bestSeed string
+	var bestScore int
+	var bestModTime time.Time
+	for _, seedChannel := range s.Channels {
+		channelDirectory := filepath.Join(s.TargetDirectory, seedChannel)
+		filepath.WalkDir(channelDirectory, func(filePath string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if strings.HasPrefix(entry.Name(), ".") {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".squashfs") {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return nil
+			}
+
+			score := 0
+			if seedIndex, err := readDeltaIndex(filePath + deltaIndexSuffix); err == nil && seedIndex.BlockSize == index.BlockSize {
+				for _, block := range seedIndex.Blocks {
+					if strongHashes[block.Strong] {
+						score++
+					}
+				}
+			} else if seedChannel != channel {
+				return nil
+			}
+			if bestSeed == "" || score > bestScore || (score == bestScore && info.ModTime().After(bestModTime)) {
+				bestSeed, bestScore, bestModTime = filePath, score, info.ModTime()
+			}
+			return nil
+		})
+	}
+	return bestSeed
+}
+
+// findBlocksInSeed moves the weak checksum byte by byte over the seed and returns the seed offset of every block of
+// the index which was found, -1 for the blocks which have to be downloaded
+func findBlocksInSeed(seedPath string, index *DeltaIndex) ([]int64, error) {
+	offsets := make([]int64, len(index.Blocks))
+	blocksByWeak := map[uint32][]int{}
+	for i, block := range index.Blocks {
+		offsets[i] = -1
+		// The last block is shorter, it is always downloaded
+		if int64(i+1)*index.BlockSize <= index.FileSize {
+			blocksByWeak[block.Weak] = append(blocksByWeak[block.Weak], i)
+		}
+	}
+
+	seed, err := os.Open(seedPath)
+	if err != nil {
+		return nil, err
+	}
+	defer seed.Close()
+	reader := bufio.NewReaderSize(seed, 1024*1024)
+
+	window := make([]byte, index.BlockSize)
+	if _, err := io.ReadFull(reader, window); err != nil {
+		// The seed is smaller than a block
+		return offsets, nil
+	}
+	checksum := newWeakChecksum(window)
+	// head is the position of the first byte of the window, which is a ring buffer
+	head := 0
+	var offset int64
+	linear := make([]byte, index.BlockSize)
+	for {
+		matched := false
+		if candidates, ok := blocksByWeak[checksum.sum()]; ok {
+			copy(linear, window[head:])
+			copy(linear[len(window)-head:], window[:head])
+			strong := strongHash(linear)
+			for _, block := range candidates {
+				if offsets[block] < 0 && index.Blocks[block].Strong == strong {
+					offsets[block] = offset
+					matched = true
+				}
+			}
+		}
+
+		if matched {
+			// Continue after the matched block
+			if _, err := io.ReadFull(reader, window); err != nil {
+				return offsets, nil
+			}
+			checksum = newWeakChecksum(window)
+			head = 0
+			offset += index.BlockSize
+			continue
+		}
+
+		next, err := reader.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return offsets, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		checksum.roll(window[head], next)
+		window[head] = next
+		head = (head + 1) % len(window)
+		offset++
+	}
+}
+
+// syncDelta rebuilds a file from the most similar local squashfs file and the blocks which are not found in it.
+// The result is verified against the hash of the manifest, on any error the file is downloaded completely.
+func (s *Syncer) syncDelta(ctx context.Context, channel string, remotePath string, file RemoteFile, indexPath string, localPath string) (*DeltaResult, error) {
+	index, err := readDeltaIndex(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	if index.FileSize != file.Size {
+		return nil, fmt.Errorf("the block index is for %d bytes, the file has %d", index.FileSize, file.Size)
+	}
+	if file.SHA256 == "" {
+		file.SHA256 = hex.EncodeToString(index.SHA256[:])
+	}
+	seedPath := s.findDeltaSeed(channel, index)
+	if seedPath == "" {
+		return nil, fmt.Errorf("no local image to rebuild from")
+	}
+	offsets, err := findBlocksInSeed(seedPath, index)
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := os.Open(seedPath)
+	if err != nil {
+		return nil, err
+	}
+	defer seed.Close()
+	deltaPath := localPath + deltaFileSuffix
+	output, err := os.Create(deltaPath)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(deltaPath)
+	defer output.Close()
+
+	result := &DeltaResult{Seed: seedPath}
+	for block := 0; block < len(index.Blocks); {
+		offset := int64(block) * index.BlockSize
+		if offsets[block] >= 0 {
+			if _, err := io.Copy(io.NewOffsetWriter(output, offset), io.NewSectionReader(seed, offsets[block], index.BlockSize)); err != nil {
+				return nil, err
+			}
+			result.ReusedBytes += index.BlockSize
+			block++
+			continue
+		}
+
+		// Download consecutive missing blocks with one range request, at most a chunk at once
+		end := block + 1
+		for end < len(index.Blocks) && offsets[end] < 0 && int64(end-block+1)*index.BlockSize <= s.chunkSizeOf(RemoteFile{}) {
+			end++
+		}
+		length := int64(end-block) * index.BlockSize
+		if offset+length > file.Size {
+			length = file.Size - offset
+		}
+		err := s.retryWithBackoff(ctx, channel, remotePath, func() error {
+			written, err := s.downloadChunk(ctx, channel, remotePath, output, offset, length, "")
+			result.DownloadedBytes += written
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		block = end
+	}
+
+	if err := verifyFile(output, file); err != nil {
+		return nil, err
+	}
+	if err := output.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Chtimes(deltaPath, file.ModTime, file.ModTime); err != nil {
+		return nil, err
+	}
+	return result, os.Rename(deltaPath, localPath)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func randomTestContent(seed int64, size int) []byte {
+	content := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(content)
+	return content
+}
+
+// newerTestContent changes the content the way a new build does: bytes are inserted at the start, so all blocks move,
+// and one block in the middle changes
+func newerTestContent(content []byte) []byte {
+	newer := append(randomTestContent(2, 100), content...)
+	copy(newer[5000:], randomTestContent(3, 1024))
+	return newer
+}
+
+func TestWeakChecksumRoll(t *testing.T) {
+	// Arrange
+	content := randomTestContent(1, 300)
+	checksum := newWeakChecksum(content[:100])
+
+	// Act
+	for i := 100; i < len(content); i++ {
+		checksum.roll(content[i-100], content[i])
+	}
+
+	// Assert
+	assert.Equal(t, newWeakChecksum(content[200:]).sum(), checksum.sum())
+}
+
+func TestDeltaIndexRoundTrip(t *testing.T) {
+	// Arrange
+	filePath := filepath.Join(t.TempDir(), "image.squashfs")
+	require.NoError(t, os.WriteFile(filePath, randomTestContent(1, 2500), 0644))
+	index, err := createDeltaIndex(filePath, 1024)
+	require.NoError(t, err)
+
+	// Act
+	buffer := &bytes.Buffer{}
+	_, err = index.WriteTo(buffer)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filePath+deltaIndexSuffix, buffer.Bytes(), 0644))
+	readIndex, err := readDeltaIndex(filePath + deltaIndexSuffix)
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, index, readIndex)
+	assert.Len(t, readIndex.Blocks, 3)
+	assert.Equal(t, int64(2500), readIndex.FileSize)
+}
+
+func TestFindBlocksInSeed(t *testing.T) {
+	// Arrange
+	tempDir := t.TempDir()
+	seed := randomTestContent(1, 10*1024)
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "seed.squashfs"), seed, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "new.squashfs"), newerTestContent(seed), 0644))
+	index, err := createDeltaIndex(filepath.Join(tempDir, "new.squashfs"), 1024)
+	require.NoError(t, err)
+
+	// Act
+	offsets, err := findBlocksInSeed(filepath.Join(tempDir, "seed.squashfs"), index)
+
+	// Assert
+	require.NoError(t, err)
+	require.Len(t, offsets, 11)
+	// The new block 1 starts with the inserted bytes, it is found at offset 924 of the seed
+	assert.Equal(t, int64(924), offsets[1])
+	var found int
+	for _, offset := range offsets {
+		if offset >= 0 {
+			found++
+		}
+	}
+	// The first block contains the inserted bytes, blocks 4 and 5 the changed bytes and the last block is shorter
+	assert.Equal(t, 7, found)
+}
+
+func TestSyncRebuildsFromLocalImage(t *testing.T) {
+	// Arrange
+	syncer, sourceDir, targetDir := newTestSyncer(t, "prod")
+	modTime := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	seed := randomTestContent(1, 64*1024)
+	writeTestFile(t, filepath.Join(targetDir, "prod", "image1", "image1.squashfs"), string(seed), modTime)
+	newer := newerTestContent(seed)
+	writeTestFile(t, filepath.Join(sourceDir, "prod", "image2", "image2.squashfs"), string(newer), modTime)
+	manifest, err := createManifest(filepath.Join(sourceDir, "prod"), &Manifest{}, 1024*1024, 1024)
+	require.NoError(t, err)
+	writeTestManifest(t, filepath.Join(sourceDir, "prod"), *manifest)
+	backend := &flakyBackend{Backend: syncer.Backend}
+	syncer.Backend = backend
+
+	// Act
+	err = syncer.Sync(context.Background())
+
+	// Assert
+	require.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(targetDir, "prod", "image2", "image2.squashfs"))
+	require.NoError(t, err)
+	assert.Equal(t, newer, content)
+	assert.FileExists(t, filepath.Join(targetDir, "prod", "image2", "image2.squashfs"+deltaIndexSuffix))
+	assert.Less(t, backend.requestedBytes, int64(len(newer))/4)
+	metrics := &strings.Builder{}
+	syncer.Stats.WriteMetrics(metrics)
+	assert.Contains(t, metrics.String(), `netboot_sync_delta_saved_bytes_total{channel="prod"} 62464`)
+}
+
+func TestSyncFallsBackWithoutSeed(t *testing.T) {
+	// Arrange
+	syncer, sourceDir, targetDir := newTestSyncer(t, "prod")
+	modTime := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	content := randomTestContent(1, 4096)
+	writeTestFile(t, filepath.Join(sourceDir, "prod", "image1", "image1.squashfs"), string(content), modTime)
+	manifest, err := createManifest(filepath.Join(sourceDir, "prod"), &Manifest{}, 1024*1024, 1024)
+	require.NoError(t, err)
+	writeTestManifest(t, filepath.Join(sourceDir, "prod"), *manifest)
+
+	// Act
+	err = syncer.Sync(context.Background())
+
+	// Assert
+	require.NoError(t, err)
+	synced, err := os.ReadFile(filepath.Join(targetDir, "prod", "image1", "image1.squashfs"))
+	require.NoError(t, err)
+	assert.Equal(t, content, synced)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// journalSuffix is appended to the partial file for the download journal, which records the chunks already downloaded
+const journalSuffix = ".journal"
+
+// DownloadJournal is persisted next to a partial file, so an interrupted download resumes after the last complete chunk
+type DownloadJournal struct {
+	Size            int64     `json:"size"`
+	ModTime         time.Time `json:"modTime"`
+	SHA256          string    `json:"sha256,omitempty"`
+	ChunkSize       int64     `json:"chunkSize"`
+	CompletedChunks int       `json:"completedChunks"`
+}
+
+// chunkSizeOf returns the chunk size of the manifest, or the default chunk size for files without chunk hashes
+func (s *Syncer) chunkSizeOf(file RemoteFile) int64 {
+	if file.ChunkSize > 0 {
+		return file.ChunkSize
+	}
+	if s.ChunkSize > 0 {
+		return s.ChunkSize
+	}
+	return DefaultChunkSize
+}
+
+// download fetches the file chunk by chunk with range requests into the partial path. Every chunk is retried with
+// exponential backoff and verified against its hash, the complete file against its size and hash.
+// The partial file and its journal are kept when the download fails, so the next run resumes it.
+func (s *Syncer) download(ctx context.Context, channel string, remotePath string, file RemoteFile, partialPath string) (int64, error) {
+	chunkSize := s.chunkSizeOf(file)
+	chunkCount := int((file.Size + chunkSize - 1) / chunkSize)
+	journalPath := partialPath + journalSuffix
+	journal := DownloadJournal{Size: file.Size, ModTime: file.ModTime, SHA256: file.SHA256, ChunkSize: chunkSize}
+	if previous, err := readJournal(journalPath); err == nil && previous.matches(journal) && previous.CompletedChunks <= chunkCount {
+		journal.CompletedChunks = previous.CompletedChunks
+	}
+
+	output, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer output.Close()
+	// A chunk after the last complete one may be half written
+	if err := output.Truncate(int64(journal.CompletedChunks) * chunkSize); err != nil {
+		return 0, err
+	}
+	if journal.CompletedChunks > 0 {
+		log.WithFields(log.Fields{"channel": channel, "file": remotePath, "completedChunks": journal.CompletedChunks, "chunks": chunkCount}).Info("resuming download")
+	}
+
+	var bytes int64
+	for chunk := journal.CompletedChunks; chunk < chunkCount; chunk++ {
+		offset := int64(chunk) * chunkSize
+		length := chunkSize
+		if offset+length > file.Size {
+			length = file.Size - offset
+		}
+		expectedHash := ""
+		if chunk < len(file.Chunks) {
+			expectedHash = file.Chunks[chunk]
+		}
+
+		err := s.retryWithBackoff(ctx, channel, remotePath, func() error {
+			written, err := s.downloadChunk(ctx, channel, remotePath, output, offset, length, expectedHash)
+			bytes += written
+			return err
+		})
+		if err != nil {
+			return bytes, err
+		}
+		journal.CompletedChunks = chunk + 1
+		if err := writeJournal(journalPath, journal); err != nil {
+			return bytes, err
+		}
+	}
+
+	if err := verifyFile(output, file); err != nil {
+		// A corrupt file cannot be resumed, the next run starts from scratch
+		os.Remove(journalPath)
+		os.Remove(partialPath)
+		return bytes, err
+	}
+	return bytes, os.Remove(journalPath)
+}
+
+// downloadChunk writes a chunk at its offset into the partial file and verifies its hash
+func (s *Syncer) downloadChunk(ctx context.Context, channel string, remotePath string, output *os.File, offset int64, length int64, expectedHash string) (int64, error) {
+	body, err := s.Backend.OpenRange(ctx, channel, remotePath, offset, length)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	chunkHash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(io.NewOffsetWriter(output, offset), chunkHash), &rateLimitedReader{ctx: ctx, reader: body, limiter: s.Limiter})
+	if err != nil {
+		return written, err
+	}
+	if written != length {
+		return written, fmt.Errorf("expected %d bytes at offset %d, got %d", length, offset, written)
+	}
+	if expectedHash != "" && !hashEquals(chunkHash, expectedHash) {
+		return written, fmt.Errorf("SHA-256 mismatch of the chunk at offset %d", offset)
+	}
+	return written, nil
+}
+
+// verifyFile checks the size and hash of the complete partial file, it is read from disk as the chunks may come from earlier runs
+func verifyFile(output *os.File, file RemoteFile) error {
+	info, err := output.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != file.Size {
+		return fmt.Errorf("expected %d bytes, got %d", file.Size, info.Size())
+	}
+	if file.SHA256 == "" {
+		return nil
+	}
+	fileHash := sha256.New()
+	if _, err := io.Copy(fileHash, io.NewSectionReader(output, 0, file.Size)); err != nil {
+		return err
+	}
+	if !hashEquals(fileHash, file.SHA256) {
+		return fmt.Errorf("SHA-256 mismatch, expected %s", file.SHA256)
+	}
+	return nil
+}
+
+// retryWithBackoff retries a failed chunk up to MaxRetries times, the delay starts at InitialBackoff and doubles up to MaxBackoff
+func (s *Syncer) retryWithBackoff(ctx context.Context, channel string, remotePath string, attempt func() error) error {
+	backoff := s.InitialBackoff
+	var err error
+	for retry := 0; ; retry++ {
+		err = attempt()
+		if err == nil || ctx.Err() != nil || retry >= s.MaxRetries {
+			break
+		}
+		s.Stats.RecordRetry(channel)
+		// Up to 50% jitter, so the servers of all sites do not retry at the same time
+		delay := backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+		log.WithFields(log.Fields{"channel": channel, "file": remotePath, "retry": retry + 1, "delay": delay.String()}).WithError(err).Warn("chunk download failed, retrying")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		backoff *= 2
+		if backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+	}
+	return err
+}
+
+func (j DownloadJournal) matches(other DownloadJournal) bool {
+	return j.Size == other.Size && j.ModTime.Equal(other.ModTime) && j.SHA256 == other.SHA256 && j.ChunkSize == other.ChunkSize
+}
+
+func readJournal(journalPath string) (DownloadJournal, error) {
+	var journal DownloadJournal
+	content, err := os.ReadFile(journalPath)
+	if err != nil {
+		return journal, err
+	}
+	return journal, json.Unmarshal(content, &journal)
+}
+
+// writeJournal replaces the journal with a rename, so a crash never leaves a truncated journal behind
+func writeJournal(journalPath string, journal DownloadJournal) error {
+	content, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	temporaryPath := filepath.Join(filepath.Dir(journalPath), "."+filepath.Base(journalPath))
+	if err := os.WriteFile(temporaryPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporaryPath, journalPath)
+}
+
+func hashEquals(hash hash.Hash, expected string) bool {
+	return strings.EqualFold(hex.EncodeToString(hash.Sum(nil)), expected)
+}
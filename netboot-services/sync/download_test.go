@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyBackend fails the range requests of the chunks in failingOffsets and counts the bytes it returned
+type flakyBackend struct {
+	Backend
+	mutex          sync.Mutex
+	failingOffsets map[int64]int
+	corrupt        bool
+	requestedBytes int64
+}
+
+func (b *flakyBackend) OpenRange(ctx context.Context, channel string, path string, offset int64, length int64) (io.ReadCloser, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.failingOffsets[offset] > 0 {
+		b.failingOffsets[offset]--
+		if b.corrupt {
+			return io.NopCloser(strings.NewReader(strings.Repeat("x", int(length)))), nil
+		}
+		return nil, errors.New("connection reset by peer")
+	}
+	b.requestedBytes += length
+	return b.Backend.OpenRange(ctx, channel, path, offset, length)
+}
+
+func newChunkedTestFile(t *testing.T, sourceDir string) RemoteFile {
+	content := "chunk-0|chunk-1|chunk-2|chunk-3|"
+	modTime := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	writeTestFile(t, filepath.Join(sourceDir, "prod", "image1", "image1.squashfs"), content, modTime)
+	file, err := describeFile(filepath.Join(sourceDir, "prod", "image1", "image1.squashfs"), "image1.squashfs", map[string]RemoteFile{}, 8)
+	require.NoError(t, err)
+	writeTestManifest(t, filepath.Join(sourceDir, "prod"), Manifest{Images: []ManifestImage{{Name: "image1", Files: []RemoteFile{file}}}})
+	return file
+}
+
+func TestDownloadResumesAfterFailure(t *testing.T) {
+	// Arrange
+	syncer, sourceDir, targetDir := newTestSyncer(t, "prod")
+	newChunkedTestFile(t, sourceDir)
+	backend := &flakyBackend{Backend: syncer.Backend, failingOffsets: map[int64]int{16: 1}}
+	syncer.Backend = backend
+
+	// Act
+	firstErr := syncer.Sync(context.Background())
+	journal, journalErr := readJournal(filepath.Join(targetDir, "prod", stagingDirectoryName, "image1", "image1.squashfs"+partialFileSuffix+journalSuffix))
+	secondErr := syncer.Sync(context.Background())
+
+	// Assert
+	assert.Error(t, firstErr)
+	require.NoError(t, journalErr)
+	assert.Equal(t, 2, journal.CompletedChunks)
+	require.NoError(t, secondErr)
+	// The first two chunks were only downloaded once
+	assert.Equal(t, int64(32), backend.requestedBytes)
+	content, err := os.ReadFile(filepath.Join(targetDir, "prod", "image1", "image1.squashfs"))
+	require.NoError(t, err)
+	assert.Equal(t, "chunk-0|chunk-1|chunk-2|chunk-3|", string(content))
+	assert.NoFileExists(t, filepath.Join(targetDir, "prod", "image1", "image1.squashfs"+partialFileSuffix+journalSuffix))
+}
+
+func TestDownloadRetriesCorruptChunks(t *testing.T) {
+	tests := []struct {
+		name            string
+		failures        int
+		expectedRetries int
+		expectError     bool
+	}{
+		{name: "Retried", failures: 2, expectedRetries: 2},
+		{name: "Too many failures", failures: 4, expectedRetries: 3, expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			syncer, sourceDir, targetDir := newTestSyncer(t, "prod")
+			newChunkedTestFile(t, sourceDir)
+			syncer.Backend = &flakyBackend{Backend: syncer.Backend, failingOffsets: map[int64]int{8: test.failures}, corrupt: true}
+			syncer.MaxRetries = 3
+
+			// Act
+			err := syncer.Sync(context.Background())
+
+			// Assert
+			metrics := &strings.Builder{}
+			syncer.Stats.WriteMetrics(metrics)
+			assert.Contains(t, metrics.String(), fmt.Sprintf(`netboot_sync_chunk_retries_total{channel="prod"} %d`, test.expectedRetries))
+			if test.expectError {
+				assert.Error(t, err)
+				assert.NoDirExists(t, filepath.Join(targetDir, "prod", "image1"))
+				return
+			}
+			assert.NoError(t, err)
+			assert.FileExists(t, filepath.Join(targetDir, "prod", "image1", "image1.squashfs"))
+		})
+	}
+}
+
+func TestDownloadRestartsWithChangedFile(t *testing.T) {
+	// Arrange
+	syncer, sourceDir, targetDir := newTestSyncer(t, "prod")
+	file := newChunkedTestFile(t, sourceDir)
+	partialPath := filepath.Join(targetDir, "prod", stagingDirectoryName, "image1", "image1.squashfs"+partialFileSuffix)
+	writeTestFile(t, partialPath, "old-0|||old-1|||", time.Now())
+	// The journal belongs to an older version of the file
+	require.NoError(t, writeJournal(partialPath+journalSuffix, DownloadJournal{Size: file.Size, ModTime: file.ModTime, SHA256: "old", ChunkSize: 8, CompletedChunks: 2}))
+
+	// Act
+	err := syncer.Sync(context.Background())
+
+	// Assert
+	require.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(targetDir, "prod", "image1", "image1.squashfs"))
+	require.NoError(t, err)
+	assert.Equal(t, "chunk-0|chunk-1|chunk-2|chunk-3|", string(content))
+}
+
+func TestHTTPManifestBackendOpenRange(t *testing.T) {
+	tests := []struct {
+		name            string
+		supportsRanges  bool
+		offset          int64
+		expectedContent string
+		expectError     bool
+	}{
+		{name: "Range", supportsRanges: true, offset: 8, expectedContent: "chunk-1|"},
+		{name: "Start of the file without range support", offset: 0, expectedContent: "chunk-0|"},
+		{name: "No range support", offset: 8, expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.supportsRanges {
+					http.ServeContent(w, r, "image1.squashfs", time.Now(), strings.NewReader("chunk-0|chunk-1|"))
+					return
+				}
+				fmt.Fprint(w, "chunk-0|chunk-1|")
+			}))
+			defer server.Close()
+			backend := &HTTPManifestBackend{BaseURL: server.URL, Client: server.Client()}
+
+			// Act
+			body, err := backend.OpenRange(context.Background(), "prod", "image1/image1.squashfs", test.offset, 8)
+
+			// Assert
+			if test.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			content, err := io.ReadAll(body)
+			body.Close()
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedContent, string(content))
+		})
+	}
+}
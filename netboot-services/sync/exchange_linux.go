@@ -0,0 +1,8 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// exchangeDirectories swaps the two folders with a single renameat2 RENAME_EXCHANGE, so both paths exist at all times
+func exchangeDirectories(first string, second string) error {
+	return unix.Renameat2(unix.AT_FDCWD, first, unix.AT_FDCWD, second, unix.RENAME_EXCHANGE)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExchangeDirectories(t *testing.T) {
+	// Arrange
+	tempDir := t.TempDir()
+	writeTestFile(t, filepath.Join(tempDir, "staging", "image1", "vmlinuz"), "new", time.Now())
+	writeTestFile(t, filepath.Join(tempDir, "prod", "image1", "vmlinuz"), "old", time.Now())
+
+	// Act
+	err := exchangeDirectories(filepath.Join(tempDir, "staging", "image1"), filepath.Join(tempDir, "prod", "image1"))
+
+	// Assert
+	require.NoError(t, err)
+	published, err := os.ReadFile(filepath.Join(tempDir, "prod", "image1", "vmlinuz"))
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(published))
+	previous, err := os.ReadFile(filepath.Join(tempDir, "staging", "image1", "vmlinuz"))
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(previous))
+}
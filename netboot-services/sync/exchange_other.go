@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// exchangeDirectories is only supported on Linux, publishImage falls back to two renames
+func exchangeDirectories(first string, second string) error {
+	return errors.New("exchanging folders is not supported on this platform")
+}
@@ -0,0 +1,15 @@
+module github.com/DigitecGalaxus/netboot/netboot-sync
+
+go 1.20
+
+require (
+	github.com/sirupsen/logrus v1.9.3
+	github.com/stretchr/testify v1.8.4
+	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
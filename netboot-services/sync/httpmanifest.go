@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// HTTPManifestBackend reads the images from a plain web server, which cannot list folders.
+// Every channel needs a published manifest.json (see the publish command).
+type HTTPManifestBackend struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+func (b *HTTPManifestBackend) List(ctx context.Context, channel string) ([]RemoteFile, error) {
+	body, err := b.Open(ctx, channel, manifestFilename)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var manifest Manifest
+	if err := json.NewDecoder(body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("could not parse the manifest of %s: %w", channel, err)
+	}
+	return manifest.allFiles(), nil
+}
+
+func (b *HTTPManifestBackend) Open(ctx context.Context, channel string, path string) (io.ReadCloser, error) {
+	return getWithContext(ctx, b.Client, b.BaseURL+"/"+escapePath(channel+"/"+path))
+}
+
+func (b *HTTPManifestBackend) OpenRange(ctx context.Context, channel string, path string, offset int64, length int64) (io.ReadCloser, error) {
+	return getRange(ctx, b.Client, b.BaseURL+"/"+escapePath(channel+"/"+path), offset, length)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// LocalBackend reads the images from a directory, e.g. a mounted network share or a test fixture
+type LocalBackend struct {
+	Directory string
+}
+
+func (b *LocalBackend) List(ctx context.Context, channel string) ([]RemoteFile, error) {
+	channelDirectory := filepath.Join(b.Directory, channel)
+
+	var files []RemoteFile
+	err := filepath.WalkDir(channelDirectory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(channelDirectory, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, RemoteFile{Path: filepath.ToSlash(relativePath), Size: info.Size(), ModTime: info.ModTime()})
+		return ctx.Err()
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return files, nil
+	}
+	return files, err
+}
+
+func (b *LocalBackend) Open(ctx context.Context, channel string, path string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(b.Directory, channel, filepath.FromSlash(path)))
+}
+
+func (b *LocalBackend) OpenRange(ctx context.Context, channel string, path string, offset int64, length int64) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.Join(b.Directory, channel, filepath.FromSlash(path)))
+	if err != nil {
+		return nil, err
+	}
+	return &limitedReadCloser{Reader: io.NewSectionReader(file, offset, length), Closer: file}, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	// The schedule is in the time zone of TZ, the image has no time zone database
+	_ "time/tzdata"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	TargetDirectory      = "/home/syncer"
+	BandwidthLimitMbits  = 300.0
+	MetricsListenAddress = ":9070"
+	MaxSleepBetweenRuns  = 300 * time.Second
+	DefaultChunkSize     = int64(64 * 1024 * 1024)
+	DeltaBlockSize       = int64(64 * 1024)
+	MaxRetries           = 5
+	InitialBackoff       = time.Second
+	MaxBackoff           = 2 * time.Minute
+	// While the asset server has BusyActiveDownloads or more downloads in progress, the bandwidth is lowered to BusyBandwidthLimitMbits
+	BusyActiveDownloads     = 1.0
+	BusyBandwidthLimitMbits = 20.0
+	ThrottleInterval        = 10 * time.Second
+	ThrottleIdleDelay       = 2 * time.Minute
+)
+
+const (
+	// kernelsChannel holds the kernel files of all images, it is always synced
+	kernelsChannel          = "kernels"
+	legacyBandwidthVariable = "SYNC_BANDWITDH_LIMIT_MBITS"
+)
+
+func main() {
+	log.SetLevel(log.InfoLevel)
+	log.SetFormatter(&log.JSONFormatter{})
+
+	if len(os.Args) > 1 && os.Args[1] == "publish" {
+		err := runPublishCommand(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if os.Getenv("SYNC_TARGET_DIRECTORY") != "" {
+		TargetDirectory = os.Getenv("SYNC_TARGET_DIRECTORY")
+	}
+	if os.Getenv("METRICS_LISTEN_ADDRESS") != "" {
+		MetricsListenAddress = os.Getenv("METRICS_LISTEN_ADDRESS")
+	}
+	bandwidthLimit, err := loadBandwidthLimit()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if os.Getenv("SYNC_CHUNK_SIZE_MIB") != "" {
+		chunkSizeMiB, err := strconv.Atoi(os.Getenv("SYNC_CHUNK_SIZE_MIB"))
+		if err != nil || chunkSizeMiB <= 0 {
+			log.Fatalf("invalid SYNC_CHUNK_SIZE_MIB %s", os.Getenv("SYNC_CHUNK_SIZE_MIB"))
+		}
+		DefaultChunkSize = int64(chunkSizeMiB) * 1024 * 1024
+	}
+	if os.Getenv("SYNC_MAX_RETRIES") != "" {
+		MaxRetries, err = strconv.Atoi(os.Getenv("SYNC_MAX_RETRIES"))
+		if err != nil || MaxRetries < 0 {
+			log.Fatalf("invalid SYNC_MAX_RETRIES %s", os.Getenv("SYNC_MAX_RETRIES"))
+		}
+	}
+
+	schedule, err := parseBandwidthSchedule(os.Getenv("SYNC_BANDWIDTH_SCHEDULE"), bandwidthLimit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if os.Getenv("SYNC_BUSY_ACTIVE_DOWNLOADS") != "" {
+		BusyActiveDownloads, err = strconv.ParseFloat(os.Getenv("SYNC_BUSY_ACTIVE_DOWNLOADS"), 64)
+		if err != nil || BusyActiveDownloads < 1 {
+			log.Fatalf("invalid SYNC_BUSY_ACTIVE_DOWNLOADS %s", os.Getenv("SYNC_BUSY_ACTIVE_DOWNLOADS"))
+		}
+	}
+	if os.Getenv("SYNC_BUSY_BANDWIDTH_LIMIT_MBITS") != "" {
+		BusyBandwidthLimitMbits, err = strconv.ParseFloat(os.Getenv("SYNC_BUSY_BANDWIDTH_LIMIT_MBITS"), 64)
+		if err != nil || BusyBandwidthLimitMbits <= 0 {
+			log.Fatalf("invalid SYNC_BUSY_BANDWIDTH_LIMIT_MBITS %s", os.Getenv("SYNC_BUSY_BANDWIDTH_LIMIT_MBITS"))
+		}
+	}
+
+	backend, err := newBackendFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	syncer := &Syncer{
+		Backend:         backend,
+		TargetDirectory: TargetDirectory,
+		Channels:        loadChannels(),
+		Limiter:         NewRateLimiter(schedule.LimitAt(time.Now())),
+		Stats:           NewSyncStats(),
+		ChunkSize:       DefaultChunkSize,
+		MaxRetries:      MaxRetries,
+		InitialBackoff:  InitialBackoff,
+		MaxBackoff:      MaxBackoff,
+	}
+	log.WithFields(log.Fields{
+		"channels":            syncer.Channels,
+		"targetDirectory":     TargetDirectory,
+		"bandwidthLimitMbits": bandwidthLimit,
+		"bandwidthRules":      len(schedule.Rules),
+		"assetServerMetrics":  os.Getenv("SYNC_ASSET_SERVER_METRICS_URL"),
+	}).Info("starting sync")
+
+	controller := &BandwidthController{
+		Schedule:              schedule,
+		Limiter:               syncer.Limiter,
+		Stats:                 syncer.Stats,
+		AssetServerMetricsURL: os.Getenv("SYNC_ASSET_SERVER_METRICS_URL"),
+		Client:                &http.Client{},
+		BusyActiveDownloads:   BusyActiveDownloads,
+		BusyLimitMbits:        BusyBandwidthLimitMbits,
+		IdleDelay:             ThrottleIdleDelay,
+	}
+	go controller.Run(context.Background(), ThrottleInterval)
+
+	if err := syncer.RemovePartialDownloads(); err != nil {
+		log.WithError(err).Error("could not remove partial downloads")
+	}
+
+	go func() {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", syncer.Stats)
+		log.WithFields(log.Fields{"address": MetricsListenAddress}).Info("serving metrics")
+		if err := http.ListenAndServe(MetricsListenAddress, mux); err != nil {
+			log.WithError(err).Error("metrics server stopped")
+		}
+	}()
+
+	for {
+		if err := syncer.Sync(context.Background()); err != nil {
+			log.WithError(err).Error("sync run failed")
+		}
+		// Random sleep, so not all netboot servers hit the storage at the same time
+		sleep := time.Duration(rand.Int63n(int64(MaxSleepBetweenRuns))) + time.Second
+		log.WithFields(log.Fields{"sleep": sleep.String()}).Info("sync run processed")
+		time.Sleep(sleep)
+	}
+}
+
+// loadChannels returns the channels of SYNC_CHANNELS, or dev and prod depending on SYNC_DEV and SYNC_PROD.
+// The kernels are always synced.
+func loadChannels() []string {
+	var channels []string
+	if os.Getenv("SYNC_CHANNELS") != "" {
+		for _, channel := range strings.Split(os.Getenv("SYNC_CHANNELS"), ",") {
+			if channel = strings.TrimSpace(channel); channel != "" {
+				channels = append(channels, channel)
+			}
+		}
+	} else {
+		if isTrue(os.Getenv("SYNC_DEV")) {
+			channels = append(channels, "dev")
+		}
+		if isTrue(os.Getenv("SYNC_PROD")) {
+			channels = append(channels, "prod")
+		}
+	}
+
+	for _, channel := range channels {
+		if channel == kernelsChannel {
+			return channels
+		}
+	}
+	return append(channels, kernelsChannel)
+}
+
+func isTrue(value string) bool {
+	return value == "true" || value == "True"
+}
+
+// loadBandwidthLimit reads SYNC_BANDWIDTH_LIMIT_MBITS, the misspelled variable of the old sync script is still accepted
+func loadBandwidthLimit() (float64, error) {
+	value := os.Getenv("SYNC_BANDWIDTH_LIMIT_MBITS")
+	if value == "" && os.Getenv(legacyBandwidthVariable) != "" {
+		log.Warnf("%s is deprecated, use SYNC_BANDWIDTH_LIMIT_MBITS", legacyBandwidthVariable)
+		value = os.Getenv(legacyBandwidthVariable)
+	}
+	if value == "" {
+		return BandwidthLimitMbits, nil
+	}
+	limit, err := strconv.ParseFloat(value, 64)
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("invalid bandwidth limit %s, expected megabits per second or 0 for unlimited", value)
+	}
+	return limit, nil
+}
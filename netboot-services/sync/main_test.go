@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadChannels(t *testing.T) {
+	tests := []struct {
+		name             string
+		syncChannels     string
+		syncDev          string
+		syncProd         string
+		expectedChannels []string
+	}{
+		{name: "Prod", syncProd: "true", expectedChannels: []string{"prod", "kernels"}},
+		{name: "Dev and prod", syncDev: "True", syncProd: "true", expectedChannels: []string{"dev", "prod", "kernels"}},
+		{name: "Nothing", syncDev: "false", expectedChannels: []string{"kernels"}},
+		{name: "Channel list", syncChannels: "prod, test", syncDev: "true", expectedChannels: []string{"prod", "test", "kernels"}},
+		{name: "Channel list with kernels", syncChannels: "kernels,prod", expectedChannels: []string{"kernels", "prod"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			t.Setenv("SYNC_CHANNELS", test.syncChannels)
+			t.Setenv("SYNC_DEV", test.syncDev)
+			t.Setenv("SYNC_PROD", test.syncProd)
+
+			// Act
+			channels := loadChannels()
+
+			// Assert
+			assert.Equal(t, test.expectedChannels, channels)
+		})
+	}
+}
+
+func TestLoadBandwidthLimit(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         string
+		legacyValue   string
+		expectedLimit float64
+		expectError   bool
+	}{
+		{name: "Default", expectedLimit: 300},
+		{name: "Limit", value: "200", legacyValue: "100", expectedLimit: 200},
+		{name: "Misspelled variable", legacyValue: "100", expectedLimit: 100},
+		{name: "Unlimited", value: "0", expectedLimit: 0},
+		{name: "Invalid", value: "fast", expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			t.Setenv("SYNC_BANDWIDTH_LIMIT_MBITS", test.value)
+			t.Setenv(legacyBandwidthVariable, test.legacyValue)
+
+			// Act
+			limit, err := loadBandwidthLimit()
+
+			// Assert
+			if test.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectedLimit, limit)
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// manifestFilename is published in the channel folder of the storage, next to the image folders
+const manifestFilename = "manifest.json"
+
+// Manifest lists the images of a channel with the size, modification time and SHA-256 hash of their files
+type Manifest struct {
+	Images []ManifestImage `json:"images"`
+	// Files lie directly in the channel folder, e.g. kernels/newest-kernel-version.json
+	Files []RemoteFile `json:"files,omitempty"`
+}
+
+// ManifestImage is an image folder, the paths of its files are relative to the image folder
+type ManifestImage struct {
+	Name  string       `json:"name"`
+	Files []RemoteFile `json:"files"`
+}
+
+// loadManifest reads the manifest of the channel. Channels without a manifest are listed, their files are synced without hash verification.
+func loadManifest(ctx context.Context, backend Backend, channel string) (*Manifest, error) {
+	body, err := backend.Open(ctx, channel, manifestFilename)
+	if isNotFound(err) {
+		files, err := backend.List(ctx, channel)
+		if err != nil {
+			return nil, fmt.Errorf("could not list the files: %w", err)
+		}
+		manifest := manifestFromFiles(files)
+		return manifest, manifest.validate()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not download the manifest: %w", err)
+	}
+	defer body.Close()
+
+	var manifest Manifest
+	if err := json.NewDecoder(body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("could not parse the manifest: %w", err)
+	}
+	return &manifest, manifest.validate()
+}
+
+// manifestFromFiles groups the files of a channel listing by their image folder
+func manifestFromFiles(files []RemoteFile) *Manifest {
+	manifest := &Manifest{}
+	imageIndex := map[string]int{}
+	for _, file := range files {
+		// Hidden files, e.g. the .staging folder of a local backend, are no part of any image
+		if validateRelativePath(file.Path) != nil {
+			continue
+		}
+		imageName, filePath, ok := strings.Cut(file.Path, "/")
+		if !ok {
+			if file.Path != manifestFilename {
+				manifest.Files = append(manifest.Files, file)
+			}
+			continue
+		}
+		index, ok := imageIndex[imageName]
+		if !ok {
+			index = len(manifest.Images)
+			imageIndex[imageName] = index
+			manifest.Images = append(manifest.Images, ManifestImage{Name: imageName})
+		}
+		file.Path = filePath
+		manifest.Images[index].Files = append(manifest.Images[index].Files, file)
+	}
+	return manifest
+}
+
+// validate rejects paths which would escape the channel folder or which would be hidden from the consumers
+func (m *Manifest) validate() error {
+	for _, file := range m.Files {
+		if err := validateRelativePath(file.Path); err != nil || strings.Contains(file.Path, "/") {
+			return fmt.Errorf("invalid file path %q", file.Path)
+		}
+	}
+	for _, image := range m.Images {
+		if err := validateRelativePath(image.Name); err != nil || strings.Contains(image.Name, "/") {
+			return fmt.Errorf("invalid image name %q", image.Name)
+		}
+		for _, file := range image.Files {
+			if err := validateRelativePath(file.Path); err != nil {
+				return fmt.Errorf("image %s: %w", image.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// allFiles returns the files of all images with their path relative to the channel
+func (m *Manifest) allFiles() []RemoteFile {
+	files := append([]RemoteFile{}, m.Files...)
+	for _, image := range m.Images {
+		for _, file := range image.Files {
+			file.Path = image.Name + "/" + file.Path
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+func validateRelativePath(relativePath string) error {
+	cleanPath := path.Clean("/" + relativePath)[1:]
+	if cleanPath == "" || cleanPath != relativePath {
+		return fmt.Errorf("invalid file path %q", relativePath)
+	}
+	for _, segment := range strings.Split(cleanPath, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return fmt.Errorf("invalid file path %q", relativePath)
+		}
+	}
+	return nil
+}
+
+func isNotFound(err error) bool {
+	var statusError *httpStatusError
+	return errors.Is(err, fs.ErrNotExist) || (errors.As(err, &statusError) && statusError.StatusCode == http.StatusNotFound)
+}
+
+// runPublishCommand writes the manifest of a local channel folder, before the folder is uploaded to the storage.
+// The hashes of files which did not change since the last manifest are reused.
+func runPublishCommand(args []string) error {
+	flags := flag.NewFlagSet("publish", flag.ContinueOnError)
+	output := flags.String("output", "", "Path of the manifest, defaults to manifest.json in the channel folder")
+	deltaBlockSizeKiB := flags.Int64("delta-block-size-kib", DeltaBlockSize/1024, "Block size of the block indexes for delta syncs, which are written next to every squashfs file, 0 disables them")
+	chunkSizeMiB := flags.Int64("chunk-size-mib", DefaultChunkSize/1024/1024, "Size of the chunks which are hashed separately, so a broken chunk is detected and retried right away")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || *chunkSizeMiB <= 0 || *deltaBlockSizeKiB < 0 {
+		return fmt.Errorf("usage: netboot-sync publish [--output manifest.json] [--chunk-size-mib 64] [--delta-block-size-kib 64] [channel folder]")
+	}
+	channelDirectory := flags.Arg(0)
+	if *output == "" {
+		*output = filepath.Join(channelDirectory, manifestFilename)
+	}
+
+	var previous Manifest
+	if content, err := os.ReadFile(*output); err == nil {
+		if err := json.Unmarshal(content, &previous); err != nil {
+			return fmt.Errorf("could not parse the existing manifest %s: %w", *output, err)
+		}
+	}
+
+	manifest, err := createManifest(channelDirectory, &previous, *chunkSizeMiB*1024*1024, *deltaBlockSizeKiB*1024)
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporaryPath := filepath.Join(filepath.Dir(*output), "."+filepath.Base(*output))
+	if err := os.WriteFile(temporaryPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporaryPath, *output)
+}
+
+// createManifest hashes all image folders and files of the channel folder, hidden files and folders are left out.
+// If deltaBlockSize is set, the block indexes of the squashfs files are written first, so they are part of the manifest.
+func createManifest(channelDirectory string, previous *Manifest, chunkSize int64, deltaBlockSize int64) (*Manifest, error) {
+	previousHashes := map[string]RemoteFile{}
+	for _, file := range previous.allFiles() {
+		previousHashes[file.Path] = file
+	}
+
+	entries, err := os.ReadDir(channelDirectory)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{Images: []ManifestImage{}}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") || entry.Name() == manifestFilename {
+			continue
+		}
+		if !entry.IsDir() {
+			file, err := describeFile(filepath.Join(channelDirectory, entry.Name()), entry.Name(), previousHashes, chunkSize)
+			if err != nil {
+				return nil, err
+			}
+			manifest.Files = append(manifest.Files, file)
+			continue
+		}
+
+		image := ManifestImage{Name: entry.Name()}
+		imageDirectory := filepath.Join(channelDirectory, entry.Name())
+		if deltaBlockSize > 0 {
+			if err := writeDeltaIndexes(imageDirectory, deltaBlockSize); err != nil {
+				return nil, err
+			}
+		}
+		err := filepath.WalkDir(imageDirectory, func(filePath string, fileEntry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if strings.HasPrefix(fileEntry.Name(), ".") {
+				if fileEntry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if fileEntry.IsDir() {
+				return nil
+			}
+			relativePath, err := filepath.Rel(imageDirectory, filePath)
+			if err != nil {
+				return err
+			}
+			file, err := describeFile(filePath, entry.Name()+"/"+filepath.ToSlash(relativePath), previousHashes, chunkSize)
+			if err != nil {
+				return err
+			}
+			file.Path = filepath.ToSlash(relativePath)
+			image.Files = append(image.Files, file)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		manifest.Images = append(manifest.Images, image)
+	}
+
+	sort.Slice(manifest.Images, func(i, j int) bool { return manifest.Images[i].Name < manifest.Images[j].Name })
+	return manifest, nil
+}
+
+// describeFile returns the size, modification time, hash and chunk hashes of a file, channelPath is its path relative to the channel folder
+func describeFile(filePath string, channelPath string, previousHashes map[string]RemoteFile, chunkSize int64) (RemoteFile, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return RemoteFile{}, err
+	}
+	file := RemoteFile{Path: channelPath, Size: info.Size(), ModTime: info.ModTime().UTC().Truncate(time.Second), ChunkSize: chunkSize}
+
+	previousFile, ok := previousHashes[channelPath]
+	if ok && previousFile.Size == file.Size && previousFile.ModTime.Equal(file.ModTime) && previousFile.SHA256 != "" && previousFile.ChunkSize == chunkSize {
+		file.SHA256 = previousFile.SHA256
+		file.Chunks = previousFile.Chunks
+		return file, nil
+	}
+
+	content, err := os.Open(filePath)
+	if err != nil {
+		return RemoteFile{}, err
+	}
+	defer content.Close()
+	fileHash := sha256.New()
+	for offset := int64(0); offset < file.Size; offset += chunkSize {
+		chunkHash := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(fileHash, chunkHash), io.NewSectionReader(content, offset, chunkSize)); err != nil {
+			return RemoteFile{}, err
+		}
+		file.Chunks = append(file.Chunks, hex.EncodeToString(chunkHash.Sum(nil)))
+	}
+	file.SHA256 = hex.EncodeToString(fileHash.Sum(nil))
+	return file, nil
+}
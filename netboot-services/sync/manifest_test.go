@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifestFromFiles(t *testing.T) {
+	// Arrange
+	modTime := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	files := []RemoteFile{
+		{Path: "newest-kernel-version.json", Size: 1, ModTime: modTime},
+		{Path: "manifest.json", Size: 1, ModTime: modTime},
+		{Path: "6.8.0/vmlinuz", Size: 2, ModTime: modTime},
+		{Path: "6.8.0/initrd", Size: 3, ModTime: modTime},
+		{Path: ".staging/6.9.0/vmlinuz", Size: 4, ModTime: modTime},
+	}
+
+	// Act
+	manifest := manifestFromFiles(files)
+
+	// Assert
+	assert.Equal(t, &Manifest{
+		Images: []ManifestImage{{Name: "6.8.0", Files: []RemoteFile{
+			{Path: "vmlinuz", Size: 2, ModTime: modTime},
+			{Path: "initrd", Size: 3, ModTime: modTime},
+		}}},
+		Files: []RemoteFile{{Path: "newest-kernel-version.json", Size: 1, ModTime: modTime}},
+	}, manifest)
+}
+
+func TestManifestValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		manifest    Manifest
+		expectError bool
+	}{
+		{name: "Valid", manifest: Manifest{Images: []ManifestImage{{Name: "image1", Files: []RemoteFile{{Path: "arm64/image1.squashfs"}}}}}},
+		{name: "Parent folder", manifest: Manifest{Images: []ManifestImage{{Name: "image1", Files: []RemoteFile{{Path: "../../etc/passwd"}}}}}, expectError: true},
+		{name: "Absolute path", manifest: Manifest{Images: []ManifestImage{{Name: "image1", Files: []RemoteFile{{Path: "/etc/passwd"}}}}}, expectError: true},
+		{name: "Hidden image", manifest: Manifest{Images: []ManifestImage{{Name: ".staging"}}}, expectError: true},
+		{name: "Nested image name", manifest: Manifest{Images: []ManifestImage{{Name: "a/b"}}}, expectError: true},
+		{name: "Channel file in a folder", manifest: Manifest{Files: []RemoteFile{{Path: "image1/vmlinuz"}}}, expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			err := test.manifest.validate()
+
+			// Assert
+			if test.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// squashfsHash is the SHA-256 hash of the test file content "squashfs"
+const squashfsHash = "5cce3f70c6cb9f62ab53e322fa3975d02128080e1341e41de3a8dd3712cf1607"
+
+func TestRunPublishCommand(t *testing.T) {
+	// Arrange
+	channelDir := t.TempDir()
+	modTime := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	writeTestFile(t, filepath.Join(channelDir, "image1", "image1.squashfs"), "squashfs", modTime)
+	writeTestFile(t, filepath.Join(channelDir, "image1", "arm64", "image1.squashfs"), "squashfs", modTime)
+	writeTestFile(t, filepath.Join(channelDir, "image1", ".azDownload-vmlinuz"), "half", modTime)
+	writeTestFile(t, filepath.Join(channelDir, ".staging", "image2", "image2.squashfs"), "squashfs", modTime)
+	// A hash from the previous manifest is reused if size and modification time did not change
+	writeTestManifest(t, channelDir, Manifest{Images: []ManifestImage{{
+		Name:  "image1",
+		Files: []RemoteFile{{Path: "image1.squashfs", Size: 8, ModTime: modTime, SHA256: "cached", ChunkSize: 1024 * 1024, Chunks: []string{"cached"}}},
+	}}})
+
+	// Act
+	err := runPublishCommand([]string{"--chunk-size-mib", "1", "--delta-block-size-kib", "0", channelDir})
+
+	// Assert
+	require.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(channelDir, manifestFilename))
+	require.NoError(t, err)
+	var manifest Manifest
+	require.NoError(t, json.Unmarshal(content, &manifest))
+	assert.Equal(t, []ManifestImage{{Name: "image1", Files: []RemoteFile{
+		{Path: "arm64/image1.squashfs", Size: 8, ModTime: modTime, SHA256: squashfsHash, ChunkSize: 1024 * 1024, Chunks: []string{squashfsHash}},
+		{Path: "image1.squashfs", Size: 8, ModTime: modTime, SHA256: "cached", ChunkSize: 1024 * 1024, Chunks: []string{"cached"}},
+	}}}, manifest.Images)
+	assert.Empty(t, manifest.Files)
+}
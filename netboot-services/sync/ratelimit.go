@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter caps the bandwidth of all downloads together with a token bucket. A rate of 0 means unlimited.
+type RateLimiter struct {
+	mutex          sync.Mutex
+	bytesPerSecond float64
+	tokens         float64
+	last           time.Time
+}
+
+func NewRateLimiter(megabitsPerSecond float64) *RateLimiter {
+	limiter := &RateLimiter{last: time.Now()}
+	limiter.SetRate(megabitsPerSecond)
+	return limiter
+}
+
+// SetRate changes the limit, running downloads pick it up with their next read
+func (l *RateLimiter) SetRate(megabitsPerSecond float64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.bytesPerSecond = megabitsPerSecond * 1000 * 1000 / 8
+	if l.tokens > l.bytesPerSecond {
+		l.tokens = l.bytesPerSecond
+	}
+}
+
+// Rate returns the current limit in megabits per second
+func (l *RateLimiter) Rate() float64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.bytesPerSecond * 8 / 1000 / 1000
+}
+
+// Wait blocks until n bytes may be transferred
+func (l *RateLimiter) Wait(ctx context.Context, n int) error {
+	l.mutex.Lock()
+	if l.bytesPerSecond <= 0 {
+		l.mutex.Unlock()
+		return nil
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.bytesPerSecond
+	// At most one second of burst
+	if l.tokens > l.bytesPerSecond {
+		l.tokens = l.bytesPerSecond
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.bytesPerSecond * float64(time.Second))
+	l.mutex.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimitedReader limits the reads of a download with the shared rate limiter
+type rateLimitedReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *RateLimiter
+}
+
+// rateLimitedChunkSize keeps the reads small, so the bandwidth is shared evenly and a new rate applies quickly
+const rateLimitedChunkSize = 32 * 1024
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > rateLimitedChunkSize {
+		p = p[:rateLimitedChunkSize]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.Wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
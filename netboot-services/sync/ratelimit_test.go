@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterWait(t *testing.T) {
+	tests := []struct {
+		name              string
+		megabitsPerSecond float64
+		expectDelay       bool
+	}{
+		{name: "Unlimited", megabitsPerSecond: 0, expectDelay: false},
+		{name: "Limited", megabitsPerSecond: 8, expectDelay: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			limiter := NewRateLimiter(test.megabitsPerSecond)
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			// Act
+			// 2 MB at 1 MB/s take about two seconds
+			err := limiter.Wait(ctx, 2*1000*1000)
+
+			// Assert
+			if test.expectDelay {
+				assert.ErrorIs(t, err, context.DeadlineExceeded)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	// Arrange
+	limiter := NewRateLimiter(300)
+
+	// Act
+	limiter.SetRate(50)
+
+	// Assert
+	assert.Equal(t, 50.0, limiter.Rate())
+}
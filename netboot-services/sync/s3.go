@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3TimeFormat      = "20060102T150405Z"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3EmptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Backend reads the images from an S3 compatible storage (AWS, MinIO, Ceph, ...) with path-style requests.
+// The channels are folders in the bucket below the optional prefix.
+type S3Backend struct {
+	Endpoint        string
+	Bucket          string
+	Prefix          string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	Client          *http.Client
+	// now is replaced in tests
+	now func() time.Time
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		Size         int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (b *S3Backend) channelPrefix(channel string) string {
+	prefix := strings.Trim(b.Prefix, "/")
+	if prefix == "" {
+		return channel + "/"
+	}
+	return prefix + "/" + channel + "/"
+}
+
+func (b *S3Backend) List(ctx context.Context, channel string) ([]RemoteFile, error) {
+	prefix := b.channelPrefix(channel)
+
+	var files []RemoteFile
+	continuationToken := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, b.Endpoint+"/"+escapePath(b.Bucket)+"?"+s3EncodeQuery(query), nil)
+		if err != nil {
+			return nil, err
+		}
+		b.sign(request, s3EmptyPayload)
+		body, err := doRequest(b.Client, request)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListBucketResult
+		err = xml.NewDecoder(body).Decode(&result)
+		body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not parse the object list of %s: %w", channel, err)
+		}
+
+		for _, object := range result.Contents {
+			// Folder placeholders created by some S3 clients
+			if strings.HasSuffix(object.Key, "/") {
+				continue
+			}
+			modTime, err := time.Parse(time.RFC3339, object.LastModified)
+			if err != nil {
+				return nil, fmt.Errorf("invalid LastModified of %s: %w", object.Key, err)
+			}
+			files = append(files, RemoteFile{
+				Path:    strings.TrimPrefix(object.Key, prefix),
+				Size:    object.Size,
+				ModTime: modTime,
+			})
+		}
+
+		if !result.IsTruncated {
+			return files, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+func (b *S3Backend) Open(ctx context.Context, channel string, path string) (io.ReadCloser, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, b.objectURL(channel, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	b.sign(request, s3UnsignedPayload)
+	return doRequest(b.Client, request)
+}
+
+func (b *S3Backend) OpenRange(ctx context.Context, channel string, path string, offset int64, length int64) (io.ReadCloser, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, b.objectURL(channel, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	b.sign(request, s3UnsignedPayload)
+	return doRangeRequest(b.Client, request, offset, length)
+}
+
+func (b *S3Backend) objectURL(channel string, path string) string {
+	return b.Endpoint + "/" + escapePath(b.Bucket+"/"+b.channelPrefix(channel)+path)
+}
+
+// sign adds the AWS Signature Version 4 authorization header to the request
+func (b *S3Backend) sign(request *http.Request, payloadHash string) {
+	now := time.Now
+	if b.now != nil {
+		now = b.now
+	}
+	timestamp := now().UTC().Format(s3TimeFormat)
+	date := timestamp[:8]
+
+	request.Header.Set("Host", request.URL.Host)
+	request.Header.Set("X-Amz-Date", timestamp)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaderNames := make([]string, 0, len(request.Header))
+	for name := range request.Header {
+		signedHeaderNames = append(signedHeaderNames, strings.ToLower(name))
+	}
+	sort.Strings(signedHeaderNames)
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaderNames {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(request.Header.Get(name)) + "\n")
+	}
+	signedHeaders := strings.Join(signedHeaderNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		s3EncodeQuery(request.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + b.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{s3Algorithm, timestamp, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+b.SecretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, b.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", s3Algorithm, b.AccessKeyID, scope, signedHeaders, signature))
+	// Go sends the host from the URL, the header is only needed for the signature
+	request.Header.Del("Host")
+}
+
+// s3EncodeQuery encodes the query sorted by name with %20 for spaces, as required for the canonical request
+func s3EncodeQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// weekdayNames are the day names of the bandwidth schedule, in the order of time.Weekday
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// BandwidthRule limits the bandwidth on some weekdays between two times of the day, Start and End are minutes after midnight.
+// A rule ending before it starts runs over midnight, e.g. 22:00-06:00.
+type BandwidthRule struct {
+	Weekdays   [7]bool
+	Start      int
+	End        int
+	LimitMbits float64
+}
+
+// BandwidthSchedule returns the bandwidth limit for a point in time, the first matching rule wins.
+// Outside of all rules the default limit applies.
+type BandwidthSchedule struct {
+	DefaultLimitMbits float64
+	Rules             []BandwidthRule
+}
+
+// parseBandwidthSchedule parses rules like "mon-fri 06:00-09:00 20; sat,sun 00:00-24:00 0", separated by semicolons or new lines.
+// Every rule consists of the weekdays (a list of days or day ranges, * for every day), the time range and the limit in megabits per second.
+func parseBandwidthSchedule(value string, defaultLimitMbits float64) (*BandwidthSchedule, error) {
+	schedule := &BandwidthSchedule{DefaultLimitMbits: defaultLimitMbits}
+	for _, ruleValue := range strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == '\n' }) {
+		fields := strings.Fields(ruleValue)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid bandwidth rule %q, expected [weekdays] [hh:mm]-[hh:mm] [megabits per second]", strings.TrimSpace(ruleValue))
+		}
+
+		var rule BandwidthRule
+		var err error
+		if rule.Weekdays, err = parseWeekdays(fields[0]); err != nil {
+			return nil, err
+		}
+		if rule.Start, rule.End, err = parseTimeRange(fields[1]); err != nil {
+			return nil, err
+		}
+		rule.LimitMbits, err = strconv.ParseFloat(fields[2], 64)
+		if err != nil || rule.LimitMbits < 0 {
+			return nil, fmt.Errorf("invalid bandwidth limit %s, expected megabits per second or 0 for unlimited", fields[2])
+		}
+		schedule.Rules = append(schedule.Rules, rule)
+	}
+	return schedule, nil
+}
+
+// LimitAt returns the bandwidth limit in megabits per second at the given time, in the time zone of the time
+func (s *BandwidthSchedule) LimitAt(t time.Time) float64 {
+	weekday := int(t.Weekday())
+	minute := t.Hour()*60 + t.Minute()
+	for _, rule := range s.Rules {
+		if rule.matches(weekday, minute) {
+			return rule.LimitMbits
+		}
+	}
+	return s.DefaultLimitMbits
+}
+
+func (r BandwidthRule) matches(weekday int, minute int) bool {
+	if r.Start < r.End {
+		return r.Weekdays[weekday] && minute >= r.Start && minute < r.End
+	}
+	// The part after midnight belongs to the rule of the previous day
+	return (r.Weekdays[weekday] && minute >= r.Start) || (r.Weekdays[(weekday+6)%7] && minute < r.End)
+}
+
+// parseWeekdays parses a list of days and day ranges like "mon-fri,sun", ranges may wrap around the week, e.g. "fri-mon"
+func parseWeekdays(value string) ([7]bool, error) {
+	var weekdays [7]bool
+	if value == "*" {
+		for i := range weekdays {
+			weekdays[i] = true
+		}
+		return weekdays, nil
+	}
+	for _, part := range strings.Split(strings.ToLower(value), ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		if !isRange {
+			last = first
+		}
+		firstDay, lastDay := weekdayIndex(first), weekdayIndex(last)
+		if firstDay < 0 || lastDay < 0 {
+			return weekdays, fmt.Errorf("invalid weekdays %q, expected days like mon-fri,sun", value)
+		}
+		for day := firstDay; ; day = (day + 1) % 7 {
+			weekdays[day] = true
+			if day == lastDay {
+				break
+			}
+		}
+	}
+	return weekdays, nil
+}
+
+func weekdayIndex(name string) int {
+	for i, weekdayName := range weekdayNames {
+		if name == weekdayName {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseTimeRange parses a time range like "06:00-09:00" into minutes after midnight, 24:00 is allowed as end
+func parseTimeRange(value string) (int, int, error) {
+	startValue, endValue, ok := strings.Cut(value, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid time range %q, expected hh:mm-hh:mm", value)
+	}
+	start, err := parseTimeOfDay(startValue)
+	if err != nil || start == 24*60 {
+		return 0, 0, fmt.Errorf("invalid time range %q, expected hh:mm-hh:mm", value)
+	}
+	end, err := parseTimeOfDay(endValue)
+	if err != nil || start == end {
+		return 0, 0, fmt.Errorf("invalid time range %q, expected hh:mm-hh:mm", value)
+	}
+	if end == 24*60 {
+		end = 0
+	}
+	return start, end, nil
+}
+
+func parseTimeOfDay(value string) (int, error) {
+	hourValue, minuteValue, ok := strings.Cut(value, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	hour, err := strconv.Atoi(hourValue)
+	if err != nil {
+		return 0, err
+	}
+	minute, err := strconv.Atoi(minuteValue)
+	if err != nil {
+		return 0, err
+	}
+	if hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return hour*60 + minute, nil
+}
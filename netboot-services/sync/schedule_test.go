@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBandwidthScheduleLimitAt(t *testing.T) {
+	schedule, err := parseBandwidthSchedule("mon-fri 06:00-09:00 20; fri-mon 22:00-06:00 0\nsat,sun 00:00-24:00 500", 100)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		time          time.Time
+		expectedLimit float64
+	}{
+		// 2024-01-01 was a Monday
+		{name: "Monday morning", time: time.Date(2024, 1, 1, 7, 30, 0, 0, time.UTC), expectedLimit: 20},
+		{name: "End of the rule", time: time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC), expectedLimit: 100},
+		{name: "Monday night", time: time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC), expectedLimit: 0},
+		{name: "Tuesday after midnight", time: time.Date(2024, 1, 2, 1, 0, 0, 0, time.UTC), expectedLimit: 0},
+		{name: "Tuesday night", time: time.Date(2024, 1, 2, 23, 0, 0, 0, time.UTC), expectedLimit: 100},
+		{name: "Saturday after midnight", time: time.Date(2024, 1, 6, 1, 0, 0, 0, time.UTC), expectedLimit: 0},
+		{name: "Saturday", time: time.Date(2024, 1, 6, 12, 0, 0, 0, time.UTC), expectedLimit: 500},
+		{name: "Sunday before midnight", time: time.Date(2024, 1, 7, 23, 59, 0, 0, time.UTC), expectedLimit: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			limit := schedule.LimitAt(test.time)
+
+			// Assert
+			assert.Equal(t, test.expectedLimit, limit)
+		})
+	}
+}
+
+func TestParseBandwidthSchedule(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         string
+		expectedRules int
+		expectError   bool
+	}{
+		{name: "Empty", value: "", expectedRules: 0},
+		{name: "Every day", value: "* 08:00-18:00 50;", expectedRules: 1},
+		{name: "Missing limit", value: "mon 08:00-18:00", expectError: true},
+		{name: "Unknown day", value: "monday 08:00-18:00 50", expectError: true},
+		{name: "Invalid time", value: "mon 08:00-25:00 50", expectError: true},
+		{name: "Empty time range", value: "mon 08:00-08:00 50", expectError: true},
+		{name: "Negative limit", value: "mon 08:00-18:00 -1", expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			schedule, err := parseBandwidthSchedule(test.value, 100)
+
+			// Assert
+			if test.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, schedule.Rules, test.expectedRules)
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// channelCounter holds the sync counters of a channel
+type channelCounter struct {
+	Downloads       int64
+	FailedDownloads int64
+	Bytes           int64
+	FailedRuns      int64
+	Retries         int64
+	DeltaSavedBytes int64
+	LastSuccess     time.Time
+}
+
+// SyncStats counts the downloads and sync runs per channel
+type SyncStats struct {
+	mutex      sync.Mutex
+	perChannel map[string]*channelCounter
+	// bandwidthLimitMbits and throttled are set by the bandwidth controller
+	bandwidthLimitMbits float64
+	throttled           bool
+}
+
+func NewSyncStats() *SyncStats {
+	return &SyncStats{perChannel: map[string]*channelCounter{}}
+}
+
+func (s *SyncStats) counter(channel string) *channelCounter {
+	counter, ok := s.perChannel[channel]
+	if !ok {
+		counter = &channelCounter{}
+		s.perChannel[channel] = counter
+	}
+	return counter
+}
+
+// RecordDownload adds a finished or failed download, the bytes of failed downloads are counted as well
+func (s *SyncStats) RecordDownload(channel string, bytes int64, success bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	counter := s.counter(channel)
+	if success {
+		counter.Downloads++
+	} else {
+		counter.FailedDownloads++
+	}
+	counter.Bytes += bytes
+}
+
+func (s *SyncStats) RecordSuccess(channel string, finished time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.counter(channel).LastSuccess = finished
+}
+
+func (s *SyncStats) RecordRetry(channel string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.counter(channel).Retries++
+}
+
+// RecordDeltaSavings adds the bytes which were taken from a local image instead of being downloaded
+func (s *SyncStats) RecordDeltaSavings(channel string, bytes int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.counter(channel).DeltaSavedBytes += bytes
+}
+
+// SetBandwidthLimit records the current bandwidth limit and whether it was lowered for the asset server
+func (s *SyncStats) SetBandwidthLimit(megabitsPerSecond float64, throttled bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.bandwidthLimitMbits = megabitsPerSecond
+	s.throttled = throttled
+}
+
+func (s *SyncStats) RecordFailure(channel string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.counter(channel).FailedRuns++
+}
+
+// ServeHTTP exports the counters in the Prometheus text format, which can be scraped by the telegraf prometheus input
+func (s *SyncStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.WriteMetrics(w)
+}
+
+func (s *SyncStats) WriteMetrics(w io.Writer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	channels := make([]string, 0, len(s.perChannel))
+	for channel := range s.perChannel {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+
+	families := []struct {
+		name       string
+		metricType string
+		help       string
+		value      func(*channelCounter) int64
+	}{
+		{"netboot_sync_downloads_total", "counter", "Number of files downloaded per channel.", func(c *channelCounter) int64 { return c.Downloads }},
+		{"netboot_sync_failed_downloads_total", "counter", "Number of failed downloads per channel.", func(c *channelCounter) int64 { return c.FailedDownloads }},
+		{"netboot_sync_download_bytes_total", "counter", "Bytes downloaded per channel.", func(c *channelCounter) int64 { return c.Bytes }},
+		{"netboot_sync_delta_saved_bytes_total", "counter", "Bytes taken from local images instead of being downloaded per channel.", func(c *channelCounter) int64 { return c.DeltaSavedBytes }},
+		{"netboot_sync_chunk_retries_total", "counter", "Number of retried chunk downloads per channel.", func(c *channelCounter) int64 { return c.Retries }},
+		{"netboot_sync_failed_runs_total", "counter", "Number of failed sync runs per channel.", func(c *channelCounter) int64 { return c.FailedRuns }},
+		{"netboot_sync_last_success_timestamp_seconds", "gauge", "Unix time of the last successful sync per channel.", func(c *channelCounter) int64 {
+			if c.LastSuccess.IsZero() {
+				return 0
+			}
+			return c.LastSuccess.Unix()
+		}},
+	}
+	for _, family := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", family.name, family.metricType)
+		for _, channel := range channels {
+			fmt.Fprintf(w, "%s{channel=\"%s\"} %d\n", family.name, escapeLabelValue(channel), family.value(s.perChannel[channel]))
+		}
+	}
+
+	throttled := 0
+	if s.throttled {
+		throttled = 1
+	}
+	fmt.Fprintln(w, "# HELP netboot_sync_bandwidth_limit_mbits Current bandwidth limit in megabits per second, 0 for unlimited.")
+	fmt.Fprintln(w, "# TYPE netboot_sync_bandwidth_limit_mbits gauge")
+	fmt.Fprintf(w, "netboot_sync_bandwidth_limit_mbits %g\n", s.bandwidthLimitMbits)
+	fmt.Fprintln(w, "# HELP netboot_sync_throttled Whether the bandwidth limit is lowered because the asset server is busy.")
+	fmt.Fprintln(w, "# TYPE netboot_sync_throttled gauge")
+	fmt.Fprintf(w, "netboot_sync_throttled %d\n", throttled)
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
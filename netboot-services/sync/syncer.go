@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// stagingDirectoryName is the hidden folder in every channel folder where images are downloaded. Complete images
+	// are renamed into the channel folder, so the cleaner and the menu generator only ever see complete images.
+	stagingDirectoryName = ".staging"
+	partialFileSuffix    = ".partial"
+	// legacyPartialDownloadPrefix marks the files azcopy was still downloading, the consumers skip image folders containing such a file
+	legacyPartialDownloadPrefix = ".azDownload-"
+)
+
+// Syncer downloads new and changed images of the channels from the backend into the target directory,
+// every channel ends up in [target directory]/[channel]/[image folder]/[file].
+type Syncer struct {
+	Backend         Backend
+	TargetDirectory string
+	Channels        []string
+	Limiter         *RateLimiter
+	Stats           *SyncStats
+	// ChunkSize is used for files without chunk hashes in the manifest
+	ChunkSize int64
+	// MaxRetries, InitialBackoff and MaxBackoff define how often and how long after a failed chunk is retried
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// Sync syncs all channels, a failing channel does not stop the others
+func (s *Syncer) Sync(ctx context.Context) error {
+	var errs []error
+	for _, channel := range s.Channels {
+		if err := s.SyncChannel(ctx, channel); err != nil {
+			log.WithFields(log.Fields{"channel": channel}).WithError(err).Error("sync of channel failed")
+			errs = append(errs, fmt.Errorf("%s: %w", channel, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SyncChannel downloads the images of the channel manifest which are missing locally or have changed.
+// Local images which were removed in the backend are left to the cleaner.
+func (s *Syncer) SyncChannel(ctx context.Context, channel string) error {
+	start := time.Now()
+	manifest, err := loadManifest(ctx, s.Backend, channel)
+	if err != nil {
+		s.Stats.RecordFailure(channel)
+		return err
+	}
+
+	channelDirectory := filepath.Join(s.TargetDirectory, channel)
+	stagingDirectory := filepath.Join(channelDirectory, stagingDirectoryName)
+
+	var publishedImages int
+	var errs []error
+	for _, file := range manifest.Files {
+		if err := s.syncFile(ctx, channel, file.Path, file, stagingDirectory, filepath.Join(channelDirectory, file.Path)); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", file.Path, err))
+		}
+	}
+	for _, image := range manifest.Images {
+		published, err := s.syncImage(ctx, channel, image)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.WithFields(log.Fields{"channel": channel, "image": image.Name}).WithError(err).Error("sync of image failed")
+			errs = append(errs, fmt.Errorf("%s: %w", image.Name, err))
+			continue
+		}
+		if published {
+			publishedImages++
+		}
+	}
+	if err := removeStaleStaging(stagingDirectory, manifest); err != nil {
+		log.WithFields(log.Fields{"channel": channel}).WithError(err).Warn("could not clean up the staging folder")
+	}
+
+	if len(errs) > 0 {
+		s.Stats.RecordFailure(channel)
+		return errors.Join(errs...)
+	}
+	s.Stats.RecordSuccess(channel, time.Now())
+	log.WithFields(log.Fields{
+		"channel":         channel,
+		"images":          len(manifest.Images),
+		"publishedImages": publishedImages,
+		"duration":        time.Since(start).String(),
+	}).Info("channel synced")
+	return nil
+}
+
+// syncImage stages the files of a changed image and renames the complete image folder into the channel folder.
+// Unchanged files of the previous version are linked instead of downloaded again.
+func (s *Syncer) syncImage(ctx context.Context, channel string, image ManifestImage) (bool, error) {
+	imageDirectory := filepath.Join(s.TargetDirectory, channel, image.Name)
+	if len(image.Files) == 0 || imageIsUpToDate(imageDirectory, image) {
+		return false, nil
+	}
+	start := time.Now()
+	stagingDirectory := filepath.Join(s.TargetDirectory, channel, stagingDirectoryName, image.Name)
+
+	for _, file := range image.Files {
+		stagedPath := filepath.Join(stagingDirectory, filepath.FromSlash(file.Path))
+		if !needsDownload(stagedPath, file) {
+			continue
+		}
+		publishedPath := filepath.Join(imageDirectory, filepath.FromSlash(file.Path))
+		if !needsDownload(publishedPath, file) {
+			if err := linkOrCopy(publishedPath, stagedPath); err != nil {
+				return false, err
+			}
+			continue
+		}
+		if indexFile, ok := deltaIndexOf(image, file); ok {
+			if s.syncFileWithDelta(ctx, channel, image, file, indexFile, stagedPath) {
+				continue
+			}
+		}
+		if err := s.syncFile(ctx, channel, image.Name+"/"+file.Path, file, filepath.Dir(stagedPath), stagedPath); err != nil {
+			return false, fmt.Errorf("%s: %w", file.Path, err)
+		}
+	}
+
+	if err := publishImage(stagingDirectory, imageDirectory); err != nil {
+		return false, err
+	}
+	log.WithFields(log.Fields{
+		"channel":  channel,
+		"image":    image.Name,
+		"files":    len(image.Files),
+		"duration": time.Since(start).String(),
+	}).Info("published image")
+	return true, nil
+}
+
+// syncFileWithDelta stages the block index of the file and rebuilds the file from a local image, it returns false if
+// the file has to be downloaded completely
+func (s *Syncer) syncFileWithDelta(ctx context.Context, channel string, image ManifestImage, file RemoteFile, indexFile RemoteFile, stagedPath string) bool {
+	remotePath := image.Name + "/" + file.Path
+	stagedIndexPath := stagedPath + deltaIndexSuffix
+	if err := s.syncFile(ctx, channel, image.Name+"/"+indexFile.Path, indexFile, filepath.Dir(stagedIndexPath), stagedIndexPath); err != nil {
+		log.WithFields(log.Fields{"channel": channel, "file": remotePath}).WithError(err).Warn("could not download the block index, downloading the complete file")
+		return false
+	}
+
+	start := time.Now()
+	result, err := s.syncDelta(ctx, channel, remotePath, file, stagedIndexPath, stagedPath)
+	if err != nil {
+		log.WithFields(log.Fields{"channel": channel, "file": remotePath}).WithError(err).Warn("delta sync failed, downloading the complete file")
+		return false
+	}
+	s.Stats.RecordDownload(channel, result.DownloadedBytes, true)
+	s.Stats.RecordDeltaSavings(channel, result.ReusedBytes)
+	log.WithFields(log.Fields{
+		"channel":         channel,
+		"file":            remotePath,
+		"seed":            result.Seed,
+		"downloadedBytes": result.DownloadedBytes,
+		"savedBytes":      result.ReusedBytes,
+		"savedPercent":    fmt.Sprintf("%.1f", float64(result.ReusedBytes)*100/float64(file.Size)),
+		"duration":        time.Since(start).String(),
+	}).Info("rebuilt file from a local image")
+	return true
+}
+
+// deltaIndexOf returns the block index of a squashfs file, if it was published
+func deltaIndexOf(image ManifestImage, file RemoteFile) (RemoteFile, bool) {
+	if !strings.HasSuffix(file.Path, ".squashfs") || file.Size == 0 {
+		return RemoteFile{}, false
+	}
+	for _, indexFile := range image.Files {
+		if indexFile.Path == file.Path+deltaIndexSuffix {
+			return indexFile, true
+		}
+	}
+	return RemoteFile{}, false
+}
+
+// syncFile downloads a file of the channel into a partial file in the download folder and renames it to the local path,
+// once its size and hash are verified. A failed download is resumed by the next run.
+func (s *Syncer) syncFile(ctx context.Context, channel string, remotePath string, file RemoteFile, downloadDirectory string, localPath string) error {
+	if !needsDownload(localPath, file) {
+		return nil
+	}
+	start := time.Now()
+	if err := os.MkdirAll(downloadDirectory, 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	partialPath := filepath.Join(downloadDirectory, filepath.Base(localPath)+partialFileSuffix)
+
+	bytes, err := s.download(ctx, channel, remotePath, file, partialPath)
+	s.Stats.RecordDownload(channel, bytes, err == nil)
+	if err != nil {
+		return err
+	}
+	if err := os.Chtimes(partialPath, file.ModTime, file.ModTime); err != nil {
+		return err
+	}
+	if err := os.Rename(partialPath, localPath); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"channel":  channel,
+		"file":     remotePath,
+		"bytes":    bytes,
+		"duration": time.Since(start).String(),
+	}).Info("downloaded file")
+	return nil
+}
+
+// needsDownload compares size and modification time, the same way azcopy's --overwrite=ifSourceNewer did
+func needsDownload(localPath string, file RemoteFile) bool {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return true
+	}
+	return info.Size() != file.Size || file.ModTime.After(info.ModTime())
+}
+
+func imageIsUpToDate(imageDirectory string, image ManifestImage) bool {
+	for _, file := range image.Files {
+		if needsDownload(filepath.Join(imageDirectory, filepath.FromSlash(file.Path)), file) {
+			return false
+		}
+	}
+	_, err := os.Stat(imageDirectory)
+	return err == nil
+}
+
+func linkOrCopy(source string, destination string) error {
+	if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+		return err
+	}
+	os.Remove(destination)
+	if err := os.Link(source, destination); err == nil {
+		return nil
+	}
+
+	input, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	info, err := input.Stat()
+	if err != nil {
+		return err
+	}
+	output, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(output, input)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(destination, info.ModTime(), info.ModTime())
+}
+
+// publishImage renames the staged image folder into the channel folder. A previous version of the image is swapped
+// with the staged folder in one step and removed afterwards. Filesystems without RENAME_EXCHANGE (e.g. some network
+// filesystems) need two renames, the image folder is missing for a moment in between and a menu rendered then lacks
+// the image until the next render.
+func publishImage(stagingDirectory string, imageDirectory string) error {
+	if _, err := os.Stat(imageDirectory); err != nil {
+		return os.Rename(stagingDirectory, imageDirectory)
+	}
+
+	err := exchangeDirectories(stagingDirectory, imageDirectory)
+	if err == nil {
+		// The staging folder holds the previous version now
+		return os.RemoveAll(stagingDirectory)
+	}
+	log.Debugf("Could not exchange %s and %s, replacing the image with two renames: %s", stagingDirectory, imageDirectory, err)
+
+	previousDirectory := stagingDirectory + ".previous"
+	if err := os.RemoveAll(previousDirectory); err != nil {
+		return err
+	}
+	if err := os.Rename(imageDirectory, previousDirectory); err != nil {
+		return err
+	}
+	if err := os.Rename(stagingDirectory, imageDirectory); err != nil {
+		// Put the previous version back, it is better than no image
+		os.Rename(previousDirectory, imageDirectory)
+		return err
+	}
+	return os.RemoveAll(previousDirectory)
+}
+
+// removeStaleStaging removes the staged images and files which are not in the manifest anymore
+func removeStaleStaging(stagingDirectory string, manifest *Manifest) error {
+	entries, err := os.ReadDir(stagingDirectory)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	images := map[string]bool{}
+	for _, image := range manifest.Images {
+		images[image.Name] = true
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && images[entry.Name()] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(stagingDirectory, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemovePartialDownloads deletes the partial download files azcopy left behind,
+// otherwise their image folders would be skipped by the cleaner and the menu generator forever
+func (s *Syncer) RemovePartialDownloads() error {
+	for _, channel := range s.Channels {
+		err := filepath.WalkDir(filepath.Join(s.TargetDirectory, channel), func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !entry.IsDir() && strings.HasPrefix(entry.Name(), legacyPartialDownloadPrefix) {
+				log.WithFields(log.Fields{"file": path}).Info("removing partial download")
+				return os.Remove(path)
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestFile(t *testing.T, path string, content string, modTime time.Time) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func writeTestManifest(t *testing.T, channelDir string, manifest Manifest) {
+	content, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(channelDir, manifestFilename), content, 0644))
+}
+
+func newTestSyncer(t *testing.T, channels ...string) (*Syncer, string, string) {
+	sourceDir := t.TempDir()
+	targetDir := t.TempDir()
+	return &Syncer{
+		Backend:         &LocalBackend{Directory: sourceDir},
+		TargetDirectory: targetDir,
+		Channels:        channels,
+		Limiter:         NewRateLimiter(0),
+		Stats:           NewSyncStats(),
+	}, sourceDir, targetDir
+}
+
+func TestSyncDownloadsChannels(t *testing.T) {
+	// Arrange
+	syncer, sourceDir, targetDir := newTestSyncer(t, "prod", "kernels")
+	modTime := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	writeTestFile(t, filepath.Join(sourceDir, "prod", "image1", "image1.squashfs"), "squashfs", modTime)
+	writeTestFile(t, filepath.Join(sourceDir, "kernels", "kernel1", "vmlinuz"), "kernel", modTime)
+	writeTestFile(t, filepath.Join(sourceDir, "dev", "image2", "image2.squashfs"), "squashfs", modTime)
+
+	// Act
+	err := syncer.Sync(context.Background())
+
+	// Assert
+	require.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(targetDir, "prod", "image1", "image1.squashfs"))
+	require.NoError(t, err)
+	assert.Equal(t, "squashfs", string(content))
+	info, err := os.Stat(filepath.Join(targetDir, "kernels", "kernel1", "vmlinuz"))
+	require.NoError(t, err)
+	assert.True(t, info.ModTime().Equal(modTime))
+	assert.NoDirExists(t, filepath.Join(targetDir, "dev"))
+	assert.NoDirExists(t, filepath.Join(targetDir, "prod", stagingDirectoryName, "image1"))
+}
+
+func TestSyncOnlyDownloadsChangedFiles(t *testing.T) {
+	tests := []struct {
+		name            string
+		localContent    string
+		localModTime    time.Time
+		expectedContent string
+	}{
+		{name: "Up to date", localContent: "old", localModTime: time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC), expectedContent: "old"},
+		{name: "Newer in the backend", localContent: "old", localModTime: time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC), expectedContent: "new"},
+		{name: "Different size", localContent: "older", localModTime: time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC), expectedContent: "new"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			syncer, sourceDir, targetDir := newTestSyncer(t, "prod")
+			writeTestFile(t, filepath.Join(sourceDir, "prod", "image1", "vmlinuz"), "new", time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC))
+			writeTestFile(t, filepath.Join(targetDir, "prod", "image1", "vmlinuz"), test.localContent, test.localModTime)
+
+			// Act
+			err := syncer.Sync(context.Background())
+
+			// Assert
+			require.NoError(t, err)
+			content, err := os.ReadFile(filepath.Join(targetDir, "prod", "image1", "vmlinuz"))
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedContent, string(content))
+		})
+	}
+}
+
+func TestSyncVerifiesHashes(t *testing.T) {
+	tests := []struct {
+		name          string
+		sha256        string
+		expectError   bool
+		expectedImage bool
+	}{
+		{name: "Matching hash", sha256: squashfsHash, expectedImage: true},
+		{name: "Wrong hash", sha256: "0000000000000000000000000000000000000000000000000000000000000000", expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			syncer, sourceDir, targetDir := newTestSyncer(t, "prod")
+			modTime := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+			writeTestFile(t, filepath.Join(sourceDir, "prod", "image1", "image1.squashfs"), "squashfs", modTime)
+			writeTestManifest(t, filepath.Join(sourceDir, "prod"), Manifest{Images: []ManifestImage{{
+				Name:  "image1",
+				Files: []RemoteFile{{Path: "image1.squashfs", Size: 8, ModTime: modTime, SHA256: test.sha256}},
+			}}})
+
+			// Act
+			err := syncer.Sync(context.Background())
+
+			// Assert
+			if test.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			if test.expectedImage {
+				assert.FileExists(t, filepath.Join(targetDir, "prod", "image1", "image1.squashfs"))
+			} else {
+				assert.NoDirExists(t, filepath.Join(targetDir, "prod", "image1"))
+			}
+			assert.NoFileExists(t, filepath.Join(targetDir, "prod", stagingDirectoryName, "image1", "image1.squashfs"+partialFileSuffix))
+		})
+	}
+}
+
+func TestSyncOnlyPublishesCompleteImages(t *testing.T) {
+	// Arrange
+	syncer, sourceDir, targetDir := newTestSyncer(t, "prod")
+	modTime := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	writeTestFile(t, filepath.Join(sourceDir, "prod", "image1", "vmlinuz"), "kernel", modTime)
+	// The squashfs of the manifest is not uploaded yet
+	writeTestManifest(t, filepath.Join(sourceDir, "prod"), Manifest{Images: []ManifestImage{{
+		Name: "image1",
+		Files: []RemoteFile{
+			{Path: "vmlinuz", Size: 6, ModTime: modTime},
+			{Path: "image1.squashfs", Size: 8, ModTime: modTime},
+		},
+	}}})
+
+	// Act
+	err := syncer.Sync(context.Background())
+
+	// Assert
+	assert.Error(t, err)
+	assert.NoDirExists(t, filepath.Join(targetDir, "prod", "image1"))
+	assert.FileExists(t, filepath.Join(targetDir, "prod", stagingDirectoryName, "image1", "vmlinuz"))
+}
+
+func TestSyncReplacesChangedImage(t *testing.T) {
+	// Arrange
+	syncer, sourceDir, targetDir := newTestSyncer(t, "prod")
+	oldModTime := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	newModTime := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+	writeTestFile(t, filepath.Join(targetDir, "prod", "image1", "image1.squashfs"), "squashfs", oldModTime)
+	writeTestFile(t, filepath.Join(targetDir, "prod", "image1", "image1-kernel.json"), "{}", oldModTime)
+	writeTestFile(t, filepath.Join(sourceDir, "prod", "image1", "image1.squashfs"), "squashfs", oldModTime)
+	writeTestFile(t, filepath.Join(sourceDir, "prod", "image1", "image1-kernel.json"), `{"kernel": "6.8"}`, newModTime)
+
+	// Act
+	err := syncer.Sync(context.Background())
+
+	// Assert
+	require.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(targetDir, "prod", "image1", "image1-kernel.json"))
+	require.NoError(t, err)
+	assert.Equal(t, `{"kernel": "6.8"}`, string(content))
+	assert.FileExists(t, filepath.Join(targetDir, "prod", "image1", "image1.squashfs"))
+	entries, err := os.ReadDir(filepath.Join(targetDir, "prod", stagingDirectoryName))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestRemovePartialDownloads(t *testing.T) {
+	// Arrange
+	syncer, _, targetDir := newTestSyncer(t, "prod")
+	partialPath := filepath.Join(targetDir, "prod", "image1", legacyPartialDownloadPrefix+"image1.squashfs")
+	kernelPath := filepath.Join(targetDir, "prod", "image1", "vmlinuz")
+	writeTestFile(t, partialPath, "half", time.Now())
+	writeTestFile(t, kernelPath, "kernel", time.Now())
+
+	// Act
+	err := syncer.RemovePartialDownloads()
+
+	// Assert
+	require.NoError(t, err)
+	assert.NoFileExists(t, partialPath)
+	assert.FileExists(t, kernelPath)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// activeDownloadsMetric is the gauge of the asset server counting the squashfs downloads in progress. Menus, kernels
+// and sidecars are small and would throttle the sync without any client booting.
+const activeDownloadsMetric = "netboot_asset_active_image_downloads"
+
+// BandwidthController sets the rate limiter to the limit of the schedule. While the local asset server is serving
+// booting clients, the limit is lowered to BusyLimitMbits, so the syncs do not slow down the boots.
+type BandwidthController struct {
+	Schedule *BandwidthSchedule
+	Limiter  *RateLimiter
+	Stats    *SyncStats
+	// AssetServerMetricsURL is optional, without it only the schedule applies
+	AssetServerMetricsURL string
+	Client                *http.Client
+	// BusyActiveDownloads is the number of active downloads from which the asset server counts as busy
+	BusyActiveDownloads float64
+	BusyLimitMbits      float64
+	// IdleDelay is how long the asset server has to be idle before the limit is raised again,
+	// so the limit does not flap between the boots of a boot storm
+	IdleDelay time.Duration
+
+	limit     float64
+	throttled bool
+	lastBusy  time.Time
+	started   bool
+}
+
+// Run updates the limit every interval until the context is done
+func (c *BandwidthController) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		c.Update(ctx, time.Now())
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Update applies the limit of the schedule at the given time, lowered if the asset server is busy
+func (c *BandwidthController) Update(ctx context.Context, now time.Time) {
+	limit := c.Schedule.LimitAt(now)
+	throttled := c.isBusy(ctx, now) && (limit == 0 || limit > c.BusyLimitMbits)
+	if throttled {
+		limit = c.BusyLimitMbits
+	}
+	if c.started && limit == c.limit && throttled == c.throttled {
+		return
+	}
+
+	c.started, c.limit, c.throttled = true, limit, throttled
+	c.Limiter.SetRate(limit)
+	c.Stats.SetBandwidthLimit(limit, throttled)
+	log.WithFields(log.Fields{"bandwidthLimitMbits": limit, "throttled": throttled}).Info("changed bandwidth limit")
+}
+
+// isBusy reports whether the asset server is busy or was busy within the idle delay.
+// If its metrics cannot be read, the asset server is not serving any clients either.
+func (c *BandwidthController) isBusy(ctx context.Context, now time.Time) bool {
+	if c.AssetServerMetricsURL == "" {
+		return false
+	}
+	activeDownloads, err := c.fetchActiveDownloads(ctx)
+	if err != nil {
+		log.WithFields(log.Fields{"url": c.AssetServerMetricsURL}).WithError(err).Warn("could not read the active downloads of the asset server")
+	} else if activeDownloads >= c.BusyActiveDownloads {
+		c.lastBusy = now
+		return true
+	}
+	return !c.lastBusy.IsZero() && now.Sub(c.lastBusy) < c.IdleDelay
+}
+
+// fetchActiveDownloads reads the active downloads gauge from the Prometheus text metrics of the asset server
+func (c *BandwidthController) fetchActiveDownloads(ctx context.Context) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, c.AssetServerMetricsURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	body, err := doRequest(c.Client, request)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == activeDownloadsMetric {
+			return strconv.ParseFloat(fields[1], 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("metric %s not found", activeDownloadsMetric)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBandwidthControllerThrottlesWhileAssetServerIsBusy(t *testing.T) {
+	// Arrange
+	var activeDownloads atomic.Int64
+	assetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Menus and kernels are no boots, only the squashfs downloads count
+		fmt.Fprintln(w, "# TYPE netboot_asset_active_downloads gauge")
+		fmt.Fprintf(w, "netboot_asset_active_downloads %d\n", activeDownloads.Load()+5)
+		fmt.Fprintln(w, "# TYPE netboot_asset_active_image_downloads gauge")
+		fmt.Fprintf(w, "netboot_asset_active_image_downloads %d\n", activeDownloads.Load())
+	}))
+	defer assetServer.Close()
+	controller := &BandwidthController{
+		Schedule:              &BandwidthSchedule{DefaultLimitMbits: 0},
+		Limiter:               NewRateLimiter(0),
+		Stats:                 NewSyncStats(),
+		AssetServerMetricsURL: assetServer.URL,
+		Client:                assetServer.Client(),
+		BusyActiveDownloads:   2,
+		BusyLimitMbits:        8,
+		IdleDelay:             time.Minute,
+	}
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+
+	// Act & Assert
+	activeDownloads.Store(1)
+	controller.Update(context.Background(), start)
+	assert.Equal(t, 0.0, controller.Limiter.Rate())
+
+	activeDownloads.Store(5)
+	controller.Update(context.Background(), start.Add(10*time.Second))
+	assert.InDelta(t, 8, controller.Limiter.Rate(), 0.001)
+	metrics := &strings.Builder{}
+	controller.Stats.WriteMetrics(metrics)
+	assert.Contains(t, metrics.String(), "netboot_sync_throttled 1")
+	assert.Contains(t, metrics.String(), "netboot_sync_bandwidth_limit_mbits 8")
+
+	// Still throttled within the idle delay
+	activeDownloads.Store(0)
+	controller.Update(context.Background(), start.Add(40*time.Second))
+	assert.InDelta(t, 8, controller.Limiter.Rate(), 0.001)
+
+	controller.Update(context.Background(), start.Add(80*time.Second))
+	assert.Equal(t, 0.0, controller.Limiter.Rate())
+}
+
+func TestBandwidthControllerFollowsSchedule(t *testing.T) {
+	// Arrange
+	schedule, _ := parseBandwidthSchedule("mon 06:00-09:00 4", 100)
+	controller := &BandwidthController{
+		Schedule: schedule,
+		Limiter:  NewRateLimiter(100),
+		Stats:    NewSyncStats(),
+		// The asset server is not reachable, only the schedule applies
+		AssetServerMetricsURL: "http://127.0.0.1:1/metrics",
+		Client:                &http.Client{},
+		BusyActiveDownloads:   1,
+		BusyLimitMbits:        8,
+		IdleDelay:             time.Minute,
+	}
+
+	// Act
+	controller.Update(context.Background(), time.Date(2024, 1, 1, 7, 0, 0, 0, time.UTC))
+
+	// Assert
+	// The schedule is lower than the busy limit anyway
+	assert.InDelta(t, 4, controller.Limiter.Rate(), 0.001)
+	assert.False(t, controller.throttled)
+}